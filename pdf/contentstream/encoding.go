@@ -65,13 +65,45 @@ func newEncoderFromInlineImage(inlineImage *ContentStreamInlineImage) (core.Stre
 	} else if *filterName == "LZW" {
 		return newLZWEncoderFromInlineImage(inlineImage, nil)
 	} else if *filterName == "CCF" {
-		return core.NewCCITTFaxEncoder(), nil
+		return newCCITTFaxEncoderFromInlineImage(inlineImage, nil)
 	} else {
 		common.Log.Debug("Unsupported inline image encoding filter name : %s", *filterName)
 		return nil, errors.New("Unsupported inline encoding method")
 	}
 }
 
+// Create a new CCITTFax decoder from an inline image object, getting all the encoding parameters
+// from the DecodeParms stream object dictionary entry that can be provided optionally, usually
+// only when a multi filter is used.
+func newCCITTFaxEncoderFromInlineImage(inlineImage *ContentStreamInlineImage, decodeParams *core.PdfObjectDictionary) (*core.CCITTFaxEncoder, error) {
+	encoder := core.NewCCITTFaxEncoder()
+
+	// If decodeParams not provided, see if we can get from the stream.
+	if decodeParams == nil {
+		obj := inlineImage.DecodeParms
+		if obj != nil {
+			dp, isDict := obj.(*core.PdfObjectDictionary)
+			if !isDict {
+				common.Log.Debug("Error: DecodeParms not a dictionary (%T)", obj)
+				return nil, fmt.Errorf("Invalid DecodeParms")
+			}
+			decodeParams = dp
+		}
+	}
+	if decodeParams == nil {
+		// No decode parameters, use the defaults.
+		return encoder, nil
+	}
+
+	common.Log.Trace("decode params: %s", decodeParams.String())
+	err := encoder.SetDecodeParams(decodeParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return encoder, nil
+}
+
 // Create a new flate decoder from an inline image object, getting all the encoding parameters
 // from the DecodeParms stream object dictionary entry that can be provided optionally, usually
 // only when a multi filter is used.
@@ -378,6 +410,12 @@ func newMultiEncoderFromInlineImage(inlineImage *ContentStreamInlineImage) (*cor
 		} else if *name == core.StreamEncodingFilterNameASCII85 || *name == "A85" {
 			encoder := core.NewASCII85Encoder()
 			mencoder.AddEncoder(encoder)
+		} else if *name == core.StreamEncodingFilterNameCCITTFax || *name == "CCF" {
+			encoder, err := newCCITTFaxEncoderFromInlineImage(inlineImage, dParams)
+			if err != nil {
+				return nil, err
+			}
+			mencoder.AddEncoder(encoder)
 		} else {
 			common.Log.Error("Unsupported filter %s", *name)
 			return nil, fmt.Errorf("Invalid filter in multi filter array")
@@ -0,0 +1,250 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"container/list"
+)
+
+// Estimated memory size of objects, in bytes, not counting the contents of strings, names and
+// streams.
+const (
+	objectOverhead = 32
+	entryOverhead  = 16
+)
+
+// objectCache is a cache of the objects loaded by the parser, by object number.  The cache can be
+// bounded by a budget of the estimated memory size of the cached objects: the least recently used
+// objects are evicted when the budget is exceeded.  The decoded data of object streams is cached
+// within the same budget.
+//
+// Evicted objects are loaded anew from the file when looked up again, the changes made to evicted
+// objects are lost.  The objects remain valid as long as they are referred to: in particular, the
+// objects whose references were resolved in place keep referring to the objects loaded at the
+// time, which are distinct from the copies loaded anew once evicted.
+//
+// The cache is not safe for concurrent use by itself: the parser accesses it with its lock held.
+type objectCache struct {
+	// The cached objects, shared with PdfParser.ObjCache.
+	objects ObjectCache
+
+	limit   int64
+	size    int64
+	entries map[cacheKey]*list.Element
+	lru     *list.List // Most recently used first.
+
+	// Called when an entry is evicted.
+	onEvict func(key cacheKey, obj PdfObject)
+}
+
+// cacheKey identifies a cached object, or the decoded data of an object stream.
+type cacheKey struct {
+	objNum    int
+	objStream bool
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	obj  PdfObject
+	size int64
+}
+
+// newObjectCache returns a new cache bounded by the budget `limit` in bytes, or unbounded if
+// `limit` is 0.
+func newObjectCache(limit int64) *objectCache {
+	return &objectCache{
+		objects: ObjectCache{},
+		limit:   limit,
+		entries: map[cacheKey]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Get returns the cached object `objNum` if cached, and marks it as recently used.
+func (cache *objectCache) Get(objNum int) (PdfObject, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	obj, ok := cache.objects[objNum]
+	if !ok {
+		return nil, false
+	}
+	// Not tracked if set in the map directly.
+	if elem, ok := cache.entries[cacheKey{objNum: objNum}]; ok {
+		cache.lru.MoveToFront(elem)
+	}
+	return obj, true
+}
+
+// Set caches the object `obj` as object `objNum`, and evicts the least recently used objects if
+// the budget is exceeded.
+func (cache *objectCache) Set(objNum int, obj PdfObject) {
+	if cache == nil {
+		return
+	}
+	cache.objects[objNum] = obj
+	cache.add(cacheKey{objNum: objNum}, obj, EstimateObjectSize(obj))
+}
+
+// Delete removes the object `objNum` from the cache.
+func (cache *objectCache) Delete(objNum int) {
+	if cache == nil {
+		return
+	}
+	if elem, ok := cache.entries[cacheKey{objNum: objNum}]; ok {
+		cache.remove(elem)
+	}
+	delete(cache.objects, objNum)
+}
+
+// Clear removes all the objects from the cache.
+func (cache *objectCache) Clear() {
+	if cache == nil {
+		return
+	}
+	for cache.lru.Len() > 0 {
+		cache.remove(cache.lru.Back())
+	}
+	for objNum := range cache.objects {
+		delete(cache.objects, objNum)
+	}
+}
+
+// Len returns the number of cached objects.
+func (cache *objectCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+	return len(cache.objects)
+}
+
+// Size returns the estimated memory size of the cached objects and object stream data in bytes.
+func (cache *objectCache) Size() int64 {
+	if cache == nil {
+		return 0
+	}
+	return cache.size
+}
+
+// Limit returns the budget of the cache in bytes, 0 if unbounded.
+func (cache *objectCache) Limit() int64 {
+	if cache == nil {
+		return 0
+	}
+	return cache.limit
+}
+
+// SetLimit sets the budget of the cache to `limit` bytes, or unbounded if 0, and evicts the least
+// recently used objects if exceeded.
+func (cache *objectCache) SetLimit(limit int64) {
+	if cache == nil {
+		return
+	}
+	cache.limit = limit
+	cache.evict()
+}
+
+// hasObjectStream returns true if the decoded data of object stream `objNum` is cached, and marks
+// it as recently used.
+func (cache *objectCache) hasObjectStream(objNum int) bool {
+	if cache == nil {
+		return false
+	}
+	elem, ok := cache.entries[cacheKey{objNum: objNum, objStream: true}]
+	if ok {
+		cache.lru.MoveToFront(elem)
+	}
+	return ok
+}
+
+// addObjectStream accounts for the decoded data of object stream `objNum`, of size `size`.
+func (cache *objectCache) addObjectStream(objNum int, size int64) {
+	if cache == nil {
+		return
+	}
+	cache.add(cacheKey{objNum: objNum, objStream: true}, nil, size)
+}
+
+func (cache *objectCache) add(key cacheKey, obj PdfObject, size int64) {
+	if elem, ok := cache.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		cache.size += size - entry.size
+		entry.obj = obj
+		entry.size = size
+		cache.lru.MoveToFront(elem)
+	} else {
+		cache.entries[key] = cache.lru.PushFront(&cacheEntry{key: key, obj: obj, size: size})
+		cache.size += size
+	}
+	cache.evict()
+}
+
+// evict removes the least recently used entries until the budget is met.  The most recently used
+// entry is kept even if larger than the budget.
+func (cache *objectCache) evict() {
+	if cache.limit <= 0 {
+		return
+	}
+	for cache.size > cache.limit && cache.lru.Len() > 1 {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+func (cache *objectCache) remove(elem *list.Element) {
+	entry := cache.lru.Remove(elem).(*cacheEntry)
+	delete(cache.entries, entry.key)
+	if !entry.key.objStream {
+		delete(cache.objects, entry.key.objNum)
+	}
+	cache.size -= entry.size
+	if cache.onEvict != nil {
+		cache.onEvict(entry.key, entry.obj)
+	}
+}
+
+// EstimateObjectSize returns an estimate of the memory size of `obj` in bytes, including the
+// direct objects it contains, but not the indirect objects it refers to.
+func EstimateObjectSize(obj PdfObject) int64 {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		return objectOverhead + EstimateObjectSize(t.PdfObject)
+	case *PdfObjectStream:
+		return objectOverhead + int64(len(t.Stream)) + EstimateObjectSize(t.PdfObjectDictionary)
+	case *PdfObjectDictionary:
+		if t == nil {
+			return objectOverhead
+		}
+		size := int64(objectOverhead)
+		for _, key := range t.Keys() {
+			size += entryOverhead + int64(len(key)) + estimateDirectObjectSize(t.Get(key))
+		}
+		return size
+	case *PdfObjectArray:
+		if t == nil {
+			return objectOverhead
+		}
+		size := int64(objectOverhead)
+		for _, v := range *t {
+			size += entryOverhead + estimateDirectObjectSize(v)
+		}
+		return size
+	case *PdfObjectString:
+		return objectOverhead + int64(len(*t))
+	case *PdfObjectName:
+		return objectOverhead + int64(len(*t))
+	}
+	return objectOverhead
+}
+
+// estimateDirectObjectSize estimates the size of `obj`, not counting indirect objects, which are
+// cached separately.
+func estimateDirectObjectSize(obj PdfObject) int64 {
+	switch obj.(type) {
+	case *PdfIndirectObject, *PdfObjectStream:
+		return 0
+	}
+	return EstimateObjectSize(obj)
+}
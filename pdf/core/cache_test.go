@@ -0,0 +1,119 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"testing"
+)
+
+func TestObjectCacheEviction(t *testing.T) {
+	makeObject := func(objNum int64) *PdfIndirectObject {
+		obj := MakeIndirectObject(MakeString("0123456789"))
+		obj.ObjectNumber = objNum
+		return obj
+	}
+	objSize := EstimateObjectSize(makeObject(1))
+
+	evicted := []cacheKey{}
+	cache := newObjectCache(3 * objSize)
+	cache.onEvict = func(key cacheKey, obj PdfObject) {
+		evicted = append(evicted, key)
+	}
+	for i := 1; i <= 3; i++ {
+		cache.Set(i, makeObject(int64(i)))
+	}
+	if cache.Len() != 3 || cache.Size() != 3*objSize || len(evicted) != 0 {
+		t.Fatalf("Incorrect cache: %d objects, size %d, %d evicted", cache.Len(), cache.Size(), len(evicted))
+	}
+
+	// Object 1 is used, object 2 is the least recently used.
+	if obj, ok := cache.Get(1); !ok || obj.(*PdfIndirectObject).ObjectNumber != 1 {
+		t.Fatalf("Object 1 not cached")
+	}
+	cache.Set(4, makeObject(4))
+	if _, ok := cache.Get(2); ok {
+		t.Fatalf("Object 2 not evicted")
+	}
+	if len(evicted) != 1 || evicted[0] != (cacheKey{objNum: 2}) {
+		t.Fatalf("Incorrect evicted objects %v", evicted)
+	}
+	if _, ok := cache.objects[2]; ok || len(cache.objects) != 3 {
+		t.Fatalf("Incorrect cached objects %v", cache.objects)
+	}
+	for _, objNum := range []int{1, 3, 4} {
+		if _, ok := cache.Get(objNum); !ok {
+			t.Fatalf("Object %d evicted", objNum)
+		}
+	}
+
+	// Object stream data shares the budget.
+	cache.addObjectStream(5, 2*objSize)
+	if !cache.hasObjectStream(5) || cache.Len() != 1 || cache.Size() != 3*objSize {
+		t.Fatalf("Incorrect cache: %d objects, size %d", cache.Len(), cache.Size())
+	}
+	if _, ok := cache.Get(4); !ok {
+		t.Fatalf("Most recent object evicted")
+	}
+
+	// The most recent entry is kept even if exceeding the budget.
+	cache.SetLimit(1)
+	if cache.Len() != 1 || cache.hasObjectStream(5) || cache.Size() != objSize {
+		t.Fatalf("Incorrect cache: %d objects, size %d", cache.Len(), cache.Size())
+	}
+
+	// Unbounded.
+	cache.SetLimit(0)
+	for i := 10; i < 100; i++ {
+		cache.Set(i, makeObject(int64(i)))
+	}
+	if cache.Len() != 91 {
+		t.Fatalf("Incorrect number of objects %d", cache.Len())
+	}
+	// Objects set in the map directly are not evicted.
+	cache.objects[200] = makeObject(200)
+	if obj, ok := cache.Get(200); !ok || obj.(*PdfIndirectObject).ObjectNumber != 200 {
+		t.Fatalf("Object 200 not cached")
+	}
+	cache.SetLimit(1)
+	if _, ok := cache.Get(200); !ok || cache.Len() != 2 {
+		t.Fatalf("Incorrect number of objects %d", cache.Len())
+	}
+	cache.Clear()
+	if cache.Len() != 0 || cache.Size() != 0 {
+		t.Fatalf("Cache not cleared")
+	}
+
+	// Nil caches are empty.
+	var nilCache *objectCache
+	nilCache.Set(1, makeObject(1))
+	if _, ok := nilCache.Get(1); ok || nilCache.Len() != 0 {
+		t.Fatalf("Nil cache not empty")
+	}
+}
+
+func TestEstimateObjectSize(t *testing.T) {
+	str := MakeString("0123456789")
+	ind := MakeIndirectObject(str)
+	dict := MakeDict()
+	dict.Set("Key", str)
+	withRef := MakeDict()
+	withRef.Set("Key", ind)
+
+	if EstimateObjectSize(ind) != EstimateObjectSize(str)+objectOverhead {
+		t.Fatalf("Incorrect indirect object size %d", EstimateObjectSize(ind))
+	}
+	if EstimateObjectSize(dict) <= EstimateObjectSize(str) {
+		t.Fatalf("Incorrect dictionary size %d", EstimateObjectSize(dict))
+	}
+	// Indirect objects are not counted in the objects referring to them.
+	if EstimateObjectSize(withRef) >= EstimateObjectSize(dict) {
+		t.Fatalf("Indirect object counted %d", EstimateObjectSize(withRef))
+	}
+	stream := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: make([]byte, 1000)}
+	if EstimateObjectSize(stream) < 1000 {
+		t.Fatalf("Incorrect stream size %d", EstimateObjectSize(stream))
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"context"
+	"io"
+)
+
+// Number of bytes scanned between the checks for cancellation in the byte-by-byte loops.
+const contextCheckInterval = 4096
+
+// contextErr returns the error of `ctx` if canceled or past its deadline, nil otherwise or if
+// `ctx` is nil.
+func contextErr(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// contextReader is a reader that fails with the error of its context once canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// withContext returns a reader for `r` that stops on cancellation of `ctx`, or `r` itself if `ctx`
+// is nil.
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	if ctx == nil {
+		return r
+	}
+	return contextReader{ctx: ctx, r: r}
+}
+
+// setDecodeContext makes `encoder` check `ctx` for cancellation while decoding, for the encoders
+// with potentially long running decoding.
+func setDecodeContext(encoder StreamEncoder, ctx context.Context) {
+	switch t := encoder.(type) {
+	case *FlateEncoder:
+		t.ctx = ctx
+	case *LZWEncoder:
+		t.ctx = ctx
+	case *CCITTFaxEncoder:
+		t.ctx = ctx
+	case *JBIG2Encoder:
+		t.ctx = ctx
+	case *JPXEncoder:
+		t.ctx = ctx
+	case *MultiEncoder:
+		t.ctx = ctx
+		for _, enc := range t.encoders {
+			setDecodeContext(enc, ctx)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 
@@ -71,19 +72,32 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 
 	objstm, cached = parser.objstms[sobjNumber]
 	if !cached {
-		soi, err := parser.LookupByNumber(sobjNumber)
+		soi, err := parser.lookupObject(sobjNumber)
 		if err != nil {
 			common.Log.Debug("Missing object stream with number %d", sobjNumber)
 			return nil, err
 		}
 
+		// Errors in the object stream, located by its object number as offsets are relative to
+		// the decoded data.
+		streamError := func(key string, msg string) error {
+			err := newKeyError(key, "%s", msg)
+			return setErrorObject(err, int64(sobjNumber), 0)
+		}
+		inStream := func(err error) error {
+			if loc := errorLocation(err); loc != nil {
+				loc.Offset = -1
+			}
+			return setErrorObject(err, int64(sobjNumber), 0)
+		}
+
 		so, ok := soi.(*PdfObjectStream)
 		if !ok {
-			return nil, errors.New("Invalid object stream")
+			return nil, streamError("", "Invalid object stream")
 		}
 
 		if parser.crypter != nil && !parser.crypter.isDecrypted(so) {
-			return nil, errors.New("Need to decrypt the stream")
+			return nil, setErrorObject(newEncryptionError("", "Need to decrypt the stream"), so.ObjectNumber, so.GenerationNumber)
 		}
 
 		sod := so.PdfObjectDictionary
@@ -91,24 +105,27 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 		name, ok := sod.Get("Type").(*PdfObjectName)
 		if !ok {
 			common.Log.Debug("ERROR: Object stream should always have a Type")
-			return nil, errors.New("Object stream missing Type")
+			return nil, streamError("Type", "Object stream missing Type")
 		}
 		if strings.ToLower(string(*name)) != "objstm" {
 			common.Log.Debug("ERROR: Object stream type shall always be ObjStm !")
-			return nil, errors.New("Object stream type != ObjStm")
+			return nil, streamError("Type", "Object stream type != ObjStm")
 		}
 
 		N, ok := sod.Get("N").(*PdfObjectInteger)
 		if !ok {
-			return nil, errors.New("Invalid N in stream dictionary")
+			return nil, streamError("N", "Invalid N in stream dictionary")
+		}
+		if err := parser.checkObjectCount(int(*N)); err != nil {
+			return nil, err
 		}
 		firstOffset, ok := sod.Get("First").(*PdfObjectInteger)
 		if !ok {
-			return nil, errors.New("Invalid First in stream dictionary")
+			return nil, streamError("First", "Invalid First in stream dictionary")
 		}
 
 		common.Log.Trace("type: %s number of objects: %d", name, *N)
-		ds, err := DecodeStream(so)
+		ds, err := DecodeStreamContext(parser.context(), so)
 		if err != nil {
 			return nil, err
 		}
@@ -132,22 +149,22 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 			// Object number.
 			obj, err := parser.parseNumber()
 			if err != nil {
-				return nil, err
+				return nil, inStream(err)
 			}
 			onum, ok := obj.(*PdfObjectInteger)
 			if !ok {
-				return nil, errors.New("Invalid object stream offset table")
+				return nil, streamError("", "Invalid object stream offset table")
 			}
 
 			parser.skipSpaces()
 			// Offset.
 			obj, err = parser.parseNumber()
 			if err != nil {
-				return nil, err
+				return nil, inStream(err)
 			}
 			offset, ok := obj.(*PdfObjectInteger)
 			if !ok {
-				return nil, errors.New("Invalid object stream offset table")
+				return nil, streamError("", "Invalid object stream offset table")
 			}
 
 			common.Log.Trace("obj %d offset %d", *onum, *offset)
@@ -156,7 +173,11 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 
 		objstm = ObjectStream{N: int(*N), ds: ds, offsets: offsets}
 		parser.objstms[sobjNumber] = objstm
+		parser.objCache.addObjectStream(sobjNumber, int64(len(ds)))
 	} else {
+		// Mark as recently used.
+		parser.objCache.hasObjectStream(sobjNumber)
+
 		// Temporarily change the reader object to this decoded buffer.
 		// Point back afterwards.
 		bakOffset := parser.GetFileOffset()
@@ -179,10 +200,14 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 	val, err := parser.parseObject()
 	if err != nil {
 		common.Log.Debug("ERROR Fail to read object (%s)", err)
-		return nil, err
+		if loc := errorLocation(err); loc != nil {
+			// Offset within the decoded object stream.
+			loc.Offset = -1
+		}
+		return nil, setErrorObject(err, int64(objNum), 0)
 	}
 	if val == nil {
-		return nil, errors.New("Object cannot be null")
+		return nil, setErrorObject(newSyntaxError("Object cannot be null"), int64(objNum), 0)
 	}
 
 	// Make an indirect object around it.
@@ -196,6 +221,16 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 // LookupByNumber looks up a PdfObject by object number.  Returns an error on failure.
 // TODO (v3): Unexport.
 func (parser *PdfParser) LookupByNumber(objNumber int) (PdfObject, error) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+	return parser.lookupObject(objNumber)
+}
+
+// lookupObject looks up a PdfObject by object number, with the lock of the parser held.
+func (parser *PdfParser) lookupObject(objNumber int) (PdfObject, error) {
+	if err := contextErr(parser.ctx); err != nil {
+		return nil, err
+	}
 	// Outside interface for lookupByNumberWrapper.  Default attempts repairs of bad xref tables.
 	obj, _, err := parser.lookupByNumberWrapper(objNumber, true)
 	return obj, err
@@ -233,7 +268,7 @@ func getObjectNumber(obj PdfObject) (int64, int64, error) {
 // LookupByNumber
 // Repair signals whether to repair if broken.
 func (parser *PdfParser) lookupByNumber(objNumber int, attemptRepairs bool) (PdfObject, bool, error) {
-	obj, ok := parser.ObjCache[objNumber]
+	obj, ok := parser.objCache.Get(objNumber)
 	if ok {
 		common.Log.Trace("Returning cached object %d", objNumber)
 		return obj, false, nil
@@ -261,16 +296,28 @@ func (parser *PdfParser) lookupByNumber(objNumber int, attemptRepairs bool) (Pdf
 		obj, err := parser.ParseIndirectObject()
 		if err != nil {
 			common.Log.Debug("ERROR Failed reading xref (%s)", err)
+			err = setErrorObject(err, int64(objNumber), int64(xref.generation))
+			if _, isLimit := err.(*LimitError); isLimit {
+				return nil, false, err
+			}
 			// Offset pointing to a non-object.  Try to repair the file.
 			if attemptRepairs {
 				common.Log.Debug("Attempting to repair xrefs (top down)")
+				loc := ErrorLocation{Offset: xref.offset, ObjectNumber: int64(objNumber), GenerationNumber: int64(xref.generation)}
+				if err := parser.repair(loc, err.Error(), err, "Rebuilt xref table top down"); err != nil {
+					return nil, false, err
+				}
 				xrefTable, err := parser.repairRebuildXrefsTopDown()
 				if err != nil {
 					common.Log.Debug("ERROR Failed repair (%s)", err)
 					return nil, false, err
 				}
 				parser.xrefs = *xrefTable
-				return parser.lookupByNumber(objNumber, false)
+				obj, inObjStm, err := parser.lookupByNumber(objNumber, false)
+				if err != nil {
+					return nil, inObjStm, newRepairError("Rebuilt xref table top down", objNumber, err)
+				}
+				return obj, inObjStm, nil
 			}
 			return nil, false, err
 		}
@@ -282,19 +329,28 @@ func (parser *PdfParser) lookupByNumber(objNumber int, attemptRepairs bool) (Pdf
 			realObjNum, _, _ := getObjectNumber(obj)
 			if int(realObjNum) != objNumber {
 				common.Log.Debug("Invalid xrefs: Rebuilding")
+				loc := ErrorLocation{Offset: xref.offset, ObjectNumber: int64(objNumber), GenerationNumber: int64(xref.generation)}
+				problem := fmt.Sprintf("Xref entry pointing to object %d", realObjNum)
+				if err := parser.repair(loc, problem, nil, "Rebuilt xref table"); err != nil {
+					return nil, false, err
+				}
 				err := parser.rebuildXrefTable()
 				if err != nil {
 					return nil, false, err
 				}
 				// Empty the cache.
-				parser.ObjCache = ObjectCache{}
+				parser.objCache.Clear()
 				// Try looking up again and return.
-				return parser.lookupByNumberWrapper(objNumber, false)
+				obj, inObjStm, err := parser.lookupByNumberWrapper(objNumber, false)
+				if err != nil {
+					return nil, inObjStm, newRepairError("Rebuilt xref table", objNumber, err)
+				}
+				return obj, inObjStm, nil
 			}
 		}
 
 		common.Log.Trace("Returning obj")
-		parser.ObjCache[objNumber] = obj
+		parser.objCache.Set(objNumber, obj)
 		return obj, false, nil
 	} else if xref.xtype == XREF_OBJECT_STREAM {
 		common.Log.Trace("xref from object stream!")
@@ -303,7 +359,7 @@ func (parser *PdfParser) lookupByNumber(objNumber int, attemptRepairs bool) (Pdf
 
 		if xref.osObjNumber == objNumber {
 			common.Log.Debug("ERROR Circular reference!?!")
-			return nil, true, errors.New("Xref circular reference")
+			return nil, true, setErrorObject(newSyntaxError("Xref circular reference"), int64(objNumber), 0)
 		}
 		_, exists := parser.xrefs[xref.osObjNumber]
 		if exists {
@@ -313,7 +369,7 @@ func (parser *PdfParser) lookupByNumber(objNumber int, attemptRepairs bool) (Pdf
 				return nil, true, err
 			}
 			common.Log.Trace("<Loaded via OS")
-			parser.ObjCache[objNumber] = optr
+			parser.objCache.Set(objNumber, optr)
 			if parser.crypter != nil {
 				// Mark as decrypted (inside object stream) for caching.
 				// and avoid decrypting decrypted object.
@@ -322,10 +378,10 @@ func (parser *PdfParser) lookupByNumber(objNumber int, attemptRepairs bool) (Pdf
 			return optr, true, nil
 		} else {
 			common.Log.Debug("?? Belongs to a non-cross referenced object ...!")
-			return nil, true, errors.New("OS belongs to a non cross referenced object")
+			return nil, true, setErrorObject(newSyntaxError("OS belongs to a non cross referenced object"), int64(objNumber), 0)
 		}
 	}
-	return nil, false, errors.New("Unknown xref type")
+	return nil, false, setErrorObject(newSyntaxError("Unknown xref type"), int64(objNumber), 0)
 }
 
 // LookupByReference looks up a PdfObject by a reference.
@@ -337,6 +393,17 @@ func (parser *PdfParser) LookupByReference(ref PdfObjectReference) (PdfObject, e
 // Trace traces a PdfObject to direct object, looking up and resolving references as needed (unlike TraceToDirect).
 // TODO (v3): Unexport.
 func (parser *PdfParser) Trace(obj PdfObject) (PdfObject, error) {
+	if _, isRef := obj.(*PdfObjectReference); !isRef {
+		// Direct object already.
+		return obj, nil
+	}
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+	return parser.trace(obj)
+}
+
+// trace traces a PdfObject to direct object, with the lock of the parser held.
+func (parser *PdfParser) trace(obj PdfObject) (PdfObject, error) {
 	ref, isRef := obj.(*PdfObjectReference)
 	if !isRef {
 		// Direct object already.
@@ -346,7 +413,7 @@ func (parser *PdfParser) Trace(obj PdfObject) (PdfObject, error) {
 	bakOffset := parser.GetFileOffset()
 	defer func() { parser.SetFileOffset(bakOffset) }()
 
-	o, err := parser.LookupByReference(*ref)
+	o, err := parser.lookupObject(int(ref.ObjectNumber))
 	if err != nil {
 		return nil, err
 	}
@@ -6,13 +6,16 @@
 package core
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 
 	"github.com/unidoc/unidoc/common"
@@ -29,17 +32,22 @@ type PdfCrypt struct {
 	R                int
 	O                []byte
 	U                []byte
+	OE               []byte // R=6 only.
+	UE               []byte // R=6 only.
 	P                int
+	Perms            []byte // R=6 only.
 	EncryptMetadata  bool
 	Id0              string
 	EncryptionKey    []byte
 	DecryptedObjects map[PdfObject]bool
 	EncryptedObjects map[PdfObject]bool
 	Authenticated    bool
-	// Crypt filters (V4).
+	// Crypt filters (V4 and V5).
 	CryptFilters CryptFilters
 	StreamFilter string
 	StringFilter string
+	// Public-key security handler (Adobe.PubSec).
+	Recipients [][]byte
 
 	parser *PdfParser
 }
@@ -71,13 +79,17 @@ const padding = "\x28\xBF\x4E\x5E\x4E\x75\x8A\x41\x64\x00\x4E\x56\xFF" +
 type CryptFilter struct {
 	Cfm    string
 	Length int
+
+	// Public-key security handler only.
+	Recipients      [][]byte
+	EncryptMetadata bool
 }
 
 // CryptFilters is a map of crypt filter name and underlying CryptFilter info.
 // TODO (v3): Unexport.
 type CryptFilters map[string]CryptFilter
 
-// LoadCryptFilters loads crypt filter information from the encryption dictionary (V4 only).
+// LoadCryptFilters loads crypt filter information from the encryption dictionary (V4 and V5).
 // TODO (v3): Unexport.
 func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 	crypt.CryptFilters = CryptFilters{}
@@ -85,7 +97,7 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 	obj := ed.Get("CF")
 	obj = TraceToDirectObject(obj) // XXX may need to resolve reference...
 	if ref, isRef := obj.(*PdfObjectReference); isRef {
-		o, err := crypt.parser.LookupByReference(*ref)
+		o, err := crypt.parser.lookupObject(int(ref.ObjectNumber))
 		if err != nil {
 			common.Log.Debug("Error looking up CF reference")
 			return err
@@ -96,14 +108,14 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 	cf, ok := obj.(*PdfObjectDictionary)
 	if !ok {
 		common.Log.Debug("Invalid CF, type: %T", obj)
-		return errors.New("Invalid CF")
+		return newEncryptionError("CF", "Invalid CF")
 	}
 
 	for _, name := range cf.Keys() {
 		v := cf.Get(name)
 
 		if ref, isRef := v.(*PdfObjectReference); isRef {
-			o, err := crypt.parser.LookupByReference(*ref)
+			o, err := crypt.parser.lookupObject(int(ref.ObjectNumber))
 			if err != nil {
 				common.Log.Debug("Error lookup up dictionary reference")
 				return err
@@ -113,7 +125,7 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 
 		dict, ok := v.(*PdfObjectDictionary)
 		if !ok {
-			return fmt.Errorf("Invalid dict in CF (name %s) - not a dictionary but %T", name, v)
+			return newEncryptionError("CF", "Invalid dict in CF (name %s) - not a dictionary but %T", name, v)
 		}
 
 		if name == "Identity" {
@@ -124,11 +136,11 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 		// If Type present, should be CryptFilter.
 		if typename, ok := dict.Get("Type").(*PdfObjectName); ok {
 			if string(*typename) != "CryptFilter" {
-				return fmt.Errorf("CF dict type != CryptFilter (%s)", typename)
+				return newEncryptionError("CF", "CF dict type != CryptFilter (%s)", typename)
 			}
 		}
 
-		cf := CryptFilter{}
+		cf := CryptFilter{EncryptMetadata: true}
 
 		// Method.
 		cfMethod := "None" // Default.
@@ -138,12 +150,18 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 				cfMethod = "V2"
 			} else if *cfm == "AESV2" {
 				cfMethod = "AESV2"
+			} else if *cfm == "AESV3" {
+				cfMethod = "AESV3"
 			} else {
-				return fmt.Errorf("Unsupported crypt filter (%s)", *cfm)
+				err := newEncryptionError("CFM", "Unsupported crypt filter (%s)", *cfm)
+				err.Filter = string(*cfm)
+				return err
 			}
 		}
-		if cfMethod != "V2" && cfMethod != "AESV2" {
-			return fmt.Errorf("Unsupported crypt filter (%s)", cfMethod)
+		if cfMethod != "V2" && cfMethod != "AESV2" && cfMethod != "AESV3" {
+			err := newEncryptionError("CFM", "Unsupported crypt filter (%s)", cfMethod)
+			err.Filter = cfMethod
+			return err
 		}
 		cf.Cfm = cfMethod
 
@@ -152,20 +170,42 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 		length, ok := dict.Get("Length").(*PdfObjectInteger)
 		if ok {
 			if *length%8 != 0 {
-				return fmt.Errorf("Crypt filter length not multiple of 8 (%d)", *length)
+				return newEncryptionError("Length", "Crypt filter length not multiple of 8 (%d)", *length)
 			}
+			l := int(*length)
 
-			// Standard security handler expresses the length in multiples of 8 (16 means 128)
-			// We only deal with standard so far. (Public key not supported yet).
-			if *length < 5 || *length > 16 {
-				if *length == 64 || *length == 128 {
-					common.Log.Debug("STANDARD VIOLATION: Crypt Length appears to be in bits rather than bytes - assuming bits (%d)", *length)
-					*length /= 8
+			if cfMethod == "AESV3" {
+				// AESV3 always uses a 256 bit key (32 bytes).
+				if l == 256 {
+					common.Log.Debug("STANDARD VIOLATION: Crypt Length appears to be in bits rather than bytes - assuming bits (%d)", l)
+					l /= 8
+				}
+				if l != 32 {
+					return newEncryptionError("Length", "Crypt filter length not 256 bit for AESV3 (%d)", l)
+				}
+			} else if l < 5 || l > 16 {
+				// Standard security handler expresses the length in multiples of 8 (16 means 128)
+				// We only deal with standard so far. (Public key not supported yet).
+				if l == 64 || l == 128 {
+					common.Log.Debug("STANDARD VIOLATION: Crypt Length appears to be in bits rather than bytes - assuming bits (%d)", l)
+					l /= 8
 				} else {
-					return fmt.Errorf("Crypt filter length not in range 40 - 128 bit (%d)", *length)
+					return newEncryptionError("Length", "Crypt filter length not in range 40 - 128 bit (%d)", l)
 				}
 			}
-			cf.Length = int(*length)
+			cf.Length = l
+		}
+
+		// Recipients and EncryptMetadata of public-key crypt filters.
+		if obj := dict.Get("Recipients"); obj != nil {
+			recipients, err := crypt.loadRecipients(obj)
+			if err != nil {
+				return err
+			}
+			cf.Recipients = recipients
+		}
+		if em, ok := dict.Get("EncryptMetadata").(*PdfObjectBool); ok {
+			cf.EncryptMetadata = bool(*em)
 		}
 
 		crypt.CryptFilters[string(name)] = cf
@@ -177,7 +217,7 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 	crypt.StringFilter = "Identity"
 	if strf, ok := ed.Get("StrF").(*PdfObjectName); ok {
 		if _, exists := crypt.CryptFilters[string(*strf)]; !exists {
-			return fmt.Errorf("Crypt filter for StrF not specified in CF dictionary (%s)", *strf)
+			return newEncryptionError("StrF", "Crypt filter for StrF not specified in CF dictionary (%s)", *strf)
 		}
 		crypt.StringFilter = string(*strf)
 	}
@@ -186,7 +226,7 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 	crypt.StreamFilter = "Identity"
 	if stmf, ok := ed.Get("StmF").(*PdfObjectName); ok {
 		if _, exists := crypt.CryptFilters[string(*stmf)]; !exists {
-			return fmt.Errorf("Crypt filter for StmF not specified in CF dictionary (%s)", *stmf)
+			return newEncryptionError("StmF", "Crypt filter for StmF not specified in CF dictionary (%s)", *stmf)
 		}
 		crypt.StreamFilter = string(*stmf)
 	}
@@ -194,6 +234,48 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 	return nil
 }
 
+// loadRecipients loads the Recipients entry of the public-key security handler: a string or an
+// array of strings, each holding a PKCS #7 enveloped data object.
+func (crypt *PdfCrypt) loadRecipients(obj PdfObject) ([][]byte, error) {
+	obj = TraceToDirectObject(obj)
+	if ref, isRef := obj.(*PdfObjectReference); isRef {
+		o, err := crypt.parser.lookupObject(int(ref.ObjectNumber))
+		if err != nil {
+			common.Log.Debug("Error looking up Recipients reference")
+			return nil, err
+		}
+		obj = TraceToDirectObject(o)
+	}
+
+	var objs []PdfObject
+	switch t := obj.(type) {
+	case *PdfObjectString:
+		objs = []PdfObject{t}
+	case *PdfObjectArray:
+		objs = *t
+	default:
+		return nil, newEncryptionError("Recipients", "Invalid Recipients type (%T)", obj)
+	}
+
+	recipients := [][]byte{}
+	for _, o := range objs {
+		if ref, isRef := o.(*PdfObjectReference); isRef {
+			var err error
+			o, err = crypt.parser.lookupObject(int(ref.ObjectNumber))
+			if err != nil {
+				common.Log.Debug("Error looking up recipient reference")
+				return nil, err
+			}
+		}
+		str, ok := TraceToDirectObject(o).(*PdfObjectString)
+		if !ok {
+			return nil, newEncryptionError("Recipients", "Invalid recipient type (%T)", o)
+		}
+		recipients = append(recipients, []byte(*str))
+	}
+	return recipients, nil
+}
+
 // PdfCryptMakeNew makes the document crypt handler based on the encryption dictionary
 // and trailer dictionary. Returns an error on failure to process.
 func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCrypt, error) {
@@ -206,24 +288,30 @@ func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCr
 	filter, ok := ed.Get("Filter").(*PdfObjectName)
 	if !ok {
 		common.Log.Debug("ERROR Crypt dictionary missing required Filter field!")
-		return crypter, errors.New("Required crypt field Filter missing")
+		return crypter, newEncryptionError("Filter", "Required crypt field Filter missing")
 	}
-	if *filter != "Standard" {
+	if *filter != "Standard" && *filter != "Adobe.PubSec" {
 		common.Log.Debug("ERROR Unsupported filter (%s)", *filter)
-		return crypter, errors.New("Unsupported Filter")
+		err := newEncryptionError("Filter", "Unsupported Filter")
+		err.Filter = string(*filter)
+		return crypter, err
 	}
 	crypter.Filter = string(*filter)
 
-	subfilter, ok := ed.Get("SubFilter").(*PdfObjectString)
-	if ok {
+	// SubFilter should be a name, but accept a string also.
+	switch subfilter := ed.Get("SubFilter").(type) {
+	case *PdfObjectName:
+		crypter.Subfilter = string(*subfilter)
+		common.Log.Debug("Using subfilter %s", crypter.Subfilter)
+	case *PdfObjectString:
 		crypter.Subfilter = string(*subfilter)
-		common.Log.Debug("Using subfilter %s", subfilter)
+		common.Log.Debug("Using subfilter %s", crypter.Subfilter)
 	}
 
 	if L, ok := ed.Get("Length").(*PdfObjectInteger); ok {
 		if (*L % 8) != 0 {
 			common.Log.Debug("ERROR Invalid encryption length")
-			return crypter, errors.New("Invalid encryption length")
+			return crypter, newEncryptionError("Length", "Invalid encryption length")
 		}
 		crypter.Length = int(*L)
 	} else {
@@ -237,52 +325,105 @@ func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCr
 			// Default algorithm is V2.
 			crypter.CryptFilters = CryptFilters{}
 			crypter.CryptFilters["Default"] = CryptFilter{Cfm: "V2", Length: crypter.Length}
-		} else if *V == 4 {
+		} else if *V == 4 || *V == 5 {
 			crypter.V = int(*V)
+			if *V == 5 && ed.Get("Length") == nil {
+				// AES-256 only.
+				crypter.Length = 256
+			}
 			if err := crypter.LoadCryptFilters(ed); err != nil {
 				return crypter, err
 			}
 		} else {
 			common.Log.Debug("ERROR Unsupported encryption algo V = %d", *V)
-			return crypter, errors.New("Unsupported algorithm")
+			return crypter, newEncryptionError("V", "Unsupported algorithm")
 		}
 	} else {
 		crypter.V = 0
 	}
 
+	if crypter.Filter == "Adobe.PubSec" {
+		err := crypter.loadPubSec(ed)
+		return crypter, err
+	}
+
 	R, ok := ed.Get("R").(*PdfObjectInteger)
 	if !ok {
-		return crypter, errors.New("Encrypt dictionary missing R")
+		return crypter, newEncryptionError("R", "Encrypt dictionary missing R")
 	}
-	if *R < 2 || *R > 4 {
-		return crypter, errors.New("Invalid R")
+	if *R < 2 || *R > 6 {
+		return crypter, newEncryptionError("R", "Invalid R")
 	}
 	crypter.R = int(*R)
 
 	O, ok := ed.Get("O").(*PdfObjectString)
 	if !ok {
-		return crypter, errors.New("Encrypt dictionary missing O")
+		return crypter, newEncryptionError("O", "Encrypt dictionary missing O")
 	}
-	if len(*O) != 32 {
-		return crypter, fmt.Errorf("Length(O) != 32 (%d)", len(*O))
+	if crypter.R >= 5 {
+		// O and U are 48 bytes (hash, validation salt and key salt) for R >= 5.
+		// Some writers pad them with extra bytes, which are ignored.
+		if len(*O) < 48 {
+			return crypter, newEncryptionError("O", "Length(O) < 48 (%d)", len(*O))
+		}
+		crypter.O = []byte(*O)[:48]
+	} else {
+		if len(*O) != 32 {
+			return crypter, newEncryptionError("O", "Length(O) != 32 (%d)", len(*O))
+		}
+		crypter.O = []byte(*O)
 	}
-	crypter.O = []byte(*O)
 
 	U, ok := ed.Get("U").(*PdfObjectString)
 	if !ok {
-		return crypter, errors.New("Encrypt dictionary missing U")
+		return crypter, newEncryptionError("U", "Encrypt dictionary missing U")
 	}
-	if len(*U) != 32 {
-		// Strictly this does not cause an error.
-		// If O is OK and others then can still read the file.
-		common.Log.Debug("Warning: Length(U) != 32 (%d)", len(*U))
-		//return crypter, errors.New("Length(U) != 32")
+	if crypter.R >= 5 {
+		if len(*U) < 48 {
+			return crypter, newEncryptionError("U", "Length(U) < 48 (%d)", len(*U))
+		}
+		crypter.U = []byte(*U)[:48]
+	} else {
+		if len(*U) != 32 {
+			// Strictly this does not cause an error.
+			// If O is OK and others then can still read the file.
+			common.Log.Debug("Warning: Length(U) != 32 (%d)", len(*U))
+			//return crypter, errors.New("Length(U) != 32")
+		}
+		crypter.U = []byte(*U)
+	}
+
+	if crypter.R >= 5 {
+		// The file encryption key is stored encrypted in OE and UE.
+		OE, ok := ed.Get("OE").(*PdfObjectString)
+		if !ok {
+			return crypter, newEncryptionError("OE", "Encrypt dictionary missing OE")
+		}
+		if len(*OE) < 32 {
+			return crypter, newEncryptionError("OE", "Length(OE) < 32 (%d)", len(*OE))
+		}
+		crypter.OE = []byte(*OE)[:32]
+
+		UE, ok := ed.Get("UE").(*PdfObjectString)
+		if !ok {
+			return crypter, newEncryptionError("UE", "Encrypt dictionary missing UE")
+		}
+		if len(*UE) < 32 {
+			return crypter, newEncryptionError("UE", "Length(UE) < 32 (%d)", len(*UE))
+		}
+		crypter.UE = []byte(*UE)[:32]
+
+		// Perms is required, but only used to detect tampering of P, so can do without.
+		if Perms, ok := ed.Get("Perms").(*PdfObjectString); ok && len(*Perms) >= 16 {
+			crypter.Perms = []byte(*Perms)[:16]
+		} else {
+			common.Log.Debug("Warning: Encrypt dictionary missing or invalid Perms")
+		}
 	}
-	crypter.U = []byte(*U)
 
 	P, ok := ed.Get("P").(*PdfObjectInteger)
 	if !ok {
-		return crypter, errors.New("Encrypt dictionary missing permissions attr")
+		return crypter, newEncryptionError("P", "Encrypt dictionary missing permissions attr")
 	}
 	crypter.P = int(*P)
 
@@ -300,7 +441,7 @@ func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCr
 	if idArray, ok := trailer.Get("ID").(*PdfObjectArray); ok && len(*idArray) >= 1 {
 		id0obj, ok := (*idArray)[0].(*PdfObjectString)
 		if !ok {
-			return crypter, errors.New("Invalid trailer ID")
+			return crypter, newEncryptionError("ID", "Invalid trailer ID")
 		}
 		id0 = *id0obj
 	} else {
@@ -311,6 +452,84 @@ func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCr
 	return crypter, nil
 }
 
+// loadPubSec loads the recipients and the metadata encryption flag of the public-key security
+// handler (Section 7.6.5).  The adbe.pkcs7.s4 sub-filter lists the recipients in the encryption
+// dictionary, while adbe.pkcs7.s5 uses crypt filters (V4 and V5).
+func (crypt *PdfCrypt) loadPubSec(ed *PdfObjectDictionary) error {
+	crypt.EncryptMetadata = true
+
+	if crypt.V >= 4 {
+		filter := crypt.StreamFilter
+		if filter == "Identity" {
+			filter = crypt.StringFilter
+		}
+		cf := crypt.CryptFilters[filter]
+		crypt.Recipients = cf.Recipients
+		crypt.EncryptMetadata = cf.EncryptMetadata
+	} else if obj := ed.Get("Recipients"); obj != nil {
+		recipients, err := crypt.loadRecipients(obj)
+		if err != nil {
+			return err
+		}
+		crypt.Recipients = recipients
+	}
+
+	if len(crypt.Recipients) == 0 {
+		return newEncryptionError("Recipients", "Public-key encryption dictionary missing Recipients")
+	}
+	return nil
+}
+
+// Duplicate returns a copy of the crypt handler with the same security settings and encryption
+// key, which can be used to encrypt another file in the same way.  For the standard security handler
+// the owner password is required, and is checked on the copy so that the crypt handler is left
+// unchanged.  The public-key security handler must have been authenticated with a recipient
+// certificate (the password is not used).
+func (crypt *PdfCrypt) Duplicate(ownerPass []byte) (*PdfCrypt, error) {
+	if crypt.Filter == "Adobe.PubSec" && !crypt.Authenticated {
+		return nil, errors.New("Not authenticated with a recipient certificate")
+	}
+
+	dup := PdfCrypt{}
+	dup.Filter = crypt.Filter
+	dup.Subfilter = crypt.Subfilter
+	dup.V = crypt.V
+	dup.Length = crypt.Length
+	dup.R = crypt.R
+	dup.O = append([]byte{}, crypt.O...)
+	dup.U = append([]byte{}, crypt.U...)
+	dup.OE = append([]byte{}, crypt.OE...)
+	dup.UE = append([]byte{}, crypt.UE...)
+	dup.P = crypt.P
+	dup.Perms = append([]byte{}, crypt.Perms...)
+	dup.EncryptMetadata = crypt.EncryptMetadata
+	dup.Id0 = crypt.Id0
+	dup.DecryptedObjects = map[PdfObject]bool{}
+	dup.EncryptedObjects = map[PdfObject]bool{}
+	dup.CryptFilters = CryptFilters{}
+	for name, cf := range crypt.CryptFilters {
+		dup.CryptFilters[name] = cf
+	}
+	dup.StreamFilter = crypt.StreamFilter
+	dup.StringFilter = crypt.StringFilter
+	dup.Recipients = crypt.Recipients
+
+	if dup.Filter == "Adobe.PubSec" {
+		dup.EncryptionKey = append([]byte{}, crypt.EncryptionKey...)
+	} else {
+		// Sets the encryption key of the copy.
+		isOwner, err := dup.checkOwnerPassword(ownerPass)
+		if err != nil {
+			return nil, err
+		}
+		if !isOwner {
+			return nil, errors.New("Invalid owner password")
+		}
+	}
+	dup.Authenticated = true
+	return &dup, nil
+}
+
 // GetAccessPermissions returns the PDF access permissions as an AccessPermissions object.
 func (crypt *PdfCrypt) GetAccessPermissions() AccessPermissions {
 	perms := AccessPermissions{}
@@ -380,9 +599,14 @@ func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
 
 	crypt.Authenticated = false
 
+	if crypt.Filter == "Adobe.PubSec" {
+		// Requires a recipient certificate and private key (authenticateCertificate).
+		return false, nil
+	}
+
 	// Try user password.
 	common.Log.Trace("Debugging authentication - user pass")
-	authenticated, err := crypt.Alg6(password)
+	authenticated, err := crypt.checkUserPassword(password)
 	if err != nil {
 		return false, err
 	}
@@ -396,7 +620,7 @@ func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
 	// May not be necessary if only want to get all contents.
 	// (user pass needs to be known or empty).
 	common.Log.Trace("Debugging authentication - owner pass")
-	authenticated, err = crypt.Alg7(password)
+	authenticated, err = crypt.checkOwnerPassword(password)
 	if err != nil {
 		return false, err
 	}
@@ -418,8 +642,16 @@ func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
 func (crypt *PdfCrypt) checkAccessRights(password []byte) (bool, AccessPermissions, error) {
 	perms := AccessPermissions{}
 
+	if crypt.Filter == "Adobe.PubSec" {
+		// The permissions are only known after authenticating with a recipient certificate.
+		if crypt.Authenticated {
+			return true, crypt.GetAccessPermissions(), nil
+		}
+		return false, perms, nil
+	}
+
 	// Try owner password -> full rights.
-	isOwner, err := crypt.Alg7(password)
+	isOwner, err := crypt.checkOwnerPassword(password)
 	if err != nil {
 		return false, perms, err
 	}
@@ -437,7 +669,7 @@ func (crypt *PdfCrypt) checkAccessRights(password []byte) (bool, AccessPermissio
 	}
 
 	// Try user password.
-	isUser, err := crypt.Alg6(password)
+	isUser, err := crypt.checkUserPassword(password)
 	if err != nil {
 		return false, perms, err
 	}
@@ -450,6 +682,24 @@ func (crypt *PdfCrypt) checkAccessRights(password []byte) (bool, AccessPermissio
 	return false, perms, nil
 }
 
+// checkUserPassword authenticates the user password, using the algorithm for the handler revision.
+// Sets the encryption key on success.
+func (crypt *PdfCrypt) checkUserPassword(upass []byte) (bool, error) {
+	if crypt.R >= 5 {
+		return crypt.alg11(upass)
+	}
+	return crypt.Alg6(upass)
+}
+
+// checkOwnerPassword authenticates the owner password, using the algorithm for the handler revision.
+// Sets the encryption key on success.
+func (crypt *PdfCrypt) checkOwnerPassword(opass []byte) (bool, error) {
+	if crypt.R >= 5 {
+		return crypt.alg12(opass)
+	}
+	return crypt.Alg7(opass)
+}
+
 func (crypt *PdfCrypt) paddedPass(pass []byte) []byte {
 	key := make([]byte, 32)
 	if len(pass) >= 32 {
@@ -473,7 +723,13 @@ func (crypt *PdfCrypt) makeKey(filter string, objNum, genNum uint32, ekey []byte
 	cf, ok := crypt.CryptFilters[filter]
 	if !ok {
 		common.Log.Debug("ERROR Unsupported crypt filter (%s)", filter)
-		return nil, fmt.Errorf("Unsupported crypt filter (%s)", filter)
+		err := newEncryptionError("", "Unsupported crypt filter (%s)", filter)
+		err.Filter = filter
+		return nil, err
+	}
+	if cf.Cfm == "AESV3" {
+		// AES-256 uses the file encryption key directly for all objects.
+		return ekey, nil
 	}
 	isAES := false
 	if cf.Cfm == "AESV2" {
@@ -532,7 +788,9 @@ func (crypt *PdfCrypt) decryptBytes(buf []byte, filter string, okey []byte) ([]b
 	cf, ok := crypt.CryptFilters[filter]
 	if !ok {
 		common.Log.Debug("ERROR Unsupported crypt filter (%s)", filter)
-		return nil, fmt.Errorf("Unsupported crypt filter (%s)", filter)
+		err := newEncryptionError("", "Unsupported crypt filter (%s)", filter)
+		err.Filter = filter
+		return nil, err
 	}
 
 	cfMethod := cf.Cfm
@@ -546,7 +804,7 @@ func (crypt *PdfCrypt) decryptBytes(buf []byte, filter string, okey []byte) ([]b
 		ciph.XORKeyStream(buf, buf)
 		common.Log.Trace("to: % x", buf)
 		return buf, nil
-	} else if cfMethod == "AESV2" {
+	} else if cfMethod == "AESV2" || cfMethod == "AESV3" {
 		// Strings and streams encrypted with AES shall use a padding
 		// scheme that is described in Internet RFC 2898, PKCS #5:
 		// Password-Based Cryptography Specification Version 2.0; see
@@ -572,7 +830,7 @@ func (crypt *PdfCrypt) decryptBytes(buf []byte, filter string, okey []byte) ([]b
 		// 16 bytes of the encrypted stream or string.
 		if len(buf) < 16 {
 			common.Log.Debug("ERROR AES invalid buf %s", buf)
-			return buf, fmt.Errorf("AES: Buf len < 16 (%d)", len(buf))
+			return buf, newEncryptionError("", "AES: Buf len < 16 (%d)", len(buf))
 		}
 
 		iv := buf[:16]
@@ -581,7 +839,7 @@ func (crypt *PdfCrypt) decryptBytes(buf []byte, filter string, okey []byte) ([]b
 		if len(buf)%16 != 0 {
 			common.Log.Debug(" iv (%d): % x", len(iv), iv)
 			common.Log.Debug("buf (%d): % x", len(buf), buf)
-			return buf, fmt.Errorf("AES buf length not multiple of 16 (%d)", len(buf))
+			return buf, newEncryptionError("", "AES buf length not multiple of 16 (%d)", len(buf))
 		}
 
 		mode := cipher.NewCBCDecrypter(ciph, iv)
@@ -598,15 +856,17 @@ func (crypt *PdfCrypt) decryptBytes(buf []byte, filter string, okey []byte) ([]b
 
 		// The padded length is indicated by the last values.  Remove those.
 		padLen := int(buf[len(buf)-1])
-		if padLen >= len(buf) {
+		if padLen > len(buf) {
 			common.Log.Debug("Illegal pad length")
-			return buf, fmt.Errorf("Invalid pad length")
+			return buf, newEncryptionError("", "Invalid pad length")
 		}
 		buf = buf[:len(buf)-padLen]
 
 		return buf, nil
 	}
-	return nil, fmt.Errorf("Unsupported crypt filter method (%s)", cfMethod)
+	err := newEncryptionError("", "Unsupported crypt filter method (%s)", cfMethod)
+	err.Filter = cfMethod
+	return nil, err
 }
 
 // Decrypt an object with specified key. For numbered objects,
@@ -674,6 +934,11 @@ func (crypt *PdfCrypt) Decrypt(obj PdfObject, parentObjNum, parentGenNum int64)
 				}
 			}
 
+			if !crypt.EncryptMetadata && isMetadataStream(dict) {
+				// Metadata streams are left unencrypted (Section 7.6.5).
+				streamFilter = "Identity"
+			}
+
 			common.Log.Trace("with %s filter", streamFilter)
 			if streamFilter == "Identity" {
 				// Identity: pass unchanged.
@@ -749,7 +1014,7 @@ func (crypt *PdfCrypt) Decrypt(obj PdfObject, parentObjNum, parentGenNum int64)
 		isSig := false
 		if t := d.Get("Type"); t != nil {
 			typeStr, ok := t.(*PdfObjectName)
-			if ok && *typeStr == "Sig" {
+			if ok && (*typeStr == "Sig" || *typeStr == "DocTimeStamp") {
 				isSig = true
 			}
 		}
@@ -793,7 +1058,9 @@ func (crypt *PdfCrypt) encryptBytes(buf []byte, filter string, okey []byte) ([]b
 	cf, ok := crypt.CryptFilters[filter]
 	if !ok {
 		common.Log.Debug("ERROR Unsupported crypt filter (%s)", filter)
-		return nil, fmt.Errorf("Unsupported crypt filter (%s)", filter)
+		err := newEncryptionError("", "Unsupported crypt filter (%s)", filter)
+		err.Filter = filter
+		return nil, err
 	}
 
 	cfMethod := cf.Cfm
@@ -807,7 +1074,7 @@ func (crypt *PdfCrypt) encryptBytes(buf []byte, filter string, okey []byte) ([]b
 		ciph.XORKeyStream(buf, buf)
 		common.Log.Trace("to: % x", buf)
 		return buf, nil
-	} else if cfMethod == "AESV2" {
+	} else if cfMethod == "AESV2" || cfMethod == "AESV3" {
 		// Strings and streams encrypted with AES shall use a padding
 		// scheme that is described in Internet RFC 2898, PKCS #5:
 		// Password-Based Cryptography Specification Version 2.0; see
@@ -854,7 +1121,15 @@ func (crypt *PdfCrypt) encryptBytes(buf []byte, filter string, okey []byte) ([]b
 
 		return buf, nil
 	}
-	return nil, fmt.Errorf("Unsupported crypt filter method (%s)", cfMethod)
+	err := newEncryptionError("", "Unsupported crypt filter method (%s)", cfMethod)
+	err.Filter = cfMethod
+	return nil, err
+}
+
+// isMetadataStream returns true if `dict` is the dictionary of a metadata stream (Type Metadata).
+func isMetadataStream(dict *PdfObjectDictionary) bool {
+	name, ok := TraceToDirectObject(dict.Get("Type")).(*PdfObjectName)
+	return ok && *name == "Metadata"
 }
 
 // Encrypt an object with specified key. For numbered objects,
@@ -923,6 +1198,11 @@ func (crypt *PdfCrypt) Encrypt(obj PdfObject, parentObjNum, parentGenNum int64)
 				}
 			}
 
+			if !crypt.EncryptMetadata && isMetadataStream(dict) {
+				// Metadata streams are left unencrypted (Section 7.6.5).
+				streamFilter = "Identity"
+			}
+
 			common.Log.Trace("with %s filter", streamFilter)
 			if streamFilter == "Identity" {
 				// Identity: pass unchanged.
@@ -996,7 +1276,7 @@ func (crypt *PdfCrypt) Encrypt(obj PdfObject, parentObjNum, parentGenNum int64)
 		isSig := false
 		if t := d.Get("Type"); t != nil {
 			typeStr, ok := t.(*PdfObjectName)
-			if ok && *typeStr == "Sig" {
+			if ok && (*typeStr == "Sig" || *typeStr == "DocTimeStamp") {
 				isSig = true
 			}
 		}
@@ -1224,7 +1504,7 @@ func (crypt *PdfCrypt) Alg6(upass []byte) (bool, error) {
 	} else if crypt.R >= 3 {
 		uo, key, err = crypt.Alg5(upass)
 	} else {
-		return false, errors.New("invalid R")
+		return false, newEncryptionError("R", "invalid R")
 	}
 
 	if err != nil {
@@ -1282,7 +1562,7 @@ func (crypt *PdfCrypt) Alg7(opass []byte) (bool, error) {
 			s = append([]byte{}, decrypted...)
 		}
 	} else {
-		return false, errors.New("invalid R")
+		return false, newEncryptionError("R", "invalid R")
 	}
 
 	auth, err := crypt.Alg6(decrypted)
@@ -1292,3 +1572,329 @@ func (crypt *PdfCrypt) Alg7(opass []byte) (bool, error) {
 
 	return auth, nil
 }
+
+// alg2b computes a hash for R >= 5 (Algorithm 2.B, ISO 32000-2 7.6.4.3.4).  For R=5 the hash is a
+// single SHA-256 round, for R=6 it is iterated with SHA-256/384/512 and AES-128 encryption.
+// `udata` is the 48 byte U string when checking/computing the owner password and nil otherwise.
+func (crypt *PdfCrypt) alg2b(pass, salt, udata []byte) ([]byte, error) {
+	h := sha256.New()
+	h.Write(pass)
+	h.Write(salt)
+	h.Write(udata)
+	K := h.Sum(nil)
+
+	if crypt.R == 5 {
+		return K, nil
+	}
+
+	var E []byte
+	for i := 0; i < 64 || int(E[len(E)-1]) > i-32; i++ {
+		// K1 is 64 repetitions of the password, K and the user data.
+		n := len(pass) + len(K) + len(udata)
+		K1 := make([]byte, 0, 64*n)
+		for j := 0; j < 64; j++ {
+			K1 = append(K1, pass...)
+			K1 = append(K1, K...)
+			K1 = append(K1, udata...)
+		}
+
+		// Encrypt K1 with AES-128 (CBC, no padding), using the first 16 bytes of K as key and the
+		// second 16 bytes as initialization vector.
+		ciph, err := aes.NewCipher(K[:16])
+		if err != nil {
+			return nil, err
+		}
+		E = make([]byte, len(K1))
+		cipher.NewCBCEncrypter(ciph, K[16:32]).CryptBlocks(E, K1)
+
+		// The sum of the first 16 bytes of E modulo 3 selects the next hash function.
+		sum := 0
+		for _, b := range E[:16] {
+			sum += int(b)
+		}
+		switch sum % 3 {
+		case 0:
+			h = sha256.New()
+		case 1:
+			h = sha512.New384()
+		case 2:
+			h = sha512.New()
+		}
+		h.Write(E)
+		K = h.Sum(nil)
+	}
+
+	return K[:32], nil
+}
+
+// saslPass prepares the password for R >= 5 (Algorithm 2.A).  The password is expected to be UTF-8
+// and is truncated to 127 bytes.
+// TODO: Process the password with SASLprep (RFC 4013).
+func saslPass(pass []byte) []byte {
+	if len(pass) > 127 {
+		return pass[:127]
+	}
+	return pass
+}
+
+// decryptFileKey decrypts the 32 byte `encKey` (OE or UE) with AES-256 (CBC, zero initialization
+// vector, no padding) using `key` (Algorithm 2.A).
+func decryptFileKey(key, encKey []byte) ([]byte, error) {
+	ciph, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ekey := make([]byte, len(encKey))
+	cipher.NewCBCDecrypter(ciph, make([]byte, aes.BlockSize)).CryptBlocks(ekey, encKey)
+	return ekey, nil
+}
+
+// alg11 authenticates the user password for R >= 5 and retrieves the file encryption key from UE
+// (Algorithms 11 and 2.A).
+func (crypt *PdfCrypt) alg11(upass []byte) (bool, error) {
+	if len(crypt.U) < 48 || len(crypt.UE) < 32 {
+		return false, newEncryptionError("U", "Invalid U/UE for R >= 5")
+	}
+	upass = saslPass(upass)
+
+	// The first 32 bytes of U are the hash of the password and the validation salt (bytes 32-39).
+	hash, err := crypt.alg2b(upass, crypt.U[32:40], nil)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(hash, crypt.U[:32]) {
+		return false, nil
+	}
+
+	// The intermediate key from the key salt (bytes 40-47) decrypts UE.
+	key, err := crypt.alg2b(upass, crypt.U[40:48], nil)
+	if err != nil {
+		return false, err
+	}
+	ekey, err := decryptFileKey(key, crypt.UE[:32])
+	if err != nil {
+		return false, err
+	}
+
+	if err := crypt.alg13(ekey); err != nil {
+		common.Log.Debug("Warning: %v", err)
+	}
+	crypt.EncryptionKey = ekey
+	return true, nil
+}
+
+// alg12 authenticates the owner password for R >= 5 and retrieves the file encryption key from OE
+// (Algorithms 12 and 2.A).
+func (crypt *PdfCrypt) alg12(opass []byte) (bool, error) {
+	if len(crypt.O) < 48 || len(crypt.OE) < 32 || len(crypt.U) < 48 {
+		return false, newEncryptionError("O", "Invalid O/OE for R >= 5")
+	}
+	opass = saslPass(opass)
+
+	// As for the user password, but the 48 bytes of U are hashed too.
+	hash, err := crypt.alg2b(opass, crypt.O[32:40], crypt.U[:48])
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(hash, crypt.O[:32]) {
+		return false, nil
+	}
+
+	key, err := crypt.alg2b(opass, crypt.O[40:48], crypt.U[:48])
+	if err != nil {
+		return false, err
+	}
+	ekey, err := decryptFileKey(key, crypt.OE[:32])
+	if err != nil {
+		return false, err
+	}
+
+	if err := crypt.alg13(ekey); err != nil {
+		common.Log.Debug("Warning: %v", err)
+	}
+	crypt.EncryptionKey = ekey
+	return true, nil
+}
+
+// alg13 validates the permissions (P and EncryptMetadata) against the Perms entry, which is
+// encrypted with the file encryption key `ekey` (Algorithm 13).
+func (crypt *PdfCrypt) alg13(ekey []byte) error {
+	if len(crypt.Perms) != 16 {
+		return newEncryptionError("Perms", "Perms missing")
+	}
+	ciph, err := aes.NewCipher(ekey)
+	if err != nil {
+		return err
+	}
+
+	// Single block, so ECB mode is the same as decrypting the block.
+	perms := make([]byte, 16)
+	ciph.Decrypt(perms, crypt.Perms)
+
+	if !bytes.Equal(perms[9:12], []byte("adb")) {
+		return newEncryptionError("Perms", "Decoded Perms invalid")
+	}
+	p := int32(binary.LittleEndian.Uint32(perms[0:4]))
+	if p != int32(crypt.P) {
+		return newEncryptionError("Perms", "Perms P mismatch (%d != %d)", p, int32(crypt.P))
+	}
+	if encMeta := perms[8] == 'T'; encMeta != crypt.EncryptMetadata {
+		return newEncryptionError("Perms", "Perms EncryptMetadata mismatch")
+	}
+	return nil
+}
+
+// GenerateParams generates the encryption key and the O and U entries (and OE, UE and Perms for
+// R >= 5) of the encryption dictionary for the user and owner passwords.  The handler parameters
+// (V, R, P, Length, EncryptMetadata and Id0) must be set prior to calling.
+// If the owner password is empty, the user password is used for it.
+func (crypt *PdfCrypt) GenerateParams(upass, opass []byte) error {
+	if crypt.R >= 5 {
+		// The file encryption key is random (Algorithm 8 step a).
+		crypt.EncryptionKey = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, crypt.EncryptionKey); err != nil {
+			return err
+		}
+		if len(opass) == 0 {
+			opass = upass
+		}
+		if err := crypt.alg8(upass); err != nil {
+			return err
+		}
+		if err := crypt.alg9(opass); err != nil {
+			return err
+		}
+		return crypt.alg10()
+	}
+
+	O, err := crypt.Alg3(upass, opass)
+	if err != nil {
+		common.Log.Debug("ERROR: Error generating O for encryption (%s)", err)
+		return err
+	}
+	crypt.O = []byte(O)
+	common.Log.Trace("gen O: % x", O)
+
+	var U PdfObjectString
+	var key []byte
+	if crypt.R == 2 {
+		U, key, err = crypt.Alg4(upass)
+	} else {
+		U, key, err = crypt.Alg5(upass)
+	}
+	if err != nil {
+		common.Log.Debug("ERROR: Error generating U for encryption (%s)", err)
+		return err
+	}
+	common.Log.Trace("gen U: % x", U)
+	crypt.U = []byte(U)
+	crypt.EncryptionKey = key
+	return nil
+}
+
+// encryptFileKey encrypts the file encryption key with AES-256 (CBC, zero initialization vector,
+// no padding) using `key`, as stored in OE and UE.
+func (crypt *PdfCrypt) encryptFileKey(key []byte) ([]byte, error) {
+	ciph, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	encKey := make([]byte, len(crypt.EncryptionKey))
+	cipher.NewCBCEncrypter(ciph, make([]byte, aes.BlockSize)).CryptBlocks(encKey, crypt.EncryptionKey)
+	return encKey, nil
+}
+
+// alg8 computes the U and UE entries for R >= 5 from the user password and the file encryption
+// key (Algorithm 8).
+func (crypt *PdfCrypt) alg8(upass []byte) error {
+	upass = saslPass(upass)
+
+	// 8 bytes of validation salt followed by 8 bytes of key salt.
+	salts := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salts); err != nil {
+		return err
+	}
+
+	hash, err := crypt.alg2b(upass, salts[:8], nil)
+	if err != nil {
+		return err
+	}
+	U := make([]byte, 0, 48)
+	U = append(U, hash...)
+	U = append(U, salts...)
+
+	key, err := crypt.alg2b(upass, salts[8:], nil)
+	if err != nil {
+		return err
+	}
+	UE, err := crypt.encryptFileKey(key)
+	if err != nil {
+		return err
+	}
+
+	crypt.U = U
+	crypt.UE = UE
+	return nil
+}
+
+// alg9 computes the O and OE entries for R >= 5 from the owner password, the file encryption key
+// and U (Algorithm 9).  Requires U to be computed first (alg8).
+func (crypt *PdfCrypt) alg9(opass []byte) error {
+	if len(crypt.U) < 48 {
+		return errors.New("U must be computed before O")
+	}
+	opass = saslPass(opass)
+
+	salts := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salts); err != nil {
+		return err
+	}
+
+	hash, err := crypt.alg2b(opass, salts[:8], crypt.U[:48])
+	if err != nil {
+		return err
+	}
+	O := make([]byte, 0, 48)
+	O = append(O, hash...)
+	O = append(O, salts...)
+
+	key, err := crypt.alg2b(opass, salts[8:], crypt.U[:48])
+	if err != nil {
+		return err
+	}
+	OE, err := crypt.encryptFileKey(key)
+	if err != nil {
+		return err
+	}
+
+	crypt.O = O
+	crypt.OE = OE
+	return nil
+}
+
+// alg10 computes the Perms entry for R >= 5 from P, EncryptMetadata and the file encryption key
+// (Algorithm 10).
+func (crypt *PdfCrypt) alg10() error {
+	perms := make([]byte, 16)
+	// P extended to 64 bits (lower order byte first).
+	binary.LittleEndian.PutUint64(perms[0:8], uint64(int64(crypt.P))|0xffffffff00000000)
+	if crypt.EncryptMetadata {
+		perms[8] = 'T'
+	} else {
+		perms[8] = 'F'
+	}
+	copy(perms[9:12], "adb")
+	if _, err := io.ReadFull(rand.Reader, perms[12:]); err != nil {
+		return err
+	}
+
+	ciph, err := aes.NewCipher(crypt.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	// Single block, so ECB mode is the same as encrypting the block.
+	ciph.Encrypt(perms, perms)
+
+	crypt.Perms = perms
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/unidoc/unidoc/common"
+	"github.com/unidoc/unidoc/pdf/internal/pkcs7"
+)
+
+// PubKeyRecipient is a recipient of a document encrypted with the public-key security handler,
+// with the access permissions granted to it.
+type PubKeyRecipient struct {
+	Certificate *x509.Certificate
+	Permissions AccessPermissions
+}
+
+// authenticateCertificate authenticates with the public-key security handler, using the
+// certificate and private key of a recipient (Section 7.6.5.2).  Sets the encryption key and the
+// permissions of the recipient on success.
+func (crypt *PdfCrypt) authenticateCertificate(cert *x509.Certificate, key crypto.PrivateKey) (bool, error) {
+	crypt.Authenticated = false
+	if crypt.Filter != "Adobe.PubSec" {
+		return false, errors.New("Not encrypted with the public-key security handler")
+	}
+
+	var lastErr error
+	for i, recipient := range crypt.Recipients {
+		// Each recipient entry holds the seed and permissions, enveloped for one or more recipients.
+		content, err := pkcs7.Decrypt(recipient, cert, key)
+		if err == pkcs7.ErrNotRecipient {
+			continue
+		}
+		if err != nil {
+			common.Log.Debug("Recipient %d: failed to decrypt enveloped data (%v)", i, err)
+			lastErr = err
+			continue
+		}
+		if len(content) != 24 {
+			common.Log.Debug("Recipient %d: invalid enveloped data length (%d)", i, len(content))
+			lastErr = errors.New("Invalid public-key enveloped data")
+			continue
+		}
+
+		// 20 bytes of seed followed by the 4 bytes of permissions (high order byte first).
+		crypt.P = int(int32(binary.BigEndian.Uint32(content[20:24])))
+		crypt.EncryptionKey = crypt.pubKeyEncryptionKey(content[:20])
+		crypt.Authenticated = true
+		return true, nil
+	}
+
+	return false, lastErr
+}
+
+// pubKeyEncryptionKey computes the file encryption key from the `seed` and the recipients
+// (Section 7.6.5.3).  SHA-256 is used for AES-256 and SHA-1 otherwise.
+func (crypt *PdfCrypt) pubKeyEncryptionKey(seed []byte) []byte {
+	keyLen := crypt.Length / 8
+	var h hash.Hash = sha1.New()
+	if crypt.V >= 4 {
+		cf := crypt.CryptFilters[crypt.StreamFilter]
+		if crypt.StreamFilter == "Identity" {
+			cf = crypt.CryptFilters[crypt.StringFilter]
+		}
+		keyLen = cf.Length
+		if cf.Cfm == "AESV3" {
+			h = sha256.New()
+			keyLen = 32
+		} else if keyLen == 0 {
+			keyLen = 16
+		}
+	}
+
+	h.Write(seed)
+	for _, recipient := range crypt.Recipients {
+		h.Write(recipient)
+	}
+	if crypt.V >= 4 && !crypt.EncryptMetadata {
+		h.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}
+	digest := h.Sum(nil)
+
+	if keyLen <= 0 || keyLen > len(digest) {
+		keyLen = len(digest)
+	}
+	return digest[:keyLen]
+}
+
+// GeneratePubKeyParams generates the Recipients entries and the encryption key for the public-key
+// security handler, with separate permissions for each recipient.  The handler parameters
+// (V, Length, crypt filters and EncryptMetadata) must be set prior to calling.
+func (crypt *PdfCrypt) GeneratePubKeyParams(recipients []PubKeyRecipient) error {
+	if len(recipients) == 0 {
+		return errors.New("No recipients")
+	}
+
+	seed := make([]byte, 20)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return err
+	}
+
+	crypt.Recipients = nil
+	for _, recipient := range recipients {
+		content := make([]byte, 24)
+		copy(content, seed)
+		binary.BigEndian.PutUint32(content[20:], uint32(recipient.Permissions.GetP()))
+
+		enveloped, err := pkcs7.Encrypt(content, []*x509.Certificate{recipient.Certificate})
+		if err != nil {
+			common.Log.Debug("ERROR: Failed to envelope seed for recipient (%v)", err)
+			return err
+		}
+		crypt.Recipients = append(crypt.Recipients, enveloped)
+	}
+
+	crypt.EncryptionKey = crypt.pubKeyEncryptionKey(seed)
+	return nil
+}
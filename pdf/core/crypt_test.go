@@ -210,3 +210,248 @@ func TestDecryption1(t *testing.T) {
 		return
 	}
 }
+
+// makeAESV3EncryptDict returns a standard security handler encryption dictionary using AES-256.
+func makeAESV3EncryptDict(R int, O, U, OE, UE, Perms []byte) *PdfObjectDictionary {
+	stdCF := MakeDict()
+	stdCF.Set("Type", MakeName("CryptFilter"))
+	stdCF.Set("CFM", MakeName("AESV3"))
+	stdCF.Set("AuthEvent", MakeName("DocOpen"))
+	stdCF.Set("Length", MakeInteger(32))
+	cf := MakeDict()
+	cf.Set("StdCF", stdCF)
+
+	ed := MakeDict()
+	ed.Set("Filter", MakeName("Standard"))
+	ed.Set("V", MakeInteger(5))
+	ed.Set("R", MakeInteger(int64(R)))
+	ed.Set("CF", cf)
+	ed.Set("StmF", MakeName("StdCF"))
+	ed.Set("StrF", MakeName("StdCF"))
+	ed.Set("O", MakeString(string(O)))
+	ed.Set("U", MakeString(string(U)))
+	ed.Set("OE", MakeString(string(OE)))
+	ed.Set("UE", MakeString(string(UE)))
+	ed.Set("Perms", MakeString(string(Perms)))
+	ed.Set("P", MakeInteger(-3904))
+	return ed
+}
+
+// Test AES-256 decryption with a revision 6 security handler (PDF 2.0).
+// User password "user", owner password "owner".
+func TestDecryptionAESV3R6(t *testing.T) {
+	O := []byte{
+		0x7e, 0x13, 0x14, 0xd5, 0x0a, 0x58, 0xa5, 0x55, 0xc4, 0xf7, 0xb9, 0xcf,
+		0x87, 0x5a, 0x19, 0x81, 0xc8, 0x7f, 0xca, 0x8f, 0xcd, 0xe1, 0x58, 0x7f,
+		0x76, 0xa2, 0x8f, 0xcf, 0xdf, 0x5e, 0x00, 0xd3, 0x21, 0x22, 0x23, 0x24,
+		0x25, 0x26, 0x27, 0x28, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38}
+	U := []byte{
+		0x17, 0x42, 0x4b, 0x40, 0xea, 0xd3, 0x66, 0xf7, 0xdd, 0xef, 0x0f, 0xf0,
+		0x73, 0x60, 0x8a, 0xa6, 0x8b, 0xa7, 0x01, 0x71, 0x4b, 0x5c, 0xef, 0x34,
+		0x09, 0xb9, 0x4c, 0x4f, 0xfa, 0x76, 0x37, 0x26, 0x01, 0x02, 0x03, 0x04,
+		0x05, 0x06, 0x07, 0x08, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+	OE := []byte{
+		0xa4, 0x79, 0x47, 0x46, 0x76, 0x8a, 0xdf, 0x32, 0x10, 0x3e, 0x50, 0xec,
+		0x41, 0xf7, 0x6d, 0x88, 0xac, 0x4c, 0x60, 0x1f, 0x98, 0x2a, 0xb5, 0xbe,
+		0x5c, 0x39, 0x1b, 0x9e, 0xc5, 0x18, 0x59, 0x30}
+	UE := []byte{
+		0x38, 0x58, 0x9d, 0xbe, 0x12, 0xc4, 0x7c, 0xdb, 0x68, 0xef, 0x9a, 0xe7,
+		0xf6, 0xd0, 0xc3, 0x80, 0x59, 0xf2, 0x65, 0xdf, 0x05, 0xfc, 0x4c, 0x50,
+		0x23, 0x08, 0xa9, 0x64, 0x4d, 0x81, 0x33, 0xcf}
+	Perms := []byte{
+		0x5d, 0x1c, 0xa9, 0xb8, 0xab, 0x88, 0x80, 0x6f, 0x8b, 0x79, 0xb2, 0xf2,
+		0x50, 0x4f, 0x73, 0x57}
+	ekey := []byte{
+		0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x29, 0x2a, 0x2b,
+		0x2c, 0x2d, 0x2e, 0x2f, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37,
+		0x38, 0x39, 0x3a, 0x3b, 0x3c, 0x3d, 0x3e, 0x3f}
+
+	// Initialization vector followed by the encrypted stream.
+	streamData := []byte{
+		0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xab,
+		0xac, 0xad, 0xae, 0xaf, 0x28, 0x2a, 0x9b, 0x6a, 0x5e, 0x3e, 0x9e, 0x5e,
+		0x52, 0xef, 0xb5, 0x63, 0xfb, 0x16, 0x86, 0xd2, 0x9d, 0x8f, 0xc8, 0x5a,
+		0x13, 0x18, 0xf0, 0xdb, 0x26, 0x97, 0xeb, 0xb7, 0x17, 0x77, 0x25, 0xd5,
+		0xb9, 0x02, 0xc7, 0x6d, 0xac, 0x89, 0x7c, 0xb4, 0x97, 0xed, 0xce, 0x92,
+		0x2a, 0x73, 0xca, 0x8a}
+	exp := "BT /F1 18 Tf 0 0 Td (Hello World) Tj ET"
+
+	ed := makeAESV3EncryptDict(6, O, U, OE, UE, Perms)
+
+	parser := PdfParser{}
+	parser.xrefs = make(XrefTable)
+	parser.objstms = make(ObjectStreams)
+	rawText := "2 0 obj\n<< /Length 64 >>\nstream\n" + string(streamData) + "\nendstream\n"
+	parser.rs, parser.reader, parser.fileSize = makeReaderForText(rawText)
+
+	crypter, err := PdfCryptMakeNew(&parser, ed, MakeDict())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if crypter.V != 5 || crypter.R != 6 || crypter.Length != 256 {
+		t.Fatalf("Incorrect crypter V=%d R=%d Length=%d", crypter.V, crypter.R, crypter.Length)
+	}
+	if cf := crypter.CryptFilters["StdCF"]; cf.Cfm != "AESV3" || cf.Length != 32 {
+		t.Fatalf("Incorrect crypt filter %+v", cf)
+	}
+	parser.crypter = &crypter
+
+	// Wrong and empty passwords.
+	for _, pass := range []string{"", "wrong", "use"} {
+		auth, err := crypter.authenticate([]byte(pass))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if auth {
+			t.Fatalf("Authenticated with invalid password %q", pass)
+		}
+	}
+
+	// Owner password.
+	crypter.EncryptionKey = nil
+	isOwner, err := crypter.checkOwnerPassword([]byte("owner"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !isOwner || string(crypter.EncryptionKey) != string(ekey) {
+		t.Fatalf("Owner authentication failed (%v, % x)", isOwner, crypter.EncryptionKey)
+	}
+
+	// User password.
+	crypter.EncryptionKey = nil
+	isUser, err := crypter.checkUserPassword([]byte("user"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !isUser || string(crypter.EncryptionKey) != string(ekey) {
+		t.Fatalf("User authentication failed (%v, % x)", isUser, crypter.EncryptionKey)
+	}
+	if isOwner, _ := crypter.checkOwnerPassword([]byte("user")); isOwner {
+		t.Fatalf("User password accepted as owner password")
+	}
+
+	// Permissions validation.
+	if err := crypter.alg13(ekey); err != nil {
+		t.Fatalf("Perms validation failed: %v", err)
+	}
+	crypter.P = -3908
+	if err := crypter.alg13(ekey); err == nil {
+		t.Fatalf("Perms validation should fail for modified P")
+	}
+	crypter.P = -3904
+
+	obj, err := parser.ParseIndirectObject()
+	if err != nil {
+		t.Fatalf("Error parsing object: %v", err)
+	}
+	so, ok := obj.(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Should be stream (is %q)", obj)
+	}
+
+	authenticated, err := parser.Decrypt([]byte("user"))
+	if err != nil {
+		t.Fatalf("Error authenticating: %v", err)
+	}
+	if !authenticated {
+		t.Fatalf("Failed to authenticate")
+	}
+
+	if err := parser.crypter.Decrypt(so, 0, 0); err != nil {
+		t.Fatalf("Error decrypting: %v", err)
+	}
+	if string(so.Stream) != exp {
+		t.Fatalf("Stream content wrong (%q)", so.Stream)
+	}
+}
+
+// Test the revision 5 security handler (deprecated Adobe extension level 3).
+func TestAuthenticationAESV3R5(t *testing.T) {
+	O := []byte{
+		0x27, 0x71, 0x87, 0x7b, 0xdc, 0x4e, 0x53, 0x4c, 0xc3, 0x0f, 0x65, 0x38,
+		0xa3, 0xfa, 0xdf, 0x32, 0x34, 0x30, 0xc9, 0x74, 0xe3, 0x79, 0x86, 0x0d,
+		0xa5, 0x2d, 0x2b, 0xad, 0x94, 0x01, 0xa2, 0x70, 0x21, 0x22, 0x23, 0x24,
+		0x25, 0x26, 0x27, 0x28, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37, 0x38}
+	U := []byte{
+		0xad, 0x7c, 0x98, 0xe2, 0x51, 0xcb, 0x1c, 0x7b, 0x3e, 0x28, 0x30, 0xb6,
+		0xf0, 0xbe, 0xcb, 0xd8, 0x35, 0x2a, 0x6a, 0xb7, 0x12, 0x23, 0x2d, 0x6e,
+		0x82, 0xf2, 0xfc, 0xa4, 0x5f, 0x30, 0x4d, 0xcc, 0x01, 0x02, 0x03, 0x04,
+		0x05, 0x06, 0x07, 0x08, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+	OE := []byte{
+		0x35, 0xb5, 0x90, 0x91, 0xb4, 0x3b, 0x53, 0x86, 0x79, 0xf4, 0x4d, 0xdb,
+		0xd2, 0xe2, 0x8e, 0xf9, 0x4b, 0x80, 0xba, 0xcd, 0xaa, 0x3d, 0x81, 0xcf,
+		0xdb, 0x8a, 0x36, 0x1c, 0xbe, 0xa5, 0x2b, 0x72}
+	UE := []byte{
+		0x65, 0xe0, 0xc3, 0xb8, 0xdd, 0xa5, 0x6d, 0xe9, 0x38, 0xb8, 0xa2, 0x0c,
+		0x7d, 0x36, 0x82, 0xa5, 0x6d, 0xbe, 0xa4, 0x7c, 0x10, 0x1e, 0x1f, 0xe7,
+		0x3e, 0xd5, 0x89, 0x85, 0x2d, 0x2a, 0xef, 0xc6}
+	Perms := []byte{
+		0x1a, 0x34, 0x84, 0xa0, 0x4b, 0x8e, 0x0b, 0x47, 0x05, 0x60, 0xa3, 0x72,
+		0x48, 0xb4, 0x4e, 0x2b}
+	ekey := []byte{
+		0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49, 0x4a, 0x4b,
+		0x4c, 0x4d, 0x4e, 0x4f, 0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57,
+		0x58, 0x59, 0x5a, 0x5b, 0x5c, 0x5d, 0x5e, 0x5f}
+
+	crypter, err := PdfCryptMakeNew(&PdfParser{}, makeAESV3EncryptDict(5, O, U, OE, UE, Perms), MakeDict())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for _, pass := range []string{"user", "owner"} {
+		crypter.EncryptionKey = nil
+		auth, err := crypter.authenticate([]byte(pass))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !auth || string(crypter.EncryptionKey) != string(ekey) {
+			t.Fatalf("Authentication failed for %q (%v, % x)", pass, auth, crypter.EncryptionKey)
+		}
+	}
+	if err := crypter.alg13(ekey); err != nil {
+		t.Fatalf("Perms validation failed: %v", err)
+	}
+
+	auth, err := crypter.authenticate([]byte(""))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if auth {
+		t.Fatalf("Authenticated with empty password")
+	}
+}
+
+// Test generating the R6 encryption parameters and authenticating with them.
+func TestGenerateParamsAESV3(t *testing.T) {
+	crypter := PdfCrypt{V: 5, R: 6, Length: 256, P: -3904, EncryptMetadata: false}
+	if err := crypter.GenerateParams([]byte("user"), []byte("owner")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(crypter.O) != 48 || len(crypter.U) != 48 || len(crypter.OE) != 32 || len(crypter.UE) != 32 ||
+		len(crypter.Perms) != 16 {
+		t.Fatalf("Incorrect lengths O=%d U=%d OE=%d UE=%d Perms=%d", len(crypter.O), len(crypter.U),
+			len(crypter.OE), len(crypter.UE), len(crypter.Perms))
+	}
+	ekey := crypter.EncryptionKey
+	if err := crypter.alg13(ekey); err != nil {
+		t.Fatalf("Perms validation failed: %v", err)
+	}
+
+	crypter.EncryptionKey = nil
+	if isOwner, err := crypter.checkOwnerPassword([]byte("owner")); err != nil || !isOwner {
+		t.Fatalf("Owner authentication failed (%v)", err)
+	}
+	if string(crypter.EncryptionKey) != string(ekey) {
+		t.Fatalf("Incorrect key from OE")
+	}
+	crypter.EncryptionKey = nil
+	if isUser, err := crypter.checkUserPassword([]byte("user")); err != nil || !isUser {
+		t.Fatalf("User authentication failed (%v)", err)
+	}
+	if string(crypter.EncryptionKey) != string(ekey) {
+		t.Fatalf("Incorrect key from UE")
+	}
+	if isOwner, _ := crypter.checkOwnerPassword([]byte("user")); isOwner {
+		t.Fatalf("User password accepted as owner password")
+	}
+}
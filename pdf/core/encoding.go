@@ -13,13 +13,14 @@ package core
 // - RunLength
 // - ASCII Hex
 // - ASCII85
-// - CCITT Fax (dummy)
-// - JBIG2 (dummy)
-// - JPX (dummy)
+// - CCITT Fax (Group 3 and Group 4 decoding, Group 4 encoding)
+// - JBIG2 (decoding)
+// - JPX (decoding)
 
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -34,6 +35,9 @@ import (
 	lzw1 "golang.org/x/image/tiff/lzw"
 
 	"github.com/unidoc/unidoc/common"
+	"github.com/unidoc/unidoc/pdf/internal/ccittfax"
+	"github.com/unidoc/unidoc/pdf/internal/jbig2"
+	"github.com/unidoc/unidoc/pdf/internal/jpx"
 )
 
 const (
@@ -70,6 +74,16 @@ type FlateEncoder struct {
 	// For predictors
 	Columns int
 	Colors  int
+
+	// Compression level for encoding, from zlib.BestSpeed (1) to zlib.BestCompression (9), or
+	// zlib.DefaultCompression (-1), the default.  zlib.NoCompression (0) stores the data.
+	CompressionLevel int
+
+	// Checked for cancellation while decoding, if set.
+	ctx context.Context
+	// Maximum decoded size in bytes and the name of the corresponding limit, if set.
+	maxSize int64
+	limit   string
 }
 
 // Make a new flate encoder with default parameters, predictor 1 and bits per component 8.
@@ -85,6 +99,8 @@ func NewFlateEncoder() *FlateEncoder {
 	encoder.Colors = 1
 	encoder.Columns = 1
 
+	encoder.CompressionLevel = zlib.DefaultCompression
+
 	return encoder
 }
 
@@ -154,7 +170,7 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 			if arr, isArr := obj.(*PdfObjectArray); isArr {
 				if len(*arr) != 1 {
 					common.Log.Debug("Error: DecodeParms array length != 1 (%d)", len(*arr))
-					return nil, errors.New("Range check error")
+					return nil, newKeyError("DecodeParms", "Range check error")
 				}
 				obj = TraceToDirectObject((*arr)[0])
 			}
@@ -162,7 +178,7 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 			dp, isDict := obj.(*PdfObjectDictionary)
 			if !isDict {
 				common.Log.Debug("Error: DecodeParms not a dictionary (%T)", obj)
-				return nil, fmt.Errorf("Invalid DecodeParms")
+				return nil, newKeyError("DecodeParms", "Invalid DecodeParms")
 			}
 			decodeParams = dp
 		}
@@ -180,7 +196,7 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 		predictor, ok := obj.(*PdfObjectInteger)
 		if !ok {
 			common.Log.Debug("Error: Predictor specified but not numeric (%T)", obj)
-			return nil, fmt.Errorf("Invalid Predictor")
+			return nil, newKeyError("Predictor", "Invalid Predictor")
 		}
 		encoder.Predictor = int(*predictor)
 	}
@@ -191,7 +207,7 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 		bpc, ok := obj.(*PdfObjectInteger)
 		if !ok {
 			common.Log.Debug("ERROR: Invalid BitsPerComponent")
-			return nil, fmt.Errorf("Invalid BitsPerComponent")
+			return nil, newKeyError("BitsPerComponent", "Invalid BitsPerComponent")
 		}
 		encoder.BitsPerComponent = int(*bpc)
 	}
@@ -203,7 +219,7 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 		if obj != nil {
 			columns, ok := obj.(*PdfObjectInteger)
 			if !ok {
-				return nil, fmt.Errorf("Predictor column invalid")
+				return nil, newKeyError("Columns", "Predictor column invalid")
 			}
 
 			encoder.Columns = int(*columns)
@@ -216,7 +232,7 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 		if obj != nil {
 			colors, ok := obj.(*PdfObjectInteger)
 			if !ok {
-				return nil, fmt.Errorf("Predictor colors not an integer")
+				return nil, newKeyError("Colors", "Predictor colors not an integer")
 			}
 			encoder.Colors = int(*colors)
 		}
@@ -237,8 +253,15 @@ func (this *FlateEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 	}
 	defer r.Close()
 
+	lr := &limitReader{r: withContext(this.ctx, r), max: this.maxSize, limit: this.limit}
 	var outBuf bytes.Buffer
-	outBuf.ReadFrom(r)
+	outBuf.ReadFrom(lr)
+	if err := contextErr(this.ctx); err != nil {
+		return nil, err
+	}
+	if lr.err != nil {
+		return nil, lr.err
+	}
 
 	common.Log.Trace("En: % x\n", encoded)
 	common.Log.Trace("De: % x\n", outBuf.Bytes())
@@ -253,7 +276,9 @@ func (this *FlateEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, erro
 	common.Log.Trace("FlateDecode stream")
 	common.Log.Trace("Predictor: %d", this.Predictor)
 	if this.BitsPerComponent != 8 {
-		return nil, fmt.Errorf("Invalid BitsPerComponent=%d (only 8 supported)", this.BitsPerComponent)
+		err := newUnsupportedError(this.GetFilterName(), "Invalid BitsPerComponent=%d (only 8 supported)", this.BitsPerComponent)
+		err.Key = "BitsPerComponent"
+		return nil, err
 	}
 
 	outData, err := this.DecodeBytes(streamObj.Stream)
@@ -276,14 +301,14 @@ func (this *FlateEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, erro
 			rows := len(outData) / rowLength
 			if len(outData)%rowLength != 0 {
 				common.Log.Debug("ERROR: TIFF encoding: Invalid row length...")
-				return nil, fmt.Errorf("Invalid row length (%d/%d)", len(outData), rowLength)
+				return nil, newSyntaxError("Invalid row length (%d/%d)", len(outData), rowLength)
 			}
 			if rowLength%this.Colors != 0 {
-				return nil, fmt.Errorf("Invalid row length (%d) for colors %d", rowLength, this.Colors)
+				return nil, newSyntaxError("Invalid row length (%d) for colors %d", rowLength, this.Colors)
 			}
 			if rowLength > len(outData) {
 				common.Log.Debug("Row length cannot be longer than data length (%d/%d)", rowLength, len(outData))
-				return nil, errors.New("Range check error")
+				return nil, newSyntaxError("Range check error")
 			}
 			common.Log.Trace("inp outData (%d): % x", len(outData), outData)
 
@@ -309,11 +334,11 @@ func (this *FlateEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, erro
 			rowLength := int(this.Columns*this.Colors + 1) // 1 byte to specify predictor algorithms per row.
 			rows := len(outData) / rowLength
 			if len(outData)%rowLength != 0 {
-				return nil, fmt.Errorf("Invalid row length (%d/%d)", len(outData), rowLength)
+				return nil, newSyntaxError("Invalid row length (%d/%d)", len(outData), rowLength)
 			}
 			if rowLength > len(outData) {
 				common.Log.Debug("Row length cannot be longer than data length (%d/%d)", rowLength, len(outData))
-				return nil, errors.New("Range check error")
+				return nil, newSyntaxError("Range check error")
 			}
 
 			pOutBuffer := bytes.NewBuffer(nil)
@@ -379,7 +404,7 @@ func (this *FlateEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, erro
 
 				default:
 					common.Log.Debug("ERROR: Invalid filter byte (%d) @row %d", fb, i)
-					return nil, fmt.Errorf("Invalid filter byte (%d)", fb)
+					return nil, newSyntaxError("Invalid filter byte (%d)", fb)
 				}
 
 				for i := 0; i < rowLength; i++ {
@@ -391,7 +416,9 @@ func (this *FlateEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, erro
 			return pOutData, nil
 		} else {
 			common.Log.Debug("ERROR: Unsupported predictor (%d)", this.Predictor)
-			return nil, fmt.Errorf("Unsupported predictor (%d)", this.Predictor)
+			err := newUnsupportedError(this.GetFilterName(), "Unsupported predictor (%d)", this.Predictor)
+			err.Key = "Predictor"
+			return nil, err
 		}
 	}
 
@@ -438,7 +465,10 @@ func (this *FlateEncoder) EncodeBytes(data []byte) ([]byte, error) {
 	}
 
 	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
+	w, err := zlib.NewWriterLevel(&b, this.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
 	w.Write(data)
 	w.Close()
 
@@ -454,6 +484,12 @@ type LZWEncoder struct {
 	Colors  int
 	// LZW algorithm setting.
 	EarlyChange int
+
+	// Checked for cancellation while decoding, if set.
+	ctx context.Context
+	// Maximum decoded size in bytes and the name of the corresponding limit, if set.
+	maxSize int64
+	limit   string
 }
 
 // Make a new LZW encoder with default parameters.
@@ -541,7 +577,7 @@ func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObject
 			}
 			if decodeParams == nil {
 				common.Log.Error("DecodeParms not a dictionary %#v", obj)
-				return nil, fmt.Errorf("Invalid DecodeParms")
+				return nil, newKeyError("DecodeParms", "Invalid DecodeParms")
 			}
 		}
 	}
@@ -555,10 +591,10 @@ func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObject
 		earlyChange, ok := obj.(*PdfObjectInteger)
 		if !ok {
 			common.Log.Debug("Error: EarlyChange specified but not numeric (%T)", obj)
-			return nil, fmt.Errorf("Invalid EarlyChange")
+			return nil, newKeyError("EarlyChange", "Invalid EarlyChange")
 		}
 		if *earlyChange != 0 && *earlyChange != 1 {
-			return nil, fmt.Errorf("Invalid EarlyChange value (not 0 or 1)")
+			return nil, newKeyError("EarlyChange", "Invalid EarlyChange value (not 0 or 1)")
 		}
 
 		encoder.EarlyChange = int(*earlyChange)
@@ -577,7 +613,7 @@ func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObject
 		predictor, ok := obj.(*PdfObjectInteger)
 		if !ok {
 			common.Log.Debug("Error: Predictor specified but not numeric (%T)", obj)
-			return nil, fmt.Errorf("Invalid Predictor")
+			return nil, newKeyError("Predictor", "Invalid Predictor")
 		}
 		encoder.Predictor = int(*predictor)
 	}
@@ -588,7 +624,7 @@ func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObject
 		bpc, ok := obj.(*PdfObjectInteger)
 		if !ok {
 			common.Log.Debug("ERROR: Invalid BitsPerComponent")
-			return nil, fmt.Errorf("Invalid BitsPerComponent")
+			return nil, newKeyError("BitsPerComponent", "Invalid BitsPerComponent")
 		}
 		encoder.BitsPerComponent = int(*bpc)
 	}
@@ -600,7 +636,7 @@ func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObject
 		if obj != nil {
 			columns, ok := obj.(*PdfObjectInteger)
 			if !ok {
-				return nil, fmt.Errorf("Predictor column invalid")
+				return nil, newKeyError("Columns", "Predictor column invalid")
 			}
 
 			encoder.Columns = int(*columns)
@@ -613,7 +649,7 @@ func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObject
 		if obj != nil {
 			colors, ok := obj.(*PdfObjectInteger)
 			if !ok {
-				return nil, fmt.Errorf("Predictor colors not an integer")
+				return nil, newKeyError("Colors", "Predictor colors not an integer")
 			}
 			encoder.Colors = int(*colors)
 		}
@@ -637,7 +673,7 @@ func (this *LZWEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 	}
 	defer r.Close()
 
-	_, err := outBuf.ReadFrom(r)
+	_, err := outBuf.ReadFrom(&limitReader{r: withContext(this.ctx, r), max: this.maxSize, limit: this.limit})
 	if err != nil {
 		return nil, err
 	}
@@ -675,16 +711,16 @@ func (this *LZWEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error)
 			rows := len(outData) / rowLength
 			if len(outData)%rowLength != 0 {
 				common.Log.Debug("ERROR: TIFF encoding: Invalid row length...")
-				return nil, fmt.Errorf("Invalid row length (%d/%d)", len(outData), rowLength)
+				return nil, newSyntaxError("Invalid row length (%d/%d)", len(outData), rowLength)
 			}
 
 			if rowLength%this.Colors != 0 {
-				return nil, fmt.Errorf("Invalid row length (%d) for colors %d", rowLength, this.Colors)
+				return nil, newSyntaxError("Invalid row length (%d) for colors %d", rowLength, this.Colors)
 			}
 
 			if rowLength > len(outData) {
 				common.Log.Debug("Row length cannot be longer than data length (%d/%d)", rowLength, len(outData))
-				return nil, errors.New("Range check error")
+				return nil, newSyntaxError("Range check error")
 			}
 			common.Log.Trace("inp outData (%d): % x", len(outData), outData)
 
@@ -716,11 +752,11 @@ func (this *LZWEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error)
 			}
 			rows := len(outData) / rowLength
 			if len(outData)%rowLength != 0 {
-				return nil, fmt.Errorf("Invalid row length (%d/%d)", len(outData), rowLength)
+				return nil, newSyntaxError("Invalid row length (%d/%d)", len(outData), rowLength)
 			}
 			if rowLength > len(outData) {
 				common.Log.Debug("Row length cannot be longer than data length (%d/%d)", rowLength, len(outData))
-				return nil, errors.New("Range check error")
+				return nil, newSyntaxError("Range check error")
 			}
 
 			pOutBuffer := bytes.NewBuffer(nil)
@@ -751,7 +787,7 @@ func (this *LZWEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error)
 					}
 				default:
 					common.Log.Debug("ERROR: Invalid filter byte (%d)", fb)
-					return nil, fmt.Errorf("Invalid filter byte (%d)", fb)
+					return nil, newSyntaxError("Invalid filter byte (%d)", fb)
 				}
 
 				for i := 0; i < rowLength; i++ {
@@ -763,7 +799,9 @@ func (this *LZWEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error)
 			return pOutData, nil
 		} else {
 			common.Log.Debug("ERROR: Unsupported predictor (%d)", this.Predictor)
-			return nil, fmt.Errorf("Unsupported predictor (%d)", this.Predictor)
+			err := newUnsupportedError(this.GetFilterName(), "Unsupported predictor (%d)", this.Predictor)
+			err.Key = "Predictor"
+			return nil, err
 		}
 	}
 
@@ -1287,7 +1325,7 @@ func (this *ASCIIHexEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 			inb = append(inb, b)
 		} else {
 			common.Log.Debug("ERROR: Invalid ascii hex character (%c)", b)
-			return nil, fmt.Errorf("Invalid ascii hex character (%c)", b)
+			return nil, newSyntaxError("Invalid ascii hex character (%c)", b)
 		}
 	}
 	if len(inb)%2 == 1 {
@@ -1388,7 +1426,7 @@ func (this *ASCII85Encoder) DecodeBytes(encoded []byte) ([]byte, error) {
 				break
 			} else {
 				common.Log.Error("Failed decoding, invalid code")
-				return nil, errors.New("Invalid code encountered")
+				return nil, newSyntaxError("Invalid code encountered")
 			}
 
 			codes[j-spaces] = code
@@ -1525,12 +1563,143 @@ func (this *RawEncoder) EncodeBytes(data []byte) ([]byte, error) {
 }
 
 //
-// CCITTFax encoder/decoder (dummy, for now)
+// CCITTFax encoder/decoder.
 //
-type CCITTFaxEncoder struct{}
+type CCITTFaxEncoder struct {
+	// K < 0: pure two-dimensional (Group 4), K = 0: pure one-dimensional (Group 3 1-D),
+	// K > 0: mixed one- and two-dimensional (Group 3 2-D).
+	K int
+	// Width of the image in pixels (default 1728).
+	Columns int
+	// Height of the image in rows.  0 if not known in advance.
+	Rows int
+
+	EndOfLine              bool
+	EncodedByteAlign       bool
+	EndOfBlock             bool
+	BlackIs1               bool
+	DamagedRowsBeforeError int
 
+	// Checked for cancellation while decoding, if set.
+	ctx context.Context
+	// Maximum decoded size in bytes and the name of the corresponding limit, if set.
+	maxSize int64
+	limit   string
+}
+
+// Make a new CCITTFax encoder with default parameters (K = 0, 1728 columns).
+// For encoding, set K to -1 (Group 4) and Columns/Rows to the image dimensions.
 func NewCCITTFaxEncoder() *CCITTFaxEncoder {
-	return &CCITTFaxEncoder{}
+	encoder := &CCITTFaxEncoder{}
+
+	encoder.Columns = 1728
+	encoder.EndOfBlock = true
+
+	return encoder
+}
+
+// Create a new CCITTFax encoder/decoder from a stream object, getting all the encoding parameters
+// from the DecodeParms stream object dictionary entry.
+func newCCITTFaxEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObjectDictionary) (*CCITTFaxEncoder, error) {
+	encoder := NewCCITTFaxEncoder()
+
+	encDict := streamObj.PdfObjectDictionary
+	if encDict == nil {
+		// No encoding dictionary.
+		return encoder, nil
+	}
+
+	// If decodeParams not provided, see if we can get from the stream.
+	if decodeParams == nil {
+		obj := TraceToDirectObject(encDict.Get("DecodeParms"))
+		if obj != nil {
+			if arr, isArr := obj.(*PdfObjectArray); isArr {
+				if len(*arr) != 1 {
+					common.Log.Debug("Error: DecodeParms array length != 1 (%d)", len(*arr))
+					return nil, newKeyError("DecodeParms", "Range check error")
+				}
+				obj = TraceToDirectObject((*arr)[0])
+			}
+
+			dp, isDict := obj.(*PdfObjectDictionary)
+			if !isDict {
+				common.Log.Debug("Error: DecodeParms not a dictionary (%T)", obj)
+				return nil, newKeyError("DecodeParms", "Invalid DecodeParms")
+			}
+			decodeParams = dp
+		}
+	}
+	if decodeParams == nil {
+		// No decode parameters, use the defaults.
+		return encoder, nil
+	}
+
+	common.Log.Trace("decode params: %s", decodeParams.String())
+	err := encoder.SetDecodeParams(decodeParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return encoder, nil
+}
+
+// SetDecodeParams loads the encoding parameters from the DecodeParms dictionary `decodeParams`.
+// Parameters that are not present keep their current values.
+func (this *CCITTFaxEncoder) SetDecodeParams(decodeParams *PdfObjectDictionary) error {
+	intParams := []struct {
+		name  PdfObjectName
+		value *int
+	}{
+		{"K", &this.K},
+		{"Columns", &this.Columns},
+		{"Rows", &this.Rows},
+		{"DamagedRowsBeforeError", &this.DamagedRowsBeforeError},
+	}
+	for _, param := range intParams {
+		obj := TraceToDirectObject(decodeParams.Get(param.name))
+		if obj == nil {
+			continue
+		}
+		val, ok := obj.(*PdfObjectInteger)
+		if !ok {
+			common.Log.Debug("Error: %s specified but not numeric (%T)", param.name, obj)
+			return newKeyError(string(param.name), "Invalid %s", param.name)
+		}
+		*param.value = int(*val)
+	}
+
+	boolParams := []struct {
+		name  PdfObjectName
+		value *bool
+	}{
+		{"EndOfLine", &this.EndOfLine},
+		{"EncodedByteAlign", &this.EncodedByteAlign},
+		{"EndOfBlock", &this.EndOfBlock},
+		{"BlackIs1", &this.BlackIs1},
+	}
+	for _, param := range boolParams {
+		obj := TraceToDirectObject(decodeParams.Get(param.name))
+		if obj == nil {
+			continue
+		}
+		val, ok := obj.(*PdfObjectBool)
+		if !ok {
+			common.Log.Debug("Error: %s specified but not boolean (%T)", param.name, obj)
+			return newKeyError(string(param.name), "Invalid %s", param.name)
+		}
+		*param.value = bool(*val)
+	}
+
+	if this.Columns <= 0 || this.Columns > 8*ccittfax.MaxImageSize {
+		common.Log.Debug("Error: Invalid Columns (%d)", this.Columns)
+		return newKeyError("Columns", "Invalid Columns")
+	}
+	if this.Rows < 0 || this.Rows > ccittfax.MaxImageSize/((this.Columns+7)/8) {
+		common.Log.Debug("Error: Invalid Rows (%d)", this.Rows)
+		return newKeyError("Rows", "Invalid Rows")
+	}
+
+	return nil
 }
 
 func (this *CCITTFaxEncoder) GetFilterName() string {
@@ -1538,38 +1707,157 @@ func (this *CCITTFaxEncoder) GetFilterName() string {
 }
 
 func (this *CCITTFaxEncoder) MakeDecodeParams() PdfObject {
-	return nil
+	decodeParams := MakeDict()
+
+	// Only add if not default option.
+	if this.K != 0 {
+		decodeParams.Set("K", MakeInteger(int64(this.K)))
+	}
+	decodeParams.Set("Columns", MakeInteger(int64(this.Columns)))
+	if this.Rows > 0 {
+		decodeParams.Set("Rows", MakeInteger(int64(this.Rows)))
+	}
+	if this.EndOfLine {
+		decodeParams.Set("EndOfLine", MakeBool(true))
+	}
+	if this.EncodedByteAlign {
+		decodeParams.Set("EncodedByteAlign", MakeBool(true))
+	}
+	if !this.EndOfBlock {
+		decodeParams.Set("EndOfBlock", MakeBool(false))
+	}
+	decodeParams.Set("BlackIs1", MakeBool(this.BlackIs1))
+	if this.DamagedRowsBeforeError != 0 {
+		decodeParams.Set("DamagedRowsBeforeError", MakeInteger(int64(this.DamagedRowsBeforeError)))
+	}
+
+	return decodeParams
 }
 
 // Make a new instance of an encoding dictionary for a stream object.
+// Has the Filter set and the DecodeParms.
 func (this *CCITTFaxEncoder) MakeStreamDict() *PdfObjectDictionary {
-	return MakeDict()
+	dict := MakeDict()
+	dict.Set("Filter", MakeName(this.GetFilterName()))
+	dict.Set("DecodeParms", this.MakeDecodeParams())
+	return dict
+}
+
+// params returns the encoding parameters in the form used by the ccittfax package.
+func (this *CCITTFaxEncoder) params() ccittfax.Params {
+	return ccittfax.Params{
+		K:                      this.K,
+		Columns:                this.Columns,
+		Rows:                   this.Rows,
+		EndOfLine:              this.EndOfLine,
+		EncodedByteAlign:       this.EncodedByteAlign,
+		EndOfBlock:             this.EndOfBlock,
+		BlackIs1:               this.BlackIs1,
+		DamagedRowsBeforeError: this.DamagedRowsBeforeError,
+	}
 }
 
 func (this *CCITTFaxEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
-	common.Log.Debug("Error: Attempting to use unsupported encoding %s", this.GetFilterName())
-	return encoded, ErrNoCCITTFaxDecode
+	common.Log.Trace("CCITTFax Decode: K %d, Columns %d, Rows %d", this.K, this.Columns, this.Rows)
+	opts := &ccittfax.Options{MaxSize: decodeMaxSize(this.maxSize), Context: this.ctx}
+	decoded, err := ccittfax.Decode(encoded, this.params(), opts)
+	if err == ccittfax.ErrTooLarge {
+		err = &LimitError{Limit: this.limit, Max: this.maxSize}
+	}
+	if err != nil {
+		common.Log.Debug("Error decoding CCITTFax data: %v", err)
+		return nil, err
+	}
+	return decoded, nil
 }
 
 func (this *CCITTFaxEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
-	common.Log.Debug("Error: Attempting to use unsupported encoding %s", this.GetFilterName())
-	return streamObj.Stream, ErrNoCCITTFaxDecode
+	return this.DecodeBytes(streamObj.Stream)
 }
 
+// Encode a 1 bit per pixel image `data` with rows padded to whole bytes.
+// Only Group 4 encoding (K < 0) is supported, with Columns (and optionally Rows) set to the image
+// dimensions.
 func (this *CCITTFaxEncoder) EncodeBytes(data []byte) ([]byte, error) {
-	common.Log.Debug("Error: Attempting to use unsupported encoding %s", this.GetFilterName())
-	return data, ErrNoCCITTFaxDecode
+	if this.K >= 0 {
+		common.Log.Debug("Encoding error: CCITTFaxEncoder K < 0 only supported")
+		return nil, ErrUnsupportedEncodingParameters
+	}
+
+	encoded, err := ccittfax.Encode(data, this.params())
+	if err != nil {
+		common.Log.Debug("Error encoding CCITTFax data: %v", err)
+		return nil, err
+	}
+	return encoded, nil
 }
 
 //
-// JBIG2 encoder/decoder (dummy, for now)
+// JBIG2 encoder/decoder (decoding only)
 //
-type JBIG2Encoder struct{}
+type JBIG2Encoder struct {
+	// Globals is the decoded data of the JBIG2Globals stream with segments shared by several images.
+	Globals []byte
+
+	// Checked for cancellation while decoding, if set.
+	ctx context.Context
+	// Maximum decoded size in bytes and the name of the corresponding limit, if set.
+	maxSize int64
+	limit   string
+}
 
 func NewJBIG2Encoder() *JBIG2Encoder {
 	return &JBIG2Encoder{}
 }
 
+// Create a new JBIG2 decoder from a stream object, getting the JBIG2Globals stream from the
+// DecodeParms dictionary if present.
+func newJBIG2EncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObjectDictionary) (*JBIG2Encoder, error) {
+	encoder := NewJBIG2Encoder()
+
+	encDict := streamObj.PdfObjectDictionary
+	if encDict == nil {
+		// No encoding dictionary.
+		return encoder, nil
+	}
+
+	// If decodeParams not provided, see if we can get from the stream.
+	if decodeParams == nil {
+		obj := TraceToDirectObject(encDict.Get("DecodeParms"))
+		if arr, isArr := obj.(*PdfObjectArray); isArr {
+			if len(*arr) != 1 {
+				common.Log.Debug("Error: DecodeParms array length != 1 (%d)", len(*arr))
+				return nil, newKeyError("DecodeParms", "Range check error")
+			}
+			obj = TraceToDirectObject((*arr)[0])
+		}
+		if dp, isDict := obj.(*PdfObjectDictionary); isDict {
+			decodeParams = dp
+		}
+	}
+	if decodeParams == nil {
+		return encoder, nil
+	}
+
+	obj := decodeParams.Get("JBIG2Globals")
+	if obj == nil {
+		return encoder, nil
+	}
+	globals, ok := TraceToDirectObject(obj).(*PdfObjectStream)
+	if !ok {
+		common.Log.Debug("Error: JBIG2Globals not a stream (%T)", obj)
+		return nil, newKeyError("JBIG2Globals", "Invalid JBIG2Globals")
+	}
+	data, err := DecodeStream(globals)
+	if err != nil {
+		common.Log.Debug("Error decoding JBIG2Globals: %v", err)
+		return nil, err
+	}
+	encoder.Globals = data
+
+	return encoder, nil
+}
+
 func (this *JBIG2Encoder) GetFilterName() string {
 	return StreamEncodingFilterNameJBIG2
 }
@@ -1583,14 +1871,23 @@ func (this *JBIG2Encoder) MakeStreamDict() *PdfObjectDictionary {
 	return MakeDict()
 }
 
+// DecodeBytes decodes the JBIG2 embedded stream `encoded` into 1 bit per pixel image data, where
+// 1 bits represent white pixels.
 func (this *JBIG2Encoder) DecodeBytes(encoded []byte) ([]byte, error) {
-	common.Log.Debug("Error: Attempting to use unsupported encoding %s", this.GetFilterName())
-	return encoded, ErrNoJBIG2Decode
+	opts := &jbig2.Options{MaxSize: decodeMaxSize(this.maxSize), Context: this.ctx}
+	decoded, err := jbig2.Decode(encoded, this.Globals, opts)
+	if err == jbig2.ErrTooLarge {
+		err = &LimitError{Limit: this.limit, Max: this.maxSize}
+	}
+	if err != nil {
+		common.Log.Debug("Error decoding JBIG2 data: %v", err)
+		return nil, err
+	}
+	return decoded, nil
 }
 
 func (this *JBIG2Encoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
-	common.Log.Debug("Error: Attempting to use unsupported encoding %s", this.GetFilterName())
-	return streamObj.Stream, ErrNoJBIG2Decode
+	return this.DecodeBytes(streamObj.Stream)
 }
 
 func (this *JBIG2Encoder) EncodeBytes(data []byte) ([]byte, error) {
@@ -1599,14 +1896,91 @@ func (this *JBIG2Encoder) EncodeBytes(data []byte) ([]byte, error) {
 }
 
 //
-// JPX encoder/decoder (dummy, for now)
+// JPX (JPEG 2000) encoder/decoder (decoding only)
 //
-type JPXEncoder struct{}
+
+// JP2 enumerated colour spaces of JPEG 2000 image data.
+const (
+	JPXColorSpaceUnknown = jpx.ColorSpaceUnknown
+	JPXColorSpaceCMYK    = jpx.ColorSpaceCMYK
+	JPXColorSpaceSRGB    = jpx.ColorSpaceSRGB
+	JPXColorSpaceGray    = jpx.ColorSpaceGray
+)
+
+type JPXEncoder struct {
+	// Image properties from the JPEG 2000 data, set by DecodeConfig or when decoding.
+	Width            int
+	Height           int
+	ColorComponents  int // Number of color components, not including an alpha channel.
+	BitsPerComponent int // 8 or 16 bit.
+
+	// ColorSpace is the enumerated colour space of the JP2 header (JPXColorSpace*), or
+	// JPXColorSpaceUnknown if not specified.
+	ColorSpace int
+	// ICCProfile is the ICC profile of the JP2 header, if any.
+	ICCProfile []byte
+
+	// SMaskInData is the SMaskInData entry of the image dictionary.  If nonzero, the alpha
+	// channel of the image data is used as soft mask and can be retrieved with DecodeWithAlpha.
+	SMaskInData int
+
+	// Checked for cancellation while decoding, if set.
+	ctx context.Context
+	// Maximum decoded size in bytes and the name of the corresponding limit, if set.
+	maxSize int64
+	limit   string
+}
 
 func NewJPXEncoder() *JPXEncoder {
 	return &JPXEncoder{}
 }
 
+// Create a new JPX decoder from a stream object, getting the SMaskInData entry from the stream
+// dictionary.  The JPEG 2000 data is not read until decoded, see DecodeConfig for the image
+// properties.
+func newJPXEncoderFromStream(streamObj *PdfObjectStream) (*JPXEncoder, error) {
+	encoder := NewJPXEncoder()
+
+	encDict := streamObj.PdfObjectDictionary
+	if encDict == nil {
+		// No encoding dictionary.
+		return encoder, nil
+	}
+
+	if obj, ok := TraceToDirectObject(encDict.Get("SMaskInData")).(*PdfObjectInteger); ok {
+		encoder.SMaskInData = int(*obj)
+	}
+	common.Log.Trace("JPX Encoder: %+v", encoder)
+
+	return encoder, nil
+}
+
+// jpxBitsPerComponent returns the number of bits per component of the decoded data for JPEG 2000
+// samples of `precision` bits.
+func jpxBitsPerComponent(precision int) int {
+	if precision > 8 {
+		return 16
+	}
+	return 8
+}
+
+// DecodeConfig sets the image properties from the headers of the JPEG 2000 data `encoded`
+// without decoding the image.
+func (this *JPXEncoder) DecodeConfig(encoded []byte) error {
+	cfg, err := jpx.DecodeConfig(encoded)
+	if err != nil {
+		common.Log.Debug("Error decoding JPX header: %v", err)
+		return err
+	}
+	this.Width = cfg.Width
+	this.Height = cfg.Height
+	this.ColorComponents = cfg.NumComponents
+	this.BitsPerComponent = jpxBitsPerComponent(cfg.Precision)
+	this.ColorSpace = cfg.ColorSpace
+	this.ICCProfile = cfg.ICCProfile
+	return nil
+}
+
 func (this *JPXEncoder) GetFilterName() string {
 	return StreamEncodingFilterNameJPX
 }
@@ -1620,14 +1994,124 @@ func (this *JPXEncoder) MakeStreamDict() *PdfObjectDictionary {
 	return MakeDict()
 }
 
+// checkSize returns a *LimitError if the samples of the JPEG 2000 data `encoded`, including an
+// alpha channel, exceed the maximum decoded size.
+func (this *JPXEncoder) checkSize(encoded []byte) error {
+	cfg, err := jpx.DecodeConfig(encoded)
+	if err != nil {
+		common.Log.Debug("Error reading JPX header: %v", err)
+		return err
+	}
+	channels := int64(cfg.NumComponents)
+	if cfg.HasOpacity {
+		channels++
+	}
+	rowSize := int64(cfg.Width) * channels
+	if cfg.Precision > 8 {
+		rowSize *= 2
+	}
+	if rowSize > 0 && int64(cfg.Height) > this.maxSize/rowSize {
+		common.Log.Debug("JPX image of %d x %d x %d exceeds %d bytes", cfg.Width, cfg.Height, channels, this.maxSize)
+		return &LimitError{Limit: this.limit, Max: this.maxSize}
+	}
+	return nil
+}
+
+// DecodeBytes decodes the JPEG 2000 data `encoded` into the samples of the color components with
+// 8 or 16 bits per component.  An alpha channel is not included.
 func (this *JPXEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
-	common.Log.Debug("Error: Attempting to use unsupported encoding %s", this.GetFilterName())
-	return encoded, ErrNoJPXDecode
+	decoded, _, err := this.DecodeWithAlpha(encoded)
+	return decoded, err
+}
+
+// DecodeStreamWithAlpha decodes the JPEG 2000 data of `streamObj` like DecodeWithAlpha, subject to
+// the limits and the context of the parser which loaded the stream like DecodeStream.
+func (this *JPXEncoder) DecodeStreamWithAlpha(streamObj *PdfObjectStream) ([]byte, []byte, error) {
+	return decodeStreamWith(nil, this, streamObj, func() ([]byte, []byte, error) {
+		return this.DecodeWithAlpha(streamObj.Stream)
+	})
+}
+
+// DecodeWithAlpha decodes the JPEG 2000 data `encoded` and returns the samples of the color
+// components and the alpha channel (nil if none) with the same number of bits per component.
+// The image properties are set from the decoded image.
+func (this *JPXEncoder) DecodeWithAlpha(encoded []byte) ([]byte, []byte, error) {
+	if this.maxSize > 0 {
+		if err := this.checkSize(encoded); err != nil {
+			return nil, nil, err
+		}
+	}
+	img, err := jpx.Decode(encoded, &jpx.Options{Context: this.ctx})
+	if err != nil {
+		common.Log.Debug("Error decoding JPX data: %v", err)
+		return nil, nil, err
+	}
+
+	var colors []*jpx.Component
+	var alpha *jpx.Component
+	precision := 0
+	for _, comp := range img.Components {
+		if comp.Opacity {
+			if alpha == nil {
+				alpha = comp
+			}
+			continue
+		}
+		colors = append(colors, comp)
+		if comp.Precision > precision {
+			precision = comp.Precision
+		}
+	}
+	if len(colors) == 0 {
+		return nil, nil, errors.New("JPX image without color components")
+	}
+
+	bpc := jpxBitsPerComponent(precision)
+	this.Width = img.Width
+	this.Height = img.Height
+	this.ColorComponents = len(colors)
+	this.BitsPerComponent = bpc
+	this.ColorSpace = img.ColorSpace
+	this.ICCProfile = img.ICCProfile
+
+	decoded := packJPXSamples(colors, bpc)
+	var alphaData []byte
+	if alpha != nil {
+		alphaData = packJPXSamples([]*jpx.Component{alpha}, bpc)
+	}
+	return decoded, alphaData, nil
+}
+
+// packJPXSamples interleaves the samples of `comps`, scaled to `bpc` (8 or 16) bits.
+func packJPXSamples(comps []*jpx.Component, bpc int) []byte {
+	numSamples := len(comps[0].Samples)
+	bytesPerSample := bpc / 8
+	maxVal := int64(1)<<uint(bpc) - 1
+	data := make([]byte, numSamples*len(comps)*bytesPerSample)
+	index := 0
+	for i := 0; i < numSamples; i++ {
+		for _, comp := range comps {
+			v := int64(comp.Samples[i])
+			if comp.Signed {
+				v += int64(1) << uint(comp.Precision-1)
+			}
+			compMax := int64(1)<<uint(comp.Precision) - 1
+			if compMax != maxVal {
+				v = (v*maxVal + compMax/2) / compMax
+			}
+			if bpc == 16 {
+				data[index] = byte(v >> 8)
+				index++
+			}
+			data[index] = byte(v)
+			index++
+		}
+	}
+	return data
 }
 
 func (this *JPXEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
-	common.Log.Debug("Error: Attempting to use unsupported encoding %s", this.GetFilterName())
-	return streamObj.Stream, ErrNoJPXDecode
+	return this.DecodeBytes(streamObj.Stream)
 }
 
 func (this *JPXEncoder) EncodeBytes(data []byte) ([]byte, error) {
@@ -1641,6 +2125,9 @@ func (this *JPXEncoder) EncodeBytes(data []byte) ([]byte, error) {
 type MultiEncoder struct {
 	// Encoders in the order that they are to be applied.
 	encoders []StreamEncoder
+
+	// Checked for cancellation between the filters, if set.
+	ctx context.Context
 }
 
 func NewMultiEncoder() *MultiEncoder {
@@ -1687,18 +2174,18 @@ func newMultiEncoderFromStream(streamObj *PdfObjectStream) (*MultiEncoder, error
 
 	obj = encDict.Get("Filter")
 	if obj == nil {
-		return nil, fmt.Errorf("Filter missing")
+		return nil, newKeyError("Filter", "Filter missing")
 	}
 
 	array, ok := obj.(*PdfObjectArray)
 	if !ok {
-		return nil, fmt.Errorf("Multi filter can only be made from array")
+		return nil, newKeyError("Filter", "Multi filter can only be made from array")
 	}
 
 	for idx, obj := range *array {
 		name, ok := obj.(*PdfObjectName)
 		if !ok {
-			return nil, fmt.Errorf("Multi filter array element not a name")
+			return nil, newKeyError("Filter", "Multi filter array element not a name")
 		}
 
 		var dp PdfObject
@@ -1711,7 +2198,7 @@ func newMultiEncoderFromStream(streamObj *PdfObjectStream) (*MultiEncoder, error
 			// provided.
 			if len(decodeParamsArray) > 0 {
 				if idx >= len(decodeParamsArray) {
-					return nil, fmt.Errorf("Missing elements in decode params array")
+					return nil, newKeyError("DecodeParms", "Missing elements in decode params array")
 				}
 				dp = decodeParamsArray[idx]
 			}
@@ -1742,6 +2229,24 @@ func newMultiEncoderFromStream(streamObj *PdfObjectStream) (*MultiEncoder, error
 		} else if *name == StreamEncodingFilterNameASCII85 {
 			encoder := NewASCII85Encoder()
 			mencoder.AddEncoder(encoder)
+		} else if *name == StreamEncodingFilterNameCCITTFax {
+			encoder, err := newCCITTFaxEncoderFromStream(streamObj, dParams)
+			if err != nil {
+				return nil, err
+			}
+			mencoder.AddEncoder(encoder)
+		} else if *name == StreamEncodingFilterNameJBIG2 {
+			encoder, err := newJBIG2EncoderFromStream(streamObj, dParams)
+			if err != nil {
+				return nil, err
+			}
+			mencoder.AddEncoder(encoder)
+		} else if *name == StreamEncodingFilterNameJPX {
+			encoder, err := newJPXEncoderFromStream(streamObj)
+			if err != nil {
+				return nil, err
+			}
+			mencoder.AddEncoder(encoder)
 		} else if *name == StreamEncodingFilterNameDCT {
 			encoder, err := newDCTEncoderFromStream(streamObj, mencoder)
 			if err != nil {
@@ -1752,7 +2257,9 @@ func newMultiEncoderFromStream(streamObj *PdfObjectStream) (*MultiEncoder, error
 			common.Log.Trace("Multi encoder: %#v", mencoder)
 		} else {
 			common.Log.Error("Unsupported filter %s", *name)
-			return nil, fmt.Errorf("Invalid filter in multi filter array")
+			err := newUnsupportedError(string(*name), "Invalid filter in multi filter array")
+			err.Key = "Filter"
+			return nil, err
 		}
 	}
 
@@ -1825,6 +2332,9 @@ func (this *MultiEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 	var err error
 	// Apply in forward order.
 	for _, encoder := range this.encoders {
+		if err := contextErr(this.ctx); err != nil {
+			return nil, err
+		}
 		common.Log.Trace("Multi Encoder Decode: Applying Filter: %v %T", encoder, encoder)
 
 		decoded, err = encoder.DecodeBytes(decoded)
@@ -6,7 +6,10 @@
 package core
 
 import (
+	"compress/zlib"
+	"context"
 	"encoding/base64"
+	"strings"
 	"testing"
 
 	"github.com/unidoc/unidoc/common"
@@ -43,6 +46,47 @@ func TestFlateEncoding(t *testing.T) {
 	}
 }
 
+// Test flate encoding with the compression levels.
+func TestFlateCompressionLevel(t *testing.T) {
+	rawStream := []byte(strings.Repeat("this is a dummy text with some repetitions ", 100))
+
+	sizes := map[int]int{}
+	for _, level := range []int{zlib.NoCompression, zlib.BestSpeed, zlib.DefaultCompression, zlib.BestCompression} {
+		encoder := NewFlateEncoder()
+		encoder.CompressionLevel = level
+		encoded, err := encoder.EncodeBytes(rawStream)
+		if err != nil {
+			t.Fatalf("Failed to encode data: %v", err)
+		}
+		decoded, err := encoder.DecodeBytes(encoded)
+		if err != nil {
+			t.Fatalf("Failed to decode data: %v", err)
+		}
+		if !compareSlices(decoded, rawStream) {
+			t.Fatalf("Slices not matching at level %d", level)
+		}
+		sizes[level] = len(encoded)
+	}
+	if sizes[zlib.NoCompression] <= len(rawStream) || sizes[zlib.BestCompression] >= sizes[zlib.NoCompression] {
+		t.Fatalf("Compression level not applied: %v", sizes)
+	}
+
+	// The default level is set explicitly.
+	encoded, err := NewFlateEncoder().EncodeBytes(rawStream)
+	if err != nil {
+		t.Fatalf("Failed to encode data: %v", err)
+	}
+	if len(encoded) != sizes[zlib.DefaultCompression] {
+		t.Fatalf("Default compression level not applied: %d (expected %d)", len(encoded), sizes[zlib.DefaultCompression])
+	}
+
+	encoder := NewFlateEncoder()
+	encoder.CompressionLevel = 10
+	if _, err := encoder.EncodeBytes(rawStream); err == nil {
+		t.Fatalf("Invalid compression level not rejected")
+	}
+}
+
 // Test LZW encoding.
 func TestLZWEncoding(t *testing.T) {
 	rawStream := []byte("this is a dummy text with some \x01\x02\x03 binary data")
@@ -245,3 +289,204 @@ func TestMultiEncoder(t *testing.T) {
 		return
 	}
 }
+
+// checkDecodeCanceled checks that decoding `streamObj` with a canceled context fails.
+func checkDecodeCanceled(t *testing.T, streamObj *PdfObjectStream) {
+	encoder, err := NewEncoderFromStream(streamObj)
+	if err != nil {
+		t.Fatalf("Failed to create encoder: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	setDecodeContext(encoder, ctx)
+	if _, err := encoder.DecodeBytes(streamObj.Stream); err != context.Canceled {
+		t.Fatalf("%s: decoding not canceled (%v)", encoder.GetFilterName(), err)
+	}
+}
+
+// Test CCITTFax (Group 4) decoding of a stream with DecodeParms.
+func TestCCITTFaxDecoding(t *testing.T) {
+	// Two 8 pixel rows, each with pixels 3 and 4 black, followed by EOFB.
+	encoded := []byte{0x31, 0xf8, 0x00, 0x80, 0x08}
+	expected := []byte{0xe7, 0xe7}
+
+	decodeParms := MakeDict()
+	decodeParms.Set("K", MakeInteger(-1))
+	decodeParms.Set("Columns", MakeInteger(8))
+
+	streamObj := &PdfObjectStream{}
+	streamObj.PdfObjectDictionary = MakeDict()
+	streamObj.PdfObjectDictionary.Set("Filter", MakeName(StreamEncodingFilterNameCCITTFax))
+	streamObj.PdfObjectDictionary.Set("DecodeParms", decodeParms)
+	streamObj.Stream = encoded
+
+	decoded, err := DecodeStream(streamObj)
+	if err != nil {
+		t.Errorf("Failed to decode data: %v", err)
+		return
+	}
+
+	if !compareSlices(decoded, expected) {
+		t.Errorf("Slices not matching")
+		t.Errorf("Decoded  (%d): % x", len(decoded), decoded)
+		t.Errorf("Expected (%d): % x", len(expected), expected)
+		return
+	}
+
+	checkDecodeCanceled(t, streamObj)
+
+	// Too large, rejected when read from the parameters and when decoding.
+	decodeParms.Set("Columns", MakeInteger(1<<40))
+	decodeParms.Set("Rows", MakeInteger(1<<40))
+	if _, err := DecodeStream(streamObj); err == nil {
+		t.Errorf("Too large image not rejected")
+	}
+	encoder := NewCCITTFaxEncoder()
+	encoder.Columns, encoder.Rows = 1<<40, 1<<40
+	if _, err := encoder.DecodeBytes(encoded); err == nil {
+		t.Errorf("Too large image not rejected")
+	}
+}
+
+func TestJBIG2Decoding(t *testing.T) {
+	// Page information segment (8x2 page) in the globals.
+	globals := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x30, 0x00, 0x01, 0x00, 0x00, 0x00, 0x13,
+		0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00,
+	}
+	// Immediate lossless MMR generic region: two 8 pixel rows, each with pixels 3 and 4 black.
+	encoded := []byte{
+		0x00, 0x00, 0x00, 0x01, 0x27, 0x00, 0x01, 0x00, 0x00, 0x00, 0x17,
+		0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x01,
+		0x31, 0xf8, 0x00, 0x80, 0x08,
+	}
+	expected := []byte{0xe7, 0xe7}
+
+	globalsObj := &PdfObjectStream{}
+	globalsObj.PdfObjectDictionary = MakeDict()
+	globalsObj.Stream = globals
+
+	decodeParms := MakeDict()
+	decodeParms.Set("JBIG2Globals", &PdfIndirectObject{PdfObject: globalsObj})
+
+	streamObj := &PdfObjectStream{}
+	streamObj.PdfObjectDictionary = MakeDict()
+	streamObj.PdfObjectDictionary.Set("Filter", MakeName(StreamEncodingFilterNameJBIG2))
+	streamObj.PdfObjectDictionary.Set("DecodeParms", decodeParms)
+	streamObj.Stream = encoded
+
+	decoded, err := DecodeStream(streamObj)
+	if err != nil {
+		t.Errorf("Failed to decode data: %v", err)
+		return
+	}
+
+	if !compareSlices(decoded, expected) {
+		t.Errorf("Slices not matching")
+		t.Errorf("Decoded  (%d): % x", len(decoded), decoded)
+		t.Errorf("Expected (%d): % x", len(expected), expected)
+		return
+	}
+
+	checkDecodeCanceled(t, streamObj)
+}
+
+func TestJPXDecoding(t *testing.T) {
+	// JP2 file with a 4x2 sRGB image and an alpha channel (channel definition box), coded
+	// losslessly with one decomposition level and the reversible component transformation.
+	encoded := []byte{
+		0x00, 0x00, 0x00, 0x0c, 0x6a, 0x50, 0x20, 0x20, 0x0d, 0x0a, 0x87, 0x0a,
+		0x00, 0x00, 0x00, 0x14, 0x66, 0x74, 0x79, 0x70, 0x6a, 0x70, 0x32, 0x20,
+		0x00, 0x00, 0x00, 0x00, 0x6a, 0x70, 0x32, 0x20, 0x00, 0x00, 0x00, 0x39,
+		0x6a, 0x70, 0x32, 0x68, 0x00, 0x00, 0x00, 0x0f, 0x63, 0x6f, 0x6c, 0x72,
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x22, 0x63,
+		0x64, 0x65, 0x66, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00,
+		0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x02, 0x00, 0x00, 0x00, 0x03, 0x00,
+		0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc2, 0x6a, 0x70, 0x32,
+		0x63, 0xff, 0x4f, 0xff, 0x51, 0x00, 0x32, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x04, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x07, 0x01, 0x01, 0x07, 0x01,
+		0x01, 0x07, 0x01, 0x01, 0x07, 0x01, 0x01, 0xff, 0x52, 0x00, 0x0c, 0x00,
+		0x00, 0x00, 0x01, 0x01, 0x01, 0x02, 0x02, 0x00, 0x01, 0xff, 0x5c, 0x00,
+		0x07, 0x40, 0x40, 0x48, 0x48, 0x50, 0xff, 0x90, 0x00, 0x0a, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x6b, 0x00, 0x01, 0xff, 0x93, 0xc7, 0xd4, 0x06, 0x08,
+		0x27, 0x9f, 0xcf, 0xb4, 0x0c, 0x09, 0xf7, 0xdf, 0xcf, 0xb4, 0x0c, 0x0c,
+		0x4a, 0xf5, 0xdf, 0x80, 0x18, 0x04, 0x4f, 0xe5, 0xc3, 0xea, 0x03, 0x87,
+		0xd4, 0x07, 0x0f, 0xb4, 0x0c, 0x02, 0x72, 0x3f, 0x06, 0x15, 0x7f, 0x05,
+		0xeb, 0x5f, 0xcf, 0xc0, 0x0e, 0x7e, 0x00, 0x93, 0xf3, 0x02, 0x08, 0xf5,
+		0x7b, 0x03, 0x80, 0x8a, 0x7f, 0x03, 0x7f, 0xcf, 0xc0, 0x0e, 0x3e, 0xd0,
+		0x39, 0xf9, 0x81, 0x00, 0x07, 0xff, 0x7f, 0x05, 0x7f, 0x57, 0x05, 0x5f,
+		0xc7, 0xda, 0x05, 0x3f, 0x00, 0x38, 0xfc, 0x00, 0xc0, 0x0b, 0xbf, 0x0b,
+		0x74, 0xef, 0x0b, 0x4a, 0x4b, 0xff, 0xd9,
+	}
+	expected := []byte{
+		255, 0, 0, 0, 255, 0, 0, 0, 255, 128, 128, 128,
+		10, 50, 90, 20, 60, 100, 30, 70, 110, 40, 80, 120,
+	}
+	expectedAlpha := []byte{255, 255, 128, 0, 255, 255, 255, 255}
+
+	streamObj := &PdfObjectStream{}
+	streamObj.PdfObjectDictionary = MakeDict()
+	streamObj.PdfObjectDictionary.Set("Filter", MakeName(StreamEncodingFilterNameJPX))
+	streamObj.PdfObjectDictionary.Set("SMaskInData", MakeInteger(1))
+	streamObj.Stream = encoded
+
+	encoder, err := NewEncoderFromStream(streamObj)
+	if err != nil {
+		t.Errorf("Failed to create encoder: %v", err)
+		return
+	}
+	jpxEncoder, ok := encoder.(*JPXEncoder)
+	if !ok {
+		t.Errorf("Wrong encoder type %T", encoder)
+		return
+	}
+	if err := jpxEncoder.DecodeConfig(encoded); err != nil {
+		t.Errorf("Failed to read header: %v", err)
+		return
+	}
+	if jpxEncoder.Width != 4 || jpxEncoder.Height != 2 || jpxEncoder.ColorComponents != 3 ||
+		jpxEncoder.BitsPerComponent != 8 || jpxEncoder.ColorSpace != JPXColorSpaceSRGB ||
+		jpxEncoder.SMaskInData != 1 {
+		t.Errorf("Wrong encoder parameters %+v", jpxEncoder)
+		return
+	}
+
+	decoded, err := DecodeStream(streamObj)
+	if err != nil {
+		t.Errorf("Failed to decode data: %v", err)
+		return
+	}
+	if !compareSlices(decoded, expected) {
+		t.Errorf("Slices not matching")
+		t.Errorf("Decoded  (%d): %v", len(decoded), decoded)
+		t.Errorf("Expected (%d): %v", len(expected), expected)
+		return
+	}
+
+	_, alpha, err := jpxEncoder.DecodeWithAlpha(encoded)
+	if err != nil {
+		t.Errorf("Failed to decode data: %v", err)
+		return
+	}
+	if !compareSlices(alpha, expectedAlpha) {
+		t.Errorf("Alpha not matching: %v", alpha)
+		return
+	}
+	checkDecodeCanceled(t, streamObj)
+
+	// Invalid data is only rejected when decoded.
+	streamObj.Stream = encoded[:40]
+	if _, err := NewEncoderFromStream(streamObj); err != nil {
+		t.Errorf("Failed to create encoder: %v", err)
+		return
+	}
+	if _, err := DecodeStream(streamObj); err == nil {
+		t.Errorf("Invalid data should fail")
+	}
+}
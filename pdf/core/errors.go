@@ -0,0 +1,214 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"fmt"
+)
+
+// ErrorLocation locates an error in the document.  It is embedded in the error types of the
+// package.
+type ErrorLocation struct {
+	// Offset is the file offset at which the error was detected, -1 if unknown.
+	Offset int64
+
+	// ObjectNumber and GenerationNumber identify the object involved.  ObjectNumber is 0 if
+	// unknown or not within an object.
+	ObjectNumber     int64
+	GenerationNumber int64
+}
+
+// unknownLocation is the location of errors detected without a file offset or an object.
+var unknownLocation = ErrorLocation{Offset: -1}
+
+// String returns a description of the location, empty if unknown.
+func (loc ErrorLocation) String() string {
+	str := ""
+	if loc.Offset >= 0 {
+		str = fmt.Sprintf("offset %d", loc.Offset)
+	}
+	if loc.ObjectNumber > 0 {
+		if str != "" {
+			str += ", "
+		}
+		str += fmt.Sprintf("object %d %d", loc.ObjectNumber, loc.GenerationNumber)
+	}
+	return str
+}
+
+// withLocation returns `msg` followed by the description of `loc` if known.
+func withLocation(msg string, loc ErrorLocation) string {
+	if str := loc.String(); str != "" {
+		return fmt.Sprintf("%s (%s)", msg, str)
+	}
+	return msg
+}
+
+// SyntaxError is the error returned for a document which does not follow the syntax of PDF.
+type SyntaxError struct {
+	ErrorLocation
+	// Key is the dictionary key involved, if any.
+	Key string
+	Msg string
+}
+
+func (err *SyntaxError) Error() string {
+	return withLocation(err.Msg, err.ErrorLocation)
+}
+
+// UnsupportedError is the error returned for a feature of PDF which is not supported, such as a
+// filter or its parameters.
+type UnsupportedError struct {
+	ErrorLocation
+	// Filter is the filter involved, if any.
+	Filter string
+	// Key is the dictionary key involved, if any.
+	Key string
+	Msg string
+}
+
+func (err *UnsupportedError) Error() string {
+	return withLocation(err.Msg, err.ErrorLocation)
+}
+
+// EncryptionError is the error returned for an invalid or unsupported encryption, or failing
+// decryption.
+type EncryptionError struct {
+	ErrorLocation
+	// Filter is the security handler or the crypt filter involved, if any.
+	Filter string
+	// Key is the key of the encryption dictionary involved, if any.
+	Key string
+	Msg string
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (err *EncryptionError) Error() string {
+	msg := err.Msg
+	if err.Err != nil {
+		if msg != "" {
+			msg += ": "
+		}
+		msg += err.Err.Error()
+	}
+	return withLocation(msg, err.ErrorLocation)
+}
+
+func (err *EncryptionError) Unwrap() error {
+	return err.Err
+}
+
+// DecodeError is the error returned when the data of a stream cannot be decoded by an image
+// filter (CCITTFaxDecode, JBIG2Decode or JPXDecode).  It wraps the error of the decoder.
+type DecodeError struct {
+	ErrorLocation
+	// Filter is the filter which failed.
+	Filter string
+	// Err is the error of the decoder.
+	Err error
+}
+
+func (err *DecodeError) Error() string {
+	return withLocation(fmt.Sprintf("%s failed: %s", err.Filter, err.Err), err.ErrorLocation)
+}
+
+func (err *DecodeError) Unwrap() error {
+	return err.Err
+}
+
+// RepairError is the error returned when the document is still unreadable after being repaired.
+// It describes the repair performed and wraps the error remaining after it.
+type RepairError struct {
+	ErrorLocation
+	// Repair describes the repair performed.
+	Repair string
+	// Err is the error remaining after the repair.
+	Err error
+}
+
+func (err *RepairError) Error() string {
+	return withLocation(fmt.Sprintf("%s after repair: %s", err.Err, err.Repair), err.ErrorLocation)
+}
+
+func (err *RepairError) Unwrap() error {
+	return err.Err
+}
+
+// newSyntaxError returns a new *SyntaxError without location.
+func newSyntaxError(format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{ErrorLocation: unknownLocation, Msg: fmt.Sprintf(format, args...)}
+}
+
+// newKeyError returns a new *SyntaxError regarding the dictionary key `key` without location.
+func newKeyError(key string, format string, args ...interface{}) *SyntaxError {
+	err := newSyntaxError(format, args...)
+	err.Key = key
+	return err
+}
+
+// newUnsupportedError returns a new *UnsupportedError of `filter` without location.
+func newUnsupportedError(filter string, format string, args ...interface{}) *UnsupportedError {
+	return &UnsupportedError{ErrorLocation: unknownLocation, Filter: filter, Msg: fmt.Sprintf(format, args...)}
+}
+
+// newEncryptionError returns a new *EncryptionError regarding the key `key` of the encryption
+// dictionary, if not empty, without location.
+func newEncryptionError(key string, format string, args ...interface{}) *EncryptionError {
+	return &EncryptionError{ErrorLocation: unknownLocation, Key: key, Msg: fmt.Sprintf(format, args...)}
+}
+
+// newDecodeError returns a new *DecodeError of `filter` for the decoder error `err` without
+// location.
+func newDecodeError(filter string, err error) *DecodeError {
+	return &DecodeError{ErrorLocation: unknownLocation, Filter: filter, Err: err}
+}
+
+// newRepairError returns a new *RepairError for `err` remaining after `repair`, when looking up
+// the object `objNum`.
+func newRepairError(repair string, objNum int, err error) *RepairError {
+	loc := ErrorLocation{Offset: -1, ObjectNumber: int64(objNum)}
+	if errLoc := errorLocation(err); errLoc != nil {
+		loc = *errLoc
+	}
+	return &RepairError{ErrorLocation: loc, Repair: repair, Err: err}
+}
+
+// syntaxError returns a new *SyntaxError at the current offset of the parser.
+func (parser *PdfParser) syntaxError(format string, args ...interface{}) *SyntaxError {
+	err := newSyntaxError(format, args...)
+	if parser.rs != nil && parser.reader != nil {
+		err.Offset = parser.GetFileOffset()
+	}
+	return err
+}
+
+// errorLocation returns the location of `err` if an error type of the package, nil otherwise.
+func errorLocation(err error) *ErrorLocation {
+	switch t := err.(type) {
+	case *SyntaxError:
+		return &t.ErrorLocation
+	case *UnsupportedError:
+		return &t.ErrorLocation
+	case *EncryptionError:
+		return &t.ErrorLocation
+	case *DecodeError:
+		return &t.ErrorLocation
+	case *RepairError:
+		return &t.ErrorLocation
+	}
+	return nil
+}
+
+// setErrorObject sets the object involved in `err` to `objNum` and `genNum`, if an error type of
+// the package without the object, and returns `err`.
+func setErrorObject(err error, objNum, genNum int64) error {
+	if loc := errorLocation(err); loc != nil && loc.ObjectNumber == 0 {
+		loc.ObjectNumber = objNum
+		loc.GenerationNumber = genNum
+	}
+	return err
+}
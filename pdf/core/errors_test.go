@@ -0,0 +1,93 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestErrorTypes(t *testing.T) {
+	data := makeLimitsTestFile([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< /Length (abc) >>\nstream\nabc\nendstream",
+		"<< /Length 3 /Filter /Unknown >>\nstream\nabc\nendstream",
+		"<< /Filter /Standard /V 2 /Length 128 >>",
+		"<< /Length 1 /Filter /CCITTFaxDecode /DecodeParms << /K -1 /Columns 8 >> >>\nstream\n\x02\nendstream",
+		"<< /Length 3 /Filter /JBIG2Decode >>\nstream\nabc\nendstream",
+		"<< /Length 3 /Filter /JPXDecode >>\nstream\nabc\nendstream",
+	})
+
+	parser, err := NewParser(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// Invalid stream length, still invalid after repairing the xref table.
+	_, err = parser.LookupByNumber(3)
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Syntax error not detected (%v)", err)
+	}
+	if syntaxErr.Key != "Length" || syntaxErr.ObjectNumber != 3 || syntaxErr.Offset <= 0 {
+		t.Fatalf("Invalid syntax error: %#v", syntaxErr)
+	}
+	var repairErr *RepairError
+	if !errors.As(err, &repairErr) || repairErr.Repair == "" {
+		t.Fatalf("Repair not reported (%v)", err)
+	}
+
+	// Unsupported filter.
+	obj, err := parser.LookupByNumber(4)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream, ok := obj.(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Not a stream (%T)", obj)
+	}
+	_, err = DecodeStream(stream)
+	var unsupportedErr *UnsupportedError
+	if !errors.As(err, &unsupportedErr) {
+		t.Fatalf("Unsupported filter not detected (%v)", err)
+	}
+	if unsupportedErr.Filter != "Unknown" || unsupportedErr.Key != "Filter" || unsupportedErr.ObjectNumber != 4 {
+		t.Fatalf("Invalid unsupported error: %#v", unsupportedErr)
+	}
+
+	// Invalid image data.
+	for objNum, filter := range map[int]string{6: "CCITTFaxDecode", 7: "JBIG2Decode", 8: "JPXDecode"} {
+		obj, err := parser.LookupByNumber(objNum)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		_, err = DecodeStream(obj.(*PdfObjectStream))
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("%s: decoding error not detected (%v)", filter, err)
+		}
+		if decodeErr.Filter != filter || decodeErr.ObjectNumber != int64(objNum) || decodeErr.Err == nil {
+			t.Fatalf("Invalid decoding error: %#v", decodeErr)
+		}
+	}
+
+	// Encryption dictionary missing R.
+	data = bytes.Replace(data, []byte("/Root 1 0 R"), []byte("/Root 1 0 R /Encrypt 5 0 R"), -1)
+	parser, err = NewParser(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = parser.IsEncrypted()
+	var encryptionErr *EncryptionError
+	if !errors.As(err, &encryptionErr) {
+		t.Fatalf("Encryption error not detected (%v)", err)
+	}
+	if encryptionErr.Key != "R" || encryptionErr.ObjectNumber != 5 {
+		t.Fatalf("Invalid encryption error: %#v", encryptionErr)
+	}
+}
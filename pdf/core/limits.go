@@ -0,0 +1,171 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ParserLimits bounds the resources used for parsing a document, as a defense against malicious
+// documents such as decompression bombs and deeply nested objects.  A limit of 0 is unlimited.
+// Exceeding a limit fails with a *LimitError.
+type ParserLimits struct {
+	// MaxStreamSize is the maximum size of the decoded data of a stream in bytes.
+	MaxStreamSize int64
+
+	// MaxDocumentStreamSize is the maximum total size of the stream data decoded from the
+	// document in bytes.  A stream decoded several times is counted each time.
+	MaxDocumentStreamSize int64
+
+	// MaxNestingDepth is the maximum nesting depth of arrays and dictionaries.
+	MaxNestingDepth int
+
+	// MaxObjects is the maximum number of objects in the cross-reference table and in an object
+	// stream.
+	MaxObjects int
+
+	// MaxXrefChain is the maximum number of cross-reference sections: the last section and the
+	// previous sections chained through Prev.
+	MaxXrefChain int
+}
+
+// LimitError is the error returned when a document exceeds one of the parser limits.
+type LimitError struct {
+	// Limit is the name of the exceeded limit, as the field of ParserLimits.
+	Limit string
+	// Max is the value of the limit.
+	Max int64
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("Parser limit %s exceeded (%d)", err.Limit, err.Max)
+}
+
+// streamBudget tracks the decoded stream data of a document against the limits of the parser.
+// It is shared by the streams loaded by the parser, and can be used concurrently.
+type streamBudget struct {
+	limits ParserLimits
+
+	mu      sync.Mutex
+	decoded int64
+}
+
+// streamLimit returns the maximum size of the next stream to decode, 0 if unlimited, and the name
+// of the corresponding limit.
+func (budget *streamBudget) streamLimit() (int64, string) {
+	max, limit := budget.limits.MaxStreamSize, "MaxStreamSize"
+	if budget.limits.MaxDocumentStreamSize > 0 {
+		budget.mu.Lock()
+		remaining := budget.limits.MaxDocumentStreamSize - budget.decoded
+		budget.mu.Unlock()
+		if remaining < 1 {
+			// Exceeded by any data.
+			remaining = 1
+		}
+		if max == 0 || remaining < max {
+			max, limit = remaining, "MaxDocumentStreamSize"
+		}
+	}
+	return max, limit
+}
+
+// add accounts for `size` bytes of decoded data.
+func (budget *streamBudget) add(size int64) error {
+	if budget.limits.MaxStreamSize > 0 && size > budget.limits.MaxStreamSize {
+		return &LimitError{Limit: "MaxStreamSize", Max: budget.limits.MaxStreamSize}
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.decoded += size
+	if budget.limits.MaxDocumentStreamSize > 0 && budget.decoded > budget.limits.MaxDocumentStreamSize {
+		return &LimitError{Limit: "MaxDocumentStreamSize", Max: budget.limits.MaxDocumentStreamSize}
+	}
+	return nil
+}
+
+// limitReader is a reader failing with a *LimitError once more than `max` bytes are read, or
+// unlimited if `max` is 0.
+type limitReader struct {
+	r     io.Reader
+	max   int64
+	limit string
+	n     int64
+	err   error
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	if lr.max > 0 && int64(len(p)) > lr.max-lr.n+1 {
+		// Read at most one byte past the limit.
+		p = p[:lr.max-lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.max > 0 && lr.n > lr.max {
+		lr.err = &LimitError{Limit: lr.limit, Max: lr.max}
+		return n, lr.err
+	}
+	return n, err
+}
+
+// setDecodeLimit makes `encoder` fail with a *LimitError named `limit` when decoding more than
+// `max` bytes, for the encoders which can decode unbounded data.
+func setDecodeLimit(encoder StreamEncoder, max int64, limit string) {
+	switch t := encoder.(type) {
+	case *FlateEncoder:
+		t.maxSize, t.limit = max, limit
+	case *LZWEncoder:
+		t.maxSize, t.limit = max, limit
+	case *CCITTFaxEncoder:
+		t.maxSize, t.limit = max, limit
+	case *JBIG2Encoder:
+		t.maxSize, t.limit = max, limit
+	case *JPXEncoder:
+		t.maxSize, t.limit = max, limit
+	case *MultiEncoder:
+		for _, enc := range t.encoders {
+			setDecodeLimit(enc, max, limit)
+		}
+	}
+}
+
+// decodeMaxSize returns the maximum decoded size `max` as an int for the image decoders, 0 if
+// unlimited.
+func decodeMaxSize(max int64) int {
+	if maxInt := int64(^uint(0) >> 1); max > maxInt {
+		return int(maxInt)
+	}
+	if max < 0 {
+		return 0
+	}
+	return int(max)
+}
+
+// checkObjectCount returns a *LimitError if `count` objects exceed the limits of the parser.
+func (parser *PdfParser) checkObjectCount(count int) error {
+	if max := parser.limits.MaxObjects; max > 0 && count > max {
+		return &LimitError{Limit: "MaxObjects", Max: int64(max)}
+	}
+	return nil
+}
+
+// enterNested accounts for entering a nested array or dictionary while parsing, and returns a
+// *LimitError if too deeply nested.  Must be paired with leaveNested.
+func (parser *PdfParser) enterNested() error {
+	parser.depth++
+	if max := parser.limits.MaxNestingDepth; max > 0 && parser.depth > max {
+		return &LimitError{Limit: "MaxNestingDepth", Max: int64(max)}
+	}
+	return nil
+}
+
+func (parser *PdfParser) leaveNested() {
+	parser.depth--
+}
@@ -0,0 +1,135 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// makeLimitsTestFile returns a file with the objects `objects`, and an incremental update
+// repeating the last object, with a cross-reference section chained to the original one.
+func makeLimitsTestFile(objects []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	writeSection := func(first int, objects []string, prev int) {
+		offsets := []int{}
+		for i, obj := range objects {
+			offsets = append(offsets, buf.Len())
+			fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", first+i, obj)
+		}
+		xrefOffset := buf.Len()
+		fmt.Fprintf(&buf, "xref\n0 1\n0000000000 65535 f\r\n%d %d\n", first, len(objects))
+		for _, offset := range offsets {
+			fmt.Fprintf(&buf, "%010d 00000 n\r\n", offset)
+		}
+		fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R", first+len(objects))
+		if prev > 0 {
+			fmt.Fprintf(&buf, " /Prev %d", prev)
+		}
+		fmt.Fprintf(&buf, " >>\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+	}
+	writeSection(1, objects, 0)
+	prev := bytes.LastIndex(buf.Bytes(), []byte("\nxref\n")) + 1
+	writeSection(len(objects), objects[len(objects)-1:], prev)
+	return buf.Bytes()
+}
+
+func TestParserLimits(t *testing.T) {
+	// Decompression bomb.
+	bomb, err := MakeStream(make([]byte, 1000000), NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	small, err := MakeStream([]byte(strings.Repeat("0123456789", 60)), NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	streamObject := func(stream *PdfObjectStream) string {
+		return fmt.Sprintf("%s\nstream\n%s\nendstream", stream.PdfObjectDictionary.DefaultWriteString(), stream.Stream)
+	}
+	nested := strings.Repeat("[", 50) + strings.Repeat("]", 50)
+	data := makeLimitsTestFile([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		streamObject(bomb),
+		streamObject(small),
+		"<< /Nested " + nested + " >>",
+	})
+
+	lookup := func(limits ParserLimits, objNum int) (PdfObject, error) {
+		parser, err := NewParserWithOptions(context.Background(), bytes.NewReader(data), &ParserOptions{Limits: limits})
+		if err != nil {
+			return nil, err
+		}
+		obj, err := parser.LookupByNumber(objNum)
+		if err != nil {
+			return nil, err
+		}
+		if stream, isStream := obj.(*PdfObjectStream); isStream {
+			return nil, decodeTwice(parser, stream)
+		}
+		return obj, nil
+	}
+	checkLimit := func(err error, limit string) {
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || limitErr.Limit != limit {
+			t.Fatalf("Limit %s not detected (%v)", limit, err)
+		}
+	}
+
+	// Unlimited.
+	if _, err := lookup(ParserLimits{}, 3); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := lookup(ParserLimits{}, 5); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	_, err = lookup(ParserLimits{MaxStreamSize: 10000}, 3)
+	checkLimit(err, "MaxStreamSize")
+	if _, err := lookup(ParserLimits{MaxStreamSize: 10000}, 4); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// The small stream is decoded twice.
+	_, err = lookup(ParserLimits{MaxDocumentStreamSize: 1000}, 4)
+	checkLimit(err, "MaxDocumentStreamSize")
+	if _, err := lookup(ParserLimits{MaxDocumentStreamSize: 1200}, 4); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	_, err = lookup(ParserLimits{MaxNestingDepth: 10}, 5)
+	checkLimit(err, "MaxNestingDepth")
+	if _, err := lookup(ParserLimits{MaxNestingDepth: 51}, 5); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	_, err = lookup(ParserLimits{MaxObjects: 4}, 1)
+	checkLimit(err, "MaxObjects")
+	if _, err := lookup(ParserLimits{MaxObjects: 5}, 1); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	_, err = lookup(ParserLimits{MaxXrefChain: 1}, 1)
+	checkLimit(err, "MaxXrefChain")
+	if _, err := lookup(ParserLimits{MaxXrefChain: 2}, 1); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+}
+
+// decodeTwice decodes `stream` twice, with and without the context of `parser`.
+func decodeTwice(parser *PdfParser, stream *PdfObjectStream) error {
+	if _, err := DecodeStreamContext(parser.context(), stream); err != nil {
+		return err
+	}
+	_, err := DecodeStream(stream)
+	return err
+}
@@ -8,6 +8,9 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -16,6 +19,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/unidoc/unidoc/common"
 )
@@ -33,6 +37,13 @@ var reXrefSubsection = regexp.MustCompile(`(\d+)\s+(\d+)\s*$`)
 var reXrefEntry = regexp.MustCompile(`(\d+)\s+(\d+)\s+([nf])\s*$`)
 
 // PdfParser parses a PDF file and provides access to the object structure of the PDF.
+//
+// The lookups of objects are safe for concurrent use: they are serialized, as they share the file
+// offset and the caches.  The lower level parsing functions (such as ParseIndirectObject and
+// SetFileOffset) are not.
+//
+// The parsing stops with the error of the context of the parser once canceled, see
+// NewParserWithContext.
 type PdfParser struct {
 	majorVersion int
 	minorVersion int
@@ -41,6 +52,7 @@ type PdfParser struct {
 	reader           *bufio.Reader
 	fileSize         int64
 	xrefs            XrefTable
+	xrefOffset       int64
 	objstms          ObjectStreams
 	trailer          *PdfObjectDictionary
 	ObjCache         ObjectCache // TODO: Unexport (v3).
@@ -52,6 +64,25 @@ type PdfParser struct {
 	// the length reference (if not object) prior to reading the actual stream.  This has risks of endless looping.
 	// Tracking is necessary to avoid recursive loops.
 	streamLengthReferenceLookupInProgress map[int64]bool
+
+	// Bounded cache of the objects in ObjCache.
+	objCache *objectCache
+
+	// Serializes the lookups.
+	mu sync.Mutex
+
+	// Checked for cancellation while parsing, if set.
+	ctx context.Context
+
+	// Resource limits, and the decoding limits shared with the loaded streams.
+	limits ParserLimits
+	budget *streamBudget
+	// Current nesting depth of arrays and dictionaries.
+	depth int
+
+	// Fail instead of repairing in strict mode, otherwise record the repairs.
+	strict      bool
+	diagnostics []Diagnostic
 }
 
 // GetCrypter returns the PdfCrypt instance which has information about the PDFs encryption.
@@ -59,11 +90,56 @@ func (parser *PdfParser) GetCrypter() *PdfCrypt {
 	return parser.crypter
 }
 
+// context returns the context of the parser, the background context if not set.
+func (parser *PdfParser) context() context.Context {
+	if parser.ctx == nil {
+		return context.Background()
+	}
+	return parser.ctx
+}
+
+// onCacheEvict releases the data related to the object or object stream evicted from the object
+// cache.
+func (parser *PdfParser) onCacheEvict(key cacheKey, obj PdfObject) {
+	if key.objStream {
+		delete(parser.objstms, key.objNum)
+		return
+	}
+	if parser.crypter != nil {
+		delete(parser.crypter.DecryptedObjects, obj)
+	}
+}
+
+// SetCacheLimit bounds the object cache to the budget `limit` in bytes, or unbounded if 0.  The
+// least recently used objects are evicted from ObjCache when the budget is exceeded, and loaded
+// anew from the file when looked up again.  The objects whose references were resolved in place
+// keep referring to the objects loaded at the time, which remain valid but are distinct from the
+// objects loaded anew.
+func (parser *PdfParser) SetCacheLimit(limit int64) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+	parser.objCache.SetLimit(limit)
+}
+
+// CacheSize returns the estimated memory size in bytes of the cached objects and object stream
+// data.
+func (parser *PdfParser) CacheSize() int64 {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+	return parser.objCache.Size()
+}
+
 // IsAuthenticated returns true if the PDF has already been authenticated for accessing.
 func (parser *PdfParser) IsAuthenticated() bool {
 	return parser.crypter.Authenticated
 }
 
+// GetXrefOffset returns the offset of the last cross-reference section, which an incremental
+// update refers to as the previous section.
+func (parser *PdfParser) GetXrefOffset() int64 {
+	return parser.xrefOffset
+}
+
 // GetTrailer returns the PDFs trailer dictionary. The trailer dictionary is typically the starting point for a PDF,
 // referencing other key objects that are important in the document structure.
 func (parser *PdfParser) GetTrailer() *PdfObjectDictionary {
@@ -136,7 +212,7 @@ func (parser *PdfParser) readComment() (string, error) {
 			return r.String(), err
 		}
 		if isFirst && bb[0] != '%' {
-			return r.String(), errors.New("Comment should start with %")
+			return r.String(), parser.syntaxError("Comment should start with %%")
 		} else {
 			isFirst = false
 		}
@@ -192,7 +268,7 @@ func (parser *PdfParser) parseName() (PdfObjectName, error) {
 				parser.skipSpaces()
 			} else {
 				common.Log.Debug("ERROR Name starting with %s (% x)", bb, bb)
-				return PdfObjectName(r.String()), fmt.Errorf("Invalid name: (%c)", bb[0])
+				return PdfObjectName(r.String()), parser.syntaxError("Invalid name: (%c)", bb[0])
 			}
 		} else {
 			if IsWhiteSpace(bb[0]) {
@@ -414,6 +490,11 @@ func (parser *PdfParser) parseHexString() (PdfObjectString, error) {
 func (parser *PdfParser) parseArray() (PdfObjectArray, error) {
 	arr := make(PdfObjectArray, 0)
 
+	if err := parser.enterNested(); err != nil {
+		return arr, err
+	}
+	defer parser.leaveNested()
+
 	parser.reader.ReadByte()
 
 	for {
@@ -459,7 +540,7 @@ func (parser *PdfParser) parseBool() (PdfObjectBool, error) {
 		return PdfObjectBool(false), nil
 	}
 
-	return PdfObjectBool(false), errors.New("Unexpected boolean string")
+	return PdfObjectBool(false), parser.syntaxError("Unexpected boolean string")
 }
 
 // Parse reference to an indirect object.
@@ -469,7 +550,7 @@ func parseReference(refStr string) (PdfObjectReference, error) {
 	result := reReference.FindStringSubmatch(string(refStr))
 	if len(result) < 3 {
 		common.Log.Debug("Error parsing reference")
-		return objref, errors.New("Unable to parse reference")
+		return objref, newSyntaxError("Unable to parse reference")
 	}
 
 	objNum, _ := strconv.Atoi(result[1])
@@ -568,7 +649,7 @@ func (parser *PdfParser) parseObject() (PdfObject, error) {
 			}
 
 			common.Log.Debug("ERROR Unknown (peek \"%s\")", peekStr)
-			return nil, errors.New("Object parsing error - unexpected pattern")
+			return nil, parser.syntaxError("Object parsing error - unexpected pattern")
 		}
 	}
 }
@@ -580,14 +661,19 @@ func (parser *PdfParser) ParseDict() (*PdfObjectDictionary, error) {
 
 	dict := MakeDict()
 
+	if err := parser.enterNested(); err != nil {
+		return nil, err
+	}
+	defer parser.leaveNested()
+
 	// Pass the '<<'
 	c, _ := parser.reader.ReadByte()
 	if c != '<' {
-		return nil, errors.New("Invalid dict")
+		return nil, parser.syntaxError("Invalid dict")
 	}
 	c, _ = parser.reader.ReadByte()
 	if c != '<' {
-		return nil, errors.New("Invalid dict")
+		return nil, parser.syntaxError("Invalid dict")
 	}
 
 	for {
@@ -655,6 +741,11 @@ func (parser *PdfParser) parsePdfVersion() (int, int, error) {
 
 	result1 := rePdfVersion.FindStringSubmatch(string(b))
 	if len(result1) < 3 {
+		err := parser.repair(ErrorLocation{Offset: 0}, "Version header not found at start of file", nil,
+			"Searched the file for the version header")
+		if err != nil {
+			return 0, 0, err
+		}
 		major, minor, err := parser.seekPdfVersionTopDown()
 		if err != nil {
 			common.Log.Debug("Failed recovery - unable to find version")
@@ -694,6 +785,9 @@ func (parser *PdfParser) parseXrefTable() (*PdfObjectDictionary, error) {
 	secObjects := 0
 	insideSubsection := false
 	for {
+		if err := contextErr(parser.ctx); err != nil {
+			return nil, err
+		}
 		parser.skipSpaces()
 		_, err := parser.reader.Peek(1)
 		if err != nil {
@@ -720,7 +814,7 @@ func (parser *PdfParser) parseXrefTable() (*PdfObjectDictionary, error) {
 		if len(result2) == 4 {
 			if insideSubsection == false {
 				common.Log.Debug("ERROR Xref invalid format!\n")
-				return nil, errors.New("Xref invalid format")
+				return nil, parser.syntaxError("Xref invalid format")
 			}
 
 			first, _ := strconv.ParseInt(result2[1], 10, 64)
@@ -748,6 +842,9 @@ func (parser *PdfParser) parseXrefTable() (*PdfObjectDictionary, error) {
 						xtype:  XREF_TABLE_ENTRY,
 						offset: first, generation: gen}
 					parser.xrefs[curObjNum] = obj
+					if err := parser.checkObjectCount(len(parser.xrefs)); err != nil {
+						return nil, err
+					}
 				}
 			}
 
@@ -778,7 +875,7 @@ func (parser *PdfParser) parseXrefTable() (*PdfObjectDictionary, error) {
 
 		if txt == "%%EOF" {
 			common.Log.Debug("ERROR: end of file - trailer not found - error!")
-			return nil, errors.New("End of file - trailer not found")
+			return nil, parser.syntaxError("End of file - trailer not found")
 		}
 
 		common.Log.Trace("xref more : %s", txt)
@@ -797,17 +894,24 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 		parser.reader = bufio.NewReader(parser.rs)
 	}
 
+	offset := parser.GetFileOffset()
 	xrefObj, err := parser.ParseIndirectObject()
 	if err != nil {
-		common.Log.Debug("ERROR: Failed to read xref object")
-		return nil, errors.New("Failed to read xref object")
+		common.Log.Debug("ERROR: Failed to read xref object (%s)", err)
+		return nil, err
 	}
 
 	common.Log.Trace("XRefStm object: %s", xrefObj)
 	xs, ok := xrefObj.(*PdfObjectStream)
 	if !ok {
 		common.Log.Debug("ERROR: XRefStm pointing to non-stream object!")
-		return nil, errors.New("XRefStm pointing to a non-stream object")
+		return nil, &SyntaxError{ErrorLocation: ErrorLocation{Offset: offset}, Msg: "XRefStm pointing to a non-stream object"}
+	}
+
+	// Errors regarding the entry `key` of the xref stream dictionary.
+	streamError := func(key, msg string) error {
+		loc := ErrorLocation{Offset: offset, ObjectNumber: xs.ObjectNumber, GenerationNumber: xs.GenerationNumber}
+		return &SyntaxError{ErrorLocation: loc, Key: key, Msg: msg}
 	}
 
 	trailerDict := xs.PdfObjectDictionary
@@ -815,41 +919,42 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 	sizeObj, ok := xs.PdfObjectDictionary.Get("Size").(*PdfObjectInteger)
 	if !ok {
 		common.Log.Debug("ERROR: Missing size from xref stm")
-		return nil, errors.New("Missing Size from xref stm")
+		return nil, streamError("Size", "Missing Size from xref stm")
 	}
 	// Sanity check to avoid DoS attacks. Maximum number of indirect objects on 32 bit system.
 	if int64(*sizeObj) > 8388607 {
 		common.Log.Debug("ERROR: xref Size exceeded limit, over 8388607 (%d)", *sizeObj)
-		return nil, errors.New("Range check error")
+		return nil, streamError("Size", "Range check error")
 	}
 
 	wObj := xs.PdfObjectDictionary.Get("W")
 	wArr, ok := wObj.(*PdfObjectArray)
 	if !ok {
-		return nil, errors.New("Invalid W in xref stream")
+		return nil, streamError("W", "Invalid W in xref stream")
 	}
 
 	wLen := len(*wArr)
 	if wLen != 3 {
 		common.Log.Debug("ERROR: Unsupported xref stm (len(W) != 3 - %d)", wLen)
-		return nil, errors.New("Unsupported xref stm len(W) != 3")
+		return nil, &UnsupportedError{ErrorLocation: ErrorLocation{Offset: offset, ObjectNumber: xs.ObjectNumber,
+			GenerationNumber: xs.GenerationNumber}, Key: "W", Msg: "Unsupported xref stm len(W) != 3"}
 	}
 
 	var b []int64
 	for i := 0; i < 3; i++ {
 		w, ok := (*wArr)[i].(PdfObject)
 		if !ok {
-			return nil, errors.New("Invalid W")
+			return nil, streamError("W", "Invalid W")
 		}
 		wVal, ok := w.(*PdfObjectInteger)
 		if !ok {
-			return nil, errors.New("Invalid w object type")
+			return nil, streamError("W", "Invalid w object type")
 		}
 
 		b = append(b, int64(*wVal))
 	}
 
-	ds, err := DecodeStream(xs)
+	ds, err := DecodeStreamContext(parser.context(), xs)
 	if err != nil {
 		common.Log.Debug("ERROR: Unable to decode stream: %v", err)
 		return nil, err
@@ -862,7 +967,7 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 
 	if s0 < 0 || s1 < 0 || s2 < 0 {
 		common.Log.Debug("Error s value < 0 (%d,%d,%d)", s0, s1, s2)
-		return nil, errors.New("Range check error")
+		return nil, streamError("W", "Range check error")
 	}
 	if deltab == 0 {
 		common.Log.Debug("No xref objects in stream (deltab == 0)")
@@ -891,13 +996,13 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 		indicesArray, ok := indexObj.(*PdfObjectArray)
 		if !ok {
 			common.Log.Debug("Invalid Index object (should be an array)")
-			return nil, errors.New("Invalid Index object")
+			return nil, streamError("Index", "Invalid Index object")
 		}
 
 		// Expect indLen to be a multiple of 2.
 		if len(*indicesArray)%2 != 0 {
 			common.Log.Debug("WARNING Failure loading xref stm index not multiple of 2.")
-			return nil, errors.New("Range check error")
+			return nil, streamError("Index", "Range check error")
 		}
 
 		objCount = 0
@@ -913,6 +1018,9 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 
 			startIdx := indices[i]
 			numObjs := indices[i+1]
+			if err := parser.checkObjectCount(objCount + numObjs); err != nil {
+				return nil, err
+			}
 			for j := 0; j < numObjs; j++ {
 				indexList = append(indexList, startIdx+j)
 			}
@@ -920,6 +1028,9 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 		}
 	} else {
 		// If no Index, then assume [0 Size]
+		if err := parser.checkObjectCount(int(*sizeObj)); err != nil {
+			return nil, err
+		}
 		for i := 0; i < int(*sizeObj); i++ {
 			indexList = append(indexList, i)
 		}
@@ -936,7 +1047,7 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 	if entries != len(indexList) {
 		// If mismatch -> error (already allowing mismatch of 1 if Index not specified).
 		common.Log.Debug("ERROR: xref stm: num entries != len(indices) (%d != %d)", entries, len(indexList))
-		return nil, errors.New("Xref stm num entries != len(indices)")
+		return nil, streamError("Index", "Xref stm num entries != len(indices)")
 	}
 
 	common.Log.Trace("Objects count %d", objCount)
@@ -1059,7 +1170,12 @@ func (parser *PdfParser) parseXref() (*PdfObjectDictionary, error) {
 		}
 	} else {
 		common.Log.Debug("Warning: Unable to find xref table or stream. Repair attempted: Looking for earliest xref from bottom.")
-		err := parser.repairSeekXrefMarker()
+		loc := ErrorLocation{Offset: parser.GetFileOffset()}
+		err := parser.repair(loc, "Xref table or stream not found", nil, "Searched the last xref table from the end of the file")
+		if err != nil {
+			return nil, err
+		}
+		err = parser.repairSeekXrefMarker()
 		if err != nil {
 			common.Log.Debug("Repair failed - %v", err)
 			return nil, err
@@ -1113,7 +1229,7 @@ func (parser *PdfParser) seekToEOFMarker(fSize int64) error {
 	}
 
 	common.Log.Debug("Error: EOF marker was not found.")
-	return errors.New("EOF not found")
+	return newSyntaxError("EOF not found")
 }
 
 //
@@ -1181,11 +1297,11 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 	result := reStartXref.FindStringSubmatch(string(b2))
 	if len(result) < 2 {
 		common.Log.Debug("Error: startxref not found!")
-		return nil, errors.New("Startxref not found")
+		return nil, newSyntaxError("Startxref not found")
 	}
 	if len(result) > 2 {
 		common.Log.Debug("ERROR: Multiple startxref (%s)!", b2)
-		return nil, errors.New("Multiple startxref entries?")
+		return nil, newSyntaxError("Multiple startxref entries?")
 	}
 	offsetXref, _ := strconv.ParseInt(result[1], 10, 64)
 	common.Log.Trace("startxref at %d", offsetXref)
@@ -1193,12 +1309,20 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 	if offsetXref > fSize {
 		common.Log.Debug("ERROR: Xref offset outside of file")
 		common.Log.Debug("Attempting repair")
+		loc := ErrorLocation{Offset: offset + int64(strings.Index(string(b2), "startxref"))}
+		err := parser.repair(loc, fmt.Sprintf("Xref offset outside of file (%d)", offsetXref), nil,
+			"Searched the xref table before the end of file marker")
+		if err != nil {
+			return nil, err
+		}
 		offsetXref, err = parser.repairLocateXref()
 		if err != nil {
 			common.Log.Debug("ERROR: Repair attempt failed (%s)")
 			return nil, err
 		}
 	}
+	parser.xrefOffset = offsetXref
+
 	// Read the xref.
 	parser.rs.Seek(int64(offsetXref), io.SeekStart)
 	parser.reader = bufio.NewReader(parser.rs)
@@ -1213,7 +1337,7 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 	if xx != nil {
 		xo, ok := xx.(*PdfObjectInteger)
 		if !ok {
-			return nil, errors.New("XRefStm != int")
+			return nil, newKeyError("XRefStm", "XRefStm != int")
 		}
 		_, err = parser.parseXrefStream(xo)
 		if err != nil {
@@ -1234,6 +1358,7 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 
 	// Load any Previous xref tables (old versions), which can
 	// refer to objects also.
+	chain := 1
 	xx = trailerDict.Get("Prev")
 	for xx != nil {
 		prevInt, ok := xx.(*PdfObjectInteger)
@@ -1241,6 +1366,10 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 			// For compatibility: If Prev is invalid, just go with whatever xrefs are loaded already.
 			// i.e. not returning an error.  A debug message is logged.
 			common.Log.Debug("Invalid Prev reference: Not a *PdfObjectInteger (%T)", xx)
+			err := parser.repair(unknownLocation, fmt.Sprintf("Invalid Prev (%T)", xx), nil, "Ignored the previous xref sections")
+			if err != nil {
+				return nil, err
+			}
 			return trailerDict, nil
 		}
 
@@ -1251,10 +1380,25 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 		parser.rs.Seek(int64(off), os.SEEK_SET)
 		parser.reader = bufio.NewReader(parser.rs)
 
+		chain++
+		if max := parser.limits.MaxXrefChain; max > 0 && chain > max {
+			return nil, &LimitError{Limit: "MaxXrefChain", Max: int64(max)}
+		}
+
 		ptrailerDict, err := parser.parseXref()
 		if err != nil {
+			if ctxErr := contextErr(parser.ctx); ctxErr != nil {
+				return nil, ctxErr
+			}
+			if _, isLimit := err.(*LimitError); isLimit {
+				return nil, err
+			}
 			common.Log.Debug("Warning: Error - Failed loading another (Prev) trailer")
 			common.Log.Debug("Attempting to continue by ignoring it")
+			err = parser.repair(ErrorLocation{Offset: int64(off)}, err.Error(), err, "Ignored the previous xref sections")
+			if err != nil {
+				return nil, err
+			}
 			break
 		}
 
@@ -1264,6 +1408,11 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 			if intInSlice(int64(prevoff), prevList) {
 				// Prevent circular reference!
 				common.Log.Debug("Preventing circular xref referencing")
+				err := parser.repair(ErrorLocation{Offset: int64(prevoff)}, "Circular Prev reference", nil,
+					"Ignored the repeated xref section")
+				if err != nil {
+					return nil, err
+				}
 				break
 			}
 			prevList = append(prevList, int64(prevoff))
@@ -1292,13 +1441,13 @@ func (parser *PdfParser) traceStreamLength(lengthObj PdfObject) (PdfObject, erro
 		lookupInProgress, has := parser.streamLengthReferenceLookupInProgress[lengthRef.ObjectNumber]
 		if has && lookupInProgress {
 			common.Log.Debug("Stream Length reference unresolved (illegal)")
-			return nil, errors.New("Illegal recursive loop")
+			return nil, &SyntaxError{ErrorLocation: ErrorLocation{Offset: -1, ObjectNumber: lengthRef.ObjectNumber}, Key: "Length", Msg: "Illegal recursive loop"}
 		}
 		// Mark lookup as in progress.
 		parser.streamLengthReferenceLookupInProgress[lengthRef.ObjectNumber] = true
 	}
 
-	slo, err := parser.Trace(lengthObj)
+	slo, err := parser.trace(lengthObj)
 	if err != nil {
 		return nil, err
 	}
@@ -1329,7 +1478,7 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 	indices := reIndirectObject.FindStringSubmatchIndex(string(bb))
 	if len(indices) < 6 {
 		common.Log.Debug("ERROR: Unable to find object signature (%s)", string(bb))
-		return &indirect, errors.New("Unable to detect indirect object signature")
+		return &indirect, parser.syntaxError("Unable to detect indirect object signature")
 	}
 	parser.reader.Discard(indices[0]) // Take care of any small offset.
 	common.Log.Trace("Offsets % d", indices)
@@ -1347,7 +1496,7 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 	result := reIndirectObject.FindStringSubmatch(string(hb))
 	if len(result) < 3 {
 		common.Log.Debug("ERROR: Unable to find object signature (%s)", string(hb))
-		return &indirect, errors.New("Unable to detect indirect object signature")
+		return &indirect, parser.syntaxError("Unable to detect indirect object signature")
 	}
 
 	on, _ := strconv.Atoi(result[1])
@@ -1412,9 +1561,16 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 
 					parser.reader.Discard(discardBytes)
 
+					// Errors regarding the entry `key` of the stream dictionary.
+					streamError := func(key, msg string) error {
+						loc := ErrorLocation{Offset: parser.GetFileOffset(), ObjectNumber: indirect.ObjectNumber,
+							GenerationNumber: indirect.GenerationNumber}
+						return &SyntaxError{ErrorLocation: loc, Key: key, Msg: msg}
+					}
+
 					dict, isDict := indirect.PdfObject.(*PdfObjectDictionary)
 					if !isDict {
-						return nil, errors.New("Stream object missing dictionary")
+						return nil, streamError("", "Stream object missing dictionary")
 					}
 					common.Log.Trace("Stream dict %s", dict)
 
@@ -1428,11 +1584,11 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 
 					pstreamLength, ok := slo.(*PdfObjectInteger)
 					if !ok {
-						return nil, errors.New("Stream length needs to be an integer")
+						return nil, streamError("Length", "Stream length needs to be an integer")
 					}
 					streamLength := *pstreamLength
 					if streamLength < 0 {
-						return nil, errors.New("Stream needs to be longer than 0")
+						return nil, streamError("Length", "Stream needs to be longer than 0")
 					}
 
 					// Validate the stream length based on the cross references.
@@ -1446,10 +1602,18 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 						// endstream + "\n" endobj + "\n" (17)
 						newLength := nextObjectOffset - streamStartOffset - 17
 						if newLength < 0 {
-							return nil, errors.New("Invalid stream length, going past boundaries")
+							return nil, streamError("Length", "Invalid stream length, going past boundaries")
 						}
 
 						common.Log.Debug("Attempting a length correction to %d...", newLength)
+						loc := ErrorLocation{Offset: streamStartOffset, ObjectNumber: indirect.ObjectNumber,
+							GenerationNumber: indirect.GenerationNumber}
+						problem := fmt.Sprintf("Stream length %d going past the next object", streamLength)
+						err := parser.repair(loc, problem, streamError("Length", problem),
+							fmt.Sprintf("Corrected the stream length to %d", newLength))
+						if err != nil {
+							return nil, err
+						}
 						streamLength = PdfObjectInteger(newLength)
 						dict.Set("Length", MakeInteger(newLength))
 					}
@@ -1457,7 +1621,7 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 					// Make sure is less than actual file size.
 					if int64(streamLength) > parser.fileSize {
 						common.Log.Debug("ERROR: Stream length cannot be larger than file size")
-						return nil, errors.New("Invalid stream length, larger than file size")
+						return nil, streamError("Length", "Invalid stream length, larger than file size")
 					}
 
 					stream := make([]byte, streamLength)
@@ -1470,6 +1634,8 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 
 					streamobj := PdfObjectStream{}
 					streamobj.Stream = stream
+					streamobj.budget = parser.budget
+					streamobj.ctx = parser.ctx
 					streamobj.PdfObjectDictionary = indirect.PdfObject.(*PdfObjectDictionary)
 					streamobj.ObjectNumber = indirect.ObjectNumber
 					streamobj.GenerationNumber = indirect.GenerationNumber
@@ -1509,10 +1675,48 @@ func NewParserFromString(txt string) *PdfParser {
 // NewParser creates a new parser for a PDF file via ReadSeeker. Loads the cross reference stream and trailer.
 // An error is returned on failure.
 func NewParser(rs io.ReadSeeker) (*PdfParser, error) {
+	return NewParserWithContext(context.Background(), rs)
+}
+
+// NewParserWithContext creates a new parser for a PDF file via ReadSeeker like NewParser.  The
+// parsing, including the repairs of damaged files and the decoding of object and xref streams,
+// stops with the error of `ctx` once canceled or past its deadline.  The context applies to the
+// lookups for the lifetime of the parser, and to the decoding of the streams loaded (see
+// DecodeStream).
+func NewParserWithContext(ctx context.Context, rs io.ReadSeeker) (*PdfParser, error) {
+	return NewParserWithOptions(ctx, rs, nil)
+}
+
+// ParserOptions are the options of the parser.
+type ParserOptions struct {
+	// Limits bounds the resources used for parsing, unlimited by default.
+	Limits ParserLimits
+
+	// Strict fails on malformed documents instead of repairing them.  By default the parser
+	// repairs damaged cross-reference data and records the repairs, see GetDiagnostics.
+	Strict bool
+}
+
+// NewParserWithOptions creates a new parser for a PDF file via ReadSeeker like
+// NewParserWithContext, with the options `opts`, or the default options if nil.
+func NewParserWithOptions(ctx context.Context, rs io.ReadSeeker, opts *ParserOptions) (*PdfParser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	parser := &PdfParser{}
 
 	parser.rs = rs
-	parser.ObjCache = make(ObjectCache)
+	parser.ctx = ctx
+	if opts != nil {
+		parser.limits = opts.Limits
+		parser.strict = opts.Strict
+	}
+	if parser.limits.MaxStreamSize > 0 || parser.limits.MaxDocumentStreamSize > 0 {
+		parser.budget = &streamBudget{limits: parser.limits}
+	}
+	parser.objCache = newObjectCache(0)
+	parser.objCache.onEvict = parser.onCacheEvict
+	parser.ObjCache = parser.objCache.objects
 	parser.streamLengthReferenceLookupInProgress = map[int64]bool{}
 
 	// Start by reading the xrefs (from bottom).
@@ -1525,7 +1729,7 @@ func NewParser(rs io.ReadSeeker) (*PdfParser, error) {
 	common.Log.Trace("Trailer: %s", trailer)
 
 	if len(parser.xrefs) == 0 {
-		return nil, fmt.Errorf("Empty XREF table - Invalid")
+		return nil, newSyntaxError("Empty XREF table - Invalid")
 	}
 
 	majorVersion, minorVersion, err := parser.parsePdfVersion()
@@ -1546,6 +1750,9 @@ func NewParser(rs io.ReadSeeker) (*PdfParser, error) {
 // If encrypted, prepares a crypt datastructure which can be used to authenticate and decrypt the document.
 // On failure, an error is returned.
 func (parser *PdfParser) IsEncrypted() (bool, error) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+
 	if parser.crypter != nil {
 		return true, nil
 	}
@@ -1556,7 +1763,7 @@ func (parser *PdfParser) IsEncrypted() (bool, error) {
 		if isEncrypted {
 			common.Log.Trace("Is encrypted!")
 			common.Log.Trace("0: Look up ref %q", encDictRef)
-			encObj, err := parser.LookupByReference(*encDictRef)
+			encObj, err := parser.lookupObject(int(encDictRef.ObjectNumber))
 			common.Log.Trace("1: %q", encObj)
 			if err != nil {
 				return false, err
@@ -1565,17 +1772,18 @@ func (parser *PdfParser) IsEncrypted() (bool, error) {
 			encIndObj, ok := encObj.(*PdfIndirectObject)
 			if !ok {
 				common.Log.Debug("Encryption object not an indirect object")
-				return false, errors.New("Type check error")
+				return false, newEncryptionError("Encrypt", "Type check error")
 			}
 			encDict, ok := encIndObj.PdfObject.(*PdfObjectDictionary)
 
 			common.Log.Trace("2: %q", encDict)
 			if !ok {
-				return false, errors.New("Trailer Encrypt object non dictionary")
+				return false, setErrorObject(newEncryptionError("Encrypt", "Trailer Encrypt object non dictionary"),
+					encIndObj.ObjectNumber, encIndObj.GenerationNumber)
 			}
 			crypter, err := PdfCryptMakeNew(parser, encDict, parser.trailer)
 			if err != nil {
-				return false, err
+				return false, setErrorObject(err, encIndObj.ObjectNumber, encIndObj.GenerationNumber)
 			}
 
 			parser.crypter = &crypter
@@ -1590,6 +1798,9 @@ func (parser *PdfParser) IsEncrypted() (bool, error) {
 // decrypt with an empty password.  Returns true if successful, false otherwise.
 // An error is returned when there is a problem with decrypting.
 func (parser *PdfParser) Decrypt(password []byte) (bool, error) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+
 	// Also build the encryption/decryption key.
 	if parser.crypter == nil {
 		return false, errors.New("Check encryption first")
@@ -1607,6 +1818,33 @@ func (parser *PdfParser) Decrypt(password []byte) (bool, error) {
 	return authenticated, err
 }
 
+// DecryptWithCertificate attempts to decrypt a PDF file encrypted with the public-key security
+// handler, using the certificate and private key of one of the recipients.  Returns true if
+// successful, false if the certificate is not a recipient.
+// An error is returned when there is a problem with decrypting.
+func (parser *PdfParser) DecryptWithCertificate(cert *x509.Certificate, key crypto.PrivateKey) (bool, error) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+
+	if parser.crypter == nil {
+		return false, errors.New("Check encryption first")
+	}
+
+	return parser.crypter.authenticateCertificate(cert, key)
+}
+
+// DuplicateCrypter returns a copy of the crypt handler of the document, to encrypt another file
+// with the same security settings (see PdfCrypt.Duplicate).
+func (parser *PdfParser) DuplicateCrypter(ownerPass []byte) (*PdfCrypt, error) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+
+	if parser.crypter == nil {
+		return nil, errors.New("Document not encrypted")
+	}
+	return parser.crypter.Duplicate(ownerPass)
+}
+
 // CheckAccessRights checks access rights and permissions for a specified password. If either user/owner password is
 // specified, full rights are granted, otherwise the access rights are specified by the Permissions flag.
 //
@@ -1614,6 +1852,9 @@ func (parser *PdfParser) Decrypt(password []byte) (bool, error) {
 // The AccessPermissions shows what access the user has for editing etc.
 // An error is returned if there was a problem performing the authentication.
 func (parser *PdfParser) CheckAccessRights(password []byte) (bool, AccessPermissions, error) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+
 	// Also build the encryption/decryption key.
 	if parser.crypter == nil {
 		// If the crypter is not set, the file is not encrypted and we can assume full access permissions.
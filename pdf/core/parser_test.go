@@ -8,8 +8,9 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
-	//"fmt"
+	"fmt"
 	"io"
 	//"os"
 	"testing"
@@ -681,6 +682,50 @@ func TestObjectParse(t *testing.T) {
 	}
 }
 
+// Test the cancellation of the parsing of a damaged file, where the lookups repair the xref table.
+func TestParserContext(t *testing.T) {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	for i, obj := range objects {
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	// Offsets outside of the file.
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 3\n0000000000 65535 f\r\n0000099999 00000 n\r\n0000099999 00000 n\r\n")
+	fmt.Fprintf(&buf, "trailer\n<< /Size 3 /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+	data := buf.Bytes()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	parser, err := NewParserWithContext(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	obj, err := parser.LookupByNumber(2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if dict, ok := obj.(*PdfIndirectObject).PdfObject.(*PdfObjectDictionary); !ok || dict.Get("Count") == nil {
+		t.Fatalf("Incorrect object %s", obj)
+	}
+
+	parser, err = NewParserWithContext(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cancel()
+	if _, err := parser.LookupByNumber(2); err != context.Canceled {
+		t.Fatalf("Lookup not canceled (%v)", err)
+	}
+	if _, err := NewParserWithContext(ctx, bytes.NewReader(data)); err != context.Canceled {
+		t.Fatalf("Parsing not canceled (%v)", err)
+	}
+}
+
 /*
 var file1 = "../testfiles/minimal.pdf"
 
@@ -796,3 +841,53 @@ func TestMinimalPDFFile(t *testing.T) {
 	}
 }
 */
+
+func TestParserStrict(t *testing.T) {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	for i, obj := range objects {
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	// Offset of object 2 outside of the file.
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 3\n0000000000 65535 f\r\n0000000009 00000 n\r\n0000099999 00000 n\r\n")
+	fmt.Fprintf(&buf, "trailer\n<< /Size 3 /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+	data := buf.Bytes()
+
+	parser, err := NewParser(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(parser.GetDiagnostics()) != 0 {
+		t.Fatalf("Unexpected diagnostics: %v", parser.GetDiagnostics())
+	}
+	if _, err := parser.LookupByNumber(2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	diags := parser.GetDiagnostics()
+	if len(diags) != 1 || diags[0].Offset != 99999 || diags[0].ObjectNumber != 2 || diags[0].Repair == "" {
+		t.Fatalf("Invalid diagnostics: %v", diags)
+	}
+
+	parser, err = NewParserWithOptions(context.Background(), bytes.NewReader(data), &ParserOptions{Strict: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := parser.LookupByNumber(2); err == nil {
+		t.Fatalf("Broken xref table repaired in strict mode")
+	}
+	if len(parser.GetDiagnostics()) != 0 {
+		t.Fatalf("Unexpected diagnostics: %v", parser.GetDiagnostics())
+	}
+
+	// Startxref pointing outside of the file.
+	data = bytes.Replace(data, []byte(fmt.Sprintf("startxref\n%d", xrefOffset)), []byte("startxref\n99999"), 1)
+	_, err = NewParserWithOptions(context.Background(), bytes.NewReader(data), &ParserOptions{Strict: true})
+	if _, ok := err.(*SyntaxError); !ok {
+		t.Fatalf("Invalid startxref not detected (%v)", err)
+	}
+}
@@ -7,6 +7,7 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 
 	"github.com/unidoc/unidoc/common"
@@ -66,6 +67,10 @@ type PdfObjectStream struct {
 	PdfObjectReference
 	*PdfObjectDictionary
 	Stream []byte
+
+	// Decoding limits and context of the parser which loaded the stream, if any.
+	budget *streamBudget
+	ctx    context.Context
 }
 
 // MakeDict creates and returns an empty PdfObjectDictionary.
@@ -82,6 +87,12 @@ func MakeName(s string) *PdfObjectName {
 	return &name
 }
 
+// MakeBool creates a PdfObjectBool from a bool.
+func MakeBool(val bool) *PdfObjectBool {
+	b := PdfObjectBool(val)
+	return &b
+}
+
 // MakeInteger creates a PdfObjectInteger from an int64.
 func MakeInteger(val int64) *PdfObjectInteger {
 	num := PdfObjectInteger(val)
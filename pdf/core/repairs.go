@@ -8,7 +8,6 @@
 package core
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"regexp"
@@ -22,6 +21,46 @@ import (
 
 var repairReXrefTable = regexp.MustCompile(`[\r\n]\s*(xref)\s*[\r\n]`)
 
+// Diagnostic describes a problem found in a malformed document and the repair attempted by the
+// parser.
+type Diagnostic struct {
+	ErrorLocation
+	// Problem describes what was broken.
+	Problem string
+	// Repair describes the fix applied.
+	Repair string
+}
+
+func (diag Diagnostic) String() string {
+	return withLocation(fmt.Sprintf("%s: %s", diag.Problem, diag.Repair), diag.ErrorLocation)
+}
+
+// GetDiagnostics returns the problems found in the document and the repairs applied so far, in
+// the order found.  Empty for a well-formed document, and always in strict mode as the parser fails
+// instead of repairing.
+func (parser *PdfParser) GetDiagnostics() []Diagnostic {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+	return append([]Diagnostic(nil), parser.diagnostics...)
+}
+
+// repair is called before applying the repair `repair` to the problem `problem` found at `loc`,
+// which raised `err` if not nil.  In strict mode it returns the error of the problem: `err`, or a
+// *SyntaxError if nil.  Otherwise the problem is recorded in the diagnostics and nil is returned.
+func (parser *PdfParser) repair(loc ErrorLocation, problem string, err error, repair string) error {
+	if parser.strict {
+		common.Log.Debug("ERROR: %s (not repaired in strict mode)", problem)
+		if err != nil {
+			return err
+		}
+		return &SyntaxError{ErrorLocation: loc, Msg: problem}
+	}
+	diag := Diagnostic{ErrorLocation: loc, Problem: problem, Repair: repair}
+	common.Log.Debug("Repair: %s", diag)
+	parser.diagnostics = append(parser.diagnostics, diag)
+	return nil
+}
+
 // Locates a standard Xref table by looking for the "xref" entry.
 // Xref object stream not supported.
 func (parser *PdfParser) repairLocateXref() (int64, error) {
@@ -38,7 +77,7 @@ func (parser *PdfParser) repairLocateXref() (int64, error) {
 	results := repairReXrefTable.FindAllStringIndex(string(b2), -1)
 	if len(results) < 1 {
 		common.Log.Debug("ERROR: Repair: xref not found!")
-		return 0, errors.New("Repair: xref not found")
+		return 0, newSyntaxError("Repair: xref not found")
 	}
 
 	localOffset := int64(results[len(results)-1][0])
@@ -56,6 +95,10 @@ func (parser *PdfParser) rebuildXrefTable() error {
 		if err != nil {
 			common.Log.Debug("ERROR: Unable to look up object (%s)", err)
 			common.Log.Debug("ERROR: Xref table completely broken - attempting to repair ")
+			loc := ErrorLocation{Offset: xref.offset, ObjectNumber: int64(objNum), GenerationNumber: int64(xref.generation)}
+			if err := parser.repair(loc, err.Error(), err, "Rebuilt xref table top down"); err != nil {
+				return err
+			}
 			xrefTable, err := parser.repairRebuildXrefsTopDown()
 			if err != nil {
 				common.Log.Debug("ERROR: Failed xref rebuild repair (%s)", err)
@@ -85,7 +128,7 @@ func (parser *PdfParser) rebuildXrefTable() error {
 func parseObjectNumberFromString(str string) (int, int, error) {
 	result := reIndirectObject.FindStringSubmatch(str)
 	if len(result) < 3 {
-		return 0, 0, errors.New("Unable to detect indirect object signature")
+		return 0, 0, newSyntaxError("Unable to detect indirect object signature")
 	}
 
 	on, _ := strconv.Atoi(result[1])
@@ -100,7 +143,7 @@ func parseObjectNumberFromString(str string) (int, int, error) {
 func (parser *PdfParser) repairRebuildXrefsTopDown() (*XrefTable, error) {
 	if parser.repairsAttempted {
 		// Avoid multiple repairs (only try once).
-		return nil, fmt.Errorf("Repair failed")
+		return nil, newSyntaxError("Repair failed")
 	}
 	parser.repairsAttempted = true
 
@@ -113,7 +156,12 @@ func (parser *PdfParser) repairRebuildXrefsTopDown() (*XrefTable, error) {
 	last := make([]byte, bufLen)
 
 	xrefTable := XrefTable{}
-	for {
+	for n := 0; ; n++ {
+		if n%contextCheckInterval == 0 {
+			if err := contextErr(parser.ctx); err != nil {
+				return nil, err
+			}
+		}
 		b, err := parser.reader.ReadByte()
 		if err != nil {
 			if err == io.EOF {
@@ -175,6 +223,9 @@ func (parser *PdfParser) repairRebuildXrefsTopDown() (*XrefTable, error) {
 				xrefEntry.generation = int(genNum)
 				xrefEntry.offset = objOffset
 				xrefTable[objNum] = xrefEntry
+				if err := parser.checkObjectCount(len(xrefTable)); err != nil {
+					return nil, err
+				}
 			}
 		}
 
@@ -201,6 +252,9 @@ func (parser *PdfParser) repairSeekXrefMarker() error {
 	var buflen int64 = 1000
 
 	for offset < fSize {
+		if err := contextErr(parser.ctx); err != nil {
+			return err
+		}
 		if fSize <= (buflen + offset) {
 			buflen = fSize - offset
 		}
@@ -245,7 +299,7 @@ func (parser *PdfParser) repairSeekXrefMarker() error {
 	}
 
 	common.Log.Debug("Error: Xref table marker was not found.")
-	return errors.New("xref not found ")
+	return newSyntaxError("xref not found ")
 }
 
 // Called when Pdf version not found normally.  Looks for the PDF version by scanning top-down.
@@ -282,5 +336,5 @@ func (parser *PdfParser) seekPdfVersionTopDown() (int, int, error) {
 		last = append(last[1:bufLen], b)
 	}
 
-	return 0, 0, errors.New("Version not found")
+	return 0, 0, newSyntaxError("Version not found")
 }
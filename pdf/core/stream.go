@@ -6,7 +6,7 @@
 package core
 
 import (
-	"fmt"
+	"context"
 
 	"github.com/unidoc/unidoc/common"
 )
@@ -29,7 +29,8 @@ func NewEncoderFromStream(streamObj *PdfObjectStream) (StreamEncoder, error) {
 	if !ok {
 		array, ok := filterObj.(*PdfObjectArray)
 		if !ok {
-			return nil, fmt.Errorf("Filter not a Name or Array object")
+			err := newKeyError("Filter", "Filter not a Name or Array object")
+			return nil, setErrorObject(err, streamObj.ObjectNumber, streamObj.GenerationNumber)
 		}
 		if len(*array) == 0 {
 			// Empty array -> indicates raw filter (no filter).
@@ -51,7 +52,8 @@ func NewEncoderFromStream(streamObj *PdfObjectStream) (StreamEncoder, error) {
 		filterObj = (*array)[0]
 		method, ok = filterObj.(*PdfObjectName)
 		if !ok {
-			return nil, fmt.Errorf("Filter array member not a Name object")
+			err := newKeyError("Filter", "Filter array member not a Name object")
+			return nil, setErrorObject(err, streamObj.ObjectNumber, streamObj.GenerationNumber)
 		}
 	}
 
@@ -68,20 +70,38 @@ func NewEncoderFromStream(streamObj *PdfObjectStream) (StreamEncoder, error) {
 	} else if *method == StreamEncodingFilterNameASCII85 || *method == "A85" {
 		return NewASCII85Encoder(), nil
 	} else if *method == StreamEncodingFilterNameCCITTFax {
-		return NewCCITTFaxEncoder(), nil
+		return newCCITTFaxEncoderFromStream(streamObj, nil)
 	} else if *method == StreamEncodingFilterNameJBIG2 {
-		return NewJBIG2Encoder(), nil
+		return newJBIG2EncoderFromStream(streamObj, nil)
 	} else if *method == StreamEncodingFilterNameJPX {
-		return NewJPXEncoder(), nil
+		return newJPXEncoderFromStream(streamObj)
 	} else {
 		common.Log.Debug("ERROR: Unsupported encoding method!")
-		return nil, fmt.Errorf("Unsupported encoding method (%s)", *method)
+		err := newUnsupportedError(string(*method), "Unsupported encoding method (%s)", *method)
+		err.Key = "Filter"
+		return nil, setErrorObject(err, streamObj.ObjectNumber, streamObj.GenerationNumber)
 	}
 }
 
 // DecodeStream decodes the stream data and returns the decoded data.
 // An error is returned upon failure.
+// The decoding of streams loaded by a parser is subject to the limits and the context of the
+// parser, see ParserLimits and NewParserWithContext.
 func DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
+	return decodeStream(nil, streamObj)
+}
+
+// DecodeStreamContext decodes the stream data like DecodeStream, and stops with the error of `ctx`
+// once canceled or past its deadline.
+func DecodeStreamContext(ctx context.Context, streamObj *PdfObjectStream) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return decodeStream(ctx, streamObj)
+}
+
+// decodeStream decodes the stream data, checking `ctx` for cancellation if not nil.
+func decodeStream(ctx context.Context, streamObj *PdfObjectStream) ([]byte, error) {
 	common.Log.Trace("Decode stream")
 
 	encoder, err := NewEncoderFromStream(streamObj)
@@ -90,14 +110,62 @@ func DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
 		return nil, err
 	}
 	common.Log.Trace("Encoder: %#v\n", encoder)
+	decoded, _, err := decodeStreamWith(ctx, encoder, streamObj, func() ([]byte, []byte, error) {
+		decoded, err := encoder.DecodeStream(streamObj)
+		return decoded, nil, err
+	})
+	return decoded, err
+}
 
-	decoded, err := encoder.DecodeStream(streamObj)
+// decodeStreamWith decodes the data of `streamObj` with `decode`, after setting up `encoder` with
+// the limits of the stream and `ctx`, or the context of the stream if nil.  The second slice
+// returned by `decode`, if any, is decoded data accounted for in the limits too.
+func decodeStreamWith(ctx context.Context, encoder StreamEncoder, streamObj *PdfObjectStream,
+	decode func() ([]byte, []byte, error)) ([]byte, []byte, error) {
+	if ctx == nil {
+		ctx = streamObj.ctx
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, nil, err
+	}
+	setDecodeContext(encoder, ctx)
+	budget := streamObj.budget
+	if budget != nil {
+		max, limit := budget.streamLimit()
+		setDecodeLimit(encoder, max, limit)
+	}
+
+	decoded, extra, err := decode()
 	if err != nil {
 		common.Log.Debug("Stream decoding failed: %v", err)
-		return nil, err
+		if unsupported, ok := err.(*UnsupportedError); ok && unsupported.Filter == "" {
+			unsupported.Filter = encoder.GetFilterName()
+		}
+		err = wrapDecodeError(encoder, err)
+		return nil, nil, setErrorObject(err, streamObj.ObjectNumber, streamObj.GenerationNumber)
+	}
+	if budget != nil {
+		if err := budget.add(int64(len(decoded) + len(extra))); err != nil {
+			common.Log.Debug("Stream decoding failed: %v", err)
+			return nil, nil, err
+		}
 	}
 
-	return decoded, nil
+	return decoded, extra, nil
+}
+
+// wrapDecodeError returns the error `err` of the image decoders in a *DecodeError, other errors
+// as is.  The errors of the package, the limits and the context are not wrapped.
+func wrapDecodeError(encoder StreamEncoder, err error) error {
+	switch encoder.(type) {
+	case *CCITTFaxEncoder, *JBIG2Encoder, *JPXEncoder:
+		if _, isLimit := err.(*LimitError); isLimit || errorLocation(err) != nil ||
+			err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		return newDecodeError(encoder.GetFilterName(), err)
+	}
+	return err
 }
 
 // EncodeStream encodes the stream data using the encoded specified by the stream's dictionary.
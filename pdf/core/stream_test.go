@@ -8,6 +8,7 @@ package core
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"fmt"
 	"testing"
 
@@ -175,3 +176,47 @@ endobj`
 	}
 
 }
+
+// Test decoding streams with a context.
+func TestDecodeStreamContext(t *testing.T) {
+	rawStream := bytes.Repeat([]byte("0123456789"), 10000)
+
+	lzw := NewLZWEncoder()
+	lzw.EarlyChange = 0
+	multi := NewMultiEncoder()
+	multi.AddEncoder(NewASCIIHexEncoder())
+	multi.AddEncoder(NewFlateEncoder())
+	for _, encoder := range []StreamEncoder{NewFlateEncoder(), lzw, multi} {
+		streamObj, err := MakeStream(rawStream, encoder)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if encoder == multi {
+			streamObj.Set("Filter", MakeArray(MakeName("ASCIIHexDecode"), MakeName("FlateDecode")))
+		}
+
+		decoded, err := DecodeStreamContext(context.Background(), streamObj)
+		if err != nil {
+			t.Fatalf("%s: error: %v", encoder.GetFilterName(), err)
+		}
+		if !compareSlices(decoded, rawStream) {
+			t.Fatalf("%s: incorrect decoded data", encoder.GetFilterName())
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := DecodeStreamContext(ctx, streamObj); err != context.Canceled {
+			t.Fatalf("%s: decoding not canceled (%v)", encoder.GetFilterName(), err)
+		}
+
+		// Canceled while decoding.
+		encoder, err := NewEncoderFromStream(streamObj)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		setDecodeContext(encoder, ctx)
+		if _, err := encoder.DecodeBytes(streamObj.Stream); err != context.Canceled {
+			t.Fatalf("%s: decoding not canceled (%v)", encoder.GetFilterName(), err)
+		}
+	}
+}
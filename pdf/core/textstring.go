@@ -0,0 +1,128 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Text strings (Section 7.9.2.2) are encoded in PDFDocEncoding, or in UTF-16BE with a byte order
+// mark.  PDFDocEncoding matches Latin-1, except for the codes below.
+var pdfDocEncodingRunes = map[byte]rune{
+	0x18: '˘', // breve
+	0x19: 'ˇ', // caron
+	0x1a: 'ˆ', // circumflex
+	0x1b: '˙', // dotaccent
+	0x1c: '˝', // hungarumlaut
+	0x1d: '˛', // ogonek
+	0x1e: '˚', // ring
+	0x1f: '˜', // tilde
+	0x80: '•', // bullet
+	0x81: '†', // dagger
+	0x82: '‡', // daggerdbl
+	0x83: '…', // ellipsis
+	0x84: '—', // emdash
+	0x85: '–', // endash
+	0x86: 'ƒ', // florin
+	0x87: '⁄', // fraction
+	0x88: '‹', // guilsinglleft
+	0x89: '›', // guilsinglright
+	0x8a: '−', // minus
+	0x8b: '‰', // perthousand
+	0x8c: '„', // quotedblbase
+	0x8d: '“', // quotedblleft
+	0x8e: '”', // quotedblright
+	0x8f: '‘', // quoteleft
+	0x90: '’', // quoteright
+	0x91: '‚', // quotesinglbase
+	0x92: '™', // trademark
+	0x93: 'ﬁ', // fi
+	0x94: 'ﬂ', // fl
+	0x95: 'Ł', // Lslash
+	0x96: 'Œ', // OE
+	0x97: 'Š', // Scaron
+	0x98: 'Ÿ', // Ydieresis
+	0x99: 'Ž', // Zcaron
+	0x9a: 'ı', // dotlessi
+	0x9b: 'ł', // lslash
+	0x9c: 'œ', // oe
+	0x9d: 'š', // scaron
+	0x9e: 'ž', // zcaron
+	0xa0: '€', // Euro
+}
+
+// pdfDocEncodingCodes maps the runes of pdfDocEncodingRunes back to their codes.
+var pdfDocEncodingCodes = map[rune]byte{}
+
+func init() {
+	for code, r := range pdfDocEncodingRunes {
+		pdfDocEncodingCodes[r] = code
+	}
+}
+
+// pdfDocEncode returns `s` encoded in PDFDocEncoding, and false if any character cannot be encoded.
+func pdfDocEncode(s string) ([]byte, bool) {
+	encoded := make([]byte, 0, len(s))
+	for _, r := range s {
+		if code, has := pdfDocEncodingCodes[r]; has {
+			encoded = append(encoded, code)
+			continue
+		}
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+		case r >= 0x20 && r < 0x7f:
+		case r >= 0xa1 && r <= 0xff && r != 0xad:
+		default:
+			// Undefined in PDFDocEncoding.
+			return nil, false
+		}
+		encoded = append(encoded, byte(r))
+	}
+	return encoded, true
+}
+
+// MakeTextString creates a PdfObjectString holding the text string `s`, encoded in PDFDocEncoding
+// if possible, and in UTF-16BE otherwise.
+func MakeTextString(s string) *PdfObjectString {
+	if encoded, ok := pdfDocEncode(s); ok {
+		return MakeString(string(encoded))
+	}
+
+	encoded := []byte{0xfe, 0xff}
+	for _, v := range utf16.Encode([]rune(s)) {
+		encoded = append(encoded, byte(v>>8), byte(v))
+	}
+	return MakeString(string(encoded))
+}
+
+// Decoded returns the value of the text string `str`, decoded from UTF-16BE or UTF-8 if starting
+// with a byte order mark, and from PDFDocEncoding otherwise.
+func (str *PdfObjectString) Decoded() string {
+	b := []byte(*str)
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		b = b[2:]
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		return string(utf16.Decode(units))
+	}
+	if len(b) >= 3 && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf && utf8.Valid(b[3:]) {
+		// UTF-8 (PDF 2.0).
+		return string(b[3:])
+	}
+
+	runes := make([]rune, len(b))
+	for i, code := range b {
+		if r, has := pdfDocEncodingRunes[code]; has {
+			runes[i] = r
+		} else {
+			runes[i] = rune(code)
+		}
+	}
+	return string(runes)
+}
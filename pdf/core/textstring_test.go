@@ -0,0 +1,36 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"testing"
+)
+
+func TestTextString(t *testing.T) {
+	testcases := []struct {
+		Text    string
+		Encoded string
+	}{
+		{"Hello World", "Hello World"},
+		{"Café – “quoted” €", "Caf\xe9 \x85 \x8dquoted\x8e \xa0"},
+		{"Ελληνικά", "\xfe\xff\x03\x95\x03\xbb\x03\xbb\x03\xb7\x03\xbd\x03\xb9\x03\xba\x03\xac"},
+		{"Emoji \U0001F600", "\xfe\xff\x00E\x00m\x00o\x00j\x00i\x00 \xd8\x3d\xde\x00"},
+	}
+	for _, tcase := range testcases {
+		str := MakeTextString(tcase.Text)
+		if string(*str) != tcase.Encoded {
+			t.Fatalf("%q encoded as %q, expected %q", tcase.Text, string(*str), tcase.Encoded)
+		}
+		if decoded := str.Decoded(); decoded != tcase.Text {
+			t.Fatalf("%q decoded as %q", tcase.Encoded, decoded)
+		}
+	}
+
+	// UTF-8 with a byte order mark.
+	if decoded := MakeString("\xef\xbb\xbfCaf\xc3\xa9").Decoded(); decoded != "Café" {
+		t.Fatalf("UTF-8 decoded as %q", decoded)
+	}
+}
@@ -31,11 +31,16 @@ func checkBounds(sliceLen, a, b int) error {
 
 // Inspect analyzes the document object structure.
 func (parser *PdfParser) Inspect() (map[string]int, error) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
 	return parser.inspect()
 }
 
 // GetObjectNums returns a sorted list of object numbers of the PDF objects in the file.
 func (parser *PdfParser) GetObjectNums() []int {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+
 	objNums := []int{}
 	for _, x := range parser.xrefs {
 		objNums = append(objNums, x.objectNumber)
@@ -48,6 +53,12 @@ func (parser *PdfParser) GetObjectNums() []int {
 	return objNums
 }
 
+// GetXrefTable returns the cross-reference table of the document, with the locations of the
+// current versions of the objects.
+func (parser *PdfParser) GetXrefTable() XrefTable {
+	return parser.xrefs
+}
+
 func getUniDocVersion() string {
 	return common.Version
 }
@@ -80,7 +91,7 @@ func (parser *PdfParser) inspect() (map[string]int, error) {
 		objCount++
 		common.Log.Trace("==========")
 		common.Log.Trace("Looking up object number: %d", xref.objectNumber)
-		o, err := parser.LookupByNumber(xref.objectNumber)
+		o, err := parser.lookupObject(xref.objectNumber)
 		if err != nil {
 			common.Log.Trace("ERROR: Fail to lookup obj %d (%s)", xref.objectNumber, err)
 			failedCount++
@@ -6,6 +6,7 @@
 package creator
 
 import (
+	"context"
 	"errors"
 	"io"
 	"os"
@@ -44,6 +45,15 @@ type Creator struct {
 
 	// Forms.
 	acroForm *model.PdfAcroForm
+
+	// Document information, default if nil.
+	info *model.PdfDocumentInfo
+
+	// XMP metadata of the document, nil if none.
+	xmp *model.XmpMetadata
+
+	// Checked for cancellation while writing, if set.
+	ctx context.Context
 }
 
 // SetForms Add Acroforms to a PDF file.  Sets the specified form for writing.
@@ -52,6 +62,16 @@ func (c *Creator) SetForms(form *model.PdfAcroForm) error {
 	return nil
 }
 
+// SetDocumentInfo sets the document information (title, author, etc.) of the output.
+func (c *Creator) SetDocumentInfo(info *model.PdfDocumentInfo) {
+	c.info = info
+}
+
+// SetXmpMetadata sets the XMP metadata of the output, synchronized with the document information.
+func (c *Creator) SetXmpMetadata(m *model.XmpMetadata) {
+	c.xmp = m
+}
+
 // FrontpageFunctionArgs holds the input arguments to a front page drawing function.
 // It is designed as a struct, so additional parameters can be added in the future with backwards compatibility.
 type FrontpageFunctionArgs struct {
@@ -332,6 +352,9 @@ func (c *Creator) finalize() error {
 		blocks, _, _ := ch.GeneratePageBlocks(c.context)
 		tocpages := []*model.PdfPage{}
 		for _, block := range blocks {
+			if err := c.checkContext(); err != nil {
+				return err
+			}
 			block.SetPos(0, 0)
 			totPages++
 			p := c.newPage()
@@ -353,6 +376,9 @@ func (c *Creator) finalize() error {
 	}
 
 	for idx, page := range c.pages {
+		if err := c.checkContext(); err != nil {
+			return err
+		}
 		c.setActivePage(page)
 		if c.drawHeaderFunc != nil {
 			// Prepare a block to draw on.
@@ -436,6 +462,9 @@ func (c *Creator) Draw(d Drawable) error {
 	}
 
 	for idx, blk := range blocks {
+		if err := c.checkContext(); err != nil {
+			return err
+		}
 		if idx > 0 {
 			c.NewPage()
 		}
@@ -455,13 +484,32 @@ func (c *Creator) Draw(d Drawable) error {
 	return nil
 }
 
-// Write output of creator to io.WriteSeeker interface.
-func (c *Creator) Write(ws io.WriteSeeker) error {
+// Write output of creator to io.Writer interface.
+func (c *Creator) Write(w io.Writer) error {
+	return c.WriteContext(context.Background(), w)
+}
+
+// WriteContext writes the output of the creator like Write, and stops with the error of `ctx` once
+// canceled or past its deadline, including while laying out the headers, footers and table of
+// contents.  The creator should not be used further after cancellation.
+func (c *Creator) WriteContext(ctx context.Context, w io.Writer) error {
+	c.ctx = ctx
+	defer func() { c.ctx = nil }()
+
 	if !c.finalized {
 		c.finalize()
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	pdfWriter := model.NewPdfWriter()
+	if c.info != nil {
+		pdfWriter.SetDocumentInfo(c.info)
+	}
+	if c.xmp != nil {
+		pdfWriter.SetXmpMetadata(c.xmp)
+	}
 	// Form fields.
 	if c.acroForm != nil {
 		errF := pdfWriter.SetForms(c.acroForm)
@@ -481,6 +529,9 @@ func (c *Creator) Write(ws io.WriteSeeker) error {
 	}
 
 	for _, page := range c.pages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		err := pdfWriter.AddPage(page)
 		if err != nil {
 			common.Log.Error("Failed to add Page: %s", err)
@@ -488,7 +539,7 @@ func (c *Creator) Write(ws io.WriteSeeker) error {
 		}
 	}
 
-	err := pdfWriter.Write(ws)
+	err := pdfWriter.WriteContext(ctx, w)
 	if err != nil {
 		return err
 	}
@@ -496,6 +547,14 @@ func (c *Creator) Write(ws io.WriteSeeker) error {
 	return nil
 }
 
+// checkContext returns the error of the context of the creator if canceled, nil otherwise.
+func (c *Creator) checkContext() error {
+	if c.ctx == nil {
+		return nil
+	}
+	return c.ctx.Err()
+}
+
 // SetPdfWriterAccessFunc sets a PdfWriter access function/hook.
 // Exposes the PdfWriter just prior to writing the PDF.  Can be used to encrypt the output PDF, etc.
 //
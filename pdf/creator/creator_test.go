@@ -10,6 +10,8 @@ package creator
 // if every detail is correct.
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	goimage "image"
 	"io/ioutil"
@@ -1339,3 +1341,36 @@ func TestEncrypting1(t *testing.T) {
 		return
 	}
 }
+
+// Test canceling the writing, including the layout of the headers.
+func TestWriteContext(t *testing.T) {
+	c := New()
+	for i := 0; i < 20; i++ {
+		c.NewPage()
+		c.Draw(NewParagraph(fmt.Sprintf("Page %d", i+1)))
+	}
+	headers := 0
+	c.DrawHeader(func(header *Block, args HeaderFunctionArgs) {
+		headers++
+		header.Draw(NewParagraph(fmt.Sprintf("Page %d of %d", args.PageNum, args.TotalPages)))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.WriteContext(ctx, &writeSeekerBuffer{}); err != context.Canceled {
+		t.Fatalf("Writing not canceled (%v)", err)
+	}
+	if headers != 0 {
+		t.Fatalf("Headers laid out after cancellation (%d)", headers)
+	}
+}
+
+// writeSeekerBuffer is an in-memory io.WriteSeeker, which only supports querying the current
+// offset, as done by the writer.
+type writeSeekerBuffer struct {
+	bytes.Buffer
+}
+
+func (buf *writeSeekerBuffer) Seek(offset int64, whence int) (int64, error) {
+	return int64(buf.Len()), nil
+}
@@ -0,0 +1,128 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package ccittfax
+
+import "errors"
+
+var errEndOfData = errors.New("Unexpected end of CCITT data")
+
+// bitReader reads single bits from a byte slice, most significant bit first.
+type bitReader struct {
+	data []byte
+	pos  int // Position in bits.
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+// eof returns true when all bits have been consumed.
+func (r *bitReader) eof() bool {
+	return r.pos >= len(r.data)*8
+}
+
+// readBit returns the next bit.
+func (r *bitReader) readBit() (int, error) {
+	if r.eof() {
+		return 0, errEndOfData
+	}
+	b := (r.data[r.pos>>3] >> uint(7-r.pos&7)) & 1
+	r.pos++
+	return int(b), nil
+}
+
+// align skips to the next byte boundary.
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+// readCode reads bits until a leaf of the decoding tree is reached and returns the leaf value.
+func (r *bitReader) readCode(tree *codeNode) (int, error) {
+	node := tree
+	for !node.leaf {
+		b, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		node = node.children[b]
+		if node == nil {
+			return 0, errors.New("Invalid CCITT code")
+		}
+	}
+	return node.value, nil
+}
+
+// readRun reads a complete run length consisting of zero or more make-up codes followed by a
+// terminating code.
+func (r *bitReader) readRun(tree *codeNode) (int, error) {
+	run := 0
+	for {
+		v, err := r.readCode(tree)
+		if err != nil {
+			return 0, err
+		}
+		run += v
+		if v < 64 {
+			return run, nil
+		}
+	}
+}
+
+// skipEOL checks for an EOL code (at least 11 zero bits followed by a one) at the current position,
+// which also absorbs any fill bits preceding it. If found, the EOL is consumed and true is returned,
+// otherwise the position is left unchanged.
+func (r *bitReader) skipEOL() bool {
+	start := r.pos
+	zeros := 0
+	for !r.eof() {
+		b, _ := r.readBit()
+		if b == 1 {
+			if zeros >= 11 {
+				return true
+			}
+			break
+		}
+		zeros++
+	}
+	r.pos = start
+	return false
+}
+
+// onlyZerosLeft returns true if there are no more one bits in the data, i.e. only padding remains.
+func (r *bitReader) onlyZerosLeft() bool {
+	if r.eof() {
+		return true
+	}
+	i := r.pos >> 3
+	if r.data[i]&(0xff>>uint(r.pos&7)) != 0 {
+		return false
+	}
+	for _, b := range r.data[i+1:] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// seekEOL advances to the start of the next EOL code, if any, for resynchronizing after a damaged
+// row.  Returns false if no EOL was found.
+func (r *bitReader) seekEOL() bool {
+	zeros := 0
+	for !r.eof() {
+		b, _ := r.readBit()
+		if b == 0 {
+			zeros++
+			continue
+		}
+		if zeros >= 11 {
+			r.pos -= zeros + 1
+			return true
+		}
+		zeros = 0
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package ccittfax
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+func init() {
+	common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+}
+
+// packBits converts a string of '0' and '1' characters (spaces ignored) to bytes, padding the last
+// byte with zeros.
+func packBits(bits string) []byte {
+	bits = strings.Replace(bits, " ", "", -1)
+	data := make([]byte, (len(bits)+7)/8)
+	for i, c := range bits {
+		if c == '1' {
+			data[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return data
+}
+
+// Check that all run lengths can be decoded from their codes.
+func TestRunCodes(t *testing.T) {
+	for _, color := range []int{white, black} {
+		terminating, makeup, tree := whiteTerminatingCodes, whiteMakeupCodes, whiteTree
+		if color == black {
+			terminating, makeup, tree = blackTerminatingCodes, blackMakeupCodes, blackTree
+		}
+		for run := 0; run <= maxExtendedRun+63; run++ {
+			code := ""
+			if run >= 64 {
+				m := run / 64
+				if m*64 > maxMakeupRun {
+					code = extendedMakeupCodes[m-maxMakeupRun/64-1]
+				} else {
+					code = makeup[m-1]
+				}
+			}
+			code += terminating[run%64]
+
+			r := newBitReader(packBits(code))
+			got, err := r.readRun(tree)
+			if err != nil {
+				t.Fatalf("Color %d run %d: error %v", color, run, err)
+			}
+			if got != run {
+				t.Fatalf("Color %d run %d: got %d", color, run, got)
+			}
+			if r.pos != len(code) {
+				t.Fatalf("Color %d run %d: consumed %d bits, code has %d", color, run, r.pos, len(code))
+			}
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	testcases := []struct {
+		name     string
+		bits     string
+		params   Params
+		expected []byte
+	}{
+		{
+			// White 3, black 2, white 3.
+			name:     "MH",
+			bits:     "1000 11 1000",
+			params:   Params{Columns: 8, Rows: 1},
+			expected: []byte{0xe7},
+		},
+		{
+			name:     "MH BlackIs1",
+			bits:     "1000 11 1000",
+			params:   Params{Columns: 8, Rows: 1, BlackIs1: true},
+			expected: []byte{0x18},
+		},
+		{
+			// Rows padded with white if data runs out.
+			name:     "MH padded rows",
+			bits:     "1000 11 1000",
+			params:   Params{Columns: 8, Rows: 2},
+			expected: []byte{0xe7, 0xff},
+		},
+		{
+			// Two rows each preceded by EOL with fill bits, followed by RTC.
+			name: "MH EOL",
+			bits: "0000000000001 1000 11 1000 000000000001 00110101 10 1100 " +
+				"000000000001 000000000001 000000000001 000000000001 000000000001 000000000001",
+			params:   Params{Columns: 8, EndOfLine: true},
+			expected: []byte{0xe7, 0x1f},
+		},
+		{
+			name:     "MH byte aligned",
+			bits:     "1000 11 1000 000000 00110101 10 1100",
+			params:   Params{Columns: 8, EncodedByteAlign: true},
+			expected: []byte{0xe7, 0x1f},
+		},
+		{
+			// First row 1D (tag 1), second row 2D (tag 0) identical to the first.
+			name: "MR",
+			bits: "000000000001 1 1000 11 1000 000000000001 0 111 " +
+				"000000000001 1 000000000001 1",
+			params:   Params{Columns: 8, K: 2, EndOfLine: true},
+			expected: []byte{0xe7, 0xe7},
+		},
+		{
+			// Horizontal mode followed by V0, then an identical row and EOFB.
+			name:     "G4",
+			bits:     "001 1000 11 1 111 000000000001 000000000001",
+			params:   Params{Columns: 8, K: -1},
+			expected: []byte{0xe7, 0xe7},
+		},
+		{
+			// Second row: VR1 (white to 4), VR1 (black to 6), V0 (white to 8).
+			name:     "G4 vertical",
+			bits:     "001 1000 11 1 011 011 1 000000000001 000000000001",
+			params:   Params{Columns: 8, K: -1},
+			expected: []byte{0xe7, 0xf3},
+		},
+		{
+			// Second row: pass over the black run of the reference line, V0 (white to 8).
+			name:     "G4 pass",
+			bits:     "001 1000 11 1 0001 1 000000000001 000000000001",
+			params:   Params{Columns: 8, K: -1},
+			expected: []byte{0xe7, 0xff},
+		},
+	}
+
+	for _, tcase := range testcases {
+		decoded, err := Decode(packBits(tcase.bits), tcase.params, nil)
+		if err != nil {
+			t.Errorf("%s: error %v", tcase.name, err)
+			continue
+		}
+		if !bytes.Equal(decoded, tcase.expected) {
+			t.Errorf("%s: got % x, expected % x", tcase.name, decoded, tcase.expected)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	// Extension code (uncompressed mode).
+	_, err := Decode([]byte{0x02}, Params{Columns: 8, K: -1}, nil)
+	if err == nil {
+		t.Errorf("Expected error for invalid data")
+	}
+
+	_, err = Decode([]byte{0xff}, Params{Columns: 0}, nil)
+	if err == nil {
+		t.Errorf("Expected error for invalid columns")
+	}
+
+	// Larger than MaxImageSize, rejected before allocating.
+	for _, params := range []Params{{Columns: 1 << 40, Rows: 1 << 40}, {Columns: 8, Rows: 1 << 40}} {
+		if _, err := Decode([]byte{0xff}, params, nil); err == nil || err == ErrTooLarge {
+			t.Errorf("%d x %d: expected error, got %v", params.Columns, params.Rows, err)
+		}
+	}
+
+	// Canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	encoded, err := Encode(make([]byte, 8), Params{K: -1, Columns: 8, Rows: 8})
+	if err != nil {
+		t.Fatalf("Encode error %v", err)
+	}
+	_, err = Decode(encoded, Params{K: -1, Columns: 8, Rows: 8}, &Options{Context: ctx})
+	if err != context.Canceled {
+		t.Errorf("Expected cancellation, got %v", err)
+	}
+
+	// Larger than MaxSize, with and without known number of rows.
+	for _, rows := range []int{8, 0} {
+		params := Params{K: -1, Columns: 8, Rows: rows, EndOfBlock: true}
+		if _, err := Decode(encoded, params, &Options{MaxSize: 7}); err != ErrTooLarge {
+			t.Errorf("Rows %d: expected ErrTooLarge, got %v", rows, err)
+		}
+		if _, err := Decode(encoded, params, &Options{MaxSize: 8}); err != nil {
+			t.Errorf("Rows %d: error %v", rows, err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	// Same image as the G4 decoding test case.
+	encoded, err := Encode([]byte{0xe7, 0xe7}, Params{K: -1, Columns: 8, EndOfBlock: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := packBits("001 1000 11 1 111 000000000001 000000000001")
+	if !bytes.Equal(encoded, expected) {
+		t.Errorf("Got % x, expected % x", encoded, expected)
+	}
+
+	_, err = Encode([]byte{0xe7}, Params{K: 0, Columns: 8})
+	if err == nil {
+		t.Errorf("Expected error for K >= 0")
+	}
+}
+
+// Check that images survive an encoding and decoding round trip.
+func TestEncodeDecode(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, columns := range []int{1, 7, 8, 13, 64, 1728, 6000} {
+		for _, blackIs1 := range []bool{false, true} {
+			rows := 20
+			rowBytes := (columns + 7) / 8
+			data := make([]byte, rows*rowBytes)
+			for y := 0; y < rows; y++ {
+				// Mix runs of varying lengths, including full rows.
+				x := 0
+				for x < columns {
+					run := 1 + rnd.Intn(columns/(1+y%4)+1)
+					if y%5 == 0 {
+						run = columns
+					}
+					if rnd.Intn(2) == 1 {
+						for i := x; i < x+run && i < columns; i++ {
+							data[y*rowBytes+i/8] |= 0x80 >> uint(i%8)
+						}
+					}
+					x += run
+				}
+				// Padding bits are decoded as white.
+				for i := columns; i < rowBytes*8; i++ {
+					if blackIs1 {
+						data[y*rowBytes+i/8] &^= 0x80 >> uint(i%8)
+					} else {
+						data[y*rowBytes+i/8] |= 0x80 >> uint(i%8)
+					}
+				}
+			}
+
+			params := Params{K: -1, Columns: columns, Rows: rows, EndOfBlock: true, BlackIs1: blackIs1}
+			encoded, err := Encode(data, params)
+			if err != nil {
+				t.Fatalf("Columns %d: encode error %v", columns, err)
+			}
+			decoded, err := Decode(encoded, params, nil)
+			if err != nil {
+				t.Fatalf("Columns %d: decode error %v", columns, err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("Columns %d, BlackIs1 %v: round trip mismatch", columns, blackIs1)
+			}
+
+			// Without Rows the decoder relies on EOFB.
+			params.Rows = 0
+			decoded, err = Decode(encoded, params, nil)
+			if err != nil || !bytes.Equal(decoded, data) {
+				t.Errorf("Columns %d, BlackIs1 %v: round trip without Rows failed (%v)", columns, blackIs1, err)
+			}
+		}
+	}
+}
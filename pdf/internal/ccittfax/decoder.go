@@ -0,0 +1,393 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+// Package ccittfax implements the CCITT Group 3 and Group 4 facsimile compression schemes used by
+// the CCITTFaxDecode filter (ITU-T Recommendations T.4 and T.6).
+package ccittfax
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+// Params represents the CCITTFaxDecode filter parameters (section 7.4.6 Table 11 in the PDF32000
+// specification).
+type Params struct {
+	// K < 0: pure two-dimensional (Group 4), K = 0: pure one-dimensional (Group 3 1-D),
+	// K > 0: mixed one- and two-dimensional (Group 3 2-D).
+	K int
+
+	// Width of the image in pixels.
+	Columns int
+
+	// Height of the image in rows.  0 if not known in advance.
+	Rows int
+
+	// End of line codes are present before each row.
+	EndOfLine bool
+
+	// Each encoded row (or EOL code) starts at a byte boundary.
+	EncodedByteAlign bool
+
+	// Data is terminated by an end of block pattern (EOFB or RTC).
+	EndOfBlock bool
+
+	// 1 bits represent black pixels rather than white.
+	BlackIs1 bool
+
+	// Number of damaged rows tolerated before an error is returned (only if EndOfLine and K >= 0).
+	DamagedRowsBeforeError int
+}
+
+// DefaultParams returns the parameters with default values as defined by the PDF specification.
+func DefaultParams() Params {
+	return Params{
+		Columns:    1728,
+		EndOfBlock: true,
+	}
+}
+
+// MaxImageSize is the maximum size in bytes of the decoded images, beyond which the data is
+// considered invalid.  128 MB is a 32768 x 32768 pixels image, much more than a page scanned at
+// 600 dpi.
+const MaxImageSize = 1 << 27
+
+// ErrTooLarge is returned when the decoded image would exceed the MaxSize option.
+var ErrTooLarge = errors.New("CCITT image too large")
+
+// Options are the decoding options.
+type Options struct {
+	// MaxSize is the maximum size in bytes of the decoded image if positive.  Larger images fail
+	// with ErrTooLarge, before decoding if the number of rows is known.  Images larger than
+	// MaxImageSize are rejected in any case.
+	MaxSize int
+
+	// Context is checked for cancellation between rows if not nil.
+	Context context.Context
+}
+
+// maxSize returns the maximum decoded size of the options `opts`, which can be nil.
+func (opts *Options) maxSize() int {
+	if opts == nil {
+		return 0
+	}
+	return opts.MaxSize
+}
+
+// context returns the context of the options `opts`, which can be nil.
+func (opts *Options) context() context.Context {
+	if opts == nil {
+		return nil
+	}
+	return opts.Context
+}
+
+const (
+	white = 0
+	black = 1
+)
+
+// Decode decodes CCITT encoded `encoded` data with parameters `params` and options `opts`, which
+// can be nil for the defaults.  The output is a 1 bit per pixel image with rows padded to a whole
+// number of bytes.
+func Decode(encoded []byte, params Params, opts *Options) ([]byte, error) {
+	decoded, _, err := DecodeWithLength(encoded, params, opts)
+	return decoded, err
+}
+
+// DecodeWithLength decodes CCITT encoded `encoded` data like Decode and also returns the number of
+// bytes of `encoded` that were consumed, including the end of block pattern if present.
+func DecodeWithLength(encoded []byte, params Params, opts *Options) ([]byte, int, error) {
+	if params.Columns <= 0 || params.Columns > 8*MaxImageSize {
+		return nil, 0, fmt.Errorf("Invalid CCITT columns (%d)", params.Columns)
+	}
+	columns := params.Columns
+	rowBytes := (columns + 7) / 8
+	ctx := opts.context()
+
+	// Maximum number of rows, and the error returned beyond.
+	maxRows := MaxImageSize / rowBytes
+	tooLarge := fmt.Errorf("CCITT image too large (%d columns, more than %d rows)", columns, maxRows)
+	if maxSize := opts.maxSize(); maxSize > 0 && maxSize/rowBytes <= maxRows {
+		maxRows = maxSize / rowBytes
+		tooLarge = ErrTooLarge
+	}
+	if maxRows == 0 || params.Rows > maxRows {
+		common.Log.Debug("CCITT image of %d x %d exceeds %d rows", columns, params.Rows, maxRows)
+		return nil, 0, tooLarge
+	}
+
+	r := newBitReader(encoded)
+	var ref []int // Changing elements on the reference line (all white initially).
+	var rows [][]int
+	damaged := 0
+
+	for params.Rows <= 0 || len(rows) < params.Rows {
+		if ctx != nil {
+			if err := ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+		}
+		if params.K < 0 && params.EncodedByteAlign {
+			r.align()
+		}
+
+		hasEOL := r.skipEOL()
+		if hasEOL && endOfBlock(r, params.K) {
+			break
+		}
+		if !hasEOL && params.EncodedByteAlign && params.K >= 0 {
+			r.align()
+		}
+		if r.onlyZerosLeft() {
+			break
+		}
+
+		twoD := params.K < 0
+		if params.K > 0 {
+			tag, err := r.readBit()
+			if err != nil {
+				break
+			}
+			twoD = tag == 0
+		}
+
+		var changes []int
+		var err error
+		if twoD {
+			changes, err = decodeRow2D(r, ref, columns)
+		} else {
+			changes, err = decodeRow1D(r, columns)
+		}
+		if err != nil {
+			if params.EndOfLine && params.K >= 0 && damaged < params.DamagedRowsBeforeError && r.seekEOL() {
+				// Resynchronize at the next EOL, repeating the previous row for the damaged one.
+				common.Log.Debug("CCITT: damaged row %d (%v), resynchronizing", len(rows), err)
+				damaged++
+				if len(rows) >= maxRows {
+					return nil, 0, tooLarge
+				}
+				rows = append(rows, ref)
+				continue
+			}
+			if params.EndOfLine && params.K >= 0 && params.DamagedRowsBeforeError > 0 {
+				return nil, 0, err
+			}
+			if len(rows) == 0 {
+				return nil, 0, err
+			}
+			common.Log.Debug("CCITT: error decoding row %d (%v) - output truncated", len(rows), err)
+			break
+		}
+
+		if len(rows) >= maxRows {
+			common.Log.Debug("CCITT image exceeds %d rows", maxRows)
+			return nil, 0, tooLarge
+		}
+		rows = append(rows, changes)
+		ref = normalizeChanges(changes, columns)
+	}
+
+	if len(rows) == 0 && params.Rows <= 0 {
+		return nil, 0, errors.New("No CCITT data decoded")
+	}
+	if params.Rows > 0 && len(rows) == params.Rows && params.EndOfBlock {
+		// Consume the end of block pattern following the last row, if any.
+		pos := r.pos
+		if !r.skipEOL() || !endOfBlock(r, params.K) {
+			r.pos = pos
+		}
+	}
+
+	numRows := len(rows)
+	if params.Rows > numRows {
+		numRows = params.Rows
+	}
+	out := make([]byte, numRows*rowBytes)
+	for i := 0; i < numRows; i++ {
+		var changes []int
+		if i < len(rows) {
+			changes = rows[i]
+		}
+		fillRow(out[i*rowBytes:(i+1)*rowBytes], changes, columns, params.BlackIs1)
+	}
+	return out, (r.pos + 7) / 8, nil
+}
+
+// endOfBlock is called after an EOL code has been read and checks whether it is followed by another
+// EOL code (preceded by a tag bit if `k` > 0), marking the end of the data (RTC or EOFB).  If not,
+// the position is left unchanged.
+func endOfBlock(r *bitReader, k int) bool {
+	pos := r.pos
+	if k > 0 {
+		if _, err := r.readBit(); err != nil {
+			return true
+		}
+	}
+	if r.skipEOL() {
+		return true
+	}
+	r.pos = pos
+	return false
+}
+
+// decodeRow1D decodes a one-dimensionally (modified Huffman) coded row and returns the changing
+// elements.
+func decodeRow1D(r *bitReader, columns int) ([]int, error) {
+	var changes []int
+	a0 := 0
+	color := white
+	for a0 < columns {
+		tree := whiteTree
+		if color == black {
+			tree = blackTree
+		}
+		run, err := r.readRun(tree)
+		if err != nil {
+			return nil, err
+		}
+		a0 += run
+		if a0 > columns {
+			a0 = columns
+		}
+		changes = append(changes, a0)
+		color ^= 1
+	}
+	return changes, nil
+}
+
+// decodeRow2D decodes a two-dimensionally coded row relative to the reference line changing
+// elements `ref` and returns the changing elements of the row.
+func decodeRow2D(r *bitReader, ref []int, columns int) ([]int, error) {
+	var changes []int
+	a0 := -1
+	color := white
+	bi := 0
+	for a0 < columns {
+		v, err := r.readCode(modeTree)
+		if err != nil {
+			return nil, err
+		}
+		mode, offset := splitModeValue(v)
+
+		var b1, b2 int
+		b1, b2, bi = findB1B2(ref, a0, color, columns, bi)
+
+		switch mode {
+		case modePass:
+			a0 = b2
+		case modeHorizontal:
+			start := a0
+			if start < 0 {
+				start = 0
+			}
+			tree1, tree2 := whiteTree, blackTree
+			if color == black {
+				tree1, tree2 = blackTree, whiteTree
+			}
+			run1, err := r.readRun(tree1)
+			if err != nil {
+				return nil, err
+			}
+			run2, err := r.readRun(tree2)
+			if err != nil {
+				return nil, err
+			}
+			a1 := minInt(start+run1, columns)
+			a2 := minInt(a1+run2, columns)
+			changes = append(changes, a1, a2)
+			a0 = a2
+		case modeVertical:
+			a1 := b1 + offset
+			if a1 < 0 || a1 > columns || a1 < a0 {
+				return nil, fmt.Errorf("Invalid CCITT vertical mode position (%d)", a1)
+			}
+			changes = append(changes, a1)
+			a0 = a1
+			color ^= 1
+		default:
+			return nil, errors.New("CCITT uncompressed mode not supported")
+		}
+	}
+	return changes, nil
+}
+
+// findB1B2 locates b1, the first changing element on the reference line to the right of `a0` with
+// the opposite color of `color`, and b2, the next changing element after b1.  `bi` is a starting
+// hint for the search which is returned updated for the next call.
+func findB1B2(ref []int, a0, color, columns, bi int) (int, int, int) {
+	for bi > 0 && ref[bi-1] > a0 {
+		bi--
+	}
+	for bi < len(ref) && ref[bi] <= a0 {
+		bi++
+	}
+	// Changes at even indices are white to black, odd indices black to white.
+	i := bi
+	if i%2 != color {
+		i++
+	}
+	b1, b2 := columns, columns
+	if i < len(ref) {
+		b1 = ref[i]
+	}
+	if i+1 < len(ref) {
+		b2 = ref[i+1]
+	}
+	return b1, b2, bi
+}
+
+// normalizeChanges removes empty runs and changes at or beyond the row end from `changes` so that
+// the result can be used as a reference line.
+func normalizeChanges(changes []int, columns int) []int {
+	ref := make([]int, 0, len(changes))
+	for _, c := range changes {
+		if c >= columns {
+			break
+		}
+		if n := len(ref); n > 0 && ref[n-1] == c {
+			ref = ref[:n-1]
+			continue
+		}
+		ref = append(ref, c)
+	}
+	return ref
+}
+
+// fillRow writes the pixels described by changing elements `changes` to `row`.
+func fillRow(row []byte, changes []int, columns int, blackIs1 bool) {
+	fill := byte(0xff)
+	if blackIs1 {
+		fill = 0
+	}
+	for i := range row {
+		row[i] = fill
+	}
+	for i := 0; i < len(changes); i += 2 {
+		start := changes[i]
+		end := columns
+		if i+1 < len(changes) {
+			end = changes[i+1]
+		}
+		for x := start; x < end && x < columns; x++ {
+			mask := byte(0x80) >> uint(x&7)
+			if blackIs1 {
+				row[x>>3] |= mask
+			} else {
+				row[x>>3] &^= mask
+			}
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
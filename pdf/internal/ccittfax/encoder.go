@@ -0,0 +1,161 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package ccittfax
+
+import (
+	"errors"
+	"fmt"
+)
+
+// bitWriter writes bits to a byte slice, most significant bit first.
+type bitWriter struct {
+	data []byte
+	pos  int // Position in bits.
+}
+
+// writeCode writes the bit string `code` consisting of '0' and '1' characters.
+func (w *bitWriter) writeCode(code string) {
+	for i := 0; i < len(code); i++ {
+		if w.pos&7 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if code[i] == '1' {
+			w.data[w.pos>>3] |= 0x80 >> uint(w.pos&7)
+		}
+		w.pos++
+	}
+}
+
+// align pads with zero bits to the next byte boundary.
+func (w *bitWriter) align() {
+	w.pos = (w.pos + 7) &^ 7
+}
+
+// writeRun writes the codes for a run of `run` pixels of color `color`.
+func (w *bitWriter) writeRun(run, color int) {
+	terminating, makeup := whiteTerminatingCodes, whiteMakeupCodes
+	if color == black {
+		terminating, makeup = blackTerminatingCodes, blackMakeupCodes
+	}
+	for run > maxExtendedRun {
+		w.writeCode(extendedMakeupCodes[len(extendedMakeupCodes)-1])
+		run -= maxExtendedRun
+	}
+	if run >= 64 {
+		m := run / 64
+		if m*64 > maxMakeupRun {
+			w.writeCode(extendedMakeupCodes[m-maxMakeupRun/64-1])
+		} else {
+			w.writeCode(makeup[m-1])
+		}
+	}
+	w.writeCode(terminating[run%64])
+}
+
+// verticalCodes are the vertical mode codes indexed by a1-b1+3.
+var verticalCodes = []string{codeVL3, codeVL2, codeVL1, codeV0, codeVR1, codeVR2, codeVR3}
+
+// Encode encodes the 1 bit per pixel image `data` with rows padded to a whole number of bytes.
+// Only pure two-dimensional (Group 4, K < 0) encoding is supported.
+func Encode(data []byte, params Params) ([]byte, error) {
+	if params.K >= 0 {
+		return nil, fmt.Errorf("CCITT encoding with K=%d not supported (only K < 0)", params.K)
+	}
+	if params.Columns <= 0 {
+		return nil, fmt.Errorf("Invalid CCITT columns (%d)", params.Columns)
+	}
+	columns := params.Columns
+	rowBytes := (columns + 7) / 8
+
+	numRows := params.Rows
+	if numRows <= 0 {
+		if len(data)%rowBytes != 0 {
+			return nil, errors.New("Data length not a multiple of the row length")
+		}
+		numRows = len(data) / rowBytes
+	}
+	if len(data) < numRows*rowBytes {
+		return nil, fmt.Errorf("Insufficient data for %d rows (%d < %d)", numRows, len(data), numRows*rowBytes)
+	}
+
+	w := &bitWriter{}
+	var ref []int
+	for i := 0; i < numRows; i++ {
+		if params.EncodedByteAlign {
+			w.align()
+		}
+		changes := rowChanges(data[i*rowBytes:(i+1)*rowBytes], columns, params.BlackIs1)
+		encodeRow2D(w, changes, ref, columns)
+		ref = changes
+	}
+
+	if params.EndOfBlock {
+		w.writeCode(codeEOL)
+		w.writeCode(codeEOL)
+	}
+	return w.data, nil
+}
+
+// rowChanges returns the changing elements of the packed pixel row `row`.
+func rowChanges(row []byte, columns int, blackIs1 bool) []int {
+	var changes []int
+	color := white
+	for x := 0; x < columns; x++ {
+		bit := int(row[x>>3]>>uint(7-x&7)) & 1
+		pixel := black
+		if (bit == 1) != blackIs1 {
+			pixel = white
+		}
+		if pixel != color {
+			changes = append(changes, x)
+			color = pixel
+		}
+	}
+	return changes
+}
+
+// encodeRow2D writes the two-dimensional coding of the row with changing elements `changes`
+// relative to reference line changing elements `ref`.
+func encodeRow2D(w *bitWriter, changes, ref []int, columns int) {
+	a0 := -1
+	color := white
+	ai := 0 // Index of a1 in changes.
+	bi := 0
+	for a0 < columns {
+		for ai < len(changes) && changes[ai] <= a0 {
+			ai++
+		}
+		a1, a2 := columns, columns
+		if ai < len(changes) {
+			a1 = changes[ai]
+		}
+		if ai+1 < len(changes) {
+			a2 = changes[ai+1]
+		}
+
+		var b1, b2 int
+		b1, b2, bi = findB1B2(ref, a0, color, columns, bi)
+
+		switch {
+		case b2 < a1:
+			w.writeCode(codePass)
+			a0 = b2
+		case a1-b1 >= -3 && a1-b1 <= 3:
+			w.writeCode(verticalCodes[a1-b1+3])
+			a0 = a1
+			color ^= 1
+		default:
+			start := a0
+			if start < 0 {
+				start = 0
+			}
+			w.writeCode(codeHorizontal)
+			w.writeRun(a1-start, color)
+			w.writeRun(a2-a1, color^1)
+			a0 = a2
+		}
+	}
+}
@@ -0,0 +1,281 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jbig2
+
+// Arithmetic (MQ) decoder as described in Annex E of ITU-T Recommendation T.88.
+
+// qeEntry is an entry in the probability estimation table (Table E.1).
+type qeEntry struct {
+	qe        uint32
+	nmps      byte
+	nlps      byte
+	switchMPS bool
+}
+
+var qeTable = []qeEntry{
+	{0x5601, 1, 1, true},
+	{0x3401, 2, 6, false},
+	{0x1801, 3, 9, false},
+	{0x0ac1, 4, 12, false},
+	{0x0521, 5, 29, false},
+	{0x0221, 38, 33, false},
+	{0x5601, 7, 6, true},
+	{0x5401, 8, 14, false},
+	{0x4801, 9, 14, false},
+	{0x3801, 10, 14, false},
+	{0x3001, 11, 17, false},
+	{0x2401, 12, 18, false},
+	{0x1c01, 13, 20, false},
+	{0x1601, 29, 21, false},
+	{0x5601, 15, 14, true},
+	{0x5401, 16, 14, false},
+	{0x5101, 17, 15, false},
+	{0x4801, 18, 16, false},
+	{0x3801, 19, 17, false},
+	{0x3401, 20, 18, false},
+	{0x3001, 21, 19, false},
+	{0x2801, 22, 19, false},
+	{0x2401, 23, 20, false},
+	{0x2201, 24, 21, false},
+	{0x1c01, 25, 22, false},
+	{0x1801, 26, 23, false},
+	{0x1601, 27, 24, false},
+	{0x1401, 28, 25, false},
+	{0x1201, 29, 26, false},
+	{0x1101, 30, 27, false},
+	{0x0ac1, 31, 28, false},
+	{0x09c1, 32, 29, false},
+	{0x08a1, 33, 30, false},
+	{0x0521, 34, 31, false},
+	{0x0441, 35, 32, false},
+	{0x02a1, 36, 33, false},
+	{0x0221, 37, 34, false},
+	{0x0141, 38, 35, false},
+	{0x0111, 39, 36, false},
+	{0x0085, 40, 37, false},
+	{0x0049, 41, 38, false},
+	{0x0025, 42, 39, false},
+	{0x0015, 43, 40, false},
+	{0x0009, 44, 41, false},
+	{0x0005, 45, 42, false},
+	{0x0001, 45, 43, false},
+	{0x5601, 46, 46, false},
+}
+
+// arithDecoder is an MQ arithmetic decoder.  Context states are stored by the callers as bytes
+// holding the probability table index shifted left by one, with the MPS value in the low bit.
+type arithDecoder struct {
+	data []byte
+	bp   int
+	c    uint32
+	a    uint32
+	ct   int
+}
+
+// newArithDecoder initializes a decoder for `data` (INITDEC, E.3.5).
+func newArithDecoder(data []byte) *arithDecoder {
+	d := &arithDecoder{data: data}
+	d.c = uint32(d.byteAt(0)) << 16
+	d.byteIn()
+	d.c <<= 7
+	d.ct -= 7
+	d.a = 0x8000
+	return d
+}
+
+// byteAt returns the data byte at `i`, or 0xFF beyond the end of the data.
+func (d *arithDecoder) byteAt(i int) byte {
+	if i < len(d.data) {
+		return d.data[i]
+	}
+	return 0xff
+}
+
+// byteIn reads the next byte of data (BYTEIN, E.3.4).
+func (d *arithDecoder) byteIn() {
+	if d.byteAt(d.bp) == 0xff {
+		if d.byteAt(d.bp+1) > 0x8f {
+			d.c += 0xff00
+			d.ct = 8
+		} else {
+			d.bp++
+			d.c += uint32(d.byteAt(d.bp)) << 9
+			d.ct = 7
+		}
+	} else {
+		d.bp++
+		d.c += uint32(d.byteAt(d.bp)) << 8
+		d.ct = 8
+	}
+}
+
+// decodeBit decodes a single bit using the context state `cx` (DECODE, E.3.2).
+func (d *arithDecoder) decodeBit(cx *byte) int {
+	index := *cx >> 1
+	mps := int(*cx & 1)
+	entry := &qeTable[index]
+	qe := entry.qe
+
+	var bit int
+	d.a -= qe
+	if (d.c >> 16) < qe {
+		// LPS_EXCHANGE.
+		if d.a < qe {
+			bit = mps
+			index = entry.nmps
+		} else {
+			bit = 1 - mps
+			if entry.switchMPS {
+				mps = 1 - mps
+			}
+			index = entry.nlps
+		}
+		d.a = qe
+	} else {
+		d.c -= qe << 16
+		if d.a&0x8000 != 0 {
+			return mps
+		}
+		// MPS_EXCHANGE.
+		if d.a < qe {
+			bit = 1 - mps
+			if entry.switchMPS {
+				mps = 1 - mps
+			}
+			index = entry.nlps
+		} else {
+			bit = mps
+			index = entry.nmps
+		}
+	}
+
+	// RENORMD.
+	for {
+		if d.ct == 0 {
+			d.byteIn()
+		}
+		d.a <<= 1
+		d.c <<= 1
+		d.ct--
+		if d.a&0x8000 != 0 {
+			break
+		}
+	}
+
+	*cx = index<<1 | byte(mps)
+	return bit
+}
+
+// Names of the integer arithmetic decoding procedures (Table A.1).
+const (
+	procIADH  = "IADH"
+	procIADW  = "IADW"
+	procIAEX  = "IAEX"
+	procIAAI  = "IAAI"
+	procIADT  = "IADT"
+	procIAFS  = "IAFS"
+	procIADS  = "IADS"
+	procIAIT  = "IAIT"
+	procIARI  = "IARI"
+	procIARDW = "IARDW"
+	procIARDH = "IARDH"
+	procIARDX = "IARDX"
+	procIARDY = "IARDY"
+)
+
+// decodingContext holds the arithmetic decoder and the context states of a segment.
+type decodingContext struct {
+	decoder *arithDecoder
+	ints    map[string][]byte
+	iaid    []byte
+	gb      []byte // Generic region contexts.
+	gr      []byte // Generic refinement region contexts.
+}
+
+func newDecodingContext(data []byte) *decodingContext {
+	return &decodingContext{
+		decoder: newArithDecoder(data),
+		ints:    map[string][]byte{},
+	}
+}
+
+// genericContexts returns the generic region context states.
+func (dc *decodingContext) genericContexts() []byte {
+	if dc.gb == nil {
+		dc.gb = make([]byte, 1<<16)
+	}
+	return dc.gb
+}
+
+// refinementContexts returns the generic refinement region context states.
+func (dc *decodingContext) refinementContexts() []byte {
+	if dc.gr == nil {
+		dc.gr = make([]byte, 1<<13)
+	}
+	return dc.gr
+}
+
+// decodeInt decodes an integer with procedure `proc` (A.2).  Returns false for OOB.
+func (dc *decodingContext) decodeInt(proc string) (int, bool) {
+	cx, ok := dc.ints[proc]
+	if !ok {
+		cx = make([]byte, 512)
+		dc.ints[proc] = cx
+	}
+	d := dc.decoder
+
+	prev := 1
+	readBits := func(n uint) int {
+		v := 0
+		for i := uint(0); i < n; i++ {
+			bit := d.decodeBit(&cx[prev])
+			if prev < 256 {
+				prev = prev<<1 | bit
+			} else {
+				prev = (prev<<1|bit)&511 | 256
+			}
+			v = v<<1 | bit
+		}
+		return v
+	}
+
+	sign := readBits(1)
+	var v int
+	switch {
+	case readBits(1) == 0:
+		v = readBits(2)
+	case readBits(1) == 0:
+		v = readBits(4) + 4
+	case readBits(1) == 0:
+		v = readBits(6) + 20
+	case readBits(1) == 0:
+		v = readBits(8) + 84
+	case readBits(1) == 0:
+		v = readBits(12) + 340
+	default:
+		v = readBits(32) + 4436
+	}
+
+	if sign == 1 {
+		if v == 0 {
+			return 0, false
+		}
+		return -v, true
+	}
+	return v, true
+}
+
+// decodeIAID decodes a symbol ID of `codeLen` bits (A.3).
+func (dc *decodingContext) decodeIAID(codeLen uint) int {
+	if dc.iaid == nil || len(dc.iaid) < 1<<(codeLen+1) {
+		dc.iaid = make([]byte, 1<<(codeLen+1))
+	}
+	prev := 1
+	for i := uint(0); i < codeLen; i++ {
+		prev = prev<<1 | dc.decoder.decodeBit(&dc.iaid[prev])
+	}
+	return prev - 1<<codeLen
+}
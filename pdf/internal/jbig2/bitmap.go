@@ -0,0 +1,167 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jbig2
+
+import (
+	"fmt"
+)
+
+// Maximum size in bytes of the bitmaps decoded, beyond which the data is considered invalid.
+// 128 MB is a 32768 x 32768 pixels bitmap, much more than a page scanned at 600 dpi.
+const maxBitmapSize = 1 << 27
+
+// Combination operators (7.4.1.5 and 7.4.3.1.1).
+const (
+	opOr = iota
+	opAnd
+	opXor
+	opXnor
+	opReplace
+)
+
+// bitmap is a bilevel image with 1 bits representing black pixels, rows packed most significant
+// bit first and padded to whole bytes.
+type bitmap struct {
+	width  int
+	height int
+	stride int
+	data   []byte
+}
+
+// checkBitmapSize returns an error if a bitmap of `width` x `height` pixels would take more than
+// `max` bytes.
+func checkBitmapSize(width, height, max int) error {
+	if width < 0 || height < 0 {
+		return fmt.Errorf("Invalid JBIG2 bitmap size (%d x %d)", width, height)
+	}
+	stride := (width + 7) / 8
+	if height > 0 && stride > max/height {
+		return fmt.Errorf("JBIG2 bitmap too large (%d x %d)", width, height)
+	}
+	return nil
+}
+
+// newBitmap returns a new bitmap of `width` x `height` white pixels, or an error if larger than
+// maxBitmapSize.
+func newBitmap(width, height int) (*bitmap, error) {
+	if err := checkBitmapSize(width, height, maxBitmapSize); err != nil {
+		return nil, err
+	}
+	stride := (width + 7) / 8
+	return &bitmap{
+		width:  width,
+		height: height,
+		stride: stride,
+		data:   make([]byte, stride*height),
+	}, nil
+}
+
+// getPixel returns the pixel at (x, y), or 0 if outside the bitmap.
+func (b *bitmap) getPixel(x, y int) int {
+	if x < 0 || y < 0 || x >= b.width || y >= b.height {
+		return 0
+	}
+	return int(b.data[y*b.stride+x>>3]>>uint(7-x&7)) & 1
+}
+
+// setPixel sets the pixel at (x, y) to `v`.  Pixels outside the bitmap are ignored.
+func (b *bitmap) setPixel(x, y, v int) {
+	if x < 0 || y < 0 || x >= b.width || y >= b.height {
+		return
+	}
+	mask := byte(0x80) >> uint(x&7)
+	if v != 0 {
+		b.data[y*b.stride+x>>3] |= mask
+	} else {
+		b.data[y*b.stride+x>>3] &^= mask
+	}
+}
+
+// fill sets all pixels to `v`.
+func (b *bitmap) fill(v int) {
+	fill := byte(0)
+	if v != 0 {
+		fill = 0xff
+	}
+	for i := range b.data {
+		b.data[i] = fill
+	}
+}
+
+// copyRow copies row `src` to row `dst`.
+func (b *bitmap) copyRow(dst, src int) {
+	copy(b.data[dst*b.stride:(dst+1)*b.stride], b.data[src*b.stride:(src+1)*b.stride])
+}
+
+// subBitmap returns a copy of the area of `width` x `height` pixels at (x, y).
+func (b *bitmap) subBitmap(x, y, width, height int) (*bitmap, error) {
+	sub, err := newBitmap(width, height)
+	if err != nil {
+		return nil, err
+	}
+	for j := 0; j < height; j++ {
+		for i := 0; i < width; i++ {
+			if b.getPixel(x+i, y+j) != 0 {
+				sub.setPixel(i, j, 1)
+			}
+		}
+	}
+	return sub, nil
+}
+
+// combine draws `src` onto the bitmap at (x, y) with combination operator `op`.
+func (b *bitmap) combine(src *bitmap, x, y, op int) {
+	for j := 0; j < src.height; j++ {
+		dy := y + j
+		if dy < 0 || dy >= b.height {
+			continue
+		}
+		for i := 0; i < src.width; i++ {
+			dx := x + i
+			if dx < 0 || dx >= b.width {
+				continue
+			}
+			s := src.getPixel(i, j)
+			switch op {
+			case opOr:
+				if s != 0 {
+					b.setPixel(dx, dy, 1)
+				}
+			case opAnd:
+				if s == 0 {
+					b.setPixel(dx, dy, 0)
+				}
+			case opXor:
+				b.setPixel(dx, dy, b.getPixel(dx, dy)^s)
+			case opXnor:
+				b.setPixel(dx, dy, 1-(b.getPixel(dx, dy)^s))
+			default:
+				b.setPixel(dx, dy, s)
+			}
+		}
+	}
+}
+
+// grow extends the bitmap height to `height` rows filled with `defaultPixel`, up to `max` bytes.
+func (b *bitmap) grow(height, defaultPixel, max int) error {
+	if height <= b.height {
+		return nil
+	}
+	if err := checkBitmapSize(b.width, height, max); err != nil {
+		return err
+	}
+	fill := byte(0)
+	if defaultPixel != 0 {
+		fill = 0xff
+	}
+	extra := make([]byte, (height-b.height)*b.stride)
+	for i := range extra {
+		extra[i] = fill
+	}
+	b.data = append(b.data, extra...)
+	b.height = height
+	return nil
+}
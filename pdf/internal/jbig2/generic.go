@@ -0,0 +1,221 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jbig2
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/unidoc/unidoc/pdf/internal/ccittfax"
+)
+
+// atPixel is an adaptive template pixel position relative to the pixel being decoded.
+type atPixel struct {
+	x int
+	y int
+}
+
+// genericParams are the parameters of the generic region decoding procedure (6.2.2).
+type genericParams struct {
+	mmr      bool
+	width    int
+	height   int
+	template int
+	tpgdon   bool
+	skip     *bitmap // USESKIP if not nil.
+	at       []atPixel
+	ctx      context.Context // Checked for cancellation between rows if not nil.
+}
+
+// Contexts used for decoding SLTP with typical prediction, for each template (6.2.5.7).
+var sltpContexts = []int{0x9b25, 0x0795, 0x00e5, 0x0195}
+
+// contextErr returns the error of `ctx` if canceled or past its deadline, nil otherwise or if
+// `ctx` is nil.
+func contextErr(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// decodeMMR decodes an MMR coded bitmap of `width` x `height` pixels from `data`, checking `ctx`
+// for cancellation if not nil.  Returns the bitmap and the number of bytes consumed.
+func decodeMMR(data []byte, width, height int, endOfBlock bool, ctx context.Context) (*bitmap, int, error) {
+	bm, err := newBitmap(width, height)
+	if err != nil {
+		return nil, 0, err
+	}
+	params := ccittfax.Params{
+		K:          -1,
+		Columns:    width,
+		Rows:       height,
+		EndOfBlock: endOfBlock,
+		BlackIs1:   true,
+	}
+	decoded, n, err := ccittfax.DecodeWithLength(data, params, &ccittfax.Options{Context: ctx})
+	if err != nil {
+		return nil, 0, err
+	}
+	copy(bm.data, decoded)
+	return bm, n, nil
+}
+
+// decodeGeneric decodes an arithmetic coded generic region (6.2.5).
+func decodeGeneric(dc *decodingContext, p *genericParams) (*bitmap, error) {
+	if p.template < 0 || p.template > 3 {
+		return nil, fmt.Errorf("Invalid JBIG2 generic region template (%d)", p.template)
+	}
+	if (p.template == 0 && len(p.at) < 4) || len(p.at) < 1 {
+		return nil, fmt.Errorf("Missing JBIG2 adaptive template pixels")
+	}
+
+	bm, err := newBitmap(p.width, p.height)
+	if err != nil {
+		return nil, err
+	}
+	cx := dc.genericContexts()
+	d := dc.decoder
+	ltp := 0
+	for y := 0; y < p.height; y++ {
+		if err := contextErr(p.ctx); err != nil {
+			return nil, err
+		}
+		if p.tpgdon {
+			ltp ^= d.decodeBit(&cx[sltpContexts[p.template]])
+			if ltp == 1 {
+				if y > 0 {
+					bm.copyRow(y, y-1)
+				}
+				continue
+			}
+		}
+		for x := 0; x < p.width; x++ {
+			if p.skip != nil && p.skip.getPixel(x, y) != 0 {
+				continue
+			}
+			ctx := genericContext(bm, x, y, p.template, p.at)
+			if d.decodeBit(&cx[ctx]) != 0 {
+				bm.setPixel(x, y, 1)
+			}
+		}
+	}
+	return bm, nil
+}
+
+// genericContext forms the context of pixel (x, y) for generic region template `template`
+// (6.2.5.3 Figures 3 - 6).
+func genericContext(bm *bitmap, x, y, template int, at []atPixel) int {
+	p := bm.getPixel
+	switch template {
+	case 0:
+		return p(x-1, y) | p(x-2, y)<<1 | p(x-3, y)<<2 | p(x-4, y)<<3 |
+			p(x+at[0].x, y+at[0].y)<<4 |
+			p(x+2, y-1)<<5 | p(x+1, y-1)<<6 | p(x, y-1)<<7 | p(x-1, y-1)<<8 | p(x-2, y-1)<<9 |
+			p(x+at[1].x, y+at[1].y)<<10 | p(x+at[2].x, y+at[2].y)<<11 |
+			p(x+1, y-2)<<12 | p(x, y-2)<<13 | p(x-1, y-2)<<14 |
+			p(x+at[3].x, y+at[3].y)<<15
+	case 1:
+		return p(x-1, y) | p(x-2, y)<<1 | p(x-3, y)<<2 |
+			p(x+at[0].x, y+at[0].y)<<3 |
+			p(x+2, y-1)<<4 | p(x+1, y-1)<<5 | p(x, y-1)<<6 | p(x-1, y-1)<<7 | p(x-2, y-1)<<8 |
+			p(x+2, y-2)<<9 | p(x+1, y-2)<<10 | p(x, y-2)<<11 | p(x-1, y-2)<<12
+	case 2:
+		return p(x-1, y) | p(x-2, y)<<1 |
+			p(x+at[0].x, y+at[0].y)<<2 |
+			p(x+1, y-1)<<3 | p(x, y-1)<<4 | p(x-1, y-1)<<5 | p(x-2, y-1)<<6 |
+			p(x+1, y-2)<<7 | p(x, y-2)<<8 | p(x-1, y-2)<<9
+	default:
+		return p(x-1, y) | p(x-2, y)<<1 | p(x-3, y)<<2 | p(x-4, y)<<3 |
+			p(x+at[0].x, y+at[0].y)<<4 |
+			p(x+1, y-1)<<5 | p(x, y-1)<<6 | p(x-1, y-1)<<7 | p(x-2, y-1)<<8 | p(x-3, y-1)<<9
+	}
+}
+
+// refinementParams are the parameters of the generic refinement region decoding procedure (6.3.2).
+type refinementParams struct {
+	width     int
+	height    int
+	template  int
+	reference *bitmap
+	dx        int
+	dy        int
+	tpgron    bool
+	at        []atPixel
+	ctx       context.Context // Checked for cancellation between rows if not nil.
+}
+
+// Contexts used for decoding SLTP with typical prediction, for each refinement template.  Only
+// the reference pixel corresponding to the pixel being decoded is set (6.3.5.6).
+var refinementSltpContexts = []int{0x100, 0x080}
+
+// decodeRefinement decodes a generic refinement region (6.3.5).
+func decodeRefinement(dc *decodingContext, p *refinementParams) (*bitmap, error) {
+	if p.template < 0 || p.template > 1 {
+		return nil, fmt.Errorf("Invalid JBIG2 refinement template (%d)", p.template)
+	}
+	if p.template == 0 && len(p.at) < 2 {
+		return nil, fmt.Errorf("Missing JBIG2 refinement adaptive template pixels")
+	}
+
+	bm, err := newBitmap(p.width, p.height)
+	if err != nil {
+		return nil, err
+	}
+	cx := dc.refinementContexts()
+	d := dc.decoder
+	ref := p.reference
+	ltp := 0
+	for y := 0; y < p.height; y++ {
+		if err := contextErr(p.ctx); err != nil {
+			return nil, err
+		}
+		if p.tpgron {
+			ltp ^= d.decodeBit(&cx[refinementSltpContexts[p.template]])
+		}
+		for x := 0; x < p.width; x++ {
+			rx, ry := x-p.dx, y-p.dy
+			if ltp == 1 {
+				// Typical prediction: use the reference value if its 3x3 neighbourhood is uniform.
+				v := ref.getPixel(rx, ry)
+				uniform := true
+				for j := -1; j <= 1 && uniform; j++ {
+					for i := -1; i <= 1; i++ {
+						if ref.getPixel(rx+i, ry+j) != v {
+							uniform = false
+							break
+						}
+					}
+				}
+				if uniform {
+					bm.setPixel(x, y, v)
+					continue
+				}
+			}
+			ctx := refinementContext(bm, ref, x, y, rx, ry, p.template, p.at)
+			if d.decodeBit(&cx[ctx]) != 0 {
+				bm.setPixel(x, y, 1)
+			}
+		}
+	}
+	return bm, nil
+}
+
+// refinementContext forms the context of pixel (x, y) with corresponding reference pixel (rx, ry)
+// for refinement template `template` (6.3.5.3 Figures 12 and 13).
+func refinementContext(bm, ref *bitmap, x, y, rx, ry, template int, at []atPixel) int {
+	p := bm.getPixel
+	r := ref.getPixel
+	if template == 0 {
+		return p(x-1, y) | p(x+1, y-1)<<1 | p(x, y-1)<<2 | p(x+at[0].x, y+at[0].y)<<3 |
+			r(rx+1, ry+1)<<4 | r(rx, ry+1)<<5 | r(rx-1, ry+1)<<6 |
+			r(rx+1, ry)<<7 | r(rx, ry)<<8 | r(rx-1, ry)<<9 |
+			r(rx+1, ry-1)<<10 | r(rx, ry-1)<<11 | r(rx+at[1].x, ry+at[1].y)<<12
+	}
+	return p(x-1, y) | p(x+1, y-1)<<1 | p(x, y-1)<<2 | p(x-1, y-1)<<3 |
+		r(rx+1, ry+1)<<4 | r(rx, ry+1)<<5 | r(rx+1, ry)<<6 | r(rx, ry)<<7 | r(rx-1, ry)<<8 |
+		r(rx, ry-1)<<9
+}
@@ -0,0 +1,188 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jbig2
+
+import (
+	"errors"
+)
+
+// patternDictParams are the parameters of the pattern dictionary decoding procedure (6.7.2).
+type patternDictParams struct {
+	mmr      bool
+	width    int
+	height   int
+	grayMax  int
+	template int
+}
+
+// Maximum number of cells of a halftone grid, each one taking an int for its gray value.
+const maxGridCells = maxBitmapSize / 8
+
+// decodePatternDict decodes a pattern dictionary (6.7.5) from `data`.
+func decodePatternDict(data []byte, p *patternDictParams) ([]*bitmap, error) {
+	if p.width <= 0 || p.height <= 0 || p.grayMax < 0 {
+		return nil, errors.New("Invalid JBIG2 pattern dictionary")
+	}
+	width := (p.grayMax + 1) * p.width
+
+	var collective *bitmap
+	var err error
+	if p.mmr {
+		collective, _, err = decodeMMR(data, width, p.height, false, nil)
+	} else {
+		gp := &genericParams{
+			width:    width,
+			height:   p.height,
+			template: p.template,
+			at:       []atPixel{{-p.width, 0}, {-3, -1}, {2, -2}, {-2, -2}},
+		}
+		collective, err = decodeGeneric(newDecodingContext(data), gp)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := make([]*bitmap, p.grayMax+1)
+	for i := range patterns {
+		patterns[i], err = collective.subBitmap(i*p.width, 0, p.width, p.height)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return patterns, nil
+}
+
+// halftoneParams are the parameters of the halftone region decoding procedure (6.6.2).
+type halftoneParams struct {
+	width      int
+	height     int
+	mmr        bool
+	template   int
+	enableSkip bool
+	combOp     int
+	defPixel   int
+	gridWidth  int
+	gridHeight int
+	gridX      int
+	gridY      int
+	regionX    int
+	regionY    int
+	patterns   []*bitmap
+}
+
+// decodeHalftone decodes a halftone region (6.6.5) from `data`.
+func decodeHalftone(data []byte, p *halftoneParams) (*bitmap, error) {
+	if len(p.patterns) == 0 {
+		return nil, errors.New("No JBIG2 halftone patterns")
+	}
+	bm, err := newBitmap(p.width, p.height)
+	if err != nil {
+		return nil, err
+	}
+	bm.fill(p.defPixel)
+
+	pw, ph := p.patterns[0].width, p.patterns[0].height
+	gridPos := func(mg, ng int) (int, int) {
+		x := (p.gridX + mg*p.regionY + ng*p.regionX) >> 8
+		y := (p.gridY + mg*p.regionX - ng*p.regionY) >> 8
+		return x, y
+	}
+
+	var skip *bitmap
+	if p.enableSkip {
+		skip, err = newBitmap(p.gridWidth, p.gridHeight)
+		if err != nil {
+			return nil, err
+		}
+		for mg := 0; mg < p.gridHeight; mg++ {
+			for ng := 0; ng < p.gridWidth; ng++ {
+				x, y := gridPos(mg, ng)
+				if x+pw <= 0 || x >= p.width || y+ph <= 0 || y >= p.height {
+					skip.setPixel(ng, mg, 1)
+				}
+			}
+		}
+	}
+
+	bpp := ceilLog2(len(p.patterns))
+	grays, err := decodeGrayScale(data, p, bpp, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	for mg := 0; mg < p.gridHeight; mg++ {
+		for ng := 0; ng < p.gridWidth; ng++ {
+			x, y := gridPos(mg, ng)
+			gray := grays[mg*p.gridWidth+ng]
+			if gray >= len(p.patterns) {
+				gray = len(p.patterns) - 1
+			}
+			bm.combine(p.patterns[gray], x, y, p.combOp)
+		}
+	}
+	return bm, nil
+}
+
+// decodeGrayScale decodes the gray-scale image of a halftone region (Annex C.5) and returns the
+// gray values in row order.
+func decodeGrayScale(data []byte, p *halftoneParams, bpp uint, skip *bitmap) ([]int, error) {
+	planes := make([]*bitmap, bpp)
+
+	var dc *decodingContext
+	if !p.mmr {
+		dc = newDecodingContext(data)
+	}
+	at := []atPixel{{3, -1}, {-3, -1}, {2, -2}, {-2, -2}}
+	if p.template > 1 {
+		at[0].x = 2
+	}
+
+	pos := 0
+	for j := int(bpp) - 1; j >= 0; j-- {
+		var plane *bitmap
+		var err error
+		if p.mmr {
+			var n int
+			if pos > len(data) {
+				return nil, errUnexpectedEnd
+			}
+			plane, n, err = decodeMMR(data[pos:], p.gridWidth, p.gridHeight, true, nil)
+			pos += n
+		} else {
+			gp := &genericParams{
+				width:    p.gridWidth,
+				height:   p.gridHeight,
+				template: p.template,
+				skip:     skip,
+				at:       at,
+			}
+			plane, err = decodeGeneric(dc, gp)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if j < int(bpp)-1 {
+			// Gray code to binary.
+			next := planes[j+1]
+			for i := range plane.data {
+				plane.data[i] ^= next.data[i]
+			}
+		}
+		planes[j] = plane
+	}
+
+	grays := make([]int, p.gridWidth*p.gridHeight)
+	for mg := 0; mg < p.gridHeight; mg++ {
+		for ng := 0; ng < p.gridWidth; ng++ {
+			v := 0
+			for j := int(bpp) - 1; j >= 0; j-- {
+				v = v<<1 | planes[j].getPixel(ng, mg)
+			}
+			grays[mg*p.gridWidth+ng] = v
+		}
+	}
+	return grays, nil
+}
@@ -0,0 +1,375 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jbig2
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errHuffmanCode = errors.New("Invalid JBIG2 Huffman code")
+
+// bitReader reads bits most significant bit first from Huffman coded segment data.
+type bitReader struct {
+	data []byte
+	pos  int // Position in bits.
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) readBit() (int, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errUnexpectedEnd
+	}
+	b := int(r.data[r.pos>>3]>>uint(7-r.pos&7)) & 1
+	r.pos++
+	return b, nil
+}
+
+// readBits reads an `n` bit unsigned integer.
+func (r *bitReader) readBits(n int) (int, error) {
+	v := 0
+	for i := 0; i < n; i++ {
+		b, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// byteAlign skips to the next byte boundary.
+func (r *bitReader) byteAlign() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+// bytePos returns the current position in bytes (the reader is expected to be byte aligned).
+func (r *bitReader) bytePos() int {
+	return (r.pos + 7) / 8
+}
+
+// Kinds of Huffman table lines.
+const (
+	lineNormal = iota
+	lineLower
+	lineUpper
+	lineOOB
+)
+
+// tableLine is a line of a Huffman table (B.2).
+type tableLine struct {
+	rangeLow int
+	prefLen  int
+	rangeLen int
+	kind     int
+}
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	line     *tableLine
+}
+
+// huffmanTable decodes values with a Huffman table.
+type huffmanTable struct {
+	root *huffmanNode
+}
+
+// newHuffmanTable assigns prefix codes to `lines` (B.3) and builds the decoding tree.
+func newHuffmanTable(lines []tableLine) (*huffmanTable, error) {
+	maxLen := 0
+	for _, line := range lines {
+		if line.prefLen > maxLen {
+			maxLen = line.prefLen
+		}
+	}
+	lenCount := make([]int, maxLen+1)
+	for _, line := range lines {
+		lenCount[line.prefLen]++
+	}
+	lenCount[0] = 0
+
+	table := &huffmanTable{root: &huffmanNode{}}
+	firstCode := 0
+	for curLen := 1; curLen <= maxLen; curLen++ {
+		firstCode = (firstCode + lenCount[curLen-1]) << 1
+		code := firstCode
+		for i := range lines {
+			if lines[i].prefLen != curLen {
+				continue
+			}
+			err := table.insert(code, curLen, &lines[i])
+			if err != nil {
+				return nil, err
+			}
+			code++
+		}
+	}
+	return table, nil
+}
+
+func (t *huffmanTable) insert(code, length int, line *tableLine) error {
+	node := t.root
+	for i := length - 1; i >= 0; i-- {
+		if node.line != nil {
+			return errors.New("Invalid JBIG2 Huffman table")
+		}
+		b := (code >> uint(i)) & 1
+		if node.children[b] == nil {
+			node.children[b] = &huffmanNode{}
+		}
+		node = node.children[b]
+	}
+	if node.line != nil || node.children[0] != nil || node.children[1] != nil {
+		return errors.New("Invalid JBIG2 Huffman table")
+	}
+	node.line = line
+	return nil
+}
+
+// decode decodes a value from `r`.  Returns false for OOB.
+func (t *huffmanTable) decode(r *bitReader) (int, bool, error) {
+	node := t.root
+	for node.line == nil {
+		b, err := r.readBit()
+		if err != nil {
+			return 0, false, err
+		}
+		node = node.children[b]
+		if node == nil {
+			return 0, false, errHuffmanCode
+		}
+	}
+
+	line := node.line
+	if line.kind == lineOOB {
+		return 0, false, nil
+	}
+	offset, err := r.readBits(line.rangeLen)
+	if err != nil {
+		return 0, false, err
+	}
+	if line.kind == lineLower {
+		return line.rangeLow - offset, true, nil
+	}
+	return line.rangeLow + offset, true, nil
+}
+
+// decodeValue decodes a value that is not allowed to be OOB.
+func (t *huffmanTable) decodeValue(r *bitReader) (int, error) {
+	v, ok, err := t.decode(r)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New("Unexpected JBIG2 Huffman OOB")
+	}
+	return v, nil
+}
+
+// Standard Huffman tables B.1 - B.15 (Annex B.5) as lines of rangeLow, prefLen, rangeLen and kind.
+var standardTableLines = [][]tableLine{
+	// B.1
+	{{0, 1, 4, lineNormal}, {16, 2, 8, lineNormal}, {272, 3, 16, lineNormal}, {65808, 3, 32, lineUpper}},
+	// B.2
+	{{0, 1, 0, lineNormal}, {1, 2, 0, lineNormal}, {2, 3, 0, lineNormal}, {3, 4, 3, lineNormal},
+		{11, 5, 6, lineNormal}, {75, 6, 32, lineUpper}, {0, 6, 0, lineOOB}},
+	// B.3
+	{{-256, 8, 8, lineNormal}, {0, 1, 0, lineNormal}, {1, 2, 0, lineNormal}, {2, 3, 0, lineNormal},
+		{3, 4, 3, lineNormal}, {11, 5, 6, lineNormal}, {-257, 8, 32, lineLower}, {75, 7, 32, lineUpper},
+		{0, 6, 0, lineOOB}},
+	// B.4
+	{{1, 1, 0, lineNormal}, {2, 2, 0, lineNormal}, {3, 3, 0, lineNormal}, {4, 4, 3, lineNormal},
+		{12, 5, 6, lineNormal}, {76, 5, 32, lineUpper}},
+	// B.5
+	{{-255, 7, 8, lineNormal}, {1, 1, 0, lineNormal}, {2, 2, 0, lineNormal}, {3, 3, 0, lineNormal},
+		{4, 4, 3, lineNormal}, {12, 5, 6, lineNormal}, {-256, 7, 32, lineLower}, {76, 6, 32, lineUpper}},
+	// B.6
+	{{-2048, 5, 10, lineNormal}, {-1024, 4, 9, lineNormal}, {-512, 4, 8, lineNormal},
+		{-256, 4, 7, lineNormal}, {-128, 5, 6, lineNormal}, {-64, 5, 5, lineNormal}, {-32, 4, 5, lineNormal},
+		{0, 2, 7, lineNormal}, {128, 3, 7, lineNormal}, {256, 3, 8, lineNormal}, {512, 4, 9, lineNormal},
+		{1024, 4, 10, lineNormal}, {-2049, 6, 32, lineLower}, {2048, 6, 32, lineUpper}},
+	// B.7
+	{{-1024, 4, 9, lineNormal}, {-512, 3, 8, lineNormal}, {-256, 4, 7, lineNormal},
+		{-128, 5, 6, lineNormal}, {-64, 5, 5, lineNormal}, {-32, 4, 5, lineNormal}, {0, 4, 5, lineNormal},
+		{32, 5, 5, lineNormal}, {64, 5, 6, lineNormal}, {128, 4, 7, lineNormal}, {256, 3, 8, lineNormal},
+		{512, 3, 9, lineNormal}, {1024, 3, 10, lineNormal}, {-1025, 5, 32, lineLower},
+		{2048, 5, 32, lineUpper}},
+	// B.8
+	{{-15, 8, 3, lineNormal}, {-7, 9, 1, lineNormal}, {-5, 8, 1, lineNormal}, {-3, 9, 0, lineNormal},
+		{-2, 7, 0, lineNormal}, {-1, 4, 0, lineNormal}, {0, 2, 1, lineNormal}, {2, 5, 0, lineNormal},
+		{3, 6, 0, lineNormal}, {4, 3, 4, lineNormal}, {20, 6, 1, lineNormal}, {22, 4, 4, lineNormal},
+		{38, 4, 5, lineNormal}, {70, 5, 6, lineNormal}, {134, 5, 7, lineNormal}, {262, 6, 7, lineNormal},
+		{390, 7, 8, lineNormal}, {646, 6, 10, lineNormal}, {-16, 9, 32, lineLower},
+		{1670, 9, 32, lineUpper}, {0, 2, 0, lineOOB}},
+	// B.9
+	{{-31, 8, 4, lineNormal}, {-15, 9, 2, lineNormal}, {-11, 8, 2, lineNormal}, {-7, 9, 1, lineNormal},
+		{-5, 7, 1, lineNormal}, {-3, 4, 1, lineNormal}, {-1, 3, 1, lineNormal}, {1, 3, 1, lineNormal},
+		{3, 5, 1, lineNormal}, {5, 6, 1, lineNormal}, {7, 3, 5, lineNormal}, {39, 6, 2, lineNormal},
+		{43, 4, 5, lineNormal}, {75, 4, 6, lineNormal}, {139, 5, 7, lineNormal}, {267, 5, 8, lineNormal},
+		{523, 6, 8, lineNormal}, {779, 7, 9, lineNormal}, {1291, 6, 11, lineNormal},
+		{-32, 9, 32, lineLower}, {3339, 9, 32, lineUpper}, {0, 2, 0, lineOOB}},
+	// B.10
+	{{-21, 7, 4, lineNormal}, {-5, 8, 0, lineNormal}, {-4, 7, 0, lineNormal}, {-3, 5, 0, lineNormal},
+		{-2, 2, 2, lineNormal}, {2, 5, 0, lineNormal}, {3, 6, 0, lineNormal}, {4, 7, 0, lineNormal},
+		{5, 8, 0, lineNormal}, {6, 2, 6, lineNormal}, {70, 5, 5, lineNormal}, {102, 6, 5, lineNormal},
+		{134, 6, 6, lineNormal}, {198, 6, 7, lineNormal}, {326, 6, 8, lineNormal}, {582, 6, 9, lineNormal},
+		{1094, 6, 10, lineNormal}, {2118, 7, 11, lineNormal}, {-22, 8, 32, lineLower},
+		{4166, 8, 32, lineUpper}, {0, 2, 0, lineOOB}},
+	// B.11
+	{{1, 1, 0, lineNormal}, {2, 2, 1, lineNormal}, {4, 4, 0, lineNormal}, {5, 4, 1, lineNormal},
+		{7, 5, 1, lineNormal}, {9, 5, 2, lineNormal}, {13, 6, 2, lineNormal}, {17, 7, 2, lineNormal},
+		{21, 7, 3, lineNormal}, {29, 7, 4, lineNormal}, {45, 7, 5, lineNormal}, {77, 7, 6, lineNormal},
+		{141, 7, 32, lineUpper}},
+	// B.12
+	{{1, 1, 0, lineNormal}, {2, 2, 0, lineNormal}, {3, 3, 1, lineNormal}, {5, 5, 0, lineNormal},
+		{6, 5, 1, lineNormal}, {8, 6, 1, lineNormal}, {10, 7, 0, lineNormal}, {11, 7, 1, lineNormal},
+		{13, 7, 2, lineNormal}, {17, 7, 3, lineNormal}, {25, 7, 4, lineNormal}, {41, 8, 5, lineNormal},
+		{73, 8, 32, lineUpper}},
+	// B.13
+	{{1, 1, 0, lineNormal}, {2, 3, 0, lineNormal}, {3, 4, 0, lineNormal}, {4, 5, 0, lineNormal},
+		{5, 4, 1, lineNormal}, {7, 3, 3, lineNormal}, {15, 6, 1, lineNormal}, {17, 6, 2, lineNormal},
+		{21, 6, 3, lineNormal}, {29, 6, 4, lineNormal}, {45, 6, 5, lineNormal}, {77, 7, 6, lineNormal},
+		{141, 7, 32, lineUpper}},
+	// B.14
+	{{-2, 3, 0, lineNormal}, {-1, 3, 0, lineNormal}, {0, 1, 0, lineNormal}, {1, 3, 0, lineNormal},
+		{2, 3, 0, lineNormal}},
+	// B.15
+	{{-24, 7, 4, lineNormal}, {-8, 6, 2, lineNormal}, {-4, 5, 1, lineNormal}, {-2, 4, 0, lineNormal},
+		{-1, 3, 0, lineNormal}, {0, 1, 0, lineNormal}, {1, 3, 0, lineNormal}, {2, 4, 0, lineNormal},
+		{3, 5, 1, lineNormal}, {5, 6, 2, lineNormal}, {9, 7, 4, lineNormal}, {-25, 7, 32, lineLower},
+		{25, 7, 32, lineUpper}},
+}
+
+// The standard tables, built on init as they are shared by concurrent decoders.
+var standardTables = make([]*huffmanTable, len(standardTableLines))
+
+func init() {
+	for i, lines := range standardTableLines {
+		table, err := newHuffmanTable(lines)
+		if err != nil {
+			// Standard tables are valid.
+			panic(err)
+		}
+		standardTables[i] = table
+	}
+}
+
+// standardTable returns standard Huffman table B.`n`.
+func standardTable(n int) *huffmanTable {
+	return standardTables[n-1]
+}
+
+// parseTableSegment decodes a user defined Huffman table from the data of a tables segment
+// (7.4.13 and B.2).
+func parseTableSegment(data []byte) (*huffmanTable, error) {
+	if len(data) < 9 {
+		return nil, errUnexpectedEnd
+	}
+	flags := data[0]
+	htoob := flags&1 != 0
+	htps := int(flags>>1&7) + 1
+	htrs := int(flags>>4&7) + 1
+	low := int(int32(be32(data[1:])))
+	high := int(int32(be32(data[5:])))
+	if low >= high {
+		return nil, fmt.Errorf("Invalid JBIG2 table range (%d >= %d)", low, high)
+	}
+
+	r := newBitReader(data[9:])
+	var lines []tableLine
+	cur := low
+	for cur < high {
+		prefLen, err := r.readBits(htps)
+		if err != nil {
+			return nil, err
+		}
+		rangeLen, err := r.readBits(htrs)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, tableLine{cur, prefLen, rangeLen, lineNormal})
+		cur += 1 << uint(rangeLen)
+	}
+
+	prefLen, err := r.readBits(htps)
+	if err != nil {
+		return nil, err
+	}
+	lines = append(lines, tableLine{low - 1, prefLen, 32, lineLower})
+
+	prefLen, err = r.readBits(htps)
+	if err != nil {
+		return nil, err
+	}
+	lines = append(lines, tableLine{high, prefLen, 32, lineUpper})
+
+	if htoob {
+		prefLen, err = r.readBits(htps)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, tableLine{0, prefLen, 0, lineOOB})
+	}
+
+	return newHuffmanTable(lines)
+}
+
+// symbolIDTable decodes the symbol ID Huffman table in a text region segment (7.4.3.1.7).
+func symbolIDTable(r *bitReader, numSyms int) (*huffmanTable, error) {
+	runCodeLines := make([]tableLine, 35)
+	for i := range runCodeLines {
+		prefLen, err := r.readBits(4)
+		if err != nil {
+			return nil, err
+		}
+		runCodeLines[i] = tableLine{i, prefLen, 0, lineNormal}
+	}
+	runCodes, err := newHuffmanTable(runCodeLines)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]tableLine, 0, numSyms)
+	for len(lines) < numSyms {
+		code, err := runCodes.decodeValue(r)
+		if err != nil {
+			return nil, err
+		}
+		if code < 32 {
+			lines = append(lines, tableLine{len(lines), code, 0, lineNormal})
+			continue
+		}
+
+		var prefLen, repeat int
+		switch code {
+		case 32:
+			if len(lines) == 0 {
+				return nil, errors.New("Invalid JBIG2 symbol ID table")
+			}
+			prefLen = lines[len(lines)-1].prefLen
+			repeat, err = r.readBits(2)
+			repeat += 3
+		case 33:
+			repeat, err = r.readBits(3)
+			repeat += 3
+		default:
+			repeat, err = r.readBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < repeat && len(lines) < numSyms; i++ {
+			lines = append(lines, tableLine{len(lines), prefLen, 0, lineNormal})
+		}
+	}
+	r.byteAlign()
+
+	return newHuffmanTable(lines)
+}
@@ -0,0 +1,864 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+// Package jbig2 implements a decoder for JBIG2 (ITU-T Recommendation T.88) embedded streams as
+// used by the JBIG2Decode filter.
+package jbig2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+var errUnexpectedEnd = errors.New("Unexpected end of JBIG2 data")
+
+// ErrTooLarge is returned when the page would exceed the MaxSize option.
+var ErrTooLarge = errors.New("JBIG2 page too large")
+
+// Segment types (7.3).
+const (
+	segSymbolDict             = 0
+	segIntermediateText       = 4
+	segImmediateText          = 6
+	segImmediateLosslessText  = 7
+	segPatternDict            = 16
+	segIntermediateHalftone   = 20
+	segImmediateHalftone      = 22
+	segImmediateLosslessHalft = 23
+	segIntermediateGeneric    = 36
+	segImmediateGeneric       = 38
+	segImmediateLosslessGen   = 39
+	segIntermediateRefinement = 40
+	segImmediateRefinement    = 42
+	segImmediateLosslessRef   = 43
+	segPageInfo               = 48
+	segEndOfPage              = 49
+	segEndOfStripe            = 50
+	segEndOfFile              = 51
+	segProfiles               = 52
+	segTables                 = 53
+	segExtension              = 62
+)
+
+// be32 returns the big-endian 32 bit value at the start of `b`.
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// be16 returns the big-endian 16 bit value at the start of `b`.
+func be16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// segment is a parsed segment header with its data (7.2).
+type segment struct {
+	number   uint32
+	segType  int
+	referred []uint32
+	page     uint32
+	data     []byte
+}
+
+// regionInfo is the region segment information field (7.4.1).
+type regionInfo struct {
+	width  int
+	height int
+	x      int
+	y      int
+	combOp int
+}
+
+// regionResult is the bitmap of an intermediate region segment.
+type regionResult struct {
+	info regionInfo
+	bm   *bitmap
+}
+
+// symbolDictResult is the result of a symbol dictionary segment.
+type symbolDictResult struct {
+	symbols []*bitmap
+	gb      []byte // Retained generic region contexts.
+	gr      []byte // Retained generic refinement region contexts.
+}
+
+// document holds the decoding state of a JBIG2 embedded stream and its globals.
+type document struct {
+	symbolDicts  map[uint32]*symbolDictResult
+	patternDicts map[uint32][]*bitmap
+	tables       map[uint32]*huffmanTable
+	regions      map[uint32]*regionResult
+
+	ctx context.Context // Checked for cancellation if not nil.
+
+	page          *bitmap
+	pageMaxSize   int // Maximum size of the page bitmap in bytes from the options, 0 if unlimited.
+	pageDefPixel  int
+	pageUnknownHt bool
+	pageDone      bool
+}
+
+// Options are the decoding options.
+type Options struct {
+	// MaxSize is the maximum size in bytes of the decoded page if positive.  Larger pages fail with
+	// ErrTooLarge before allocating.
+	MaxSize int
+
+	// Context is checked for cancellation between the segments and between the rows of the
+	// generic and refinement regions if not nil.
+	Context context.Context
+}
+
+// Decode decodes the JBIG2 embedded stream `data` with optional global segments `globals`
+// (JBIG2Globals) and options `opts`, which can be nil for the defaults.  Returns the first page as
+// 1 bit per pixel rows padded to whole bytes, with 1 bits representing white pixels as expected by
+// the JBIG2Decode filter.
+func Decode(data, globals []byte, opts *Options) ([]byte, error) {
+	page, err := decodePage(data, globals, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(page.data))
+	for i, b := range page.data {
+		out[i] = ^b
+	}
+	return out, nil
+}
+
+// decodePage decodes the page bitmap from `data` and `globals` with options `opts`.
+func decodePage(data, globals []byte, opts *Options) (*bitmap, error) {
+	doc := &document{
+		symbolDicts:  map[uint32]*symbolDictResult{},
+		patternDicts: map[uint32][]*bitmap{},
+		tables:       map[uint32]*huffmanTable{},
+		regions:      map[uint32]*regionResult{},
+	}
+	if opts != nil {
+		doc.ctx = opts.Context
+		doc.pageMaxSize = opts.MaxSize
+	}
+
+	if len(globals) > 0 {
+		err := doc.processSegments(globals)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := doc.processSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	if doc.page == nil {
+		return nil, errors.New("No JBIG2 page information")
+	}
+	return doc.page, nil
+}
+
+// processSegments parses and processes the sequence of segments in `data`.
+func (doc *document) processSegments(data []byte) error {
+	pos := 0
+	for pos < len(data) && !doc.pageDone {
+		if err := contextErr(doc.ctx); err != nil {
+			return err
+		}
+		seg, n, err := parseSegment(data[pos:])
+		if err != nil {
+			return err
+		}
+		pos += n
+		common.Log.Trace("JBIG2 segment %d type %d length %d", seg.number, seg.segType, len(seg.data))
+
+		if seg.segType == segEndOfFile {
+			break
+		}
+		err = doc.processSegment(seg)
+		if err != nil {
+			common.Log.Debug("Error processing JBIG2 segment %d (type %d): %v", seg.number, seg.segType, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSegment parses the segment at the start of `data` and returns it with its total length.
+func parseSegment(data []byte) (*segment, int, error) {
+	if len(data) < 11 {
+		return nil, 0, errUnexpectedEnd
+	}
+	seg := &segment{}
+	seg.number = be32(data)
+	flags := data[4]
+	seg.segType = int(flags & 0x3f)
+	pos := 5
+
+	count := int(data[pos] >> 5)
+	if count == 7 {
+		if len(data) < pos+4 {
+			return nil, 0, errUnexpectedEnd
+		}
+		count = int(be32(data[pos:]) & 0x1fffffff)
+		pos += 4 + (count+8)/8
+	} else {
+		pos++
+	}
+
+	refSize := 4
+	if seg.number <= 256 {
+		refSize = 1
+	} else if seg.number <= 65536 {
+		refSize = 2
+	}
+	if count < 0 || len(data) < pos+count*refSize {
+		return nil, 0, errUnexpectedEnd
+	}
+	seg.referred = make([]uint32, count)
+	for i := range seg.referred {
+		switch refSize {
+		case 1:
+			seg.referred[i] = uint32(data[pos])
+		case 2:
+			seg.referred[i] = uint32(be16(data[pos:]))
+		default:
+			seg.referred[i] = be32(data[pos:])
+		}
+		pos += refSize
+	}
+
+	if flags&0x40 != 0 {
+		if len(data) < pos+4 {
+			return nil, 0, errUnexpectedEnd
+		}
+		seg.page = be32(data[pos:])
+		pos += 4
+	} else {
+		if len(data) < pos+1 {
+			return nil, 0, errUnexpectedEnd
+		}
+		seg.page = uint32(data[pos])
+		pos++
+	}
+
+	if len(data) < pos+4 {
+		return nil, 0, errUnexpectedEnd
+	}
+	length := be32(data[pos:])
+	pos += 4
+
+	if length == 0xffffffff {
+		if seg.segType != segImmediateGeneric && seg.segType != segImmediateLosslessGen {
+			return nil, 0, errors.New("Unknown JBIG2 segment data length")
+		}
+		n, err := genericRegionLength(data[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		length = uint32(n)
+	}
+	if uint64(len(data)) < uint64(pos)+uint64(length) {
+		return nil, 0, errUnexpectedEnd
+	}
+	seg.data = data[pos : pos+int(length)]
+	return seg, pos + int(length), nil
+}
+
+// genericRegionLength determines the length of immediate generic region segment data of unknown
+// length by locating the end of data marker followed by the row count (7.2.7).
+func genericRegionLength(data []byte) (int, error) {
+	if len(data) < 18 {
+		return 0, errUnexpectedEnd
+	}
+	flags := data[17]
+	mmr := flags&1 != 0
+	start := 18
+	if !mmr {
+		if (flags>>1)&3 == 0 {
+			start += 8
+		} else {
+			start += 2
+		}
+	}
+
+	for i := start; i+6 <= len(data); i++ {
+		if mmr && data[i] == 0x00 && data[i+1] == 0x00 {
+			return i + 6, nil
+		}
+		if !mmr && data[i] == 0xff && data[i+1] == 0xac {
+			return i + 6, nil
+		}
+	}
+	return 0, errors.New("JBIG2 end of generic region data not found")
+}
+
+// parseRegionInfo parses the region segment information field (7.4.1).
+func parseRegionInfo(data []byte) (regionInfo, error) {
+	if len(data) < 17 {
+		return regionInfo{}, errUnexpectedEnd
+	}
+	info := regionInfo{
+		width:  int(be32(data)),
+		height: int(be32(data[4:])),
+		x:      int(int32(be32(data[8:]))),
+		y:      int(int32(be32(data[12:]))),
+		combOp: int(data[16] & 7),
+	}
+	if err := checkBitmapSize(info.width, info.height, maxBitmapSize); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// parseAT parses `n` adaptive template pixel positions.
+func parseAT(data []byte, n int) ([]atPixel, error) {
+	if len(data) < 2*n {
+		return nil, errUnexpectedEnd
+	}
+	at := make([]atPixel, n)
+	for i := range at {
+		at[i] = atPixel{int(int8(data[2*i])), int(int8(data[2*i+1]))}
+	}
+	return at, nil
+}
+
+// processSegment processes a single segment.
+func (doc *document) processSegment(seg *segment) error {
+	switch seg.segType {
+	case segSymbolDict:
+		return doc.processSymbolDict(seg)
+	case segIntermediateText, segImmediateText, segImmediateLosslessText:
+		return doc.processTextRegion(seg)
+	case segPatternDict:
+		return doc.processPatternDict(seg)
+	case segIntermediateHalftone, segImmediateHalftone, segImmediateLosslessHalft:
+		return doc.processHalftoneRegion(seg)
+	case segIntermediateGeneric, segImmediateGeneric, segImmediateLosslessGen:
+		return doc.processGenericRegion(seg)
+	case segIntermediateRefinement, segImmediateRefinement, segImmediateLosslessRef:
+		return doc.processRefinementRegion(seg)
+	case segPageInfo:
+		return doc.processPageInfo(seg)
+	case segEndOfPage:
+		doc.pageDone = true
+		return nil
+	case segEndOfStripe:
+		if len(seg.data) < 4 {
+			return errUnexpectedEnd
+		}
+		if doc.page != nil && doc.pageUnknownHt {
+			return doc.growPage(int(be32(seg.data)) + 1)
+		}
+		return nil
+	case segTables:
+		table, err := parseTableSegment(seg.data)
+		if err != nil {
+			return err
+		}
+		doc.tables[seg.number] = table
+		return nil
+	case segProfiles, segExtension:
+		return nil
+	}
+	common.Log.Debug("Unsupported JBIG2 segment type %d - skipping", seg.segType)
+	return nil
+}
+
+// processPageInfo handles a page information segment (7.4.8).
+func (doc *document) processPageInfo(seg *segment) error {
+	if len(seg.data) < 19 {
+		return errUnexpectedEnd
+	}
+	if doc.page != nil {
+		// Only the first page is decoded.
+		doc.pageDone = true
+		return nil
+	}
+	width := be32(seg.data)
+	height := be32(seg.data[4:])
+	flags := seg.data[16]
+
+	doc.pageDefPixel = int(flags>>2) & 1
+	if height == 0xffffffff {
+		doc.pageUnknownHt = true
+		height = 0
+	}
+	if err := doc.checkPageSize(int(width), int(height)); err != nil {
+		return err
+	}
+	page, err := newBitmap(int(width), int(height))
+	if err != nil {
+		return err
+	}
+	doc.page = page
+	doc.page.fill(doc.pageDefPixel)
+	return nil
+}
+
+// checkPageSize returns an error if a page of `width` x `height` pixels would exceed the maximum
+// size of the options or maxBitmapSize.
+func (doc *document) checkPageSize(width, height int) error {
+	if doc.pageMaxSize > 0 && checkBitmapSize(width, height, doc.pageMaxSize) != nil {
+		common.Log.Debug("JBIG2 page of %d x %d exceeds %d bytes", width, height, doc.pageMaxSize)
+		return ErrTooLarge
+	}
+	return checkBitmapSize(width, height, maxBitmapSize)
+}
+
+// growPage extends the page of unknown height to `height` rows.
+func (doc *document) growPage(height int) error {
+	if height <= doc.page.height {
+		return nil
+	}
+	if err := doc.checkPageSize(doc.page.width, height); err != nil {
+		return err
+	}
+	return doc.page.grow(height, doc.pageDefPixel, maxBitmapSize)
+}
+
+// storeRegion either keeps the bitmap of an intermediate region segment or draws the region onto
+// the page.
+func (doc *document) storeRegion(seg *segment, info regionInfo, bm *bitmap) error {
+	switch seg.segType {
+	case segIntermediateText, segIntermediateHalftone, segIntermediateGeneric, segIntermediateRefinement:
+		doc.regions[seg.number] = &regionResult{info: info, bm: bm}
+		return nil
+	}
+
+	if doc.page == nil {
+		return errors.New("JBIG2 region segment before page information")
+	}
+	if doc.pageUnknownHt && info.y+bm.height > doc.page.height {
+		if err := doc.growPage(info.y + bm.height); err != nil {
+			return err
+		}
+	}
+	doc.page.combine(bm, info.x, info.y, info.combOp)
+	return nil
+}
+
+// referredSymbols returns the symbols exported by the symbol dictionaries referred to by `seg`.
+func (doc *document) referredSymbols(seg *segment) []*bitmap {
+	var syms []*bitmap
+	for _, num := range seg.referred {
+		if dict, has := doc.symbolDicts[num]; has {
+			syms = append(syms, dict.symbols...)
+		}
+	}
+	return syms
+}
+
+// referredTables returns the Huffman tables referred to by `seg`.
+func (doc *document) referredTables(seg *segment) []*huffmanTable {
+	var tables []*huffmanTable
+	for _, num := range seg.referred {
+		if table, has := doc.tables[num]; has {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// tableSelector picks standard or user defined Huffman tables in order of use.
+type tableSelector struct {
+	user []*huffmanTable
+}
+
+// pick returns standard table B.`standard` for `sel` values below the number of options, or the
+// next user defined table.
+func (ts *tableSelector) pick(sel int, standard []int) (*huffmanTable, error) {
+	if sel < len(standard) && standard[sel] > 0 {
+		return standardTable(standard[sel]), nil
+	}
+	if len(ts.user) == 0 {
+		return nil, errors.New("Missing JBIG2 user defined Huffman table")
+	}
+	table := ts.user[0]
+	ts.user = ts.user[1:]
+	return table, nil
+}
+
+// processSymbolDict handles a symbol dictionary segment (7.4.2).
+func (doc *document) processSymbolDict(seg *segment) error {
+	data := seg.data
+	if len(data) < 2 {
+		return errUnexpectedEnd
+	}
+	flags := int(be16(data))
+	pos := 2
+
+	p := &symbolDictParams{
+		huff:      flags&1 != 0,
+		refAgg:    flags&2 != 0,
+		template:  (flags >> 10) & 3,
+		rTemplate: (flags >> 12) & 1,
+	}
+	contextUsed := flags&0x100 != 0
+	contextRetained := flags&0x200 != 0
+
+	if !p.huff {
+		n := 1
+		if p.template == 0 {
+			n = 4
+		}
+		at, err := parseAT(data[pos:], n)
+		if err != nil {
+			return err
+		}
+		p.at = at
+		pos += 2 * n
+	}
+	if p.refAgg && p.rTemplate == 0 {
+		at, err := parseAT(data[pos:], 2)
+		if err != nil {
+			return err
+		}
+		p.rAt = at
+		pos += 4
+	}
+	if len(data) < pos+8 {
+		return errUnexpectedEnd
+	}
+	p.numExSyms = int(be32(data[pos:]))
+	p.numNewSyms = int(be32(data[pos+4:]))
+	pos += 8
+	if p.numExSyms < 0 || p.numNewSyms < 0 || p.numNewSyms > 1<<20 {
+		return errors.New("Invalid JBIG2 symbol count")
+	}
+
+	p.inSyms = doc.referredSymbols(seg)
+
+	if p.huff {
+		ts := &tableSelector{user: doc.referredTables(seg)}
+		var err error
+		if p.tableDH, err = ts.pick((flags>>2)&3, []int{4, 5}); err != nil {
+			return err
+		}
+		if p.tableDW, err = ts.pick((flags>>4)&3, []int{2, 3}); err != nil {
+			return err
+		}
+		if p.tableBMSize, err = ts.pick((flags>>6)&1, []int{1}); err != nil {
+			return err
+		}
+		if p.tableAggInst, err = ts.pick((flags>>7)&1, []int{1}); err != nil {
+			return err
+		}
+	}
+
+	var dc *decodingContext
+	var r *bitReader
+	if p.huff {
+		r = newBitReader(data[pos:])
+		dc = newDecodingContext(nil)
+	} else {
+		dc = newDecodingContext(data[pos:])
+	}
+
+	if contextUsed {
+		// Start from the contexts retained by the last referred symbol dictionary.
+		for i := len(seg.referred) - 1; i >= 0; i-- {
+			if dict, has := doc.symbolDicts[seg.referred[i]]; has {
+				if dict.gb != nil {
+					dc.gb = append([]byte{}, dict.gb...)
+				}
+				if dict.gr != nil {
+					dc.gr = append([]byte{}, dict.gr...)
+				}
+				break
+			}
+		}
+	}
+
+	syms, err := decodeSymbolDict(dc, r, p)
+	if err != nil {
+		return err
+	}
+	result := &symbolDictResult{symbols: syms}
+	if contextRetained {
+		result.gb = dc.gb
+		result.gr = dc.gr
+	}
+	doc.symbolDicts[seg.number] = result
+	return nil
+}
+
+// processTextRegion handles a text region segment (7.4.3).
+func (doc *document) processTextRegion(seg *segment) error {
+	data := seg.data
+	info, err := parseRegionInfo(data)
+	if err != nil {
+		return err
+	}
+	pos := 17
+	if len(data) < pos+2 {
+		return errUnexpectedEnd
+	}
+	flags := int(be16(data[pos:]))
+	pos += 2
+
+	p := &textParams{
+		huff:       flags&1 != 0,
+		refine:     flags&2 != 0,
+		width:      info.width,
+		height:     info.height,
+		logStrips:  uint(flags>>2) & 3,
+		refCorner:  (flags >> 4) & 3,
+		transposed: flags&0x40 != 0,
+		combOp:     (flags >> 7) & 3,
+		defPixel:   (flags >> 9) & 1,
+		dsOffset:   (flags >> 10) & 0x1f,
+		rTemplate:  (flags >> 15) & 1,
+	}
+	if p.dsOffset > 0x0f {
+		p.dsOffset -= 0x20
+	}
+
+	huffFlags := 0
+	if p.huff {
+		if len(data) < pos+2 {
+			return errUnexpectedEnd
+		}
+		huffFlags = int(be16(data[pos:]))
+		pos += 2
+	}
+	if p.refine && p.rTemplate == 0 {
+		at, err := parseAT(data[pos:], 2)
+		if err != nil {
+			return err
+		}
+		p.rAt = at
+		pos += 4
+	}
+	if len(data) < pos+4 {
+		return errUnexpectedEnd
+	}
+	p.numInstances = int(be32(data[pos:]))
+	pos += 4
+
+	p.syms = doc.referredSymbols(seg)
+	p.symCodeLen = ceilLog2(len(p.syms))
+
+	var dc *decodingContext
+	var r *bitReader
+	if p.huff {
+		ts := &tableSelector{user: doc.referredTables(seg)}
+		picks := []struct {
+			table    **huffmanTable
+			sel      int
+			standard []int
+		}{
+			{&p.tableFS, huffFlags & 3, []int{6, 7}},
+			{&p.tableDS, (huffFlags >> 2) & 3, []int{8, 9, 10}},
+			{&p.tableDT, (huffFlags >> 4) & 3, []int{11, 12, 13}},
+			{&p.tableRDW, (huffFlags >> 6) & 3, []int{14, 15}},
+			{&p.tableRDH, (huffFlags >> 8) & 3, []int{14, 15}},
+			{&p.tableRDX, (huffFlags >> 10) & 3, []int{14, 15}},
+			{&p.tableRDY, (huffFlags >> 12) & 3, []int{14, 15}},
+			{&p.tableRSize, (huffFlags >> 14) & 1, []int{1}},
+		}
+		for _, pick := range picks {
+			table, err := ts.pick(pick.sel, pick.standard)
+			if err != nil {
+				return err
+			}
+			*pick.table = table
+		}
+
+		r = newBitReader(data[pos:])
+		p.symIDTable, err = symbolIDTable(r, len(p.syms))
+		if err != nil {
+			return err
+		}
+		dc = newDecodingContext(nil)
+	} else {
+		dc = newDecodingContext(data[pos:])
+	}
+
+	bm, err := decodeText(dc, r, p)
+	if err != nil {
+		return err
+	}
+	return doc.storeRegion(seg, info, bm)
+}
+
+// processPatternDict handles a pattern dictionary segment (7.4.4).
+func (doc *document) processPatternDict(seg *segment) error {
+	data := seg.data
+	if len(data) < 7 {
+		return errUnexpectedEnd
+	}
+	p := &patternDictParams{
+		mmr:      data[0]&1 != 0,
+		template: int(data[0]>>1) & 3,
+		width:    int(data[1]),
+		height:   int(data[2]),
+		grayMax:  int(be32(data[3:])),
+	}
+	if p.grayMax > 1<<16 {
+		return errors.New("Invalid JBIG2 pattern count")
+	}
+	patterns, err := decodePatternDict(data[7:], p)
+	if err != nil {
+		return err
+	}
+	doc.patternDicts[seg.number] = patterns
+	return nil
+}
+
+// processHalftoneRegion handles a halftone region segment (7.4.5).
+func (doc *document) processHalftoneRegion(seg *segment) error {
+	data := seg.data
+	info, err := parseRegionInfo(data)
+	if err != nil {
+		return err
+	}
+	if len(data) < 17+21 {
+		return errUnexpectedEnd
+	}
+	flags := data[17]
+	p := &halftoneParams{
+		width:      info.width,
+		height:     info.height,
+		mmr:        flags&1 != 0,
+		template:   int(flags>>1) & 3,
+		enableSkip: flags&8 != 0,
+		combOp:     int(flags>>4) & 7,
+		defPixel:   int(flags>>7) & 1,
+		gridWidth:  int(be32(data[18:])),
+		gridHeight: int(be32(data[22:])),
+		gridX:      int(int32(be32(data[26:]))),
+		gridY:      int(int32(be32(data[30:]))),
+		regionX:    int(be16(data[34:])),
+		regionY:    int(be16(data[36:])),
+	}
+	if p.gridWidth < 0 || p.gridHeight < 0 || (p.gridHeight > 0 && p.gridWidth > maxGridCells/p.gridHeight) {
+		return fmt.Errorf("Invalid JBIG2 halftone grid size (%d x %d)", p.gridWidth, p.gridHeight)
+	}
+	for _, num := range seg.referred {
+		if patterns, has := doc.patternDicts[num]; has {
+			p.patterns = patterns
+			break
+		}
+	}
+
+	bm, err := decodeHalftone(data[38:], p)
+	if err != nil {
+		return err
+	}
+	return doc.storeRegion(seg, info, bm)
+}
+
+// processGenericRegion handles a generic region segment (7.4.6).
+func (doc *document) processGenericRegion(seg *segment) error {
+	data := seg.data
+	info, err := parseRegionInfo(data)
+	if err != nil {
+		return err
+	}
+	if len(data) < 18 {
+		return errUnexpectedEnd
+	}
+	flags := data[17]
+	pos := 18
+
+	p := &genericParams{
+		mmr:      flags&1 != 0,
+		width:    info.width,
+		height:   info.height,
+		template: int(flags>>1) & 3,
+		tpgdon:   flags&8 != 0,
+		ctx:      doc.ctx,
+	}
+	if !p.mmr {
+		n := 1
+		if p.template == 0 {
+			n = 4
+		}
+		p.at, err = parseAT(data[pos:], n)
+		if err != nil {
+			return err
+		}
+		pos += 2 * n
+	}
+
+	regionData := data[pos:]
+	if len(data) >= pos+6 {
+		// Data of unknown length ends with a marker followed by the row count.
+		tail := data[len(data)-6:]
+		if (!p.mmr && tail[0] == 0xff && tail[1] == 0xac) || (p.mmr && tail[0] == 0 && tail[1] == 0) {
+			rows := int(be32(tail[2:]))
+			if rows >= 0 && rows < info.height {
+				info.height = rows
+				p.height = rows
+			}
+		}
+	}
+
+	var bm *bitmap
+	if p.mmr {
+		bm, _, err = decodeMMR(regionData, p.width, p.height, false, doc.ctx)
+	} else {
+		bm, err = decodeGeneric(newDecodingContext(regionData), p)
+	}
+	if err != nil {
+		return err
+	}
+	return doc.storeRegion(seg, info, bm)
+}
+
+// processRefinementRegion handles a generic refinement region segment (7.4.7).
+func (doc *document) processRefinementRegion(seg *segment) error {
+	data := seg.data
+	info, err := parseRegionInfo(data)
+	if err != nil {
+		return err
+	}
+	if len(data) < 18 {
+		return errUnexpectedEnd
+	}
+	flags := data[17]
+	pos := 18
+
+	p := &refinementParams{
+		width:    info.width,
+		height:   info.height,
+		template: int(flags & 1),
+		tpgron:   flags&2 != 0,
+		ctx:      doc.ctx,
+	}
+	if p.template == 0 {
+		p.at, err = parseAT(data[pos:], 2)
+		if err != nil {
+			return err
+		}
+		pos += 4
+	}
+
+	// The reference is the referred intermediate region, or otherwise the page area.
+	for _, num := range seg.referred {
+		if region, has := doc.regions[num]; has {
+			p.reference = region.bm
+			p.dx = region.info.x - info.x
+			p.dy = region.info.y - info.y
+			delete(doc.regions, num)
+			break
+		}
+	}
+	if p.reference == nil {
+		if doc.page == nil {
+			return errors.New("JBIG2 refinement region without reference")
+		}
+		p.reference, err = doc.page.subBitmap(info.x, info.y, info.width, info.height)
+		if err != nil {
+			return err
+		}
+	}
+
+	bm, err := decodeRefinement(newDecodingContext(data[pos:]), p)
+	if err != nil {
+		return err
+	}
+	return doc.storeRegion(seg, info, bm)
+}
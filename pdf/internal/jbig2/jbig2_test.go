@@ -0,0 +1,554 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jbig2
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/unidoc/unidoc/common"
+	"github.com/unidoc/unidoc/pdf/internal/ccittfax"
+)
+
+func init() {
+	common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+}
+
+// mqEncoder is an MQ arithmetic encoder (E.2) used to produce test data.
+type mqEncoder struct {
+	a   uint32
+	c   uint32
+	ct  int
+	out []byte // The last byte is the current output byte B; the first byte is discarded.
+}
+
+func newMQEncoder() *mqEncoder {
+	return &mqEncoder{a: 0x8000, ct: 12, out: []byte{0}}
+}
+
+func (e *mqEncoder) byteOut() {
+	b := &e.out[len(e.out)-1]
+	if *b == 0xff {
+		e.out = append(e.out, byte(e.c>>20))
+		e.c &= 0xfffff
+		e.ct = 7
+		return
+	}
+	if e.c < 0x8000000 {
+		e.out = append(e.out, byte(e.c>>19))
+		e.c &= 0x7ffff
+		e.ct = 8
+		return
+	}
+	*b++
+	if *b == 0xff {
+		e.c &= 0x7ffffff
+		e.out = append(e.out, byte(e.c>>20))
+		e.c &= 0xfffff
+		e.ct = 7
+		return
+	}
+	e.out = append(e.out, byte(e.c>>19))
+	e.c &= 0x7ffff
+	e.ct = 8
+}
+
+func (e *mqEncoder) renorm() {
+	for {
+		e.a <<= 1
+		e.c <<= 1
+		e.ct--
+		if e.ct == 0 {
+			e.byteOut()
+		}
+		if e.a&0x8000 != 0 {
+			break
+		}
+	}
+}
+
+func (e *mqEncoder) encodeBit(cx *byte, bit int) {
+	index := *cx >> 1
+	mps := int(*cx & 1)
+	entry := &qeTable[index]
+	qe := uint32(entry.qe)
+
+	e.a -= qe
+	if bit == mps {
+		if e.a&0x8000 != 0 {
+			e.c += qe
+			return
+		}
+		if e.a < qe {
+			e.a = qe
+		} else {
+			e.c += qe
+		}
+		index = entry.nmps
+	} else {
+		if e.a < qe {
+			e.c += qe
+		} else {
+			e.a = qe
+		}
+		if entry.switchMPS {
+			mps = 1 - mps
+		}
+		index = entry.nlps
+	}
+	*cx = index<<1 | byte(mps)
+	e.renorm()
+}
+
+func (e *mqEncoder) flush() []byte {
+	temp := e.c + e.a
+	e.c |= 0xffff
+	if e.c >= temp {
+		e.c -= 0x8000
+	}
+	e.c <<= uint(e.ct)
+	e.byteOut()
+	e.c <<= uint(e.ct)
+	e.byteOut()
+	if e.out[len(e.out)-1] != 0xff {
+		e.out = append(e.out, 0xff)
+	}
+	e.out = append(e.out, 0xac)
+	return e.out[1:]
+}
+
+// encodeInt encodes `v` with the integer arithmetic encoding procedure using contexts `cx` (A.2).
+// An out-of-band value is encoded if `oob` is set.
+func (e *mqEncoder) encodeInt(cx []byte, v int, oob bool) {
+	prev := 1
+	writeBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bit := (v >> uint(i)) & 1
+			e.encodeBit(&cx[prev], bit)
+			if prev < 256 {
+				prev = prev<<1 | bit
+			} else {
+				prev = (prev<<1|bit)&511 | 256
+			}
+		}
+	}
+	if oob {
+		writeBits(1, 1)
+		writeBits(0, 1)
+		writeBits(0, 2)
+		return
+	}
+	sign := 0
+	if v < 0 {
+		sign = 1
+		v = -v
+	}
+	writeBits(sign, 1)
+	switch {
+	case v < 4:
+		writeBits(0, 1)
+		writeBits(v, 2)
+	case v < 20:
+		writeBits(2, 2)
+		writeBits(v-4, 4)
+	case v < 84:
+		writeBits(6, 3)
+		writeBits(v-20, 6)
+	case v < 340:
+		writeBits(14, 4)
+		writeBits(v-84, 8)
+	case v < 4436:
+		writeBits(30, 5)
+		writeBits(v-340, 12)
+	default:
+		writeBits(31, 5)
+		writeBits(v-4436, 32)
+	}
+}
+
+// encodeIAID encodes symbol ID `id` of `codeLen` bits (A.3).
+func (e *mqEncoder) encodeIAID(cx []byte, id int, codeLen uint) {
+	prev := 1
+	for i := int(codeLen) - 1; i >= 0; i-- {
+		bit := (id >> uint(i)) & 1
+		e.encodeBit(&cx[prev], bit)
+		prev = prev<<1 | bit
+	}
+}
+
+// encodeGeneric encodes `bm` as an arithmetic coded generic region.
+func (e *mqEncoder) encodeGeneric(cx []byte, bm *bitmap, template int, at []atPixel, tpgdon bool) {
+	ltp := 0
+	for y := 0; y < bm.height; y++ {
+		if tpgdon {
+			same := y > 0 && bytes.Equal(bm.data[y*bm.stride:(y+1)*bm.stride], bm.data[(y-1)*bm.stride:y*bm.stride])
+			if y == 0 {
+				same = bytes.Equal(bm.data[:bm.stride], make([]byte, bm.stride))
+			}
+			sltp := 0
+			if same {
+				sltp = 1
+			}
+			e.encodeBit(&cx[sltpContexts[template]], sltp^ltp)
+			ltp = sltp
+			if same {
+				continue
+			}
+		}
+		for x := 0; x < bm.width; x++ {
+			ctx := genericContext(bm, x, y, template, at)
+			e.encodeBit(&cx[ctx], bm.getPixel(x, y))
+		}
+	}
+}
+
+// defaultAT returns the nominal adaptive template pixels for `template`.
+func defaultAT(template int) []atPixel {
+	switch template {
+	case 0:
+		return []atPixel{{3, -1}, {-3, -1}, {2, -2}, {-2, -2}}
+	case 1:
+		return []atPixel{{3, -1}}
+	}
+	return []atPixel{{2, -1}}
+}
+
+// randomBitmap returns a bitmap with runs of pixels to give some structure.
+func randomBitmap(rnd *rand.Rand, width, height int) *bitmap {
+	bm, _ := newBitmap(width, height)
+	for y := 0; y < height; y++ {
+		if y > 0 && rnd.Intn(3) == 0 {
+			bm.copyRow(y, y-1)
+			continue
+		}
+		v := rnd.Intn(2)
+		for x := 0; x < width; x++ {
+			if rnd.Intn(6) == 0 {
+				v = 1 - v
+			}
+			bm.setPixel(x, y, v)
+		}
+	}
+	return bm
+}
+
+func appendBE32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// makeSegment returns a segment with a one byte page association.
+func makeSegment(number uint32, segType int, referred []byte, data []byte) []byte {
+	seg := appendBE32(nil, number)
+	seg = append(seg, byte(segType), byte(len(referred))<<5)
+	seg = append(seg, referred...)
+	seg = append(seg, 1)
+	seg = appendBE32(seg, uint32(len(data)))
+	return append(seg, data...)
+}
+
+func makePageInfo(width, height uint32) []byte {
+	data := appendBE32(nil, width)
+	data = appendBE32(data, height)
+	data = appendBE32(data, 0)
+	data = appendBE32(data, 0)
+	return append(data, 0, 0, 0)
+}
+
+func makeRegionInfo(width, height, x, y uint32, combOp byte) []byte {
+	data := appendBE32(nil, width)
+	data = appendBE32(data, height)
+	data = appendBE32(data, x)
+	data = appendBE32(data, y)
+	return append(data, combOp)
+}
+
+// invertBits returns the page data of `bm` as output by Decode.
+func invertBits(bm *bitmap) []byte {
+	out := make([]byte, len(bm.data))
+	for i, b := range bm.data {
+		out[i] = ^b
+	}
+	return out
+}
+
+func TestArithIntegers(t *testing.T) {
+	values := []int{0, 1, -1, 3, 4, 19, 20, -83, 84, 339, 340, 4435, 4436, 100000, -100000}
+
+	e := newMQEncoder()
+	cx := make([]byte, 512)
+	for _, v := range values {
+		e.encodeInt(cx, v, false)
+	}
+	e.encodeInt(cx, 0, true)
+	idcx := make([]byte, 1<<6)
+	e.encodeIAID(idcx, 21, 5)
+
+	dc := newDecodingContext(e.flush())
+	for _, v := range values {
+		got, ok := dc.decodeInt(procIADT)
+		if !ok || got != v {
+			t.Errorf("Integer mismatch: %d, %v (expected %d)", got, ok, v)
+			return
+		}
+	}
+	if _, ok := dc.decodeInt(procIADT); ok {
+		t.Errorf("OOB not decoded")
+		return
+	}
+	if id := dc.decodeIAID(5); id != 21 {
+		t.Errorf("Symbol ID mismatch: %d (expected 21)", id)
+	}
+}
+
+func TestGenericRegion(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for template := 0; template < 4; template++ {
+		for _, tpgdon := range []bool{false, true} {
+			bm := randomBitmap(rnd, 45, 30)
+			at := defaultAT(template)
+
+			e := newMQEncoder()
+			e.encodeGeneric(make([]byte, 1<<16), bm, template, at, tpgdon)
+
+			p := &genericParams{width: bm.width, height: bm.height, template: template, tpgdon: tpgdon, at: at}
+			decoded, err := decodeGeneric(newDecodingContext(e.flush()), p)
+			if err != nil {
+				t.Errorf("Template %d: error: %v", template, err)
+				return
+			}
+			if !bytes.Equal(decoded.data, bm.data) {
+				t.Errorf("Template %d (TPGDON %v): bitmap mismatch", template, tpgdon)
+				return
+			}
+		}
+	}
+}
+
+// Decode an embedded stream with an immediate generic region of unknown height.
+func TestDecodeGenericPage(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	bm := randomBitmap(rnd, 20, 10)
+	at := defaultAT(0)
+
+	e := newMQEncoder()
+	e.encodeGeneric(make([]byte, 1<<16), bm, 0, at, true)
+
+	region := makeRegionInfo(20, 10, 0, 0, opOr)
+	region = append(region, 0x08)
+	for _, a := range at {
+		region = append(region, byte(int8(a.x)), byte(int8(a.y)))
+	}
+	region = append(region, e.flush()...)
+
+	var data []byte
+	data = append(data, makeSegment(0, segPageInfo, nil, makePageInfo(20, 0xffffffff))...)
+	data = append(data, makeSegment(1, segImmediateGeneric, nil, region)...)
+	data = append(data, makeSegment(2, segEndOfPage, nil, nil)...)
+
+	decoded, err := Decode(data, nil, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if !bytes.Equal(decoded, invertBits(bm)) {
+		t.Errorf("Page mismatch: % x", decoded)
+	}
+}
+
+// Decode an MMR coded generic region placed on a page.
+func TestDecodeMMRPage(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	bm := randomBitmap(rnd, 16, 8)
+
+	params := ccittfax.Params{K: -1, Columns: 16, Rows: 8, BlackIs1: true}
+	encoded, err := ccittfax.Encode(bm.data, params)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+
+	region := makeRegionInfo(16, 8, 8, 4, opOr)
+	region = append(region, 0x01)
+	region = append(region, encoded...)
+
+	var data []byte
+	data = append(data, makeSegment(0, segPageInfo, nil, makePageInfo(32, 16))...)
+	data = append(data, makeSegment(1, segImmediateLosslessGen, nil, region)...)
+
+	page, err := decodePage(data, nil, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			expected := bm.getPixel(x-8, y-4)
+			if page.getPixel(x, y) != expected {
+				t.Errorf("Pixel mismatch at (%d,%d)", x, y)
+				return
+			}
+		}
+	}
+}
+
+// Decode a text region using a symbol dictionary from the globals.
+func TestDecodeTextRegion(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	syms := []*bitmap{randomBitmap(rnd, 5, 6), randomBitmap(rnd, 7, 6)}
+	at := defaultAT(0)
+
+	// Symbol dictionary: one height class with both symbols, both exported.
+	e := newMQEncoder()
+	dh, dw, ex := make([]byte, 512), make([]byte, 512), make([]byte, 512)
+	gb := make([]byte, 1<<16)
+	e.encodeInt(dh, 6, false)
+	e.encodeInt(dw, 5, false)
+	e.encodeGeneric(gb, syms[0], 0, at, false)
+	e.encodeInt(dw, 2, false)
+	e.encodeGeneric(gb, syms[1], 0, at, false)
+	e.encodeInt(dw, 0, true)
+	e.encodeInt(ex, 0, false)
+	e.encodeInt(ex, 2, false)
+
+	dict := []byte{0x00, 0x00}
+	for _, a := range at {
+		dict = append(dict, byte(int8(a.x)), byte(int8(a.y)))
+	}
+	dict = appendBE32(dict, 2)
+	dict = appendBE32(dict, 2)
+	dict = append(dict, e.flush()...)
+	globals := makeSegment(0, segSymbolDict, nil, dict)
+
+	// Text region: one strip with symbol 1 at (2, 1) and symbol 0 at (10, 1) (top left corner).
+	e = newMQEncoder()
+	dt, fs, ds, id := make([]byte, 512), make([]byte, 512), make([]byte, 512), make([]byte, 4)
+	e.encodeInt(dt, 0, false)
+	e.encodeInt(dt, 1, false)
+	e.encodeInt(fs, 2, false)
+	e.encodeIAID(id, 1, 1)
+	e.encodeInt(ds, 2, false)
+	e.encodeIAID(id, 0, 1)
+	e.encodeInt(ds, 0, true)
+
+	text := makeRegionInfo(20, 8, 0, 0, opOr)
+	text = append(text, 0x00, 0x10) // REFCORNER TOPLEFT.
+	text = appendBE32(text, 2)
+	text = append(text, e.flush()...)
+
+	var data []byte
+	data = append(data, makeSegment(1, segPageInfo, nil, makePageInfo(20, 8))...)
+	data = append(data, makeSegment(2, segImmediateText, []byte{0}, text)...)
+	data = append(data, makeSegment(3, segEndOfPage, nil, nil)...)
+
+	expected, _ := newBitmap(20, 8)
+	expected.combine(syms[1], 2, 1, opOr)
+	expected.combine(syms[0], 10, 1, opOr)
+
+	decoded, err := Decode(data, globals, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if !bytes.Equal(decoded, invertBits(expected)) {
+		t.Errorf("Page mismatch: % x (expected % x)", decoded, invertBits(expected))
+	}
+}
+
+func TestStandardHuffmanTables(t *testing.T) {
+	// B.1: values 0-15 are coded with prefix 0 and 4 bits.
+	r := newBitReader([]byte{0x28})
+	v, err := standardTable(1).decodeValue(r)
+	if err != nil || v != 5 {
+		t.Errorf("B.1 mismatch: %d, %v (expected 5)", v, err)
+		return
+	}
+	// Prefix 10 followed by 8 bits 1010 1000 codes 16 + 0xa8.
+	r = newBitReader([]byte{0xaa, 0x00, 0x00})
+	v, err = standardTable(1).decodeValue(r)
+	if err != nil || v != 16+0xa8 {
+		t.Errorf("B.1 mismatch: %d, %v (expected %d)", v, err, 16+0xa8)
+	}
+
+	// The tables are shared by concurrent decoders.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 1; n <= len(standardTableLines); n++ {
+				if standardTable(n) == nil {
+					t.Errorf("B.%d missing", n)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, err := Decode([]byte{0, 0, 0, 1, 48}, nil, nil)
+	if err == nil {
+		t.Errorf("Truncated data should fail")
+	}
+	_, err = Decode(nil, nil, nil)
+	if err == nil {
+		t.Errorf("Missing page should fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	page := makeSegment(1, segPageInfo, nil, makePageInfo(8, 8))
+	_, err = Decode(append(page, makeSegment(2, segEndOfPage, nil, nil)...), nil, &Options{Context: ctx})
+	if err != context.Canceled {
+		t.Errorf("Canceled decoding should fail (%v)", err)
+	}
+}
+
+// Test that tiny segments with huge sizes are rejected before allocating.
+func TestDecodeHostile(t *testing.T) {
+	pageInfo := makeSegment(1, segPageInfo, nil, makePageInfo(1<<19, 1<<17))
+	if _, err := Decode(pageInfo, nil, nil); err == nil {
+		t.Errorf("Huge page should fail")
+	}
+
+	unknownHt := makeSegment(1, segPageInfo, nil, makePageInfo(1<<16, 0xffffffff))
+	stripe := makeSegment(2, segEndOfStripe, nil, appendBE32(nil, 1<<20))
+	if _, err := Decode(append(unknownHt, stripe...), nil, nil); err == nil {
+		t.Errorf("Huge end of stripe should fail")
+	}
+
+	page := makeSegment(1, segPageInfo, nil, makePageInfo(8, 8))
+	region := append(makeRegionInfo(1<<19, 1<<17, 0, 0, 0), 0)
+	generic := makeSegment(2, segImmediateGeneric, nil, append(region, make([]byte, 16)...))
+	if _, err := Decode(append(page, generic...), nil, nil); err == nil {
+		t.Errorf("Huge region should fail")
+	}
+
+	halftone := append(makeRegionInfo(8, 8, 0, 0, 0), 0)
+	halftone = appendBE32(halftone, 1<<16)
+	halftone = appendBE32(halftone, 1<<16)
+	halftone = append(halftone, make([]byte, 12)...)
+	halftoneSeg := makeSegment(2, segImmediateHalftone, nil, halftone)
+	if _, err := Decode(append(page, halftoneSeg...), nil, nil); err == nil {
+		t.Errorf("Huge halftone grid should fail")
+	}
+
+	// Pages larger than MaxSize.
+	end := makeSegment(3, segEndOfPage, nil, nil)
+	if _, err := Decode(append(page, end...), nil, &Options{MaxSize: 7}); err != ErrTooLarge {
+		t.Errorf("Page larger than MaxSize should fail (%v)", err)
+	}
+	if _, err := Decode(append(page, end...), nil, &Options{MaxSize: 8}); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	stripe = makeSegment(2, segEndOfStripe, nil, appendBE32(nil, 1<<10))
+	if _, err := Decode(append(unknownHt, stripe...), nil, &Options{MaxSize: 1 << 20}); err != ErrTooLarge {
+		t.Errorf("Stripe larger than MaxSize should fail (%v)", err)
+	}
+}
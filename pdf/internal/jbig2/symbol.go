@@ -0,0 +1,308 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jbig2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// symbolDictParams are the parameters of the symbol dictionary decoding procedure (6.5.2).
+type symbolDictParams struct {
+	huff       bool
+	refAgg     bool
+	template   int
+	at         []atPixel
+	rTemplate  int
+	rAt        []atPixel
+	numExSyms  int
+	numNewSyms int
+	inSyms     []*bitmap
+
+	// Huffman tables.
+	tableDH      *huffmanTable
+	tableDW      *huffmanTable
+	tableBMSize  *huffmanTable
+	tableAggInst *huffmanTable
+}
+
+// symbolDictDecoder decodes the values of a symbol dictionary with either arithmetic or Huffman
+// coding.
+type symbolDictDecoder struct {
+	p  *symbolDictParams
+	dc *decodingContext
+	r  *bitReader
+}
+
+func (sd *symbolDictDecoder) decodeInt(proc string, table *huffmanTable) (int, bool, error) {
+	if sd.p.huff {
+		if table == nil {
+			return 0, false, errors.New("Missing JBIG2 Huffman table")
+		}
+		return table.decode(sd.r)
+	}
+	v, ok := sd.dc.decodeInt(proc)
+	return v, ok, nil
+}
+
+func (sd *symbolDictDecoder) decodeValue(proc string, table *huffmanTable) (int, error) {
+	v, ok, err := sd.decodeInt(proc, table)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("Unexpected OOB decoding %s", proc)
+	}
+	return v, nil
+}
+
+// ceilLog2 returns the number of bits needed to represent values 0 to n-1.
+func ceilLog2(n int) uint {
+	bits := uint(0)
+	for 1<<bits < n {
+		bits++
+	}
+	return bits
+}
+
+// decodeSymbolDict decodes a symbol dictionary (6.5.5) and returns the exported symbols.  With
+// Huffman coding `r` reads the data, otherwise the arithmetic decoder of `dc` is used.
+func decodeSymbolDict(dc *decodingContext, r *bitReader, p *symbolDictParams) ([]*bitmap, error) {
+	sd := &symbolDictDecoder{p: p, dc: dc, r: r}
+
+	numSyms := len(p.inSyms) + p.numNewSyms
+	symCodeLen := ceilLog2(numSyms)
+	if p.huff && symCodeLen < 1 {
+		symCodeLen = 1
+	}
+
+	newSyms := make([]*bitmap, 0, p.numNewSyms)
+	numDecoded := 0
+	var widths []int // Widths of symbols in the current height class (Huffman collective bitmap).
+	hcHeight := 0
+	for numDecoded < p.numNewSyms {
+		dh, err := sd.decodeValue(procIADH, p.tableDH)
+		if err != nil {
+			return nil, err
+		}
+		hcHeight += dh
+		if hcHeight < 0 {
+			return nil, errors.New("Invalid JBIG2 symbol height")
+		}
+
+		symWidth := 0
+		totWidth := 0
+		widths = widths[:0]
+		for {
+			dw, ok, err := sd.decodeInt(procIADW, p.tableDW)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			if numDecoded >= p.numNewSyms {
+				return nil, errors.New("Too many JBIG2 symbols in height class")
+			}
+			symWidth += dw
+			totWidth += symWidth
+			if symWidth < 0 {
+				return nil, errors.New("Invalid JBIG2 symbol width")
+			}
+
+			switch {
+			case p.refAgg:
+				allSyms := append(append([]*bitmap{}, p.inSyms...), newSyms...)
+				bm, err := sd.decodeRefAgg(symWidth, hcHeight, allSyms, symCodeLen)
+				if err != nil {
+					return nil, err
+				}
+				newSyms = append(newSyms, bm)
+			case p.huff:
+				widths = append(widths, symWidth)
+			default:
+				gp := &genericParams{
+					width:    symWidth,
+					height:   hcHeight,
+					template: p.template,
+					at:       p.at,
+				}
+				bm, err := decodeGeneric(dc, gp)
+				if err != nil {
+					return nil, err
+				}
+				newSyms = append(newSyms, bm)
+			}
+			numDecoded++
+		}
+
+		if p.huff && !p.refAgg && len(widths) > 0 {
+			collective, err := sd.decodeCollectiveBitmap(totWidth, hcHeight)
+			if err != nil {
+				return nil, err
+			}
+			x := 0
+			for _, w := range widths {
+				sym, err := collective.subBitmap(x, 0, w, hcHeight)
+				if err != nil {
+					return nil, err
+				}
+				newSyms = append(newSyms, sym)
+				x += w
+			}
+		}
+	}
+
+	// Exported symbols (6.5.10).
+	var exSyms []*bitmap
+	exFlag := false
+	i := 0
+	for i < numSyms {
+		var run int
+		var err error
+		if p.huff {
+			run, err = standardTable(1).decodeValue(r)
+		} else {
+			run, err = sd.decodeValue(procIAEX, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if run < 0 || i+run > numSyms {
+			return nil, errors.New("Invalid JBIG2 export run length")
+		}
+		if exFlag {
+			for j := i; j < i+run; j++ {
+				if j < len(p.inSyms) {
+					exSyms = append(exSyms, p.inSyms[j])
+				} else {
+					exSyms = append(exSyms, newSyms[j-len(p.inSyms)])
+				}
+			}
+		}
+		i += run
+		exFlag = !exFlag
+	}
+	if len(exSyms) != p.numExSyms {
+		return nil, fmt.Errorf("JBIG2 exported symbol count mismatch (%d != %d)", len(exSyms), p.numExSyms)
+	}
+
+	return exSyms, nil
+}
+
+// decodeCollectiveBitmap decodes the Huffman coded height class collective bitmap (6.5.9).
+func (sd *symbolDictDecoder) decodeCollectiveBitmap(width, height int) (*bitmap, error) {
+	bmSize, err := sd.p.tableBMSize.decodeValue(sd.r)
+	if err != nil {
+		return nil, err
+	}
+	sd.r.byteAlign()
+	start := sd.r.bytePos()
+
+	if bmSize == 0 {
+		// Uncompressed.
+		bm, err := newBitmap(width, height)
+		if err != nil {
+			return nil, err
+		}
+		if start+len(bm.data) > len(sd.r.data) {
+			return nil, errUnexpectedEnd
+		}
+		copy(bm.data, sd.r.data[start:])
+		sd.r.pos = (start + len(bm.data)) * 8
+		return bm, nil
+	}
+
+	if bmSize < 0 || start+bmSize > len(sd.r.data) {
+		return nil, errUnexpectedEnd
+	}
+	bm, _, err := decodeMMR(sd.r.data[start:start+bmSize], width, height, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	sd.r.pos = (start + bmSize) * 8
+	return bm, nil
+}
+
+// decodeRefAgg decodes a symbol bitmap with refinement/aggregate coding (6.5.8.2).
+func (sd *symbolDictDecoder) decodeRefAgg(width, height int, syms []*bitmap, symCodeLen uint) (*bitmap, error) {
+	p := sd.p
+	numInst, err := sd.decodeValue(procIAAI, p.tableAggInst)
+	if err != nil {
+		return nil, err
+	}
+
+	if numInst != 1 {
+		tp := &textParams{
+			huff:         p.huff,
+			refine:       true,
+			width:        width,
+			height:       height,
+			combOp:       opOr,
+			refCorner:    cornerTopLeft,
+			numInstances: numInst,
+			syms:         syms,
+			symCodeLen:   symCodeLen,
+			rTemplate:    p.rTemplate,
+			rAt:          p.rAt,
+		}
+		if p.huff {
+			// Table 17.
+			tp.tableFS = standardTable(6)
+			tp.tableDS = standardTable(8)
+			tp.tableDT = standardTable(11)
+			tp.tableRDW = standardTable(15)
+			tp.tableRDH = standardTable(15)
+			tp.tableRDX = standardTable(15)
+			tp.tableRDY = standardTable(15)
+			tp.tableRSize = standardTable(1)
+		}
+		return decodeText(sd.dc, sd.r, tp)
+	}
+
+	var id, rdx, rdy int
+	if p.huff {
+		id, err = sd.r.readBits(int(symCodeLen))
+		if err == nil {
+			rdx, err = standardTable(15).decodeValue(sd.r)
+		}
+		if err == nil {
+			rdy, err = standardTable(15).decodeValue(sd.r)
+		}
+	} else {
+		id = sd.dc.decodeIAID(symCodeLen)
+		rdx, err = sd.decodeValue(procIARDX, nil)
+		if err == nil {
+			rdy, err = sd.decodeValue(procIARDY, nil)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if id < 0 || id >= len(syms) {
+		return nil, fmt.Errorf("Invalid JBIG2 symbol ID (%d)", id)
+	}
+
+	rp := &refinementParams{
+		width:     width,
+		height:    height,
+		template:  p.rTemplate,
+		reference: syms[id],
+		dx:        rdx,
+		dy:        rdy,
+		at:        p.rAt,
+	}
+	if !p.huff {
+		return decodeRefinement(sd.dc, rp)
+	}
+
+	bmSize, err := standardTable(1).decodeValue(sd.r)
+	if err != nil {
+		return nil, err
+	}
+	sd.r.byteAlign()
+	return decodeEmbeddedRefinement(sd.dc, sd.r, bmSize, rp)
+}
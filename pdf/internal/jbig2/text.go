@@ -0,0 +1,271 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jbig2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reference corners (7.4.3.1.1).
+const (
+	cornerBottomLeft = iota
+	cornerTopLeft
+	cornerBottomRight
+	cornerTopRight
+)
+
+// textParams are the parameters of the text region decoding procedure (6.4.2).
+type textParams struct {
+	huff         bool
+	refine       bool
+	width        int
+	height       int
+	defPixel     int
+	combOp       int
+	transposed   bool
+	refCorner    int
+	dsOffset     int
+	numInstances int
+	logStrips    uint
+	syms         []*bitmap
+	symCodeLen   uint
+	rTemplate    int
+	rAt          []atPixel
+
+	// Huffman tables.
+	symIDTable *huffmanTable // Symbol ID codes, if nil IDs are read as symCodeLen bits.
+	tableFS    *huffmanTable
+	tableDS    *huffmanTable
+	tableDT    *huffmanTable
+	tableRDW   *huffmanTable
+	tableRDH   *huffmanTable
+	tableRDX   *huffmanTable
+	tableRDY   *huffmanTable
+	tableRSize *huffmanTable
+}
+
+// textDecoder decodes the values of a text region with either arithmetic or Huffman coding.
+type textDecoder struct {
+	p  *textParams
+	dc *decodingContext // Arithmetic decoding, also used for refinements with Huffman coding.
+	r  *bitReader       // Huffman decoding.
+}
+
+// decodeInt decodes an integer with the arithmetic procedure `proc` or Huffman table `table`.
+// Returns false for OOB.
+func (td *textDecoder) decodeInt(proc string, table *huffmanTable) (int, bool, error) {
+	if td.p.huff {
+		if table == nil {
+			return 0, false, errors.New("Missing JBIG2 Huffman table")
+		}
+		return table.decode(td.r)
+	}
+	v, ok := td.dc.decodeInt(proc)
+	return v, ok, nil
+}
+
+// decodeValue decodes an integer that is not allowed to be OOB.
+func (td *textDecoder) decodeValue(proc string, table *huffmanTable) (int, error) {
+	v, ok, err := td.decodeInt(proc, table)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("Unexpected OOB decoding %s", proc)
+	}
+	return v, nil
+}
+
+// decodeText decodes a text region (6.4.5).  With Huffman coding `r` reads the data, otherwise
+// the arithmetic decoder of `dc` is used.
+func decodeText(dc *decodingContext, r *bitReader, p *textParams) (*bitmap, error) {
+	td := &textDecoder{p: p, dc: dc, r: r}
+	strips := 1 << p.logStrips
+
+	bm, err := newBitmap(p.width, p.height)
+	if err != nil {
+		return nil, err
+	}
+	bm.fill(p.defPixel)
+
+	dt, err := td.decodeValue(procIADT, p.tableDT)
+	if err != nil {
+		return nil, err
+	}
+	stripT := -dt * strips
+	firstS := 0
+	instances := 0
+	for instances < p.numInstances {
+		dt, err := td.decodeValue(procIADT, p.tableDT)
+		if err != nil {
+			return nil, err
+		}
+		stripT += dt * strips
+
+		dfs, err := td.decodeValue(procIAFS, p.tableFS)
+		if err != nil {
+			return nil, err
+		}
+		firstS += dfs
+		curS := firstS
+
+		for {
+			curT := 0
+			if strips > 1 {
+				if p.huff {
+					curT, err = r.readBits(int(p.logStrips))
+				} else {
+					curT, err = td.decodeValue(procIAIT, nil)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			t := stripT + curT
+
+			id, err := td.decodeSymbolID()
+			if err != nil {
+				return nil, err
+			}
+			if id < 0 || id >= len(p.syms) {
+				return nil, fmt.Errorf("Invalid JBIG2 symbol ID (%d)", id)
+			}
+			sym := p.syms[id]
+
+			if p.refine {
+				ri := 0
+				if p.huff {
+					ri, err = r.readBit()
+				} else {
+					ri, err = td.decodeValue(procIARI, nil)
+				}
+				if err != nil {
+					return nil, err
+				}
+				if ri != 0 {
+					sym, err = td.refineSymbol(sym)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			w, h := sym.width, sym.height
+			if !p.transposed && p.refCorner >= cornerBottomRight {
+				curS += w - 1
+			} else if p.transposed && (p.refCorner == cornerBottomLeft || p.refCorner == cornerBottomRight) {
+				curS += h - 1
+			}
+
+			var x, y int
+			if !p.transposed {
+				x, y = curS, t
+			} else {
+				x, y = t, curS
+			}
+			if p.refCorner >= cornerBottomRight {
+				x -= w - 1
+			}
+			if p.refCorner == cornerBottomLeft || p.refCorner == cornerBottomRight {
+				y -= h - 1
+			}
+			bm.combine(sym, x, y, p.combOp)
+
+			if !p.transposed && p.refCorner < cornerBottomRight {
+				curS += w - 1
+			} else if p.transposed && (p.refCorner == cornerTopLeft || p.refCorner == cornerTopRight) {
+				curS += h - 1
+			}
+
+			instances++
+			ids, ok, err := td.decodeInt(procIADS, p.tableDS)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			curS += ids + p.dsOffset
+		}
+	}
+
+	return bm, nil
+}
+
+// decodeSymbolID decodes the ID of the next symbol instance (6.4.10).
+func (td *textDecoder) decodeSymbolID() (int, error) {
+	p := td.p
+	if !p.huff {
+		return td.dc.decodeIAID(p.symCodeLen), nil
+	}
+	if p.symIDTable != nil {
+		return p.symIDTable.decodeValue(td.r)
+	}
+	return td.r.readBits(int(p.symCodeLen))
+}
+
+// refineSymbol decodes a refinement of symbol `sym` (6.4.11).
+func (td *textDecoder) refineSymbol(sym *bitmap) (*bitmap, error) {
+	p := td.p
+	rdw, err := td.decodeValue(procIARDW, p.tableRDW)
+	if err != nil {
+		return nil, err
+	}
+	rdh, err := td.decodeValue(procIARDH, p.tableRDH)
+	if err != nil {
+		return nil, err
+	}
+	rdx, err := td.decodeValue(procIARDX, p.tableRDX)
+	if err != nil {
+		return nil, err
+	}
+	rdy, err := td.decodeValue(procIARDY, p.tableRDY)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &refinementParams{
+		width:     sym.width + rdw,
+		height:    sym.height + rdh,
+		template:  p.rTemplate,
+		reference: sym,
+		dx:        rdw>>1 + rdx,
+		dy:        rdh>>1 + rdy,
+		at:        p.rAt,
+	}
+	if rp.width < 0 || rp.height < 0 {
+		return nil, errors.New("Invalid JBIG2 refinement size")
+	}
+
+	if !p.huff {
+		return decodeRefinement(td.dc, rp)
+	}
+
+	// With Huffman coding the refinement is arithmetic coded in the next BMSIZE bytes.
+	bmSize, err := td.decodeValue("", p.tableRSize)
+	if err != nil {
+		return nil, err
+	}
+	td.r.byteAlign()
+	return decodeEmbeddedRefinement(td.dc, td.r, bmSize, rp)
+}
+
+// decodeEmbeddedRefinement decodes an arithmetic coded refinement of `bmSize` bytes at the current
+// (byte aligned) position of Huffman coded data `r`, advancing past it.
+func decodeEmbeddedRefinement(dc *decodingContext, r *bitReader, bmSize int, rp *refinementParams) (*bitmap, error) {
+	start := r.bytePos()
+	if bmSize < 0 || start+bmSize > len(r.data) {
+		return nil, errUnexpectedEnd
+	}
+	dc.decoder = newArithDecoder(r.data[start : start+bmSize])
+	bm, err := decodeRefinement(dc, rp)
+	if err != nil {
+		return nil, err
+	}
+	r.pos = (start + bmSize) * 8
+	return bm, nil
+}
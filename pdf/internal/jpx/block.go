@@ -0,0 +1,422 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jpx
+
+// Subband orientations.
+const (
+	bandLL = 0
+	bandHL = 1
+	bandLH = 2
+	bandHH = 3
+)
+
+// Coding pass contexts (D.3).
+const (
+	ctxRunLength = 17
+	ctxUniform   = 18
+	numContexts  = 19
+)
+
+// Coefficient state flags.
+const (
+	flagSignificant = 1 << iota
+	flagNegative
+	flagVisited // Coded in the significance propagation pass of the current bit-plane.
+	flagRefined // Refined at least once.
+)
+
+// zeroCodingContexts holds the significance context (Table D.1) for LL/LH subbands indexed by
+// h<<4 | v<<2 | d with horizontal (h), vertical (v) and diagonal (d) significant neighbour counts.
+var zeroCodingContexts [3][48]byte
+
+func init() {
+	for h := 0; h <= 2; h++ {
+		for v := 0; v <= 2; v++ {
+			// Diagonal counts above 3 map to the same contexts as 3.
+			for d := 0; d <= 3; d++ {
+				i := h<<4 | v<<2 | d
+				zeroCodingContexts[0][i] = zeroContextLL(h, v, d)
+				zeroCodingContexts[1][i] = zeroContextLL(v, h, d)
+				zeroCodingContexts[2][i] = zeroContextHH(h+v, d)
+			}
+		}
+	}
+}
+
+// zeroContextLL returns the significance context for the LL and LH subbands (Table D.1).
+func zeroContextLL(h, v, d int) byte {
+	switch {
+	case h == 2:
+		return 8
+	case h == 1 && v >= 1:
+		return 7
+	case h == 1 && d >= 1:
+		return 6
+	case h == 1:
+		return 5
+	case v == 2:
+		return 4
+	case v == 1:
+		return 3
+	case d >= 2:
+		return 2
+	case d == 1:
+		return 1
+	}
+	return 0
+}
+
+// zeroContextHH returns the significance context for the HH subband (Table D.1).
+func zeroContextHH(hv, d int) byte {
+	switch {
+	case d >= 3:
+		return 8
+	case d == 2 && hv >= 1:
+		return 7
+	case d == 2:
+		return 6
+	case d == 1 && hv >= 2:
+		return 5
+	case d == 1 && hv == 1:
+		return 4
+	case d == 1:
+		return 3
+	case hv >= 2:
+		return 2
+	case hv == 1:
+		return 1
+	}
+	return 0
+}
+
+// codeBlockDecoder decodes the coding passes of a code-block (Annex D).
+type codeBlockDecoder struct {
+	width    int
+	height   int
+	stride   int // Width of the state arrays, which have a border of one coefficient.
+	flags    []byte
+	values   []int32 // Twice the reconstructed magnitudes (midpoints of the decoded intervals).
+	zcTable  *[48]byte
+	cbStyle  int
+	contexts [numContexts]byte
+	mq       *mqDecoder
+	raw      *rawDecoder
+}
+
+// codeBlockSegment is a codeword segment of a code-block: the data of a number of coding passes.
+type codeBlockSegment struct {
+	data   []byte
+	passes int
+}
+
+func newCodeBlockDecoder(width, height, orientation, cbStyle int) *codeBlockDecoder {
+	d := &codeBlockDecoder{
+		width:   width,
+		height:  height,
+		stride:  width + 2,
+		cbStyle: cbStyle,
+	}
+	d.flags = make([]byte, (width+2)*(height+2))
+	d.values = make([]int32, (width+2)*(height+2))
+	switch orientation {
+	case bandHL:
+		d.zcTable = &zeroCodingContexts[1]
+	case bandHH:
+		d.zcTable = &zeroCodingContexts[2]
+	default:
+		d.zcTable = &zeroCodingContexts[0]
+	}
+	d.resetContexts()
+	return d
+}
+
+// resetContexts sets the initial context states (Table D.7).
+func (d *codeBlockDecoder) resetContexts() {
+	for i := range d.contexts {
+		d.contexts[i] = 0
+	}
+	d.contexts[0] = 4 << 1
+	d.contexts[ctxRunLength] = 3 << 1
+	d.contexts[ctxUniform] = 46 << 1
+}
+
+// decode decodes the coding passes in `segments`, starting with the cleanup pass of bit-plane
+// `numBitPlanes`-1.  Returns the coefficients as twice their reconstructed value (signed), in
+// raster order.
+func (d *codeBlockDecoder) decode(segments []codeBlockSegment, numBitPlanes int) []int32 {
+	pass := 0
+	bitPlane := numBitPlanes - 1
+	passType := 2 // Cleanup.
+	for _, seg := range segments {
+		raw := d.cbStyle&cbStyleBypass != 0 && pass >= 10 && passType != 2
+		if raw {
+			d.raw = newRawDecoder(seg.data)
+		} else {
+			d.mq = newMQDecoder(seg.data)
+		}
+
+		for i := 0; i < seg.passes && bitPlane >= 0; i++ {
+			switch passType {
+			case 0:
+				d.significancePass(bitPlane, raw)
+			case 1:
+				d.refinementPass(bitPlane, raw)
+			case 2:
+				d.cleanupPass(bitPlane)
+			}
+			if d.cbStyle&cbStyleReset != 0 {
+				d.resetContexts()
+			}
+
+			pass++
+			passType++
+			if passType == 3 {
+				passType = 0
+				bitPlane--
+				d.clearVisited()
+			}
+		}
+	}
+
+	out := make([]int32, d.width*d.height)
+	for y := 0; y < d.height; y++ {
+		for x := 0; x < d.width; x++ {
+			i := (y+1)*d.stride + x + 1
+			v := d.values[i]
+			if d.flags[i]&flagNegative != 0 {
+				v = -v
+			}
+			out[y*d.width+x] = v
+		}
+	}
+	return out
+}
+
+// clearVisited clears the significance propagation pass flags at the end of a bit-plane.
+func (d *codeBlockDecoder) clearVisited() {
+	for i := range d.flags {
+		d.flags[i] &^= flagVisited
+	}
+}
+
+// neighbours returns the significance counts of the horizontal, vertical and diagonal neighbours
+// of the coefficient at state index `i` in row `y`.
+func (d *codeBlockDecoder) neighbours(i, y int) (int, int, int) {
+	f := d.flags
+	s := d.stride
+	h := int(f[i-1]&flagSignificant) + int(f[i+1]&flagSignificant)
+	v := int(f[i-s] & flagSignificant)
+	diag := int(f[i-s-1]&flagSignificant) + int(f[i-s+1]&flagSignificant)
+	if d.cbStyle&cbStyleVCausal == 0 || y%4 != 3 {
+		// In vertically causal mode the next stripe is not used (D.7).
+		v += int(f[i+s] & flagSignificant)
+		diag += int(f[i+s-1]&flagSignificant) + int(f[i+s+1]&flagSignificant)
+	}
+	return h, v, diag
+}
+
+// zeroContext returns the significance coding context of the coefficient at `i`.
+func (d *codeBlockDecoder) zeroContext(i, y int) byte {
+	h, v, diag := d.neighbours(i, y)
+	return d.zcTable[h<<4|v<<2|minInt(diag, 3)]
+}
+
+// signContribution returns the contribution of a neighbour to the sign context (Table D.2).
+func signContribution(flags byte) int {
+	if flags&flagSignificant == 0 {
+		return 0
+	}
+	if flags&flagNegative != 0 {
+		return -1
+	}
+	return 1
+}
+
+// decodeSign decodes the sign of the coefficient at `i`.
+func (d *codeBlockDecoder) decodeSign(i, y int) int {
+	ctx, xor := d.signContext(i, y)
+	return d.mq.decodeBit(&d.contexts[ctx]) ^ xor
+}
+
+// signContext returns the sign coding context and the sign prediction of the coefficient at `i`
+// (D.3.2).
+func (d *codeBlockDecoder) signContext(i, y int) (byte, int) {
+	f := d.flags
+	s := d.stride
+	h := signContribution(f[i-1]) + signContribution(f[i+1])
+	v := signContribution(f[i-s])
+	if d.cbStyle&cbStyleVCausal == 0 || y%4 != 3 {
+		v += signContribution(f[i+s])
+	}
+	h = clampSign(h)
+	v = clampSign(v)
+
+	// Table D.3.
+	var ctx byte
+	xor := 0
+	switch h {
+	case 1:
+		ctx = byte(12 + v)
+	case 0:
+		if v == 0 {
+			ctx = 9
+		} else {
+			ctx = 10
+		}
+		if v < 0 {
+			xor = 1
+		}
+	default:
+		ctx = byte(12 - v)
+		xor = 1
+	}
+	return ctx, xor
+}
+
+func clampSign(v int) int {
+	if v > 1 {
+		return 1
+	}
+	if v < -1 {
+		return -1
+	}
+	return v
+}
+
+// setSignificant marks the coefficient at `i` significant in `bitPlane`.
+func (d *codeBlockDecoder) setSignificant(i, bitPlane, sign int) {
+	one := int32(1) << uint(bitPlane+1)
+	d.values[i] = one | one>>1
+	d.flags[i] |= flagSignificant
+	if sign != 0 {
+		d.flags[i] |= flagNegative
+	}
+}
+
+// significancePass is the significance propagation decoding pass (D.3.1).
+func (d *codeBlockDecoder) significancePass(bitPlane int, raw bool) {
+	for y0 := 0; y0 < d.height; y0 += 4 {
+		for x := 0; x < d.width; x++ {
+			for y := y0; y < y0+4 && y < d.height; y++ {
+				i := (y+1)*d.stride + x + 1
+				if d.flags[i]&flagSignificant != 0 {
+					continue
+				}
+				h, v, diag := d.neighbours(i, y)
+				if h+v+diag == 0 {
+					continue
+				}
+				var bit int
+				if raw {
+					bit = d.raw.decodeBit()
+				} else {
+					bit = d.mq.decodeBit(&d.contexts[d.zcTable[h<<4|v<<2|minInt(diag, 3)]])
+				}
+				if bit != 0 {
+					var sign int
+					if raw {
+						sign = d.raw.decodeBit()
+					} else {
+						sign = d.decodeSign(i, y)
+					}
+					d.setSignificant(i, bitPlane, sign)
+				}
+				d.flags[i] |= flagVisited
+			}
+		}
+	}
+}
+
+// refinementPass is the magnitude refinement decoding pass (D.3.3).
+func (d *codeBlockDecoder) refinementPass(bitPlane int, raw bool) {
+	half := int32(1) << uint(bitPlane)
+	for y0 := 0; y0 < d.height; y0 += 4 {
+		for x := 0; x < d.width; x++ {
+			for y := y0; y < y0+4 && y < d.height; y++ {
+				i := (y+1)*d.stride + x + 1
+				f := d.flags[i]
+				if f&flagSignificant == 0 || f&flagVisited != 0 {
+					continue
+				}
+				var bit int
+				if raw {
+					bit = d.raw.decodeBit()
+				} else {
+					var ctx byte = 16
+					if f&flagRefined == 0 {
+						h, v, diag := d.neighbours(i, y)
+						if h+v+diag == 0 {
+							ctx = 14
+						} else {
+							ctx = 15
+						}
+					}
+					bit = d.mq.decodeBit(&d.contexts[ctx])
+				}
+				// Move the reconstruction point to the middle of the upper or lower half interval.
+				if bit != 0 {
+					d.values[i] += half
+				} else {
+					d.values[i] -= half
+				}
+				d.flags[i] |= flagRefined
+			}
+		}
+	}
+}
+
+// cleanupPass is the cleanup decoding pass (D.3.4).
+func (d *codeBlockDecoder) cleanupPass(bitPlane int) {
+	for y0 := 0; y0 < d.height; y0 += 4 {
+		for x := 0; x < d.width; x++ {
+			y := y0
+			if y0+4 <= d.height && d.runLengthPossible(x, y0) {
+				if d.mq.decodeBit(&d.contexts[ctxRunLength]) == 0 {
+					continue
+				}
+				run := d.mq.decodeBit(&d.contexts[ctxUniform]) << 1
+				run |= d.mq.decodeBit(&d.contexts[ctxUniform])
+				y = y0 + run
+				i := (y+1)*d.stride + x + 1
+				d.setSignificant(i, bitPlane, d.decodeSign(i, y))
+				y++
+			}
+			for ; y < y0+4 && y < d.height; y++ {
+				i := (y+1)*d.stride + x + 1
+				if d.flags[i]&(flagSignificant|flagVisited) != 0 {
+					continue
+				}
+				if d.mq.decodeBit(&d.contexts[d.zeroContext(i, y)]) != 0 {
+					d.setSignificant(i, bitPlane, d.decodeSign(i, y))
+				}
+			}
+		}
+	}
+
+	if d.cbStyle&cbStyleSegSymbol != 0 {
+		// Segmentation symbol 1010.
+		for i := 0; i < 4; i++ {
+			d.mq.decodeBit(&d.contexts[ctxUniform])
+		}
+	}
+}
+
+// runLengthPossible returns true if run-length decoding applies to the stripe column of 4
+// coefficients at (`x`, `y0`): all are insignificant, not yet coded and have insignificant
+// neighbours.
+func (d *codeBlockDecoder) runLengthPossible(x, y0 int) bool {
+	for y := y0; y < y0+4; y++ {
+		i := (y+1)*d.stride + x + 1
+		if d.flags[i]&(flagSignificant|flagVisited) != 0 {
+			return false
+		}
+		h, v, diag := d.neighbours(i, y)
+		if h+v+diag != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,801 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jpx
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+// Codestream markers (A.2).
+const (
+	markerSOC = 0xff4f
+	markerSOT = 0xff90
+	markerSOD = 0xff93
+	markerEOC = 0xffd9
+	markerSIZ = 0xff51
+	markerCOD = 0xff52
+	markerCOC = 0xff53
+	markerRGN = 0xff5e
+	markerQCD = 0xff5c
+	markerQCC = 0xff5d
+	markerPOC = 0xff5f
+	markerTLM = 0xff55
+	markerPLM = 0xff57
+	markerPLT = 0xff58
+	markerPPM = 0xff60
+	markerPPT = 0xff61
+	markerSOP = 0xff91
+	markerEPH = 0xff92
+	markerCRG = 0xff63
+	markerCOM = 0xff64
+)
+
+// Progression orders (Table A.16).
+const (
+	progressionLRCP = 0
+	progressionRLCP = 1
+	progressionRPCL = 2
+	progressionPCRL = 3
+	progressionCPRL = 4
+)
+
+// Code-block style flags (Table A.19).
+const (
+	cbStyleBypass    = 0x01
+	cbStyleReset     = 0x02
+	cbStyleTermAll   = 0x04
+	cbStyleVCausal   = 0x08
+	cbStylePredTerm  = 0x10
+	cbStyleSegSymbol = 0x20
+)
+
+// Quantization styles (Table A.28).
+const (
+	quantNone     = 0
+	quantDerived  = 1
+	quantExpanded = 2
+)
+
+var errUnexpectedEnd = errors.New("Unexpected end of JPEG 2000 data")
+
+// componentInfo holds the SIZ parameters of a component.
+type componentInfo struct {
+	precision int
+	signed    bool
+	dx        int
+	dy        int
+}
+
+// imageSize holds the SIZ marker segment parameters (A.5.1).
+type imageSize struct {
+	width    int // Xsiz
+	height   int // Ysiz
+	x0       int // XOsiz
+	y0       int // YOsiz
+	tileW    int // XTsiz
+	tileH    int // YTsiz
+	tileX0   int // XTOsiz
+	tileY0   int // YTOsiz
+	comps    []componentInfo
+	numTileX int
+	numTileY int
+}
+
+// codingStyle holds the component specific coding style parameters of COD and COC marker segments.
+type codingStyle struct {
+	levels     int // Number of decomposition levels.
+	cbW        int // Code-block width exponent.
+	cbH        int // Code-block height exponent.
+	cbStyle    int
+	reversible bool
+	precincts  []precinctSize // Per resolution level, empty for the maximum size.
+}
+
+// precinctSize holds precinct width and height exponents.
+type precinctSize struct {
+	ppx int
+	ppy int
+}
+
+// precinct returns the precinct size exponents of resolution level `r`.
+func (cs *codingStyle) precinct(r int) precinctSize {
+	if r < len(cs.precincts) {
+		return cs.precincts[r]
+	}
+	return precinctSize{15, 15}
+}
+
+// quantization holds the parameters of QCD and QCC marker segments.
+type quantization struct {
+	style     int
+	guardBits int
+	steps     []quantStep
+}
+
+// quantStep is the exponent and mantissa of a subband quantization step size.
+type quantStep struct {
+	exponent int
+	mantissa int
+}
+
+// step returns the step size parameters of subband `band` (0 for LL, followed by HL, LH, HH for
+// each resolution level) of a component with `levels` decomposition levels.
+func (q *quantization) step(band, levels int) quantStep {
+	if q.style == quantDerived {
+		s := q.steps[0]
+		if band == 0 {
+			return s
+		}
+		nb := levels - (band-1)/3
+		return quantStep{exponent: s.exponent - levels + nb, mantissa: s.mantissa}
+	}
+	if band < len(q.steps) {
+		return q.steps[band]
+	}
+	return q.steps[len(q.steps)-1]
+}
+
+// progressionChange is a progression order change of a POC marker segment (A.6.6).
+type progressionChange struct {
+	resStart    int
+	compStart   int
+	layerEnd    int
+	resEnd      int
+	compEnd     int
+	progression int
+}
+
+// codingParams holds the coding parameters in effect for a tile.
+type codingParams struct {
+	progression int
+	layers      int
+	mct         bool
+	sop         bool
+	eph         bool
+	styles      []*codingStyle  // Per component.
+	quants      []*quantization // Per component.
+	roiShift    []int           // Per component.
+	pocs        []progressionChange
+}
+
+// clone returns a copy of the parameters that can be modified by tile-part headers.
+func (cp *codingParams) clone() *codingParams {
+	c := *cp
+	c.styles = append([]*codingStyle{}, cp.styles...)
+	c.quants = append([]*quantization{}, cp.quants...)
+	c.roiShift = append([]int{}, cp.roiShift...)
+	c.pocs = append([]progressionChange{}, cp.pocs...)
+	return &c
+}
+
+// tileData collects the tile-parts of a tile.
+type tileData struct {
+	index   int
+	params  *codingParams
+	data    []byte
+	headers []byte // Packed packet headers (PPM/PPT), nil if not used.
+}
+
+// codestream holds the parsed main header and tile-parts of a codestream.
+type codestream struct {
+	size   imageSize
+	params *codingParams
+	tiles  map[int]*tileData
+	order  []int // Tile indices in order of first appearance.
+	ppm    [][]byte
+}
+
+// reader reads big-endian values from a byte slice.
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) remaining() int {
+	return len(r.data) - r.pos
+}
+
+func (r *reader) u8() (int, error) {
+	if r.pos+1 > len(r.data) {
+		return 0, errUnexpectedEnd
+	}
+	v := int(r.data[r.pos])
+	r.pos++
+	return v, nil
+}
+
+func (r *reader) u16() (int, error) {
+	if r.pos+2 > len(r.data) {
+		return 0, errUnexpectedEnd
+	}
+	v := int(r.data[r.pos])<<8 | int(r.data[r.pos+1])
+	r.pos += 2
+	return v, nil
+}
+
+func (r *reader) u32() (int, error) {
+	if r.pos+4 > len(r.data) {
+		return 0, errUnexpectedEnd
+	}
+	v := int(r.data[r.pos])<<24 | int(r.data[r.pos+1])<<16 | int(r.data[r.pos+2])<<8 | int(r.data[r.pos+3])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errUnexpectedEnd
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// parseCodestream parses the main header and tile-parts of codestream `data`.  If `headerOnly` is
+// true, parsing stops after the SIZ marker segment.
+func parseCodestream(data []byte, headerOnly bool) (*codestream, error) {
+	r := &reader{data: data}
+	marker, err := r.u16()
+	if err != nil {
+		return nil, err
+	}
+	if marker != markerSOC {
+		return nil, errors.New("Missing JPEG 2000 SOC marker")
+	}
+
+	cs := &codestream{tiles: map[int]*tileData{}}
+	var segments []markerSegment
+	for {
+		marker, err := r.u16()
+		if err != nil {
+			return nil, err
+		}
+		if marker == markerSOT {
+			r.pos -= 2
+			break
+		}
+		if marker == markerEOC {
+			break
+		}
+		segment, err := readSegment(r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch marker {
+		case markerSIZ:
+			err = cs.parseSIZ(segment)
+			if err == nil && headerOnly {
+				return cs, nil
+			}
+		case markerCOD, markerCOC, markerQCD, markerQCC, markerRGN, markerPOC:
+			err = cs.checkSIZ()
+			segments = append(segments, markerSegment{marker, segment})
+		case markerPPM:
+			if len(segment) < 1 {
+				return nil, errUnexpectedEnd
+			}
+			cs.ppm = append(cs.ppm, segment[1:])
+		case markerTLM, markerPLM, markerCRG, markerCOM:
+			// Informational only.
+		default:
+			common.Log.Debug("Unsupported JPEG 2000 main header marker %04x - skipping", marker)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := cs.checkSIZ(); err != nil {
+		return nil, err
+	}
+	if err := applySegments(segments, cs.params); err != nil {
+		return nil, err
+	}
+	for i := range cs.params.styles {
+		if cs.params.styles[i] == nil || cs.params.quants[i] == nil {
+			return nil, errors.New("Missing JPEG 2000 COD or QCD marker segment")
+		}
+	}
+
+	var ppm []byte
+	for _, p := range cs.ppm {
+		ppm = append(ppm, p...)
+	}
+	ppmReader := &reader{data: ppm}
+
+	for r.remaining() >= 2 {
+		marker, err := r.u16()
+		if err != nil {
+			return nil, err
+		}
+		if marker == markerEOC {
+			break
+		}
+		if marker != markerSOT {
+			return nil, fmt.Errorf("Unexpected JPEG 2000 marker %04x", marker)
+		}
+		err = cs.parseTilePart(r, ppmReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// markerSegment is a marker segment of a header.
+type markerSegment struct {
+	marker int
+	data   []byte
+}
+
+// applySegments applies the coding parameter marker segments of a main or tile-part header to
+// `cp`.  Segments are applied in order of increasing precedence (A.6) as their order in the header
+// is not fixed.
+func applySegments(segments []markerSegment, cp *codingParams) error {
+	order := []int{markerCOD, markerCOC, markerQCD, markerQCC, markerRGN, markerPOC}
+	for _, marker := range order {
+		for _, seg := range segments {
+			if seg.marker != marker {
+				continue
+			}
+			var err error
+			switch marker {
+			case markerCOD:
+				err = parseCOD(seg.data, cp)
+			case markerCOC:
+				err = parseCOC(seg.data, cp)
+			case markerQCD:
+				err = parseQCD(seg.data, cp)
+			case markerQCC:
+				err = parseQCC(seg.data, cp)
+			case markerRGN:
+				err = parseRGN(seg.data, cp)
+			case markerPOC:
+				err = parsePOC(seg.data, cp)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readSegment reads the length and contents of a marker segment.
+func readSegment(r *reader) ([]byte, error) {
+	length, err := r.u16()
+	if err != nil {
+		return nil, err
+	}
+	if length < 2 {
+		return nil, errors.New("Invalid JPEG 2000 marker segment length")
+	}
+	return r.bytes(length - 2)
+}
+
+// checkSIZ checks that the SIZ marker segment has been parsed.
+func (cs *codestream) checkSIZ() error {
+	if cs.params == nil {
+		return errors.New("Missing JPEG 2000 SIZ marker segment")
+	}
+	return nil
+}
+
+// parseSIZ parses the image and tile size marker segment (A.5.1).
+func (cs *codestream) parseSIZ(segment []byte) error {
+	r := &reader{data: segment}
+	var vals [9]int
+	for i := range vals {
+		var err error
+		if i == 0 {
+			vals[i], err = r.u16() // Rsiz.
+		} else {
+			vals[i], err = r.u32()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	numComps, err := r.u16()
+	if err != nil {
+		return err
+	}
+	sz := imageSize{
+		width:  vals[1],
+		height: vals[2],
+		x0:     vals[3],
+		y0:     vals[4],
+		tileW:  vals[5],
+		tileH:  vals[6],
+		tileX0: vals[7],
+		tileY0: vals[8],
+	}
+	if sz.width <= sz.x0 || sz.height <= sz.y0 || sz.tileW <= 0 || sz.tileH <= 0 || numComps < 1 ||
+		sz.tileX0 > sz.x0 || sz.tileY0 > sz.y0 || sz.width-sz.x0 > 1<<16 || sz.height-sz.y0 > 1<<16 {
+		return fmt.Errorf("Invalid JPEG 2000 image size (%d x %d)", sz.width-sz.x0, sz.height-sz.y0)
+	}
+	for i := 0; i < numComps; i++ {
+		b, err := r.bytes(3)
+		if err != nil {
+			return err
+		}
+		ci := componentInfo{
+			precision: int(b[0]&0x7f) + 1,
+			signed:    b[0]&0x80 != 0,
+			dx:        int(b[1]),
+			dy:        int(b[2]),
+		}
+		if ci.dx < 1 || ci.dy < 1 || ci.precision > 31 {
+			return errors.New("Invalid JPEG 2000 component parameters")
+		}
+		sz.comps = append(sz.comps, ci)
+	}
+	sz.numTileX = ceilDiv(sz.width-sz.tileX0, sz.tileW)
+	sz.numTileY = ceilDiv(sz.height-sz.tileY0, sz.tileH)
+	if sz.numTileX*sz.numTileY > 65535 {
+		return errors.New("Too many JPEG 2000 tiles")
+	}
+	cs.size = sz
+
+	cs.params = &codingParams{
+		layers:   1,
+		styles:   make([]*codingStyle, numComps),
+		quants:   make([]*quantization, numComps),
+		roiShift: make([]int, numComps),
+	}
+	return nil
+}
+
+// componentIndex reads a component index of 1 or 2 bytes depending on the number of components.
+func componentIndex(r *reader, numComps int) (int, error) {
+	var c int
+	var err error
+	if numComps < 257 {
+		c, err = r.u8()
+	} else {
+		c, err = r.u16()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if c >= numComps {
+		return 0, fmt.Errorf("Invalid JPEG 2000 component index (%d)", c)
+	}
+	return c, nil
+}
+
+// parseStyle parses the SPcod or SPcoc parameters (Table A.15).
+func parseStyle(r *reader, customPrecincts bool) (*codingStyle, error) {
+	b, err := r.bytes(5)
+	if err != nil {
+		return nil, err
+	}
+	style := &codingStyle{
+		levels:     int(b[0]),
+		cbW:        int(b[1]) + 2,
+		cbH:        int(b[2]) + 2,
+		cbStyle:    int(b[3]),
+		reversible: b[4] == 1,
+	}
+	if style.levels > 32 || style.cbW > 10 || style.cbH > 10 || style.cbW+style.cbH > 12 {
+		return nil, errors.New("Invalid JPEG 2000 coding style")
+	}
+	if customPrecincts {
+		for i := 0; i <= style.levels; i++ {
+			v, err := r.u8()
+			if err != nil {
+				return nil, err
+			}
+			style.precincts = append(style.precincts, precinctSize{v & 0x0f, v >> 4})
+		}
+	}
+	return style, nil
+}
+
+// parseCOD parses the coding style default marker segment (A.6.1).
+func parseCOD(segment []byte, cp *codingParams) error {
+	r := &reader{data: segment}
+	b, err := r.bytes(5)
+	if err != nil {
+		return err
+	}
+	scod := b[0]
+	cp.progression = int(b[1])
+	cp.layers = int(b[2])<<8 | int(b[3])
+	cp.mct = b[4] != 0
+	cp.sop = scod&2 != 0
+	cp.eph = scod&4 != 0
+	if cp.layers < 1 || cp.progression > progressionCPRL {
+		return errors.New("Invalid JPEG 2000 COD marker segment")
+	}
+
+	style, err := parseStyle(r, scod&1 != 0)
+	if err != nil {
+		return err
+	}
+	// COD applies to all components without a COC.
+	for i := range cp.styles {
+		cp.styles[i] = style
+	}
+	return nil
+}
+
+// parseCOC parses the coding style component marker segment (A.6.2).
+func parseCOC(segment []byte, cp *codingParams) error {
+	r := &reader{data: segment}
+	c, err := componentIndex(r, len(cp.styles))
+	if err != nil {
+		return err
+	}
+	scoc, err := r.u8()
+	if err != nil {
+		return err
+	}
+	style, err := parseStyle(r, scoc&1 != 0)
+	if err != nil {
+		return err
+	}
+	cp.styles[c] = style
+	return nil
+}
+
+// parseQuant parses the Sqcd/SPqcd or Sqcc/SPqcc parameters (Table A.27).
+func parseQuant(r *reader) (*quantization, error) {
+	sq, err := r.u8()
+	if err != nil {
+		return nil, err
+	}
+	q := &quantization{style: sq & 0x1f, guardBits: sq >> 5}
+	switch q.style {
+	case quantNone:
+		for r.remaining() > 0 {
+			v, _ := r.u8()
+			q.steps = append(q.steps, quantStep{exponent: v >> 3})
+		}
+	case quantDerived, quantExpanded:
+		for r.remaining() >= 2 {
+			v, _ := r.u16()
+			q.steps = append(q.steps, quantStep{exponent: v >> 11, mantissa: v & 0x7ff})
+		}
+	default:
+		return nil, fmt.Errorf("Invalid JPEG 2000 quantization style (%d)", q.style)
+	}
+	if len(q.steps) == 0 {
+		return nil, errors.New("Missing JPEG 2000 quantization step sizes")
+	}
+	return q, nil
+}
+
+// parseQCD parses the quantization default marker segment (A.6.4).
+func parseQCD(segment []byte, cp *codingParams) error {
+	q, err := parseQuant(&reader{data: segment})
+	if err != nil {
+		return err
+	}
+	for i := range cp.quants {
+		cp.quants[i] = q
+	}
+	return nil
+}
+
+// parseQCC parses the quantization component marker segment (A.6.5).
+func parseQCC(segment []byte, cp *codingParams) error {
+	r := &reader{data: segment}
+	c, err := componentIndex(r, len(cp.quants))
+	if err != nil {
+		return err
+	}
+	q, err := parseQuant(r)
+	if err != nil {
+		return err
+	}
+	cp.quants[c] = q
+	return nil
+}
+
+// parseRGN parses the region of interest marker segment (A.6.3).
+func parseRGN(segment []byte, cp *codingParams) error {
+	r := &reader{data: segment}
+	c, err := componentIndex(r, len(cp.roiShift))
+	if err != nil {
+		return err
+	}
+	b, err := r.bytes(2)
+	if err != nil {
+		return err
+	}
+	if b[0] != 0 {
+		return errors.New("Unsupported JPEG 2000 region of interest style")
+	}
+	cp.roiShift[c] = int(b[1])
+	return nil
+}
+
+// parsePOC parses the progression order change marker segment (A.6.6).
+func parsePOC(segment []byte, cp *codingParams) error {
+	numComps := len(cp.styles)
+	r := &reader{data: segment}
+	for r.remaining() > 0 {
+		var poc progressionChange
+		var err error
+		if poc.resStart, err = r.u8(); err != nil {
+			return err
+		}
+		if numComps < 257 {
+			poc.compStart, err = r.u8()
+		} else {
+			poc.compStart, err = r.u16()
+		}
+		if err != nil {
+			return err
+		}
+		if poc.layerEnd, err = r.u16(); err != nil {
+			return err
+		}
+		if poc.resEnd, err = r.u8(); err != nil {
+			return err
+		}
+		if numComps < 257 {
+			poc.compEnd, err = r.u8()
+		} else {
+			poc.compEnd, err = r.u16()
+		}
+		if err != nil {
+			return err
+		}
+		if poc.compEnd == 0 {
+			poc.compEnd = 256
+		}
+		if poc.progression, err = r.u8(); err != nil {
+			return err
+		}
+		if poc.progression > progressionCPRL {
+			return errors.New("Invalid JPEG 2000 progression order")
+		}
+		cp.pocs = append(cp.pocs, poc)
+	}
+	return nil
+}
+
+// parseTilePart parses a tile-part starting after the SOT marker (A.4.2).
+func (cs *codestream) parseTilePart(r *reader, ppm *reader) error {
+	start := r.pos - 2
+	segment, err := readSegment(r)
+	if err != nil {
+		return err
+	}
+	if len(segment) < 8 {
+		return errUnexpectedEnd
+	}
+	sr := &reader{data: segment}
+	index, _ := sr.u16()
+	length, _ := sr.u32()
+	partIndex, _ := sr.u8()
+
+	numTiles := cs.size.numTileX * cs.size.numTileY
+	if index >= numTiles {
+		return fmt.Errorf("Invalid JPEG 2000 tile index (%d)", index)
+	}
+	end := len(r.data)
+	if length == 0 && end >= 2 && r.data[end-2] == 0xff && r.data[end-1] == 0xd9 {
+		// The last tile-part extends to the EOC marker.
+		end -= 2
+	}
+	if length != 0 {
+		end = start + length
+		if end > len(r.data) {
+			common.Log.Debug("JPEG 2000 tile-part exceeds data length - truncating")
+			end = len(r.data)
+		}
+	}
+
+	tile, has := cs.tiles[index]
+	if !has {
+		tile = &tileData{index: index, params: cs.params.clone()}
+		cs.tiles[index] = tile
+		cs.order = append(cs.order, index)
+	}
+
+	var segments []markerSegment
+	for {
+		marker, err := r.u16()
+		if err != nil {
+			return err
+		}
+		if marker == markerSOD {
+			break
+		}
+		segment, err := readSegment(r)
+		if err != nil {
+			return err
+		}
+		switch marker {
+		case markerCOD, markerCOC, markerQCD, markerQCC, markerRGN, markerPOC:
+			segments = append(segments, markerSegment{marker, segment})
+		case markerPPT:
+			if len(segment) < 1 {
+				return errUnexpectedEnd
+			}
+			tile.headers = append(tile.headers, segment[1:]...)
+		case markerPLT, markerCOM:
+			// Informational only.
+		default:
+			common.Log.Debug("Unsupported JPEG 2000 tile-part header marker %04x - skipping", marker)
+		}
+	}
+	// Coding parameters may only be changed in the first tile-part.
+	if partIndex != 0 {
+		var pocs []markerSegment
+		for _, seg := range segments {
+			if seg.marker == markerPOC {
+				pocs = append(pocs, seg)
+			}
+		}
+		segments = pocs
+	} else {
+		for _, seg := range segments {
+			if seg.marker == markerPOC {
+				tile.params.pocs = nil
+				break
+			}
+		}
+	}
+	if err := applySegments(segments, tile.params); err != nil {
+		return err
+	}
+	if r.pos > end {
+		return errors.New("Invalid JPEG 2000 tile-part length")
+	}
+
+	if len(cs.ppm) > 0 {
+		// Packed packet headers of the tile-part: Nppm followed by the headers.
+		n, err := ppm.u32()
+		if err != nil {
+			return err
+		}
+		headers, err := ppm.bytes(n)
+		if err != nil {
+			return err
+		}
+		tile.headers = append(tile.headers, headers...)
+	}
+
+	tile.data = append(tile.data, r.data[r.pos:end]...)
+	r.pos = end
+	return nil
+}
+
+// ceilDiv returns ceil(a / b) for b > 0.
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// ceilDivPow2 returns ceil(a / 2^n).
+func ceilDivPow2(a int, n uint) int {
+	return (a + (1 << n) - 1) >> n
+}
+
+// floorDivPow2 returns floor(a / 2^n).
+func floorDivPow2(a int, n uint) int {
+	return a >> n
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
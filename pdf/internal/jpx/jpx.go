@@ -0,0 +1,662 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+// Package jpx implements a decoder for JPEG 2000 (ITU-T Recommendation T.800) codestreams and JP2
+// files as used by the JPXDecode filter.
+package jpx
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+// JP2 enumerated colour spaces (I.5.3.3).
+const (
+	ColorSpaceUnknown = 0
+	ColorSpaceCMYK    = 12
+	ColorSpaceSRGB    = 16
+	ColorSpaceGray    = 17
+	ColorSpaceSYCC    = 18
+)
+
+// Image is a decoded JPEG 2000 image.
+type Image struct {
+	Width  int
+	Height int
+
+	// Components holds the channels of the image.  Colour channels come first in the order of
+	// the colour space, followed by any opacity channels.
+	Components []*Component
+
+	// ColorSpace is the enumerated colour space of the JP2 header, or ColorSpaceUnknown if not
+	// specified.  sYCC images are converted to sRGB.
+	ColorSpace int
+	// ICCProfile is the ICC profile of the JP2 header, if any.
+	ICCProfile []byte
+}
+
+// Component is a channel of a decoded image.
+type Component struct {
+	Precision int  // Bits per sample.
+	Signed    bool // Samples are signed.
+	Opacity   bool // The channel is an opacity (alpha) channel.
+
+	// Samples holds Width x Height samples at the image resolution, row by row.
+	Samples []int32
+}
+
+// Config holds the image properties from the headers of a JPEG 2000 image.
+type Config struct {
+	Width         int
+	Height        int
+	NumComponents int // Number of colour channels.
+	Precision     int // Maximum bits per sample of the colour channels.
+	HasOpacity    bool
+	ColorSpace    int
+	ICCProfile    []byte
+}
+
+// jp2Header holds the information of the JP2 header box (I.5.3).
+type jp2Header struct {
+	colorSpace int
+	icc        []byte
+	palette    *palette
+	mapping    []componentMapping
+	channels   []channelDef
+}
+
+// palette is the content of the palette box (I.5.3.4).
+type palette struct {
+	precision []int
+	signed    []bool
+	entries   [][]int32 // Per column.
+}
+
+// componentMapping is an entry of the component mapping box (I.5.3.5).
+type componentMapping struct {
+	component  int
+	usePalette bool
+	column     int
+}
+
+// channelDef is an entry of the channel definition box (I.5.3.6).
+type channelDef struct {
+	channel     int
+	typ         int
+	association int
+}
+
+// Channel types of the channel definition box.
+const (
+	channelColor         = 0
+	channelOpacity       = 1
+	channelPremulOpacity = 2
+)
+
+// DefaultMaxSize is the default maximum memory in bytes used for decoding an image.  The samples
+// take 4 bytes each at the image resolution, and 8 bytes each in the tiles while decoded.
+const DefaultMaxSize = 1 << 28
+
+// Options are the decoding options.
+type Options struct {
+	// MaxSize is the maximum memory in bytes used for decoding an image, DefaultMaxSize if 0.
+	// Larger images are rejected before decoding.
+	MaxSize int
+
+	// Context is checked for cancellation between the tiles if not nil.
+	Context context.Context
+}
+
+// maxSize returns the maximum memory size of the options `opts`, which can be nil.
+func (opts *Options) maxSize() int {
+	if opts == nil || opts.MaxSize <= 0 {
+		return DefaultMaxSize
+	}
+	return opts.MaxSize
+}
+
+// context returns the context of the options `opts`, which can be nil.
+func (opts *Options) context() context.Context {
+	if opts == nil {
+		return nil
+	}
+	return opts.Context
+}
+
+// Decode decodes the JPEG 2000 codestream or JP2 file `data` with options `opts`, which can be
+// nil for the defaults.
+func Decode(data []byte, opts *Options) (*Image, error) {
+	codestream, header, err := splitJP2(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sz, comps, err := decodeCodestream(codestream, opts.maxSize(), opts.context())
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Width:      sz.width - sz.x0,
+		Height:     sz.height - sz.y0,
+		Components: comps,
+	}
+	if header != nil {
+		img.ColorSpace = header.colorSpace
+		img.ICCProfile = header.icc
+		err = header.applyChannels(img)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if img.ColorSpace == ColorSpaceSYCC {
+		convertSYCC(img)
+	}
+	return img, nil
+}
+
+// DecodeConfig returns the image properties of the JPEG 2000 codestream or JP2 file `data`
+// without decoding the image.
+func DecodeConfig(data []byte) (*Config, error) {
+	codestream, header, err := splitJP2(data)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := parseCodestream(codestream, true)
+	if err != nil {
+		return nil, err
+	}
+	sz := cs.size
+
+	cfg := &Config{
+		Width:  sz.width - sz.x0,
+		Height: sz.height - sz.y0,
+	}
+
+	// Channels before any channel definitions.
+	var precision []int
+	if header != nil && header.palette != nil && len(header.mapping) > 0 {
+		for _, m := range header.mapping {
+			if m.usePalette && m.column < len(header.palette.precision) {
+				precision = append(precision, header.palette.precision[m.column])
+			} else if m.component < len(sz.comps) {
+				precision = append(precision, sz.comps[m.component].precision)
+			}
+		}
+	} else {
+		for _, ci := range sz.comps {
+			precision = append(precision, ci.precision)
+		}
+	}
+
+	opacity := make([]bool, len(precision))
+	if header != nil {
+		cfg.ColorSpace = header.colorSpace
+		if cfg.ColorSpace == ColorSpaceSYCC {
+			cfg.ColorSpace = ColorSpaceSRGB
+		}
+		cfg.ICCProfile = header.icc
+		for _, def := range header.channels {
+			if def.channel < len(opacity) && (def.typ == channelOpacity || def.typ == channelPremulOpacity) {
+				opacity[def.channel] = true
+			}
+		}
+	}
+	for i, p := range precision {
+		if opacity[i] {
+			cfg.HasOpacity = true
+			continue
+		}
+		cfg.NumComponents++
+		cfg.Precision = maxInt(cfg.Precision, p)
+	}
+	return cfg, nil
+}
+
+// splitJP2 returns the codestream and the JP2 header of `data`, which is either a JP2 file or a
+// raw codestream (no header).
+func splitJP2(data []byte) ([]byte, *jp2Header, error) {
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0x4f {
+		return data, nil, nil
+	}
+
+	var header *jp2Header
+	var codestream []byte
+	err := parseBoxes(data, func(typ string, content []byte) error {
+		switch typ {
+		case "jp2h":
+			h, err := parseJP2Header(content)
+			if err != nil {
+				return err
+			}
+			header = h
+		case "jp2c":
+			if codestream == nil {
+				codestream = content
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if codestream == nil {
+		return nil, nil, errors.New("Missing JPEG 2000 codestream")
+	}
+	return codestream, header, nil
+}
+
+// parseBoxes calls `handler` for each box in `data` (I.4).
+func parseBoxes(data []byte, handler func(typ string, content []byte) error) error {
+	r := &reader{data: data}
+	for r.remaining() >= 8 {
+		start := r.pos
+		length, _ := r.u32()
+		typ, _ := r.bytes(4)
+		headerLen := 8
+		switch length {
+		case 0:
+			length = len(data) - start
+		case 1:
+			hi, err := r.u32()
+			if err != nil {
+				return err
+			}
+			lo, err := r.u32()
+			if err != nil {
+				return err
+			}
+			if hi != 0 {
+				return errors.New("JPEG 2000 box too large")
+			}
+			length = lo
+			headerLen = 16
+		}
+		if length < headerLen || start+length > len(data) {
+			if string(typ) == "jp2c" && start+headerLen <= len(data) {
+				// Be tolerant of a codestream box with an invalid length.
+				common.Log.Debug("Invalid JPEG 2000 codestream box length")
+				length = len(data) - start
+			} else {
+				return errors.New("Invalid JPEG 2000 box length")
+			}
+		}
+		err := handler(string(typ), data[start+headerLen:start+length])
+		if err != nil {
+			return err
+		}
+		r.pos = start + length
+	}
+	return nil
+}
+
+// parseJP2Header parses the boxes of the JP2 header box (I.5.3).
+func parseJP2Header(data []byte) (*jp2Header, error) {
+	h := &jp2Header{}
+	colrFound := false
+	err := parseBoxes(data, func(typ string, content []byte) error {
+		r := &reader{data: content}
+		switch typ {
+		case "colr":
+			if colrFound {
+				// Only the first colour specification box is used.
+				return nil
+			}
+			colrFound = true
+			b, err := r.bytes(3)
+			if err != nil {
+				return err
+			}
+			switch b[0] {
+			case 1:
+				h.colorSpace, err = r.u32()
+				if err != nil {
+					return err
+				}
+			case 2, 3:
+				h.icc = content[3:]
+			default:
+				common.Log.Debug("Unsupported JPEG 2000 colour specification method %d", b[0])
+			}
+		case "pclr":
+			p, err := parsePalette(r)
+			if err != nil {
+				return err
+			}
+			h.palette = p
+		case "cmap":
+			for r.remaining() >= 4 {
+				cmp, _ := r.u16()
+				mtyp, _ := r.u8()
+				pcol, _ := r.u8()
+				h.mapping = append(h.mapping, componentMapping{cmp, mtyp == 1, pcol})
+			}
+		case "cdef":
+			n, err := r.u16()
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				var vals [3]int
+				for j := range vals {
+					vals[j], err = r.u16()
+					if err != nil {
+						return err
+					}
+				}
+				h.channels = append(h.channels, channelDef{vals[0], vals[1], vals[2]})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parsePalette parses the palette box (I.5.3.4).
+func parsePalette(r *reader) (*palette, error) {
+	numEntries, err := r.u16()
+	if err != nil {
+		return nil, err
+	}
+	numColumns, err := r.u8()
+	if err != nil {
+		return nil, err
+	}
+	if numEntries < 1 || numEntries > 1024 || numColumns < 1 {
+		return nil, errors.New("Invalid JPEG 2000 palette")
+	}
+	p := &palette{}
+	for i := 0; i < numColumns; i++ {
+		b, err := r.u8()
+		if err != nil {
+			return nil, err
+		}
+		p.precision = append(p.precision, b&0x7f+1)
+		p.signed = append(p.signed, b&0x80 != 0)
+		p.entries = append(p.entries, make([]int32, numEntries))
+	}
+	for e := 0; e < numEntries; e++ {
+		for c := 0; c < numColumns; c++ {
+			n := (p.precision[c] + 7) / 8
+			b, err := r.bytes(n)
+			if err != nil {
+				return nil, err
+			}
+			v := 0
+			for _, x := range b {
+				v = v<<8 | int(x)
+			}
+			if p.signed[c] && v >= 1<<uint(p.precision[c]-1) {
+				v -= 1 << uint(p.precision[c])
+			}
+			p.entries[c][e] = int32(v)
+		}
+	}
+	return p, nil
+}
+
+// applyChannels maps the codestream components of `img` to channels with the palette, component
+// mapping and channel definitions of the JP2 header.
+func (h *jp2Header) applyChannels(img *Image) error {
+	comps := img.Components
+	if h.palette != nil && len(h.mapping) > 0 {
+		var mapped []*Component
+		for _, m := range h.mapping {
+			if m.component >= len(comps) {
+				return errors.New("Invalid JPEG 2000 component mapping")
+			}
+			src := comps[m.component]
+			if !m.usePalette {
+				mapped = append(mapped, src)
+				continue
+			}
+			if m.column >= len(h.palette.entries) {
+				return errors.New("Invalid JPEG 2000 palette column")
+			}
+			entries := h.palette.entries[m.column]
+			ch := &Component{
+				Precision: h.palette.precision[m.column],
+				Signed:    h.palette.signed[m.column],
+				Samples:   make([]int32, len(src.Samples)),
+			}
+			for i, v := range src.Samples {
+				if v < 0 {
+					v = 0
+				} else if int(v) >= len(entries) {
+					v = int32(len(entries) - 1)
+				}
+				ch.Samples[i] = entries[v]
+			}
+			mapped = append(mapped, ch)
+		}
+		comps = mapped
+	}
+
+	if len(h.channels) > 0 {
+		// Order the colour channels by association, followed by the opacity channels.
+		color := make([]*Component, len(comps))
+		var opacity []*Component
+		used := make([]bool, len(comps))
+		for _, def := range h.channels {
+			if def.channel >= len(comps) {
+				continue
+			}
+			ch := comps[def.channel]
+			switch def.typ {
+			case channelOpacity, channelPremulOpacity:
+				ch.Opacity = true
+				opacity = append(opacity, ch)
+				used[def.channel] = true
+			case channelColor:
+				if def.association >= 1 && def.association <= len(color) && color[def.association-1] == nil {
+					color[def.association-1] = ch
+					used[def.channel] = true
+				}
+			}
+		}
+		var ordered []*Component
+		for _, ch := range color {
+			if ch != nil {
+				ordered = append(ordered, ch)
+			}
+		}
+		for i, ch := range comps {
+			if !used[i] {
+				ordered = append(ordered, ch)
+			}
+		}
+		comps = append(ordered, opacity...)
+	}
+
+	img.Components = comps
+	return nil
+}
+
+// convertSYCC converts the first three channels of `img` from sYCC to sRGB.
+func convertSYCC(img *Image) {
+	img.ColorSpace = ColorSpaceSRGB
+	if len(img.Components) < 3 {
+		return
+	}
+	y, cb, cr := img.Components[0], img.Components[1], img.Components[2]
+	if cb.Precision != y.Precision || cr.Precision != y.Precision {
+		return
+	}
+	offset := float64(int(1) << uint(y.Precision-1))
+	maxVal := float64(int(1)<<uint(y.Precision) - 1)
+	for i := range y.Samples {
+		vy := float64(y.Samples[i])
+		vb := float64(cb.Samples[i]) - offset
+		vr := float64(cr.Samples[i]) - offset
+		y.Samples[i] = int32(clamp(math.Floor(vy+1.402*vr+0.5), 0, maxVal))
+		cb.Samples[i] = int32(clamp(math.Floor(vy-0.344136*vb-0.714136*vr+0.5), 0, maxVal))
+		cr.Samples[i] = int32(clamp(math.Floor(vy+1.772*vb+0.5), 0, maxVal))
+	}
+}
+
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// decodeCodestream decodes the codestream `data` and returns the image size and the components
+// at the image resolution.  Images needing more than `maxSize` bytes are rejected.  `ctx` is checked
+// for cancellation before each tile if not nil.
+func decodeCodestream(data []byte, maxSize int, ctx context.Context) (*imageSize, []*Component, error) {
+	cs, err := parseCodestream(data, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	sz := &cs.size
+	width := sz.width - sz.x0
+	height := sz.height - sz.y0
+	if size := sz.memorySize(); size > int64(maxSize) {
+		common.Log.Debug("JPEG 2000 image of %d x %d x %d needs %d bytes (max %d)", width, height,
+			len(sz.comps), size, maxSize)
+		return nil, nil, errors.New("JPEG 2000 image too large")
+	}
+
+	// Component planes at the component resolution.
+	planes := make([][]int32, len(sz.comps))
+	planeW := make([]int, len(sz.comps))
+	planeH := make([]int, len(sz.comps))
+	for c, ci := range sz.comps {
+		planeW[c] = ceilDiv(sz.width, ci.dx) - ceilDiv(sz.x0, ci.dx)
+		planeH[c] = ceilDiv(sz.height, ci.dy) - ceilDiv(sz.y0, ci.dy)
+		planes[c] = make([]int32, planeW[c]*planeH[c])
+		if !ci.signed {
+			// Missing tiles are mid grey.
+			mid := int32(1) << uint(ci.precision-1)
+			for i := range planes[c] {
+				planes[c][i] = mid
+			}
+		}
+	}
+
+	for _, index := range cs.order {
+		if ctx != nil {
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+		}
+		td := cs.tiles[index]
+		t, err := newTile(sz, index, td.params)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = t.decodePackets(td.data, td.headers)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		samples := make([][]float64, len(t.comps))
+		for c, tc := range t.comps {
+			samples[c] = tc.reconstruct(tc.decodeCodeBlocks())
+		}
+		t.inverseMCT(samples)
+
+		for c, tc := range t.comps {
+			ci := tc.info
+			minVal, maxVal := 0.0, float64(int(1)<<uint(ci.precision)-1)
+			shift := float64(int(1) << uint(ci.precision-1))
+			if ci.signed {
+				minVal, maxVal = -shift, shift-1
+				shift = 0
+			}
+			w := tc.x1 - tc.x0
+			px0 := tc.x0 - ceilDiv(sz.x0, ci.dx)
+			py0 := tc.y0 - ceilDiv(sz.y0, ci.dy)
+			for y := 0; y < tc.y1-tc.y0; y++ {
+				row := planes[c][(py0+y)*planeW[c]+px0:]
+				for x := 0; x < w; x++ {
+					v := math.Floor(samples[c][y*w+x] + shift + 0.5)
+					row[x] = int32(clamp(v, minVal, maxVal))
+				}
+			}
+		}
+	}
+
+	// Upsample subsampled components to the image resolution.
+	comps := make([]*Component, len(sz.comps))
+	for c, ci := range sz.comps {
+		comp := &Component{Precision: ci.precision, Signed: ci.signed}
+		if ci.dx == 1 && ci.dy == 1 {
+			comp.Samples = planes[c]
+		} else {
+			comp.Samples = make([]int32, width*height)
+			cx0 := ceilDiv(sz.x0, ci.dx)
+			cy0 := ceilDiv(sz.y0, ci.dy)
+			for y := 0; y < height; y++ {
+				py := minInt(maxInt((sz.y0+y)/ci.dy-cy0, 0), planeH[c]-1)
+				for x := 0; x < width; x++ {
+					px := minInt(maxInt((sz.x0+x)/ci.dx-cx0, 0), planeW[c]-1)
+					comp.Samples[y*width+x] = planes[c][py*planeW[c]+px]
+				}
+			}
+		}
+		comps[c] = comp
+	}
+	return sz, comps, nil
+}
+
+// memorySize returns the memory in bytes needed for decoding the image: the component planes at
+// the component resolution, the components upsampled to the image resolution and the samples of
+// the largest tile.
+func (sz *imageSize) memorySize() int64 {
+	width := int64(sz.width - sz.x0)
+	height := int64(sz.height - sz.y0)
+	tileW := int64(minInt(sz.tileW, sz.width-sz.x0))
+	tileH := int64(minInt(sz.tileH, sz.height-sz.y0))
+	var size int64
+	for _, ci := range sz.comps {
+		dx, dy := int64(ci.dx), int64(ci.dy)
+		size += 4 * ((width + dx) / dx) * ((height + dy) / dy)
+		if ci.dx != 1 || ci.dy != 1 {
+			size += 4 * width * height
+		}
+		size += 8 * ((tileW + dx) / dx) * ((tileH + dy) / dy)
+	}
+	return size
+}
+
+// inverseMCT applies the inverse multiple component transformation to the first three
+// components of the tile (G.2, G.3).
+func (t *tile) inverseMCT(samples [][]float64) {
+	if !t.params.mct || len(t.comps) < 3 {
+		return
+	}
+	n := len(samples[0])
+	if len(samples[1]) != n || len(samples[2]) != n {
+		common.Log.Debug("JPEG 2000 component transformation with different component sizes")
+		return
+	}
+	y0, y1, y2 := samples[0], samples[1], samples[2]
+	if t.comps[0].style.reversible {
+		for i := 0; i < n; i++ {
+			g := y0[i] - math.Floor((y2[i]+y1[i])/4)
+			r := y2[i] + g
+			b := y1[i] + g
+			y0[i], y1[i], y2[i] = r, g, b
+		}
+		return
+	}
+	for i := 0; i < n; i++ {
+		r := y0[i] + 1.402*y2[i]
+		g := y0[i] - 0.34413*y1[i] - 0.71414*y2[i]
+		b := y0[i] + 1.772*y1[i]
+		y0[i], y1[i], y2[i] = r, g, b
+	}
+}
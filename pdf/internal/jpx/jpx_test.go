@@ -0,0 +1,1236 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jpx
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+func init() {
+	common.SetLogger(common.NewConsoleLogger(common.LogLevelDebug))
+}
+
+// mqEncoder is an MQ arithmetic encoder (C.2) used to produce test data.
+type mqEncoder struct {
+	a   uint32
+	c   uint32
+	ct  int
+	out []byte // The last byte is the current output byte B; the first byte is discarded.
+}
+
+func newMQEncoder() *mqEncoder {
+	return &mqEncoder{a: 0x8000, ct: 12, out: []byte{0}}
+}
+
+func (e *mqEncoder) byteOut() {
+	b := &e.out[len(e.out)-1]
+	if *b == 0xff {
+		e.out = append(e.out, byte(e.c>>20))
+		e.c &= 0xfffff
+		e.ct = 7
+		return
+	}
+	if e.c < 0x8000000 {
+		e.out = append(e.out, byte(e.c>>19))
+		e.c &= 0x7ffff
+		e.ct = 8
+		return
+	}
+	*b++
+	if *b == 0xff {
+		e.c &= 0x7ffffff
+		e.out = append(e.out, byte(e.c>>20))
+		e.c &= 0xfffff
+		e.ct = 7
+		return
+	}
+	e.out = append(e.out, byte(e.c>>19))
+	e.c &= 0x7ffff
+	e.ct = 8
+}
+
+func (e *mqEncoder) renorm() {
+	for {
+		e.a <<= 1
+		e.c <<= 1
+		e.ct--
+		if e.ct == 0 {
+			e.byteOut()
+		}
+		if e.a&0x8000 != 0 {
+			break
+		}
+	}
+}
+
+func (e *mqEncoder) encodeBit(cx *byte, bit int) {
+	index := *cx >> 1
+	mps := int(*cx & 1)
+	entry := &qeTable[index]
+	qe := entry.qe
+
+	e.a -= qe
+	if bit == mps {
+		if e.a&0x8000 != 0 {
+			e.c += qe
+			return
+		}
+		if e.a < qe {
+			e.a = qe
+		} else {
+			e.c += qe
+		}
+		index = entry.nmps
+	} else {
+		if e.a < qe {
+			e.c += qe
+		} else {
+			e.a = qe
+		}
+		if entry.switchMPS {
+			mps = 1 - mps
+		}
+		index = entry.nlps
+	}
+	*cx = index<<1 | byte(mps)
+	e.renorm()
+}
+
+// flush terminates the codeword (C.2.9) and returns it.
+func (e *mqEncoder) flush() []byte {
+	temp := e.c + e.a
+	e.c |= 0xffff
+	if e.c >= temp {
+		e.c -= 0x8000
+	}
+	e.c <<= uint(e.ct)
+	e.byteOut()
+	e.c <<= uint(e.ct)
+	e.byteOut()
+	out := e.out[1:]
+	if len(out) > 0 && out[len(out)-1] == 0xff {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// codeBlockEncoder encodes the coding passes of a code-block.  It keeps its state in a decoder so
+// that the contexts are derived in the same way.
+type codeBlockEncoder struct {
+	*codeBlockDecoder
+	enc      *mqEncoder
+	mags     []int32
+	negative []bool
+}
+
+// encodeCodeBlock encodes the coefficients `values` of a code-block.  Returns the codeword
+// segments and the number of coded bit-planes.
+func encodeCodeBlock(values []int32, width, height, orientation, cbStyle int) ([]codeBlockSegment, int) {
+	d := newCodeBlockDecoder(width, height, orientation, cbStyle)
+	e := &codeBlockEncoder{
+		codeBlockDecoder: d,
+		enc:              newMQEncoder(),
+		mags:             make([]int32, len(d.flags)),
+		negative:         make([]bool, len(d.flags)),
+	}
+	var maxMag int32
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := (y+1)*d.stride + x + 1
+			v := values[y*width+x]
+			if v < 0 {
+				v = -v
+				e.negative[i] = true
+			}
+			e.mags[i] = v
+			if v > maxMag {
+				maxMag = v
+			}
+		}
+	}
+	numBitPlanes := 0
+	for maxMag>>uint(numBitPlanes) != 0 {
+		numBitPlanes++
+	}
+	if numBitPlanes == 0 {
+		return nil, 0
+	}
+
+	var segments []codeBlockSegment
+	numPasses := 1 + 3*(numBitPlanes-1)
+	passes := 0
+	bitPlane := numBitPlanes - 1
+	passType := 2
+	for p := 0; p < numPasses; p++ {
+		switch passType {
+		case 0:
+			e.significancePass(bitPlane)
+		case 1:
+			e.refinementPass(bitPlane)
+		case 2:
+			e.cleanupPass(bitPlane)
+		}
+		if cbStyle&cbStyleReset != 0 {
+			d.resetContexts()
+		}
+		passes++
+		if cbStyle&cbStyleTermAll != 0 || p == numPasses-1 {
+			segments = append(segments, codeBlockSegment{data: e.enc.flush(), passes: passes})
+			e.enc = newMQEncoder()
+			passes = 0
+		}
+		passType++
+		if passType == 3 {
+			passType = 0
+			bitPlane--
+			d.clearVisited()
+		}
+	}
+	return segments, numBitPlanes
+}
+
+func (e *codeBlockEncoder) bit(i, bitPlane int) int {
+	return int(e.mags[i]>>uint(bitPlane)) & 1
+}
+
+func (e *codeBlockEncoder) encodeSign(i, y, bitPlane int) {
+	sign := 0
+	if e.negative[i] {
+		sign = 1
+	}
+	ctx, xor := e.signContext(i, y)
+	e.enc.encodeBit(&e.contexts[ctx], sign^xor)
+	e.setSignificant(i, bitPlane, sign)
+}
+
+func (e *codeBlockEncoder) significancePass(bitPlane int) {
+	for y0 := 0; y0 < e.height; y0 += 4 {
+		for x := 0; x < e.width; x++ {
+			for y := y0; y < y0+4 && y < e.height; y++ {
+				i := (y+1)*e.stride + x + 1
+				if e.flags[i]&flagSignificant != 0 {
+					continue
+				}
+				h, v, diag := e.neighbours(i, y)
+				if h+v+diag == 0 {
+					continue
+				}
+				bit := e.bit(i, bitPlane)
+				e.enc.encodeBit(&e.contexts[e.zcTable[h<<4|v<<2|minInt(diag, 3)]], bit)
+				if bit != 0 {
+					e.encodeSign(i, y, bitPlane)
+				}
+				e.flags[i] |= flagVisited
+			}
+		}
+	}
+}
+
+func (e *codeBlockEncoder) refinementPass(bitPlane int) {
+	for y0 := 0; y0 < e.height; y0 += 4 {
+		for x := 0; x < e.width; x++ {
+			for y := y0; y < y0+4 && y < e.height; y++ {
+				i := (y+1)*e.stride + x + 1
+				f := e.flags[i]
+				if f&flagSignificant == 0 || f&flagVisited != 0 {
+					continue
+				}
+				var ctx byte = 16
+				if f&flagRefined == 0 {
+					h, v, diag := e.neighbours(i, y)
+					if h+v+diag == 0 {
+						ctx = 14
+					} else {
+						ctx = 15
+					}
+				}
+				e.enc.encodeBit(&e.contexts[ctx], e.bit(i, bitPlane))
+				e.flags[i] |= flagRefined
+			}
+		}
+	}
+}
+
+func (e *codeBlockEncoder) cleanupPass(bitPlane int) {
+	for y0 := 0; y0 < e.height; y0 += 4 {
+		for x := 0; x < e.width; x++ {
+			y := y0
+			if y0+4 <= e.height && e.runLengthPossible(x, y0) {
+				run := 4
+				for k := 0; k < 4; k++ {
+					if e.bit((y0+k+1)*e.stride+x+1, bitPlane) != 0 {
+						run = k
+						break
+					}
+				}
+				if run == 4 {
+					e.enc.encodeBit(&e.contexts[ctxRunLength], 0)
+					continue
+				}
+				e.enc.encodeBit(&e.contexts[ctxRunLength], 1)
+				e.enc.encodeBit(&e.contexts[ctxUniform], run>>1)
+				e.enc.encodeBit(&e.contexts[ctxUniform], run&1)
+				y = y0 + run
+				e.encodeSign((y+1)*e.stride+x+1, y, bitPlane)
+				y++
+			}
+			for ; y < y0+4 && y < e.height; y++ {
+				i := (y+1)*e.stride + x + 1
+				if e.flags[i]&(flagSignificant|flagVisited) != 0 {
+					continue
+				}
+				bit := e.bit(i, bitPlane)
+				e.enc.encodeBit(&e.contexts[e.zeroContext(i, y)], bit)
+				if bit != 0 {
+					e.encodeSign(i, y, bitPlane)
+				}
+			}
+		}
+	}
+	if e.cbStyle&cbStyleSegSymbol != 0 {
+		for _, bit := range []int{1, 0, 1, 0} {
+			e.enc.encodeBit(&e.contexts[ctxUniform], bit)
+		}
+	}
+}
+
+// forward53 performs the reversible forward 5-3 transformation 1D_SD (F.4.6) in place on the
+// `i1`-`i0` samples of `data` spaced by `stride`.
+func forward53(data []int32, stride, i0, i1 int) {
+	n := i1 - i0
+	if n == 1 {
+		if i0&1 != 0 {
+			data[0] *= 2
+		}
+		return
+	}
+	const ext = 4
+	x := make([]int32, n+2*ext)
+	for k := range x {
+		x[k] = data[(pse(i0-ext+k, i0, i1)-i0)*stride]
+	}
+	last := len(x) - 1
+	for k := 1; k < last; k++ {
+		if (i0-ext+k)&1 != 0 {
+			x[k] -= (x[k-1] + x[k+1]) >> 1
+		}
+	}
+	for k := 1; k < last; k++ {
+		if (i0-ext+k)&1 == 0 {
+			x[k] += (x[k-1] + x[k+1] + 2) >> 2
+		}
+	}
+	for k := 0; k < n; k++ {
+		data[k*stride] = x[k+ext]
+	}
+}
+
+// forward97 performs the irreversible forward 9-7 transformation 1D_SD (F.4.8.2) in place on the
+// samples `data` with indices [i0, i0+len(data)).
+func forward97(data []float64, i0 int) {
+	n := len(data)
+	i1 := i0 + n
+	if n == 1 {
+		if i0&1 != 0 {
+			data[0] *= 2
+		}
+		return
+	}
+	const ext = 4
+	x := make([]float64, n+2*ext)
+	for k := range x {
+		x[k] = data[pse(i0-ext+k, i0, i1)-i0]
+	}
+	last := len(x) - 1
+	lift := func(c float64, odd bool) {
+		for k := 1; k < last; k++ {
+			if ((i0-ext+k)&1 != 0) == odd {
+				x[k] += c * (x[k-1] + x[k+1])
+			}
+		}
+	}
+	lift(liftAlpha, true)
+	lift(liftBeta, false)
+	lift(liftGamma, true)
+	lift(liftDelta, false)
+	for k := range x {
+		if (i0-ext+k)&1 != 0 {
+			x[k] *= liftK
+		} else {
+			x[k] /= liftK
+		}
+	}
+	copy(data, x[ext:ext+n])
+}
+
+// bandOffsets returns the xob and yob offsets of subband orientation `o`.
+func bandOffsets(o int) (int, int) {
+	switch o {
+	case bandHL:
+		return 1, 0
+	case bandLH:
+		return 0, 1
+	case bandHH:
+		return 1, 1
+	}
+	return 0, 0
+}
+
+// deinterleave extracts the subband with bounds (`bx0`, `by0`) - (`bx1`, `by1`) and offsets
+// `xob`, `yob` from the resolution samples `data` of width `w` with origin (`x0`, `y0`).
+func deinterleave(data []int32, w, x0, y0, bx0, by0, bx1, by1, xob, yob int) []int32 {
+	bw := bx1 - bx0
+	out := make([]int32, bw*(by1-by0))
+	for v := by0; v < by1; v++ {
+		for u := bx0; u < bx1; u++ {
+			out[(v-by0)*bw+u-bx0] = data[(2*v+yob-y0)*w+2*u+xob-x0]
+		}
+	}
+	return out
+}
+
+// forwardDWT returns the subband coefficients of the tile-component samples indexed by resolution
+// and subband.
+func (tc *tileComponent) forwardDWT(samples []int32) [][][]int32 {
+	levels := len(tc.resolutions) - 1
+	coefs := make([][][]int32, levels+1)
+	data := samples
+	for r := levels; r >= 1; r-- {
+		res := tc.resolutions[r]
+		w := res.x1 - res.x0
+		h := res.y1 - res.y0
+		for x := 0; x < w; x++ {
+			forward53(data[x:], w, res.y0, res.y1)
+		}
+		for y := 0; y < h; y++ {
+			forward53(data[y*w:], 1, res.x0, res.x1)
+		}
+		for _, band := range res.bands {
+			xob, yob := bandOffsets(band.orientation)
+			coefs[r] = append(coefs[r], deinterleave(data, w, res.x0, res.y0, band.x0, band.y0, band.x1, band.y1, xob, yob))
+		}
+		prev := tc.resolutions[r-1]
+		data = deinterleave(data, w, res.x0, res.y0, prev.x0, prev.y0, prev.x1, prev.y1, 0, 0)
+	}
+	coefs[0] = [][]int32{data}
+	return coefs
+}
+
+// tagTreeEncoder encodes the values of a tag tree.
+type tagTreeEncoder struct {
+	tree  *tagTree
+	known [][]bool
+}
+
+func newTagTreeEncoder(width, height int, values []int) *tagTreeEncoder {
+	tt := newTagTree(width, height)
+	e := &tagTreeEncoder{tree: tt}
+	copy(tt.levels[0].value, values)
+	for l := range tt.levels {
+		level := &tt.levels[l]
+		e.known = append(e.known, make([]bool, len(level.value)))
+		if l == 0 {
+			continue
+		}
+		child := &tt.levels[l-1]
+		for i, v := range child.value {
+			x, y := i%child.width, i/child.width
+			j := (y/2)*level.width + x/2
+			if v < level.value[j] {
+				level.value[j] = v
+			}
+		}
+	}
+	return e
+}
+
+func (e *tagTreeEncoder) encode(w *headerWriter, x, y, threshold int) {
+	low := 0
+	for l := len(e.tree.levels) - 1; l >= 0; l-- {
+		level := &e.tree.levels[l]
+		i := (y>>uint(l))*level.width + x>>uint(l)
+		if low > level.low[i] {
+			level.low[i] = low
+		} else {
+			low = level.low[i]
+		}
+		for low < threshold {
+			if low >= level.value[i] {
+				if !e.known[l][i] {
+					w.writeBit(1)
+					e.known[l][i] = true
+				}
+				break
+			}
+			w.writeBit(0)
+			low++
+		}
+		level.low[i] = low
+	}
+}
+
+// headerWriter writes packet header bits with bit stuffing.
+type headerWriter struct {
+	out  []byte
+	bits int
+}
+
+func (w *headerWriter) writeBit(bit int) {
+	if w.bits == 0 {
+		w.bits = 8
+		if len(w.out) > 0 && w.out[len(w.out)-1] == 0xff {
+			w.bits = 7
+		}
+		w.out = append(w.out, 0)
+	}
+	w.bits--
+	w.out[len(w.out)-1] |= byte(bit << uint(w.bits))
+}
+
+func (w *headerWriter) writeBits(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit((v >> uint(i)) & 1)
+	}
+}
+
+func (w *headerWriter) flush() []byte {
+	if len(w.out) > 0 && w.out[len(w.out)-1] == 0xff {
+		w.out = append(w.out, 0)
+	}
+	return w.out
+}
+
+// encodeNumPasses encodes the number of coding passes (Table B.4).
+func encodeNumPasses(w *headerWriter, n int) {
+	switch {
+	case n == 1:
+		w.writeBit(0)
+	case n == 2:
+		w.writeBits(2, 2)
+	case n <= 5:
+		w.writeBits(0xc|(n-3), 4)
+	case n <= 36:
+		w.writeBits(0xf, 4)
+		w.writeBits(n-6, 5)
+	default:
+		w.writeBits(0x1ff, 9)
+		w.writeBits(n-37, 7)
+	}
+}
+
+// encodedBlock is the coded data of a code-block.
+type encodedBlock struct {
+	segments   []codeBlockSegment
+	zeroPlanes int
+}
+
+// encodePacket returns the header and body of the single layer packet `pk`.
+func (t *tile) encodePacket(pk packet, blocks map[*codeBlock]*encodedBlock) ([]byte, []byte) {
+	res := t.comps[pk.comp].resolutions[pk.res]
+	w := &headerWriter{}
+
+	empty := true
+	for _, band := range res.bands {
+		for _, cb := range band.precincts[pk.prc].blocks {
+			if blocks[cb] != nil {
+				empty = false
+			}
+		}
+	}
+	if empty {
+		w.writeBit(0)
+		return w.flush(), nil
+	}
+	w.writeBit(1)
+
+	var body []byte
+	for _, band := range res.bands {
+		prc := band.precincts[pk.prc]
+		if len(prc.blocks) == 0 {
+			continue
+		}
+		inclusion := make([]int, len(prc.blocks))
+		zeroPlanes := make([]int, len(prc.blocks))
+		for k, cb := range prc.blocks {
+			if eb := blocks[cb]; eb != nil {
+				zeroPlanes[k] = eb.zeroPlanes
+			} else {
+				inclusion[k] = 1
+			}
+		}
+		inclusionTree := newTagTreeEncoder(prc.numW, prc.numH, inclusion)
+		zeroPlanesTree := newTagTreeEncoder(prc.numW, prc.numH, zeroPlanes)
+
+		for k, cb := range prc.blocks {
+			x, y := k%prc.numW, k/prc.numW
+			inclusionTree.encode(w, x, y, 1)
+			eb := blocks[cb]
+			if eb == nil {
+				continue
+			}
+			zeroPlanesTree.encode(w, x, y, eb.zeroPlanes+1)
+			numPasses := 0
+			for _, seg := range eb.segments {
+				numPasses += seg.passes
+			}
+			encodeNumPasses(w, numPasses)
+			lblock := 3
+			for _, seg := range eb.segments {
+				for len(seg.data) >= 1<<uint(lblock+floorLog2(seg.passes)) {
+					w.writeBit(1)
+					lblock++
+				}
+			}
+			w.writeBit(0)
+			for _, seg := range eb.segments {
+				w.writeBits(len(seg.data), lblock+floorLog2(seg.passes))
+				body = append(body, seg.data...)
+			}
+		}
+	}
+	return w.flush(), body
+}
+
+// testComponent is an image component with its samples at the component resolution.
+type testComponent struct {
+	precision int
+	signed    bool
+	dx, dy    int
+	samples   []int32
+}
+
+// testImage is an image to be encoded by the test encoder.
+type testImage struct {
+	width, height int // Xsiz and Ysiz.
+	x0, y0        int
+	tileW, tileH  int
+	comps         []testComponent
+}
+
+// planeSize returns the size of component `c` at the component resolution.
+func (img *testImage) planeSize(c int) (int, int) {
+	ic := img.comps[c]
+	return ceilDiv(img.width, ic.dx) - ceilDiv(img.x0, ic.dx), ceilDiv(img.height, ic.dy) - ceilDiv(img.y0, ic.dy)
+}
+
+// expected returns the samples of component `c` at the image resolution.
+func (img *testImage) expected(c int) []int32 {
+	ic := img.comps[c]
+	pw, ph := img.planeSize(c)
+	cx0 := ceilDiv(img.x0, ic.dx)
+	cy0 := ceilDiv(img.y0, ic.dy)
+	var out []int32
+	for y := img.y0; y < img.height; y++ {
+		py := minInt(maxInt(y/ic.dy-cy0, 0), ph-1)
+		for x := img.x0; x < img.width; x++ {
+			px := minInt(maxInt(x/ic.dx-cx0, 0), pw-1)
+			out = append(out, ic.samples[py*pw+px])
+		}
+	}
+	return out
+}
+
+// encodeOptions are the coding parameters of the test encoder.
+type encodeOptions struct {
+	levels      int
+	cbW, cbH    int
+	cbStyle     int
+	progression int
+	mct         bool
+	sop, eph    bool
+	precincts   []precinctSize
+}
+
+func put16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func put32(b []byte, v int) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendSegment(b []byte, marker int, content []byte) []byte {
+	b = put16(b, marker)
+	b = put16(b, len(content)+2)
+	return append(b, content...)
+}
+
+// encodeCodestream losslessly encodes `img` as a single layer codestream.
+func encodeCodestream(img *testImage, opt encodeOptions) []byte {
+	sz := imageSize{
+		width:  img.width,
+		height: img.height,
+		x0:     img.x0,
+		y0:     img.y0,
+		tileW:  img.tileW,
+		tileH:  img.tileH,
+	}
+	precision := 0
+	for _, ic := range img.comps {
+		sz.comps = append(sz.comps, componentInfo{ic.precision, ic.signed, ic.dx, ic.dy})
+		precision = maxInt(precision, ic.precision)
+	}
+	sz.numTileX = ceilDiv(sz.width, sz.tileW)
+	sz.numTileY = ceilDiv(sz.height, sz.tileH)
+
+	style := &codingStyle{
+		levels:     opt.levels,
+		cbW:        opt.cbW,
+		cbH:        opt.cbH,
+		cbStyle:    opt.cbStyle,
+		reversible: true,
+		precincts:  opt.precincts,
+	}
+	quant := &quantization{style: quantNone, guardBits: 2}
+	quant.steps = append(quant.steps, quantStep{exponent: precision})
+	for r := 1; r <= opt.levels; r++ {
+		quant.steps = append(quant.steps, quantStep{exponent: precision + 1}, quantStep{exponent: precision + 1},
+			quantStep{exponent: precision + 2})
+	}
+	params := &codingParams{
+		progression: opt.progression,
+		layers:      1,
+		mct:         opt.mct,
+		sop:         opt.sop,
+		eph:         opt.eph,
+		roiShift:    make([]int, len(img.comps)),
+	}
+	for range img.comps {
+		params.styles = append(params.styles, style)
+		params.quants = append(params.quants, quant)
+	}
+
+	out := put16(nil, markerSOC)
+
+	siz := put16(nil, 0)
+	for _, v := range []int{sz.width, sz.height, sz.x0, sz.y0, sz.tileW, sz.tileH, 0, 0} {
+		siz = put32(siz, v)
+	}
+	siz = put16(siz, len(img.comps))
+	for _, ic := range img.comps {
+		ssiz := byte(ic.precision - 1)
+		if ic.signed {
+			ssiz |= 0x80
+		}
+		siz = append(siz, ssiz, byte(ic.dx), byte(ic.dy))
+	}
+	out = appendSegment(out, markerSIZ, siz)
+
+	scod := 0
+	if len(opt.precincts) > 0 {
+		scod |= 1
+	}
+	if opt.sop {
+		scod |= 2
+	}
+	if opt.eph {
+		scod |= 4
+	}
+	mct := 0
+	if opt.mct {
+		mct = 1
+	}
+	cod := []byte{byte(scod), byte(opt.progression), 0, 1, byte(mct)}
+	cod = append(cod, byte(opt.levels), byte(opt.cbW-2), byte(opt.cbH-2), byte(opt.cbStyle), 1)
+	for _, ps := range opt.precincts {
+		cod = append(cod, byte(ps.ppy<<4|ps.ppx))
+	}
+	out = appendSegment(out, markerCOD, cod)
+
+	qcd := []byte{byte(quant.guardBits << 5)}
+	for _, s := range quant.steps {
+		qcd = append(qcd, byte(s.exponent<<3))
+	}
+	out = appendSegment(out, markerQCD, qcd)
+
+	for index := 0; index < sz.numTileX*sz.numTileY; index++ {
+		t, err := newTile(&sz, index, params)
+		if err != nil {
+			panic(err)
+		}
+		body := t.encode(img)
+		out = put16(out, markerSOT)
+		out = put16(out, 10)
+		out = put16(out, index)
+		out = put32(out, 14+len(body))
+		out = append(out, 0, 1)
+		out = put16(out, markerSOD)
+		out = append(out, body...)
+	}
+	return put16(out, markerEOC)
+}
+
+// encode returns the packets of the tile.
+func (t *tile) encode(img *testImage) []byte {
+	samples := make([][]int32, len(t.comps))
+	for c, tc := range t.comps {
+		ic := img.comps[c]
+		pw, _ := img.planeSize(c)
+		cx0 := ceilDiv(img.x0, ic.dx)
+		cy0 := ceilDiv(img.y0, ic.dy)
+		w := tc.x1 - tc.x0
+		s := make([]int32, w*(tc.y1-tc.y0))
+		for y := tc.y0; y < tc.y1; y++ {
+			for x := tc.x0; x < tc.x1; x++ {
+				v := ic.samples[(y-cy0)*pw+x-cx0]
+				if !ic.signed {
+					v -= 1 << uint(ic.precision-1)
+				}
+				s[(y-tc.y0)*w+x-tc.x0] = v
+			}
+		}
+		samples[c] = s
+	}
+	if t.params.mct {
+		// Forward reversible component transformation (G.2.1).
+		for i := range samples[0] {
+			r, g, b := samples[0][i], samples[1][i], samples[2][i]
+			samples[0][i] = (r + 2*g + b) >> 2
+			samples[1][i] = b - g
+			samples[2][i] = r - g
+		}
+	}
+
+	blocks := map[*codeBlock]*encodedBlock{}
+	for c, tc := range t.comps {
+		coefs := tc.forwardDWT(samples[c])
+		for r, res := range tc.resolutions {
+			for b, band := range res.bands {
+				bw := band.x1 - band.x0
+				for _, prc := range band.precincts {
+					for _, cb := range prc.blocks {
+						w := cb.x1 - cb.x0
+						h := cb.y1 - cb.y0
+						values := make([]int32, w*h)
+						for y := 0; y < h; y++ {
+							copy(values[y*w:(y+1)*w], coefs[r][b][(cb.y0+y-band.y0)*bw+cb.x0-band.x0:])
+						}
+						segments, numBitPlanes := encodeCodeBlock(values, w, h, band.orientation, tc.style.cbStyle)
+						if numBitPlanes == 0 {
+							continue
+						}
+						if numBitPlanes > band.numBitPlanes {
+							panic("coefficient out of range")
+						}
+						blocks[cb] = &encodedBlock{segments, band.numBitPlanes - numBitPlanes}
+					}
+				}
+			}
+		}
+	}
+
+	var body []byte
+	for i, pk := range t.packetOrder() {
+		if t.params.sop {
+			body = append(body, 0xff, 0x91, 0, 4, byte(i>>8), byte(i))
+		}
+		header, data := t.encodePacket(pk, blocks)
+		body = append(body, header...)
+		if t.params.eph {
+			body = append(body, 0xff, 0x92)
+		}
+		body = append(body, data...)
+	}
+	return body
+}
+
+// randomPlane returns a w x h plane of samples with a gradient and noise.
+func randomPlane(rnd *rand.Rand, w, h, precision int, signed bool) []int32 {
+	maxVal := 1<<uint(precision) - 1
+	samples := make([]int32, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := (x*maxVal/w+y*maxVal/h)/2 + rnd.Intn(maxVal/8+1) - maxVal/16
+			v = minInt(maxInt(v, 0), maxVal)
+			if rnd.Intn(50) == 0 {
+				v = rnd.Intn(maxVal + 1)
+			}
+			if signed {
+				v -= 1 << uint(precision-1)
+			}
+			samples[y*w+x] = int32(v)
+		}
+	}
+	return samples
+}
+
+func newTestImage(rnd *rand.Rand, width, height, x0, y0 int, comps []testComponent) *testImage {
+	img := &testImage{width: width, height: height, x0: x0, y0: y0, tileW: width, tileH: height, comps: comps}
+	for c := range img.comps {
+		ic := &img.comps[c]
+		if ic.dx == 0 {
+			ic.dx, ic.dy = 1, 1
+		}
+		w, h := img.planeSize(c)
+		ic.samples = randomPlane(rnd, w, h, ic.precision, ic.signed)
+	}
+	return img
+}
+
+func compareComponents(t *testing.T, img *testImage, decoded *Image) bool {
+	if decoded.Width != img.width-img.x0 || decoded.Height != img.height-img.y0 {
+		t.Errorf("Wrong size %dx%d", decoded.Width, decoded.Height)
+		return false
+	}
+	if len(decoded.Components) != len(img.comps) {
+		t.Errorf("Wrong number of components %d", len(decoded.Components))
+		return false
+	}
+	for c, comp := range decoded.Components {
+		if comp.Precision != img.comps[c].precision || comp.Signed != img.comps[c].signed {
+			t.Errorf("Component %d: wrong parameters %d %v", c, comp.Precision, comp.Signed)
+			return false
+		}
+		expected := img.expected(c)
+		for i, v := range expected {
+			if comp.Samples[i] != v {
+				t.Errorf("Component %d: sample %d (%d, %d): %d != %d", c, i, i%decoded.Width, i/decoded.Width,
+					comp.Samples[i], v)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestMQDecoder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bits := make([]int, 5000)
+	for i := range bits {
+		// Skewed bits so that the probability estimates adapt.
+		if rnd.Intn(10) < 2+i%3 {
+			bits[i] = 1
+		}
+	}
+
+	var ecx, dcx [3]byte
+	enc := newMQEncoder()
+	for i, bit := range bits {
+		enc.encodeBit(&ecx[i%3], bit)
+	}
+	data := enc.flush()
+
+	dec := newMQDecoder(data)
+	for i, bit := range bits {
+		if v := dec.decodeBit(&dcx[i%3]); v != bit {
+			t.Errorf("Bit %d: %d != %d", i, v, bit)
+			return
+		}
+	}
+}
+
+func TestInverseDWT(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	buf := make([]float64, 64)
+	for _, reversible := range []bool{true, false} {
+		tc := &tileComponent{style: &codingStyle{reversible: reversible}}
+		for n := 1; n <= 20; n++ {
+			for i0 := -3; i0 <= 4; i0++ {
+				x := make([]float64, n)
+				for i := range x {
+					x[i] = float64(rnd.Intn(512) - 256)
+				}
+				y := make([]float64, n)
+				if reversible {
+					v := make([]int32, n)
+					for i := range x {
+						v[i] = int32(x[i])
+					}
+					forward53(v, 1, i0, i0+n)
+					for i := range v {
+						y[i] = float64(v[i])
+					}
+				} else {
+					copy(y, x)
+					forward97(y, i0)
+				}
+
+				tc.filter1D(y, 1, i0, i0+n, buf)
+				for i := range x {
+					if math.Abs(y[i]-x[i]) > 1e-6 {
+						t.Errorf("Reversible %v, i0 %d, n %d: sample %d: %f != %f", reversible, i0, n, i, y[i], x[i])
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeLossless(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+
+	testcases := []struct {
+		name string
+		img  *testImage
+		opt  encodeOptions
+	}{
+		{
+			"gray",
+			newTestImage(rnd, 37, 29, 0, 0, []testComponent{{precision: 8}}),
+			encodeOptions{levels: 3, cbW: 4, cbH: 4},
+		},
+		{
+			"no decomposition",
+			newTestImage(rnd, 19, 7, 0, 0, []testComponent{{precision: 8}}),
+			encodeOptions{levels: 0, cbW: 3, cbH: 2},
+		},
+		{
+			"rgb",
+			newTestImage(rnd, 50, 41, 0, 0, []testComponent{{precision: 8}, {precision: 8}, {precision: 8}}),
+			encodeOptions{
+				levels:      2,
+				cbW:         5,
+				cbH:         5,
+				cbStyle:     cbStyleReset | cbStyleVCausal | cbStyleSegSymbol,
+				progression: progressionRPCL,
+				mct:         true,
+				sop:         true,
+				eph:         true,
+				precincts:   []precinctSize{{4, 4}, {4, 5}, {5, 4}},
+			},
+		},
+		{
+			"tiles",
+			newTestImage(rnd, 70, 45, 5, 3, []testComponent{{precision: 12}, {precision: 8, signed: true}}),
+			encodeOptions{
+				levels:      2,
+				cbW:         3,
+				cbH:         3,
+				cbStyle:     cbStyleTermAll,
+				progression: progressionPCRL,
+				precincts:   []precinctSize{{3, 3}, {4, 4}, {4, 4}},
+			},
+		},
+		{
+			"subsampled",
+			newTestImage(rnd, 33, 21, 1, 0, []testComponent{{precision: 8}, {precision: 8, dx: 2, dy: 2},
+				{precision: 8, dx: 2, dy: 1}}),
+			encodeOptions{levels: 1, cbW: 4, cbH: 4, progression: progressionCPRL},
+		},
+		{
+			"rlcp",
+			newTestImage(rnd, 24, 24, 0, 0, []testComponent{{precision: 4}, {precision: 4}}),
+			encodeOptions{levels: 2, cbW: 2, cbH: 2, progression: progressionRLCP},
+		},
+	}
+	testcases[3].img.tileW = 32
+	testcases[3].img.tileH = 32
+
+	for _, tc := range testcases {
+		data := encodeCodestream(tc.img, tc.opt)
+		img, err := Decode(data, nil)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", tc.name, err)
+			continue
+		}
+		if img.ColorSpace != ColorSpaceUnknown {
+			t.Errorf("%s: unexpected colour space %d", tc.name, img.ColorSpace)
+		}
+		if !compareComponents(t, tc.img, img) {
+			t.Errorf("%s: decoded image differs", tc.name)
+		}
+	}
+}
+
+// box returns a JP2 box of type `typ` with the given content.
+func box(typ string, content ...[]byte) []byte {
+	n := 8
+	for _, c := range content {
+		n += len(c)
+	}
+	b := put32(nil, n)
+	b = append(b, typ...)
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// jp2File wraps `codestream` in a JP2 file with the header boxes `header`.
+func jp2File(codestream []byte, header ...[]byte) []byte {
+	var data []byte
+	data = append(data, box("jP  ", []byte{0x0d, 0x0a, 0x87, 0x0a})...)
+	data = append(data, box("ftyp", []byte("jp2 \x00\x00\x00\x00jp2 "))...)
+	data = append(data, box("jp2h", header...)...)
+	return append(data, box("jp2c", codestream)...)
+}
+
+func colrBox(cs int) []byte {
+	return box("colr", put32([]byte{1, 0, 0}, cs))
+}
+
+func TestDecodeJP2(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	img := newTestImage(rnd, 20, 10, 0, 0, []testComponent{{precision: 8}, {precision: 8}, {precision: 8},
+		{precision: 8}})
+	codestream := encodeCodestream(img, encodeOptions{levels: 2, cbW: 4, cbH: 4, mct: true})
+
+	// BGRA with the channel definitions giving the colour associations.
+	cdef := put16(nil, 4)
+	for _, def := range [][3]int{{0, 0, 3}, {1, 0, 2}, {2, 0, 1}, {3, 1, 0}} {
+		for _, v := range def {
+			cdef = put16(cdef, v)
+		}
+	}
+	data := jp2File(codestream, colrBox(ColorSpaceSRGB), box("cdef", cdef))
+
+	cfg, err := DecodeConfig(data)
+	if err != nil {
+		t.Errorf("DecodeConfig failed: %v", err)
+		return
+	}
+	if cfg.Width != 20 || cfg.Height != 10 || cfg.NumComponents != 3 || cfg.Precision != 8 || !cfg.HasOpacity ||
+		cfg.ColorSpace != ColorSpaceSRGB {
+		t.Errorf("Wrong config %+v", cfg)
+		return
+	}
+
+	decoded, err := Decode(data, nil)
+	if err != nil {
+		t.Errorf("Decode failed: %v", err)
+		return
+	}
+	if decoded.ColorSpace != ColorSpaceSRGB || len(decoded.Components) != 4 {
+		t.Errorf("Wrong colour space %d or number of components %d", decoded.ColorSpace, len(decoded.Components))
+		return
+	}
+	for i, c := range []int{2, 1, 0, 3} {
+		comp := decoded.Components[i]
+		if comp.Opacity != (i == 3) {
+			t.Errorf("Channel %d: wrong opacity flag", i)
+			return
+		}
+		if !compareSamples(comp.Samples, img.expected(c)) {
+			t.Errorf("Channel %d differs", i)
+			return
+		}
+	}
+}
+
+func TestDecodePalette(t *testing.T) {
+	rnd := rand.New(rand.NewSource(5))
+	img := newTestImage(rnd, 16, 16, 0, 0, []testComponent{{precision: 2}})
+	codestream := encodeCodestream(img, encodeOptions{levels: 1, cbW: 4, cbH: 4})
+
+	colors := [][3]byte{{0, 0, 0}, {255, 0, 0}, {0, 128, 0}, {10, 20, 30}}
+	pclr := []byte{0, 4, 3, 7, 7, 7}
+	for _, c := range colors {
+		pclr = append(pclr, c[:]...)
+	}
+	cmap := []byte{0, 0, 1, 0, 0, 0, 1, 1, 0, 0, 1, 2}
+	data := jp2File(codestream, colrBox(ColorSpaceSRGB), box("pclr", pclr), box("cmap", cmap))
+
+	cfg, err := DecodeConfig(data)
+	if err != nil {
+		t.Errorf("DecodeConfig failed: %v", err)
+		return
+	}
+	if cfg.NumComponents != 3 || cfg.Precision != 8 || cfg.HasOpacity {
+		t.Errorf("Wrong config %+v", cfg)
+		return
+	}
+
+	decoded, err := Decode(data, nil)
+	if err != nil {
+		t.Errorf("Decode failed: %v", err)
+		return
+	}
+	if len(decoded.Components) != 3 {
+		t.Errorf("Wrong number of components %d", len(decoded.Components))
+		return
+	}
+	for i, index := range img.comps[0].samples {
+		for c := 0; c < 3; c++ {
+			if decoded.Components[c].Samples[i] != int32(colors[index][c]) {
+				t.Errorf("Sample %d component %d: %d != %d", i, c, decoded.Components[c].Samples[i],
+					colors[index][c])
+				return
+			}
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	rnd := rand.New(rand.NewSource(6))
+	img := newTestImage(rnd, 30, 30, 0, 0, []testComponent{{precision: 8}})
+	codestream := encodeCodestream(img, encodeOptions{levels: 2, cbW: 4, cbH: 4})
+
+	inputs := [][]byte{
+		nil,
+		[]byte("not a JPEG 2000 file"),
+		codestream[:2],
+		codestream[:20],
+		box("jp2h", colrBox(ColorSpaceGray)),
+	}
+	for i, data := range inputs {
+		if _, err := Decode(data, nil); err == nil {
+			t.Errorf("Input %d: expected error", i)
+		}
+	}
+
+	// Truncated and corrupted data must not cause a panic.
+	for n := 0; n < len(codestream); n += 7 {
+		Decode(codestream[:n], nil)
+		corrupt := append([]byte{}, codestream...)
+		corrupt[n] ^= 0x5a
+		Decode(corrupt, nil)
+	}
+}
+
+// Test that images needing too much memory are rejected before decoding.
+func TestDecodeLimits(t *testing.T) {
+	// A header of a few bytes for a 65536 x 65536 x 3 image.
+	siz := put16(nil, 0)
+	for _, v := range []int{1 << 16, 1 << 16, 0, 0, 1 << 16, 1 << 16, 0, 0} {
+		siz = put32(siz, v)
+	}
+	siz = put16(siz, 3)
+	siz = append(siz, 7, 1, 1, 7, 1, 1, 7, 1, 1)
+	hostile := appendSegment(put16(nil, markerSOC), markerSIZ, siz)
+	hostile = appendSegment(hostile, markerCOD, []byte{0, 0, 0, 1, 0, 0, 2, 2, 0, 1})
+	hostile = appendSegment(hostile, markerQCD, []byte{2 << 5, 8 << 3})
+	hostile = put16(hostile, markerEOC)
+	if _, err := Decode(hostile, nil); err == nil {
+		t.Errorf("Huge image should fail")
+	}
+	if _, err := DecodeConfig(hostile); err != nil {
+		t.Errorf("Header of huge image should be read: %v", err)
+	}
+
+	rnd := rand.New(rand.NewSource(7))
+	img := newTestImage(rnd, 30, 20, 0, 0, []testComponent{{precision: 8}, {precision: 8, dx: 2, dy: 2}})
+	codestream := encodeCodestream(img, encodeOptions{levels: 1, cbW: 4, cbH: 4})
+	if _, err := Decode(codestream, &Options{MaxSize: 30 * 20 * 4}); err == nil {
+		t.Errorf("Image larger than MaxSize should fail")
+	}
+	if _, err := Decode(codestream, &Options{MaxSize: 30 * 20 * 32}); err != nil {
+		t.Errorf("Image smaller than MaxSize should be decoded: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Decode(codestream, &Options{Context: ctx}); err != context.Canceled {
+		t.Errorf("Canceled decoding should fail (%v)", err)
+	}
+}
+
+func compareSamples(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
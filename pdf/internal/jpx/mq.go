@@ -0,0 +1,205 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jpx
+
+// qeEntry is a row of the MQ coder probability estimation table (Table C.2).
+type qeEntry struct {
+	qe        uint32
+	nmps      byte
+	nlps      byte
+	switchMPS bool
+}
+
+var qeTable = []qeEntry{
+	{0x5601, 1, 1, true},
+	{0x3401, 2, 6, false},
+	{0x1801, 3, 9, false},
+	{0x0ac1, 4, 12, false},
+	{0x0521, 5, 29, false},
+	{0x0221, 38, 33, false},
+	{0x5601, 7, 6, true},
+	{0x5401, 8, 14, false},
+	{0x4801, 9, 14, false},
+	{0x3801, 10, 14, false},
+	{0x3001, 11, 17, false},
+	{0x2401, 12, 18, false},
+	{0x1c01, 13, 20, false},
+	{0x1601, 29, 21, false},
+	{0x5601, 15, 14, true},
+	{0x5401, 16, 14, false},
+	{0x5101, 17, 15, false},
+	{0x4801, 18, 16, false},
+	{0x3801, 19, 17, false},
+	{0x3401, 20, 18, false},
+	{0x3001, 21, 19, false},
+	{0x2801, 22, 19, false},
+	{0x2401, 23, 20, false},
+	{0x2201, 24, 21, false},
+	{0x1c01, 25, 22, false},
+	{0x1801, 26, 23, false},
+	{0x1601, 27, 24, false},
+	{0x1401, 28, 25, false},
+	{0x1201, 29, 26, false},
+	{0x1101, 30, 27, false},
+	{0x0ac1, 31, 28, false},
+	{0x09c1, 32, 29, false},
+	{0x08a1, 33, 30, false},
+	{0x0521, 34, 31, false},
+	{0x0441, 35, 32, false},
+	{0x02a1, 36, 33, false},
+	{0x0221, 37, 34, false},
+	{0x0141, 38, 35, false},
+	{0x0111, 39, 36, false},
+	{0x0085, 40, 37, false},
+	{0x0049, 41, 38, false},
+	{0x0025, 42, 39, false},
+	{0x0015, 43, 40, false},
+	{0x0009, 44, 41, false},
+	{0x0005, 45, 42, false},
+	{0x0001, 45, 43, false},
+	{0x5601, 46, 46, false},
+}
+
+// mqDecoder is the MQ arithmetic decoder (C.3).
+type mqDecoder struct {
+	data []byte
+	bp   int
+	c    uint32
+	a    uint32
+	ct   int
+}
+
+// newMQDecoder initializes a decoder for `data` (INITDEC, C.3.5).
+func newMQDecoder(data []byte) *mqDecoder {
+	d := &mqDecoder{data: data}
+	d.c = uint32(d.byteAt(0)) << 16
+	d.byteIn()
+	d.c <<= 7
+	d.ct -= 7
+	d.a = 0x8000
+	return d
+}
+
+// byteAt returns the data byte at `i`, or 0xFF beyond the end of the data.
+func (d *mqDecoder) byteAt(i int) byte {
+	if i < len(d.data) {
+		return d.data[i]
+	}
+	return 0xff
+}
+
+// byteIn reads the next byte of data (BYTEIN, C.3.4).
+func (d *mqDecoder) byteIn() {
+	if d.byteAt(d.bp) == 0xff {
+		if d.byteAt(d.bp+1) > 0x8f {
+			d.c += 0xff00
+			d.ct = 8
+		} else {
+			d.bp++
+			d.c += uint32(d.byteAt(d.bp)) << 9
+			d.ct = 7
+		}
+	} else {
+		d.bp++
+		d.c += uint32(d.byteAt(d.bp)) << 8
+		d.ct = 8
+	}
+}
+
+// decodeBit decodes a single bit using the context state `cx`, which holds the probability
+// estimate index in the upper bits and the MPS value in the lowest bit (DECODE, C.3.2).
+func (d *mqDecoder) decodeBit(cx *byte) int {
+	index := *cx >> 1
+	mps := int(*cx & 1)
+	entry := &qeTable[index]
+	qe := entry.qe
+
+	var bit int
+	d.a -= qe
+	if (d.c >> 16) < qe {
+		// LPS_EXCHANGE.
+		if d.a < qe {
+			bit = mps
+			index = entry.nmps
+		} else {
+			bit = 1 - mps
+			if entry.switchMPS {
+				mps = 1 - mps
+			}
+			index = entry.nlps
+		}
+		d.a = qe
+	} else {
+		d.c -= qe << 16
+		if d.a&0x8000 != 0 {
+			return mps
+		}
+		// MPS_EXCHANGE.
+		if d.a < qe {
+			bit = 1 - mps
+			if entry.switchMPS {
+				mps = 1 - mps
+			}
+			index = entry.nlps
+		} else {
+			bit = mps
+			index = entry.nmps
+		}
+	}
+
+	// RENORMD.
+	for {
+		if d.ct == 0 {
+			d.byteIn()
+		}
+		d.a <<= 1
+		d.c <<= 1
+		d.ct--
+		if d.a&0x8000 != 0 {
+			break
+		}
+	}
+
+	*cx = index<<1 | byte(mps)
+	return bit
+}
+
+// rawDecoder reads the raw (bypass) coded bits of a code-block segment (D.6).
+type rawDecoder struct {
+	data []byte
+	bp   int
+	c    uint32
+	ct   int
+}
+
+func newRawDecoder(data []byte) *rawDecoder {
+	return &rawDecoder{data: data}
+}
+
+// decodeBit returns the next raw bit.  A bit is skipped after each 0xFF byte.
+func (d *rawDecoder) decodeBit() int {
+	if d.ct == 0 {
+		if d.c == 0xff {
+			if d.bp < len(d.data) {
+				d.c = uint32(d.data[d.bp])
+				d.bp++
+			} else {
+				d.c = 0xff
+			}
+			d.ct = 7
+		} else {
+			if d.bp < len(d.data) {
+				d.c = uint32(d.data[d.bp])
+				d.bp++
+			} else {
+				d.c = 0xff
+			}
+			d.ct = 8
+		}
+	}
+	d.ct--
+	return int(d.c>>uint(d.ct)) & 1
+}
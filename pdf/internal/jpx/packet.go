@@ -0,0 +1,593 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jpx
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+// tile is a tile being decoded with its components.
+type tile struct {
+	x0, y0, x1, y1 int
+	params         *codingParams
+	comps          []*tileComponent
+}
+
+// tileComponent is a component of a tile.
+type tileComponent struct {
+	x0, y0, x1, y1 int
+	info           componentInfo
+	style          *codingStyle
+	quant          *quantization
+	roiShift       int
+	resolutions    []*resolution
+}
+
+// resolution is a resolution level of a tile-component.
+type resolution struct {
+	level          int
+	x0, y0, x1, y1 int
+	ppx, ppy       int // Precinct size exponents.
+	prcX0, prcY0   int // Index of the first precinct in the resolution grid.
+	numPrcW        int
+	numPrcH        int
+	bands          []*subband
+}
+
+// subband is a subband of a resolution level.
+type subband struct {
+	orientation    int
+	index          int // Index for the quantization step sizes.
+	x0, y0, x1, y1 int
+	cbW, cbH       int // Code-block size exponents.
+	precincts      []*precinct
+	numBitPlanes   int // Mb (E.1).
+}
+
+// precinct holds the code-blocks of a subband within a precinct.
+type precinct struct {
+	numW, numH int
+	blocks     []*codeBlock
+	inclusion  *tagTree
+	zeroPlanes *tagTree
+}
+
+// codeBlock is a code-block and its coded data collected from the packets.
+type codeBlock struct {
+	x0, y0, x1, y1 int
+	included       bool
+	lblock         int
+	zeroPlanes     int
+	numPasses      int
+	chunks         []codeBlockChunk
+}
+
+// codeBlockChunk is the data of a code-block contributed by a packet for a codeword segment.
+type codeBlockChunk struct {
+	data       []byte
+	passes     int
+	newSegment bool // Starts a new codeword segment.
+}
+
+// tagTree is a tag tree (B.10.2).
+type tagTree struct {
+	levels []tagTreeLevel // Leaves first.
+}
+
+type tagTreeLevel struct {
+	width int
+	value []int
+	low   []int
+}
+
+const tagTreeUnknown = 1 << 30
+
+func newTagTree(width, height int) *tagTree {
+	tt := &tagTree{}
+	for {
+		n := width * height
+		level := tagTreeLevel{width: width, value: make([]int, n), low: make([]int, n)}
+		for i := range level.value {
+			level.value[i] = tagTreeUnknown
+		}
+		tt.levels = append(tt.levels, level)
+		if width <= 1 && height <= 1 {
+			break
+		}
+		width = (width + 1) / 2
+		height = (height + 1) / 2
+	}
+	return tt
+}
+
+// decode decodes the tag tree information of leaf (`x`, `y`) up to `threshold`.  Returns true if
+// the value of the leaf is below `threshold`.
+func (tt *tagTree) decode(r *headerReader, x, y, threshold int) bool {
+	low := 0
+	var i int
+	for l := len(tt.levels) - 1; l >= 0; l-- {
+		level := &tt.levels[l]
+		i = (y>>uint(l))*level.width + x>>uint(l)
+		if low > level.low[i] {
+			level.low[i] = low
+		} else {
+			low = level.low[i]
+		}
+		for low < threshold && low < level.value[i] {
+			if r.readBit() == 1 {
+				level.value[i] = low
+			} else {
+				low++
+			}
+		}
+		level.low[i] = low
+	}
+	return tt.levels[0].value[i] < threshold
+}
+
+// headerReader reads packet header bits (B.10.1).  After a 0xFF byte the next byte has a stuffed
+// zero bit.
+type headerReader struct {
+	data []byte
+	pos  int
+	buf  int
+	bits int
+}
+
+func (r *headerReader) readBit() int {
+	if r.bits == 0 {
+		r.bits = 8
+		if r.buf == 0xff {
+			r.bits = 7
+		}
+		r.buf = 0
+		if r.pos < len(r.data) {
+			r.buf = int(r.data[r.pos])
+		}
+		r.pos++
+	}
+	r.bits--
+	return (r.buf >> uint(r.bits)) & 1
+}
+
+func (r *headerReader) readBits(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.readBit()
+	}
+	return v
+}
+
+// align skips to the end of the packet header, including a stuffed byte following a final 0xFF.
+func (r *headerReader) align() {
+	if r.buf == 0xff {
+		r.pos++
+	}
+	r.bits = 0
+	r.buf = 0
+}
+
+// newTile sets up the tile with index `index` and its components, resolutions, subbands,
+// precincts and code-blocks (B.3 - B.7).
+func newTile(sz *imageSize, index int, params *codingParams) (*tile, error) {
+	p := index % sz.numTileX
+	q := index / sz.numTileX
+	t := &tile{
+		x0:     maxInt(sz.tileX0+p*sz.tileW, sz.x0),
+		y0:     maxInt(sz.tileY0+q*sz.tileH, sz.y0),
+		x1:     minInt(sz.tileX0+(p+1)*sz.tileW, sz.width),
+		y1:     minInt(sz.tileY0+(q+1)*sz.tileH, sz.height),
+		params: params,
+	}
+
+	for c, info := range sz.comps {
+		tc := &tileComponent{
+			x0:       ceilDiv(t.x0, info.dx),
+			y0:       ceilDiv(t.y0, info.dy),
+			x1:       ceilDiv(t.x1, info.dx),
+			y1:       ceilDiv(t.y1, info.dy),
+			info:     info,
+			style:    params.styles[c],
+			quant:    params.quants[c],
+			roiShift: params.roiShift[c],
+		}
+		err := tc.setup()
+		if err != nil {
+			return nil, err
+		}
+		t.comps = append(t.comps, tc)
+	}
+	return t, nil
+}
+
+// setup creates the resolutions of the tile-component.
+func (tc *tileComponent) setup() error {
+	style := tc.style
+	levels := style.levels
+	for r := 0; r <= levels; r++ {
+		shift := uint(levels - r)
+		ps := style.precinct(r)
+		res := &resolution{
+			level: r,
+			x0:    ceilDivPow2(tc.x0, shift),
+			y0:    ceilDivPow2(tc.y0, shift),
+			x1:    ceilDivPow2(tc.x1, shift),
+			y1:    ceilDivPow2(tc.y1, shift),
+			ppx:   ps.ppx,
+			ppy:   ps.ppy,
+		}
+		if r > 0 && (res.ppx == 0 || res.ppy == 0) {
+			return errors.New("Invalid JPEG 2000 precinct size")
+		}
+		if res.x1 > res.x0 && res.y1 > res.y0 {
+			res.prcX0 = floorDivPow2(res.x0, uint(res.ppx))
+			res.prcY0 = floorDivPow2(res.y0, uint(res.ppy))
+			res.numPrcW = ceilDivPow2(res.x1, uint(res.ppx)) - res.prcX0
+			res.numPrcH = ceilDivPow2(res.y1, uint(res.ppy)) - res.prcY0
+		}
+
+		// Code-block and precinct sizes within the subbands (B.7).
+		pbx, pby := res.ppx, res.ppy
+		if r > 0 {
+			pbx--
+			pby--
+		}
+		cbW := minInt(style.cbW, pbx)
+		cbH := minInt(style.cbH, pby)
+
+		var orientations []int
+		if r == 0 {
+			orientations = []int{bandLL}
+		} else {
+			orientations = []int{bandHL, bandLH, bandHH}
+		}
+		for _, o := range orientations {
+			band := &subband{orientation: o, cbW: cbW, cbH: cbH}
+			if r == 0 {
+				band.x0, band.y0, band.x1, band.y1 = res.x0, res.y0, res.x1, res.y1
+			} else {
+				band.index = 1 + 3*(r-1) + o - 1
+				nb := uint(levels - r + 1)
+				xob, yob := 0, 0
+				if o == bandHL || o == bandHH {
+					xob = 1
+				}
+				if o == bandLH || o == bandHH {
+					yob = 1
+				}
+				band.x0 = ceilDivPow2(tc.x0-(xob<<(nb-1)), nb)
+				band.y0 = ceilDivPow2(tc.y0-(yob<<(nb-1)), nb)
+				band.x1 = ceilDivPow2(tc.x1-(xob<<(nb-1)), nb)
+				band.y1 = ceilDivPow2(tc.y1-(yob<<(nb-1)), nb)
+			}
+			step := tc.quant.step(band.index, levels)
+			band.numBitPlanes = tc.quant.guardBits + step.exponent - 1
+			if band.numBitPlanes+tc.roiShift > 30 {
+				return errors.New("Unsupported JPEG 2000 subband dynamic range")
+			}
+
+			for py := 0; py < res.numPrcH; py++ {
+				for px := 0; px < res.numPrcW; px++ {
+					band.precincts = append(band.precincts, band.newPrecinct(res, px, py, pbx, pby))
+				}
+			}
+			res.bands = append(res.bands, band)
+		}
+		tc.resolutions = append(tc.resolutions, res)
+	}
+	return nil
+}
+
+// newPrecinct creates the precinct (`px`, `py`) of the subband with its code-blocks.  The precinct
+// size exponents in the subband are `pbx` and `pby`.
+func (band *subband) newPrecinct(res *resolution, px, py, pbx, pby int) *precinct {
+	x0 := maxInt(band.x0, (res.prcX0+px)<<uint(pbx))
+	y0 := maxInt(band.y0, (res.prcY0+py)<<uint(pby))
+	x1 := minInt(band.x1, (res.prcX0+px+1)<<uint(pbx))
+	y1 := minInt(band.y1, (res.prcY0+py+1)<<uint(pby))
+
+	prc := &precinct{}
+	if x1 <= x0 || y1 <= y0 {
+		return prc
+	}
+	cbx0 := floorDivPow2(x0, uint(band.cbW))
+	cby0 := floorDivPow2(y0, uint(band.cbH))
+	prc.numW = ceilDivPow2(x1, uint(band.cbW)) - cbx0
+	prc.numH = ceilDivPow2(y1, uint(band.cbH)) - cby0
+	for j := 0; j < prc.numH; j++ {
+		for i := 0; i < prc.numW; i++ {
+			cb := &codeBlock{
+				x0: maxInt(x0, (cbx0+i)<<uint(band.cbW)),
+				y0: maxInt(y0, (cby0+j)<<uint(band.cbH)),
+				x1: minInt(x1, (cbx0+i+1)<<uint(band.cbW)),
+				y1: minInt(y1, (cby0+j+1)<<uint(band.cbH)),
+			}
+			prc.blocks = append(prc.blocks, cb)
+		}
+	}
+	prc.inclusion = newTagTree(prc.numW, prc.numH)
+	prc.zeroPlanes = newTagTree(prc.numW, prc.numH)
+	return prc
+}
+
+// packet identifies a packet by layer, resolution, component and precinct.
+type packet struct {
+	layer int
+	res   int
+	comp  int
+	prc   int
+}
+
+// packetOrder returns the packets of the tile in the order of the progression (B.12).
+func (t *tile) packetOrder() []packet {
+	params := t.params
+	changes := params.pocs
+	if len(changes) == 0 {
+		changes = []progressionChange{{
+			layerEnd:    params.layers,
+			resEnd:      33,
+			compEnd:     len(t.comps),
+			progression: params.progression,
+		}}
+	}
+
+	// Next layer of each precinct, so that packets are only included once.
+	next := map[[3]int]int{}
+	var packets []packet
+	emit := func(l, r, c, p int) {
+		key := [3]int{c, r, p}
+		if next[key] == l {
+			next[key] = l + 1
+			packets = append(packets, packet{l, r, c, p})
+		}
+	}
+
+	for _, pc := range changes {
+		layerEnd := minInt(pc.layerEnd, params.layers)
+		compEnd := minInt(pc.compEnd, len(t.comps))
+
+		// Precincts in the progression volume with their position on the reference grid.
+		type position struct {
+			r, c, p int
+			x, y    int
+		}
+		var positions []position
+		maxRes := 0
+		for c := pc.compStart; c < compEnd; c++ {
+			tc := t.comps[c]
+			levels := len(tc.resolutions) - 1
+			for r := pc.resStart; r < pc.resEnd && r <= levels; r++ {
+				res := tc.resolutions[r]
+				maxRes = maxInt(maxRes, r+1)
+				shift := uint(levels - r)
+				for p := 0; p < res.numPrcW*res.numPrcH; p++ {
+					px := res.prcX0 + p%res.numPrcW
+					py := res.prcY0 + p/res.numPrcW
+					positions = append(positions, position{
+						r: r, c: c, p: p,
+						x: maxInt(t.x0, (px<<uint(res.ppx)<<shift)*tc.info.dx),
+						y: maxInt(t.y0, (py<<uint(res.ppy)<<shift)*tc.info.dy),
+					})
+				}
+			}
+		}
+
+		switch pc.progression {
+		case progressionLRCP:
+			for l := 0; l < layerEnd; l++ {
+				for r := pc.resStart; r < maxRes; r++ {
+					for _, pos := range positions {
+						if pos.r == r {
+							emit(l, pos.r, pos.c, pos.p)
+						}
+					}
+				}
+			}
+			continue
+		case progressionRLCP:
+			for r := pc.resStart; r < maxRes; r++ {
+				for l := 0; l < layerEnd; l++ {
+					for _, pos := range positions {
+						if pos.r == r {
+							emit(l, pos.r, pos.c, pos.p)
+						}
+					}
+				}
+			}
+			continue
+		}
+
+		// Position driven progressions.
+		var keys func(pos position) [4]int
+		switch pc.progression {
+		case progressionRPCL:
+			keys = func(pos position) [4]int { return [4]int{pos.r, pos.y, pos.x, pos.c} }
+		case progressionPCRL:
+			keys = func(pos position) [4]int { return [4]int{pos.y, pos.x, pos.c, pos.r} }
+		default:
+			keys = func(pos position) [4]int { return [4]int{pos.c, pos.y, pos.x, pos.r} }
+		}
+		sort.SliceStable(positions, func(i, j int) bool {
+			a, b := keys(positions[i]), keys(positions[j])
+			for k := range a {
+				if a[k] != b[k] {
+					return a[k] < b[k]
+				}
+			}
+			return false
+		})
+		for _, pos := range positions {
+			for l := 0; l < layerEnd; l++ {
+				emit(l, pos.r, pos.c, pos.p)
+			}
+		}
+	}
+	return packets
+}
+
+// segmentEnd returns the index following the last coding pass of the codeword segment containing
+// pass `pass` (D.4.1).
+func segmentEnd(pass, cbStyle int) int {
+	if cbStyle&cbStyleTermAll != 0 {
+		return pass + 1
+	}
+	if cbStyle&cbStyleBypass != 0 {
+		if pass < 10 {
+			return 10
+		}
+		switch (pass - 10) % 3 {
+		case 0:
+			return pass + 2 // Raw significance propagation and refinement passes.
+		default:
+			return pass + 1
+		}
+	}
+	return 1 << 30
+}
+
+// floorLog2 returns floor(log2(n)) for n > 0.
+func floorLog2(n int) int {
+	l := 0
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return l
+}
+
+// decodeNumPasses decodes the number of coding passes of a code-block (Table B.4).
+func decodeNumPasses(r *headerReader) int {
+	if r.readBit() == 0 {
+		return 1
+	}
+	if r.readBit() == 0 {
+		return 2
+	}
+	v := r.readBits(2)
+	if v < 3 {
+		return v + 3
+	}
+	v = r.readBits(5)
+	if v < 31 {
+		return v + 6
+	}
+	return r.readBits(7) + 37
+}
+
+// pendingChunk is a code-block contribution of a packet whose data follows the header.
+type pendingChunk struct {
+	cb     *codeBlock
+	length int
+	chunk  codeBlockChunk
+}
+
+// decodePackets reads the packets of the tile and collects the code-block data.
+func (t *tile) decodePackets(data, headers []byte) error {
+	body := &reader{data: data}
+	var hr *headerReader
+	if headers != nil {
+		hr = &headerReader{data: headers}
+	}
+
+	for _, pk := range t.packetOrder() {
+		if body.remaining() <= 0 && headers == nil {
+			break
+		}
+		if t.params.sop && body.remaining() >= 6 && body.data[body.pos] == 0xff && body.data[body.pos+1] == 0x91 {
+			body.pos += 6
+		}
+
+		r := hr
+		if headers == nil {
+			r = &headerReader{data: body.data, pos: body.pos}
+		}
+		pending := t.decodePacketHeader(r, pk)
+		r.align()
+		if t.params.eph && r.pos+2 <= len(r.data) && r.data[r.pos] == 0xff && r.data[r.pos+1] == 0x92 {
+			r.pos += 2
+		}
+		if headers == nil {
+			body.pos = r.pos
+		}
+
+		for _, pc := range pending {
+			chunk, err := body.bytes(pc.length)
+			if err != nil {
+				// Truncated data: use what is available.
+				common.Log.Debug("JPEG 2000 packet data truncated")
+				chunk = body.data[minInt(body.pos, len(body.data)):]
+				body.pos = len(body.data)
+			}
+			pc.chunk.data = chunk
+			pc.cb.chunks = append(pc.cb.chunks, pc.chunk)
+		}
+	}
+	return nil
+}
+
+// decodePacketHeader decodes the header of packet `pk` (B.10).
+func (t *tile) decodePacketHeader(r *headerReader, pk packet) []pendingChunk {
+	if r.readBit() == 0 {
+		// Empty packet.
+		return nil
+	}
+	tc := t.comps[pk.comp]
+	res := tc.resolutions[pk.res]
+	cbStyle := tc.style.cbStyle
+
+	var pending []pendingChunk
+	for _, band := range res.bands {
+		prc := band.precincts[pk.prc]
+		for k, cb := range prc.blocks {
+			x, y := k%prc.numW, k/prc.numW
+			var included bool
+			if !cb.included {
+				included = prc.inclusion.decode(r, x, y, pk.layer+1)
+			} else {
+				included = r.readBit() == 1
+			}
+			if !included {
+				continue
+			}
+			if !cb.included {
+				i := 1
+				for !prc.zeroPlanes.decode(r, x, y, i) {
+					i++
+				}
+				cb.zeroPlanes = i - 1
+				cb.included = true
+				cb.lblock = 3
+			}
+
+			numPasses := decodeNumPasses(r)
+			for r.readBit() == 1 {
+				cb.lblock++
+			}
+
+			// Lengths of the codeword segment contributions.
+			pass := cb.numPasses
+			for numPasses > 0 {
+				n := minInt(numPasses, segmentEnd(pass, cbStyle)-pass)
+				length := r.readBits(cb.lblock + floorLog2(n))
+				pending = append(pending, pendingChunk{
+					cb:     cb,
+					length: length,
+					chunk: codeBlockChunk{
+						passes:     n,
+						newSegment: pass == 0 || segmentEnd(pass-1, cbStyle) == pass,
+					},
+				})
+				pass += n
+				numPasses -= n
+			}
+			cb.numPasses = pass
+		}
+	}
+	return pending
+}
@@ -0,0 +1,248 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package jpx
+
+import (
+	"math"
+)
+
+// Irreversible 9-7 filter lifting parameters (Table F.4).
+const (
+	liftAlpha = -1.586134342059924
+	liftBeta  = -0.052980118572961
+	liftGamma = 0.882911075530934
+	liftDelta = 0.443506852043971
+	liftK     = 1.230174104914001
+)
+
+// decodeCodeBlocks decodes the code-blocks of the tile-component and returns the dequantized
+// coefficients of each subband, indexed by resolution and subband (E.1).
+func (tc *tileComponent) decodeCodeBlocks() [][][]float64 {
+	coefs := make([][][]float64, len(tc.resolutions))
+	for r, res := range tc.resolutions {
+		for _, band := range res.bands {
+			w := band.x1 - band.x0
+			h := band.y1 - band.y0
+			data := make([]float64, w*h)
+			coefs[r] = append(coefs[r], data)
+
+			// Quantization step size (E.1.1.1).
+			gain := 0
+			switch band.orientation {
+			case bandHL, bandLH:
+				gain = 1
+			case bandHH:
+				gain = 2
+			}
+			step := tc.quant.step(band.index, tc.style.levels)
+			delta := 1.0
+			if !tc.style.reversible {
+				rb := tc.info.precision + gain
+				delta = math.Ldexp(1+float64(step.mantissa)/2048, rb-step.exponent)
+			}
+
+			for _, prc := range band.precincts {
+				for _, cb := range prc.blocks {
+					values := tc.decodeCodeBlock(band, cb)
+					if values == nil {
+						continue
+					}
+					cbw := cb.x1 - cb.x0
+					for y := cb.y0; y < cb.y1; y++ {
+						row := data[(y-band.y0)*w+cb.x0-band.x0:]
+						src := values[(y-cb.y0)*cbw : (y-cb.y0+1)*cbw]
+						for x, v := range src {
+							row[x] = tc.dequantize(v, delta)
+						}
+					}
+				}
+			}
+		}
+	}
+	return coefs
+}
+
+// decodeCodeBlock runs the coding passes of `cb` and returns its coefficients as twice their
+// value, or nil if the code-block has no data.
+func (tc *tileComponent) decodeCodeBlock(band *subband, cb *codeBlock) []int32 {
+	if len(cb.chunks) == 0 || cb.x1 <= cb.x0 || cb.y1 <= cb.y0 {
+		return nil
+	}
+	numBitPlanes := band.numBitPlanes + tc.roiShift - cb.zeroPlanes
+	if numBitPlanes <= 0 {
+		return nil
+	}
+
+	var segments []codeBlockSegment
+	for _, chunk := range cb.chunks {
+		if chunk.newSegment || len(segments) == 0 {
+			segments = append(segments, codeBlockSegment{})
+		}
+		seg := &segments[len(segments)-1]
+		seg.data = append(seg.data, chunk.data...)
+		seg.passes += chunk.passes
+	}
+
+	d := newCodeBlockDecoder(cb.x1-cb.x0, cb.y1-cb.y0, band.orientation, tc.style.cbStyle)
+	values := d.decode(segments, numBitPlanes)
+
+	if tc.roiShift > 0 {
+		// Maxshift region of interest: scale down the region coefficients (Annex H).
+		limit := int32(2) << uint(tc.roiShift)
+		for i, v := range values {
+			if v >= limit {
+				values[i] = v >> uint(tc.roiShift)
+			} else if -v >= limit {
+				values[i] = -(-v >> uint(tc.roiShift))
+			}
+		}
+	}
+	return values
+}
+
+// dequantize returns the coefficient for the decoded value `v` (twice the quantization index).
+func (tc *tileComponent) dequantize(v int32, delta float64) float64 {
+	if tc.style.reversible {
+		// Truncate the reconstruction offset towards zero.
+		if v < 0 {
+			return -float64(-v >> 1)
+		}
+		return float64(v >> 1)
+	}
+	return float64(v) * 0.5 * delta
+}
+
+// reconstruct returns the samples of the tile-component by inverse wavelet transformation of the
+// subband coefficients (F.3).
+func (tc *tileComponent) reconstruct(coefs [][][]float64) []float64 {
+	data := coefs[0][0]
+	for r := 1; r < len(tc.resolutions); r++ {
+		prev := tc.resolutions[r-1]
+		res := tc.resolutions[r]
+		w := res.x1 - res.x0
+		h := res.y1 - res.y0
+		out := make([]float64, w*h)
+
+		// 2D_INTERLEAVE (F.3.3).
+		interleave(out, w, res.x0, res.y0, data, prev.x0, prev.y0, prev.x1, prev.y1, 0, 0)
+		for i, band := range res.bands {
+			xob, yob := 0, 0
+			if band.orientation == bandHL || band.orientation == bandHH {
+				xob = 1
+			}
+			if band.orientation == bandLH || band.orientation == bandHH {
+				yob = 1
+			}
+			interleave(out, w, res.x0, res.y0, coefs[r][i], band.x0, band.y0, band.x1, band.y1, xob, yob)
+		}
+
+		// HOR_SR and VER_SR (F.3.4, F.3.5).
+		if w > 0 && h > 0 {
+			buf := make([]float64, maxInt(w, h)+8)
+			for y := 0; y < h; y++ {
+				tc.filter1D(out[y*w:(y+1)*w], 1, res.x0, res.x1, buf)
+			}
+			for x := 0; x < w; x++ {
+				tc.filter1D(out[x:], w, res.y0, res.y1, buf)
+			}
+		}
+		data = out
+	}
+	return data
+}
+
+// interleave places the coefficients of a subband with bounds (`bx0`, `by0`) - (`bx1`, `by1`)
+// into the resolution samples `out` of width `w` with origin (`x0`, `y0`).
+func interleave(out []float64, w, x0, y0 int, band []float64, bx0, by0, bx1, by1, xob, yob int) {
+	bw := bx1 - bx0
+	for v := by0; v < by1; v++ {
+		row := out[(2*v+yob-y0)*w:]
+		src := band[(v-by0)*bw:]
+		for u := bx0; u < bx1; u++ {
+			row[2*u+xob-x0] = src[u-bx0]
+		}
+	}
+}
+
+// filter1D performs 1D_SR (F.3.6) on the `i1`-`i0` samples of `data` spaced by `stride`, using
+// `buf` as work area.
+func (tc *tileComponent) filter1D(data []float64, stride, i0, i1 int, buf []float64) {
+	n := i1 - i0
+	if n == 1 {
+		if i0%2 != 0 {
+			if tc.style.reversible {
+				data[0] = math.Trunc(data[0] / 2)
+			} else {
+				data[0] /= 2
+			}
+		}
+		return
+	}
+
+	// 1D_EXTR (F.3.7): periodic symmetric extension by 4 samples on each side.
+	const ext = 4
+	x := buf[:n+2*ext]
+	for k := range x {
+		i := pse(i0-ext+k, i0, i1)
+		x[k] = data[(i-i0)*stride]
+	}
+
+	// x[k] holds the sample at i0-ext+k.  Each lifting step is applied at all positions of the
+	// given parity with both neighbours available, which leaves the samples in [i0, i1) exact.
+	even := 1
+	if (i0-ext+1)&1 != 0 {
+		even = 2
+	}
+	odd := 3 - even
+	last := len(x) - 1
+
+	if tc.style.reversible {
+		// F.3.8.1.
+		for k := even; k < last; k += 2 {
+			x[k] -= math.Floor((x[k-1] + x[k+1] + 2) / 4)
+		}
+		for k := odd; k < last; k += 2 {
+			x[k] += math.Floor((x[k-1] + x[k+1]) / 2)
+		}
+	} else {
+		// F.3.8.2.
+		for k := even & 1; k <= last; k += 2 {
+			x[k] *= liftK
+		}
+		for k := odd & 1; k <= last; k += 2 {
+			x[k] *= 1 / liftK
+		}
+		for k := even; k < last; k += 2 {
+			x[k] -= liftDelta * (x[k-1] + x[k+1])
+		}
+		for k := odd; k < last; k += 2 {
+			x[k] -= liftGamma * (x[k-1] + x[k+1])
+		}
+		for k := even; k < last; k += 2 {
+			x[k] -= liftBeta * (x[k-1] + x[k+1])
+		}
+		for k := odd; k < last; k += 2 {
+			x[k] -= liftAlpha * (x[k-1] + x[k+1])
+		}
+	}
+
+	for k := 0; k < n; k++ {
+		data[k*stride] = x[k+ext]
+	}
+}
+
+// pse returns the index of the periodic symmetric extension of the signal [i0, i1) at `i`.
+func pse(i, i0, i1 int) int {
+	period := 2 * (i1 - i0 - 1)
+	m := (i - i0) % period
+	if m < 0 {
+		m += period
+	}
+	if period-m < m {
+		m = period - m
+	}
+	return i0 + m
+}
@@ -0,0 +1,275 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotRecipient is returned by Decrypt when the certificate is not one of the recipients.
+var ErrNotRecipient = errors.New("Certificate is not a recipient of the enveloped data")
+
+// envelopedData is the enveloped-data content type (RFC 5652 section 6.1).
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// envelopedDataOut is envelopedData without the optional fields, for marshalling.
+type envelopedDataOut struct {
+	Version              int
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+// keyTransRecipientInfo holds the content-encryption key encrypted with the public key of a
+// recipient (RFC 5652 section 6.2.1).
+type keyTransRecipientInfo struct {
+	Version                int
+	Rid                    asn1.RawValue
+	KeyEncryptionAlgorithm algorithmIdentifier
+	EncryptedKey           []byte
+}
+
+// encryptedContentInfo holds the encrypted content (RFC 5652 section 6.1).
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm algorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// Encrypt returns the DER encoded enveloped-data content info with `content` encrypted with
+// AES-256 (CBC) for each of the `recipients`.  The certificates must have RSA public keys.
+func Encrypt(content []byte, recipients []*x509.Certificate) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("No recipients")
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	// Content with PKCS #7 padding.
+	pad := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := make([]byte, len(content)+pad)
+	copy(encrypted, content)
+	for i := len(content); i < len(encrypted); i++ {
+		encrypted[i] = byte(pad)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	ed := envelopedDataOut{
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType: oidData,
+			ContentEncryptionAlgorithm: algorithmIdentifier{
+				Algorithm:  oidAES256CBC,
+				Parameters: asn1.RawValue{FullBytes: ivParam},
+			},
+			EncryptedContent: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	}
+
+	for _, cert := range recipients {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported recipient public key type (%T)", cert.PublicKey)
+		}
+		encKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, err
+		}
+		ias, err := asn1.Marshal(issuerAndSerial{
+			IssuerName:   asn1.RawValue{FullBytes: cert.RawIssuer},
+			SerialNumber: cert.SerialNumber,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ri, err := asn1.Marshal(keyTransRecipientInfo{
+			Rid: asn1.RawValue{FullBytes: ias},
+			KeyEncryptionAlgorithm: algorithmIdentifier{
+				Algorithm:  oidRSAEncryption,
+				Parameters: asn1.NullRawValue,
+			},
+			EncryptedKey: encKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ed.RecipientInfos = append(ed.RecipientInfos, asn1.RawValue{FullBytes: ri})
+	}
+
+	data, err := asn1.Marshal(ed)
+	if err != nil {
+		return nil, err
+	}
+	return marshalContentInfo(oidEnvelopedData, data)
+}
+
+// Decrypt decrypts the DER encoded enveloped-data content info `data` for the recipient with
+// certificate `cert` and private key `key`, which must implement crypto.Decrypter with RSA
+// PKCS #1 v1.5 decryption (such as *rsa.PrivateKey).  The content can be encrypted with AES,
+// Triple DES or RC2 (40, 64 or 128 bit effective keys) in CBC mode.
+// Returns ErrNotRecipient if `cert` is not one of the recipients.
+func Decrypt(data []byte, cert *x509.Certificate, key crypto.PrivateKey) ([]byte, error) {
+	content, err := parseContentInfo(data, oidEnvelopedData)
+	if err != nil {
+		return nil, err
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(content, &ed); err != nil {
+		return nil, err
+	}
+
+	ktri, err := findRecipient(ed.RecipientInfos, cert)
+	if err != nil {
+		return nil, err
+	}
+	if !ktri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSAEncryption) {
+		return nil, fmt.Errorf("Unsupported key encryption algorithm (%v)", ktri.KeyEncryptionAlgorithm.Algorithm)
+	}
+	decrypter, ok := key.(crypto.Decrypter)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type (%T)", key)
+	}
+	cek, err := decrypter.Decrypt(rand.Reader, ktri.EncryptedKey, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return ed.EncryptedContentInfo.decrypt(cek)
+}
+
+// findRecipient returns the key transport recipient info in `infos` that identifies `cert`.
+func findRecipient(infos []asn1.RawValue, cert *x509.Certificate) (*keyTransRecipientInfo, error) {
+	for _, info := range infos {
+		if info.Class != asn1.ClassUniversal || info.Tag != asn1.TagSequence {
+			// Only key transport is supported (key agreement etc. are tagged choices).
+			continue
+		}
+		var ktri keyTransRecipientInfo
+		if _, err := asn1.Unmarshal(info.FullBytes, &ktri); err != nil {
+			return nil, err
+		}
+
+		if identifies(ktri.Rid, cert) {
+			return &ktri, nil
+		}
+	}
+	return nil, ErrNotRecipient
+}
+
+// identifies returns true if the recipient or signer identifier `id`, an issuer and serial
+// number or a subject key identifier, identifies `cert`.
+func identifies(id asn1.RawValue, cert *x509.Certificate) bool {
+	if id.Class == asn1.ClassUniversal && id.Tag == asn1.TagSequence {
+		var ias issuerAndSerial
+		if _, err := asn1.Unmarshal(id.FullBytes, &ias); err != nil {
+			return false
+		}
+		return bytes.Equal(ias.IssuerName.FullBytes, cert.RawIssuer) && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+	}
+	if id.Class == asn1.ClassContextSpecific && id.Tag == 0 {
+		// Subject key identifier.
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(id.Bytes, cert.SubjectKeyId)
+	}
+	return false
+}
+
+// decrypt returns the content decrypted with the content-encryption key `cek`.
+func (eci *encryptedContentInfo) decrypt(cek []byte) ([]byte, error) {
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+
+	var block cipher.Block
+	var iv []byte
+	var err error
+	if alg.Equal(oidRC2CBC) {
+		var bits int
+		bits, iv, err = parseRC2Parameters(eci.ContentEncryptionAlgorithm.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		block, err = newRC2Cipher(cek, bits)
+	} else {
+		switch {
+		case alg.Equal(oidAES128CBC), alg.Equal(oidAES192CBC), alg.Equal(oidAES256CBC):
+			block, err = aes.NewCipher(cek)
+		case alg.Equal(oidDESEDE3CBC):
+			block, err = des.NewTripleDESCipher(cek)
+		default:
+			return nil, fmt.Errorf("Unsupported content encryption algorithm (%v)", alg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("Invalid content encryption initialization vector")
+	}
+
+	// The encrypted content may be split into several octet strings (constructed encoding).
+	encrypted := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		encrypted = nil
+		for rest := eci.EncryptedContent.Bytes; len(rest) > 0; {
+			var part []byte
+			rest, err = asn1.Unmarshal(rest, &part)
+			if err != nil {
+				return nil, err
+			}
+			encrypted = append(encrypted, part...)
+		}
+	}
+	if len(encrypted) == 0 || len(encrypted)%block.BlockSize() != 0 {
+		return nil, errors.New("Invalid encrypted content length")
+	}
+
+	content := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, encrypted)
+
+	// Remove the PKCS #7 padding.
+	pad := int(content[len(content)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errors.New("Invalid content padding")
+	}
+	for _, b := range content[len(content)-pad:] {
+		if int(b) != pad {
+			return nil, errors.New("Invalid content padding")
+		}
+	}
+	return content[:len(content)-pad], nil
+}
@@ -0,0 +1,81 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+// Package pkcs7 implements the subset of PKCS #7 (RFC 2315) / CMS (RFC 5652) message syntax used
+// by PDF security handlers.
+package pkcs7
+
+import (
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// Object identifiers.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+
+	oidRC2CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 2}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// ErrUnsupportedContentType is returned when the message is not of the expected content type.
+var ErrUnsupportedContentType = errors.New("Unsupported PKCS #7 content type")
+
+// contentInfo is the outer structure of a PKCS #7 message.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,tag:0"` // [0] EXPLICIT, the tag is handled manually.
+}
+
+// algorithmIdentifier identifies an algorithm and its parameters.
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+// issuerAndSerial identifies a certificate by its issuer name and serial number.
+type issuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// parseContentInfo parses the DER encoded `data` and returns the content if the content type is
+// `contentType`.
+func parseContentInfo(data []byte, contentType asn1.ObjectIdentifier) ([]byte, error) {
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(data, &ci)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		// Trailing bytes, e.g. zero padding of a signature placeholder, are ignored.
+		for _, b := range rest {
+			if b != 0 {
+				return nil, errors.New("Trailing data after PKCS #7 content info")
+			}
+		}
+	}
+	if !ci.ContentType.Equal(contentType) {
+		return nil, ErrUnsupportedContentType
+	}
+	return ci.Content.Bytes, nil
+}
+
+// marshalContentInfo returns the DER encoding of a content info of type `contentType` wrapping
+// the DER encoded `content`.
+func marshalContentInfo(contentType asn1.ObjectIdentifier, content []byte) ([]byte, error) {
+	ci := contentInfo{
+		ContentType: contentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content},
+	}
+	return asn1.Marshal(ci)
+}
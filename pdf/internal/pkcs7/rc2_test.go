@@ -0,0 +1,47 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package pkcs7
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test the RC2 cipher with the test vectors of RFC 2268 section 5.
+func TestRC2(t *testing.T) {
+	vectors := []struct {
+		key, plain, cipher string
+		bits               int
+	}{
+		{"0000000000000000", "0000000000000000", "ebb773f993278eff", 63},
+		{"ffffffffffffffff", "ffffffffffffffff", "278b27e42e2f0d49", 64},
+		{"3000000000000000", "1000000000000001", "30649edf9be7d2c2", 64},
+		{"88", "0000000000000000", "61a8a244adacccf0", 64},
+		{"88bca90e90875a", "0000000000000000", "6ccf4308974c267f", 64},
+		{"88bca90e90875a7f0f79c384627bafb2", "0000000000000000", "1a807d272bbe5db1", 64},
+		{"88bca90e90875a7f0f79c384627bafb2", "0000000000000000", "2269552ab0f85ca6", 128},
+		{"88bca90e90875a7f0f79c384627bafb216f80a6f85920584c42fceb0be255daf1e", "0000000000000000",
+			"5b78d3a43dfff1f1", 129},
+	}
+	for i, v := range vectors {
+		key, _ := hex.DecodeString(v.key)
+		plain, _ := hex.DecodeString(v.plain)
+		c, err := newRC2Cipher(key, v.bits)
+		if err != nil {
+			t.Fatalf("Vector %d: %v", i, err)
+		}
+		out := make([]byte, rc2BlockSize)
+		c.Encrypt(out, plain)
+		if hex.EncodeToString(out) != v.cipher {
+			t.Fatalf("Vector %d: encrypted % x", i, out)
+		}
+		c.Decrypt(out, out)
+		if !bytes.Equal(out, plain) {
+			t.Fatalf("Vector %d: decrypted % x", i, out)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Object identifiers of signed data.
+var (
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	oidAttributeContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidAttributeSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidAttributeTimestampToken       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+// digestAlgorithms maps the supported digest algorithms to their object identifiers.
+var digestAlgorithms = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   oidSHA1,
+	crypto.SHA256: oidSHA256,
+	crypto.SHA384: oidSHA384,
+	crypto.SHA512: oidSHA512,
+}
+
+// ecdsaAlgorithms maps the digest algorithms to the ECDSA signature algorithm identifiers.
+var ecdsaAlgorithms = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   oidECDSAWithSHA1,
+	crypto.SHA256: oidECDSAWithSHA256,
+	crypto.SHA384: oidECDSAWithSHA384,
+	crypto.SHA512: oidECDSAWithSHA512,
+}
+
+// Errors of signature verification.
+var (
+	ErrDigestMismatch   = errors.New("Message digest mismatch")
+	ErrInvalidSignature = errors.New("Invalid signature")
+)
+
+// signedData is the signed-data content type (RFC 5652 section 5.1).
+type signedData struct {
+	Version          int
+	DigestAlgorithms []algorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+// signedDataOut is signedData without the optional revocation information, for marshalling.
+type signedDataOut struct {
+	Version          int
+	DigestAlgorithms []algorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+// encapsulatedContentInfo holds the signed content, which is absent for detached signatures
+// (RFC 5652 section 5.2).
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"optional,explicit,tag:0"`
+}
+
+// signerInfo holds the signature of a signer (RFC 5652 section 5.3).
+type signerInfo struct {
+	Version            int
+	Sid                asn1.RawValue
+	DigestAlgorithm    algorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm algorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// attribute is a signed or unsigned attribute of a signer.
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// essCertIDv2 identifies the signing certificate by its SHA-256 hash (RFC 5035 section 4).
+// The hash algorithm is omitted as SHA-256 is the default.
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+// signingCertificateV2 is the value of the ESS signing-certificate-v2 attribute.
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// SignOptions are the options of SignDetached.
+type SignOptions struct {
+	// Digest algorithm of the content digest and of the signature: crypto.SHA1, crypto.SHA256
+	// (default), crypto.SHA384 or crypto.SHA512.
+	Hash crypto.Hash
+
+	// Signing time, included as a signed attribute unless zero.
+	SigningTime time.Time
+
+	// Include the ESS signing-certificate-v2 attribute identifying the signer certificate, as
+	// required by CAdES.
+	SigningCertificateV2 bool
+
+	// Returns the DER encoded RFC 3161 timestamp token of the signature value `signature`, added
+	// as an unsigned attribute (signature timestamp), if not nil.
+	Timestamp func(signature []byte) ([]byte, error)
+}
+
+// SignDetached returns the DER encoded signed-data content info with a detached signature of the
+// content with the digest `digest`, computed with the digest algorithm of `opts`.
+// The signature is created with `signer`, an RSA (PKCS #1 v1.5) or ECDSA private key, and
+// `certs` holds the certificate of the signer followed by the rest of the certificate chain.
+func SignDetached(digest []byte, signer crypto.Signer, certs []*x509.Certificate, opts *SignOptions) ([]byte, error) {
+	return sign(oidData, nil, digest, signer, certs, opts)
+}
+
+// sign returns the DER encoded signed-data content info with the signature of the content of
+// type `contentType` with the digest `digest`.  The content is encapsulated unless nil.
+func sign(contentType asn1.ObjectIdentifier, content []byte, digest []byte, signer crypto.Signer,
+	certs []*x509.Certificate, opts *SignOptions) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("Missing signer certificate")
+	}
+	if opts == nil {
+		opts = &SignOptions{}
+	}
+	hash := opts.Hash
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	digestOID, ok := digestAlgorithms[hash]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported digest algorithm (%v)", hash)
+	}
+	if len(digest) != hash.Size() {
+		return nil, errors.New("Invalid digest length")
+	}
+
+	var sigAlg algorithmIdentifier
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = algorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlg = algorithmIdentifier{Algorithm: ecdsaAlgorithms[hash]}
+	default:
+		return nil, fmt.Errorf("Unsupported signer public key type (%T)", signer.Public())
+	}
+
+	// Signed attributes.
+	attrs := []attribute{}
+	addAttribute := func(oid asn1.ObjectIdentifier, val interface{}) error {
+		b, err := asn1.Marshal(val)
+		if err != nil {
+			return err
+		}
+		attrs = append(attrs, attribute{
+			Type:   oid,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: b},
+		})
+		return nil
+	}
+	if err := addAttribute(oidAttributeContentType, contentType); err != nil {
+		return nil, err
+	}
+	if err := addAttribute(oidAttributeMessageDigest, digest); err != nil {
+		return nil, err
+	}
+	if !opts.SigningTime.IsZero() {
+		if err := addAttribute(oidAttributeSigningTime, opts.SigningTime.UTC()); err != nil {
+			return nil, err
+		}
+	}
+	if opts.SigningCertificateV2 {
+		certHash := sha256.Sum256(certs[0].Raw)
+		val := signingCertificateV2{Certs: []essCertIDv2{{CertHash: certHash[:]}}}
+		if err := addAttribute(oidAttributeSigningCertificateV2, val); err != nil {
+			return nil, err
+		}
+	}
+	attrsSet, err := marshalSet(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature is computed over the DER encoding of the signed attributes (as a SET OF).
+	h := hash.New()
+	h.Write(attrsSet)
+	signature, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, err
+	}
+
+	ias, err := asn1.Marshal(issuerAndSerial{
+		IssuerName:   asn1.RawValue{FullBytes: certs[0].RawIssuer},
+		SerialNumber: certs[0].SerialNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// In the signer info, the signed attributes are tagged [0] IMPLICIT.
+	signedAttrs := asn1.RawValue{}
+	if _, err := asn1.Unmarshal(attrsSet, &signedAttrs); err != nil {
+		return nil, err
+	}
+	signedAttrs = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedAttrs.Bytes}
+	info := signerInfo{
+		Version:            1,
+		Sid:                asn1.RawValue{FullBytes: ias},
+		DigestAlgorithm:    algorithmIdentifier{Algorithm: digestOID},
+		SignedAttrs:        signedAttrs,
+		SignatureAlgorithm: sigAlg,
+		Signature:          signature,
+	}
+	if opts.Timestamp != nil {
+		token, err := opts.Timestamp(signature)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(attribute{
+			Type:   oidAttributeTimestampToken,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: token},
+		})
+		if err != nil {
+			return nil, err
+		}
+		info.UnsignedAttrs = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: attr}
+	}
+	si, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	var certsBuf bytes.Buffer
+	for _, cert := range certs {
+		certsBuf.Write(cert.Raw)
+	}
+	// Version 3 with other content types than data (RFC 5652 section 5.1).
+	version := 1
+	if !contentType.Equal(oidData) {
+		version = 3
+	}
+	sd := signedDataOut{
+		Version:          version,
+		DigestAlgorithms: []algorithmIdentifier{{Algorithm: digestOID}},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: contentType},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certsBuf.Bytes()},
+		SignerInfos:      []asn1.RawValue{{FullBytes: si}},
+	}
+	if content != nil {
+		econtent, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		sd.EncapContentInfo.EContent = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: econtent}
+	}
+	data, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return marshalContentInfo(oidSignedData, data)
+}
+
+// marshalSet returns the DER encoding of `attrs` as a SET OF, with the elements sorted by their
+// encodings as required by DER.
+func marshalSet(attrs []attribute) ([]byte, error) {
+	encoded := make([][]byte, len(attrs))
+	for i, attr := range attrs {
+		b, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = b
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	return asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      bytes.Join(encoded, nil),
+	})
+}
+
+// SignedData is a parsed signed-data message with a single signer.
+type SignedData struct {
+	// Certificates included in the message.
+	Certificates []*x509.Certificate
+
+	// Certificate of the signer, nil if not included in the message.
+	SignerCertificate *x509.Certificate
+
+	// Digest algorithm of the signer.
+	Hash crypto.Hash
+
+	// Signing time given by the signer, zero if not present.
+	SigningTime time.Time
+
+	// Encapsulated content, nil for detached signatures.
+	Content []byte
+
+	// DER encoded RFC 3161 timestamp token of the signature, nil if not present.
+	TimestampToken []byte
+
+	contentType asn1.ObjectIdentifier
+	signer      signerInfo
+	// Content digest of the message-digest attribute, nil without signed attributes.
+	digest []byte
+}
+
+// ParseSignedData parses the DER encoded signed-data content info `data`, which may be followed by
+// zero padding.
+func ParseSignedData(data []byte) (*SignedData, error) {
+	content, err := parseContentInfo(data, oidSignedData)
+	if err != nil {
+		return nil, err
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(content, &sd); err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("Unsupported number of signers (%d)", len(sd.SignerInfos))
+	}
+
+	result := &SignedData{contentType: sd.EncapContentInfo.EContentType}
+	if len(sd.Certificates.Bytes) > 0 {
+		result.Certificates, err = x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(sd.EncapContentInfo.EContent.Bytes) > 0 {
+		if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent.Bytes, &result.Content); err != nil {
+			return nil, err
+		}
+	}
+
+	si := &result.signer
+	if _, err := asn1.Unmarshal(sd.SignerInfos[0].FullBytes, si); err != nil {
+		return nil, err
+	}
+	for hash, oid := range digestAlgorithms {
+		if si.DigestAlgorithm.Algorithm.Equal(oid) {
+			result.Hash = hash
+		}
+	}
+	if result.Hash == 0 {
+		return nil, fmt.Errorf("Unsupported digest algorithm (%v)", si.DigestAlgorithm.Algorithm)
+	}
+	for _, cert := range result.Certificates {
+		if identifies(si.Sid, cert) {
+			result.SignerCertificate = cert
+			break
+		}
+	}
+
+	for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+		var attr attribute
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case attr.Type.Equal(oidAttributeMessageDigest):
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &result.digest); err != nil {
+				return nil, err
+			}
+		case attr.Type.Equal(oidAttributeSigningTime):
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &result.SigningTime); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(si.SignedAttrs.Bytes) > 0 && result.digest == nil {
+		return nil, errors.New("Missing message digest attribute")
+	}
+	for rest := si.UnsignedAttrs.Bytes; len(rest) > 0; {
+		var attr attribute
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			return nil, err
+		}
+		if attr.Type.Equal(oidAttributeTimestampToken) {
+			result.TimestampToken = attr.Values.Bytes
+		}
+	}
+
+	return result, nil
+}
+
+// Verify checks that the signed content has the digest `digest`, computed with the digest
+// algorithm sd.Hash, and that the signature is valid for the public key of the signer
+// certificate.  The signer certificate itself is not verified.
+// Returns ErrDigestMismatch or ErrInvalidSignature if the verification fails.
+func (sd *SignedData) Verify(digest []byte) error {
+	if sd.SignerCertificate == nil {
+		return errors.New("Signer certificate not found")
+	}
+
+	// Without signed attributes, the signature is computed over the content digest.
+	signedDigest := digest
+	if sd.digest != nil {
+		if !bytes.Equal(sd.digest, digest) {
+			return ErrDigestMismatch
+		}
+		// The signed attributes are signed with the SET OF tag in place of the [0] tag.
+		attrs := append([]byte{}, sd.signer.SignedAttrs.FullBytes...)
+		attrs[0] = 0x31
+		h := sd.Hash.New()
+		h.Write(attrs)
+		signedDigest = h.Sum(nil)
+	} else if len(digest) != sd.Hash.Size() {
+		return ErrDigestMismatch
+	}
+
+	signature := sd.signer.Signature
+	switch pub := sd.SignerCertificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if sd.signer.SignatureAlgorithm.Algorithm.Equal(oidRSASSAPSS) {
+			err = rsa.VerifyPSS(pub, sd.Hash, signedDigest, signature, nil)
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, sd.Hash, signedDigest, signature)
+		}
+		if err != nil {
+			return ErrInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, signedDigest, signature) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("Unsupported signer public key type (%T)", pub)
+	}
+	return nil
+}
+
+// Chain returns the certificate chain of the signer, starting with the signer certificate,
+// built from the certificates of the message.  Only the signatures of the certificates are
+// checked, the chain needs to be verified against trusted roots (see x509.Certificate.Verify).
+func (sd *SignedData) Chain() []*x509.Certificate {
+	if sd.SignerCertificate == nil {
+		return nil
+	}
+	chain := []*x509.Certificate{sd.SignerCertificate}
+	for cert := sd.SignerCertificate; !bytes.Equal(cert.RawIssuer, cert.RawSubject); {
+		var issuer *x509.Certificate
+		for _, c := range sd.Certificates {
+			if bytes.Equal(c.RawSubject, cert.RawIssuer) &&
+				c.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil || len(chain) > len(sd.Certificates) {
+			break
+		}
+		chain = append(chain, issuer)
+		cert = issuer
+	}
+	return chain
+}
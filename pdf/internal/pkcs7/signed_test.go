@@ -0,0 +1,152 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/unidoc/unidoc/pdf/internal/testutil"
+)
+
+// makeTestECDSACertificate returns a certificate with an ECDSA key, issued by `parent` with
+// private key `parentKey`, or self-signed if `parent` is nil.
+func makeTestECDSACertificate(t *testing.T, name string, serial int64, parent *x509.Certificate,
+	parentKey crypto.Signer) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		parent, parentKey = &template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return cert, key
+}
+
+func TestSignDetachedRSA(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Signer", 1)
+	other, _ := testutil.MakeCertificate(t, "Other", 2)
+
+	digest := sha256.Sum256([]byte("Signed content"))
+	signingTime := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	data, err := SignDetached(digest[:], key, []*x509.Certificate{cert, other}, &SignOptions{SigningTime: signingTime})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Signatures are embedded in zero padded placeholders in PDF files.
+	data = append(data, make([]byte, 100)...)
+
+	sd, err := ParseSignedData(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if sd.Content != nil || sd.Hash != crypto.SHA256 || !sd.SigningTime.Equal(signingTime) {
+		t.Fatalf("Incorrect signed data %+v", sd)
+	}
+	if len(sd.Certificates) != 2 || sd.SignerCertificate == nil || !sd.SignerCertificate.Equal(cert) {
+		t.Fatalf("Incorrect certificates")
+	}
+	if err := sd.Verify(digest[:]); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	tampered := sha256.Sum256([]byte("Tampered content"))
+	if err := sd.Verify(tampered[:]); err != ErrDigestMismatch {
+		t.Fatalf("Tampered content not detected (%v)", err)
+	}
+	sd.signer.Signature[0] ^= 0xff
+	if err := sd.Verify(digest[:]); err != ErrInvalidSignature {
+		t.Fatalf("Invalid signature not detected (%v)", err)
+	}
+}
+
+func TestSignDetachedECDSA(t *testing.T) {
+	cert, key := makeTestECDSACertificate(t, "Signer", 1, nil, nil)
+
+	digest := sha256.Sum256([]byte("Signed content"))
+	data, err := SignDetached(digest[:], key, []*x509.Certificate{cert}, &SignOptions{SigningCertificateV2: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	sd, err := ParseSignedData(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !sd.signer.SignatureAlgorithm.Algorithm.Equal(oidECDSAWithSHA256) || !sd.SigningTime.IsZero() {
+		t.Fatalf("Incorrect signed data %+v", sd)
+	}
+	found := false
+	for rest := sd.signer.SignedAttrs.Bytes; len(rest) > 0; {
+		var attr attribute
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if attr.Type.Equal(oidAttributeSigningCertificateV2) {
+			var sc signingCertificateV2
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &sc); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			certHash := sha256.Sum256(cert.Raw)
+			found = len(sc.Certs) == 1 && bytes.Equal(sc.Certs[0].CertHash, certHash[:])
+		}
+	}
+	if !found {
+		t.Fatalf("Missing signing certificate attribute")
+	}
+	if err := sd.Verify(digest[:]); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if _, err := SignDetached(digest[:4], key, []*x509.Certificate{cert}, nil); err == nil {
+		t.Fatalf("Invalid digest accepted")
+	}
+}
+
+func TestSignedDataChain(t *testing.T) {
+	root, rootKey := testutil.MakeCertificate(t, "Root", 1)
+	cert, key := makeTestECDSACertificate(t, "Signer", 2, root, rootKey)
+	other, _ := testutil.MakeCertificate(t, "Other", 3)
+
+	digest := sha256.Sum256([]byte("Signed content"))
+	data, err := SignDetached(digest[:], key, []*x509.Certificate{cert, other, root}, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sd, err := ParseSignedData(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	chain := sd.Chain()
+	if len(chain) != 2 || !chain[0].Equal(cert) || !chain[1].Equal(root) {
+		t.Fatalf("Incorrect chain %v", chain)
+	}
+}
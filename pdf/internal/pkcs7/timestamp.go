@@ -0,0 +1,265 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package pkcs7
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Content type of timestamp tokens (RFC 3161 section 2.4.2).
+var oidTSTInfo = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+
+// messageImprint is the digest of the timestamped data.
+type messageImprint struct {
+	HashAlgorithm algorithmIdentifier
+	HashedMessage []byte
+}
+
+// timeStampReq is a timestamp request (RFC 3161 section 2.4.1).
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     asn1.RawValue         `asn1:"optional,tag:0"`
+}
+
+// accuracy is the accuracy of the time of a timestamp.
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// tstInfo is the content of a timestamp token (RFC 3161 section 2.4.2).
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       accuracy      `asn1:"optional"`
+	Ordering       bool          `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// pkiStatusInfo is the status of a timestamp response.
+type pkiStatusInfo struct {
+	Status       int
+	StatusString asn1.RawValue  `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+// timeStampResp is a timestamp response (RFC 3161 section 2.4.2).
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// hashForAlgorithm returns the digest algorithm identified by `oid`, 0 if not supported.
+func hashForAlgorithm(oid asn1.ObjectIdentifier) crypto.Hash {
+	for hash, hashOID := range digestAlgorithms {
+		if oid.Equal(hashOID) {
+			return hash
+		}
+	}
+	return 0
+}
+
+// TimestampRequest is a request of a timestamp token for data with the digest Digest.
+type TimestampRequest struct {
+	// Digest algorithm of the digest.
+	Hash   crypto.Hash
+	Digest []byte
+
+	// Optional nonce, returned in the timestamp token.
+	Nonce *big.Int
+
+	// Request the certificate of the time stamping authority in the token.
+	CertReq bool
+}
+
+// Marshal returns the DER encoding of the request.
+func (req *TimestampRequest) Marshal() ([]byte, error) {
+	hashOID, ok := digestAlgorithms[req.Hash]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported digest algorithm (%v)", req.Hash)
+	}
+	return asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: algorithmIdentifier{Algorithm: hashOID, Parameters: asn1.NullRawValue},
+			HashedMessage: req.Digest,
+		},
+		Nonce:   req.Nonce,
+		CertReq: req.CertReq,
+	})
+}
+
+// ParseTimestampRequest parses the DER encoded timestamp request `data`.
+func ParseTimestampRequest(data []byte) (*TimestampRequest, error) {
+	var req timeStampReq
+	if _, err := asn1.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	hash := hashForAlgorithm(req.MessageImprint.HashAlgorithm.Algorithm)
+	if hash == 0 {
+		return nil, fmt.Errorf("Unsupported digest algorithm (%v)", req.MessageImprint.HashAlgorithm.Algorithm)
+	}
+	return &TimestampRequest{
+		Hash:    hash,
+		Digest:  req.MessageImprint.HashedMessage,
+		Nonce:   req.Nonce,
+		CertReq: req.CertReq,
+	}, nil
+}
+
+// TimestampInfo is the content of a timestamp token: the time at which the data with the digest
+// Digest existed.
+type TimestampInfo struct {
+	// Policy of the time stamping authority.
+	Policy asn1.ObjectIdentifier
+	// Serial number of the token, unique for the time stamping authority.
+	SerialNumber *big.Int
+	Time         time.Time
+
+	// Digest algorithm of the digest.
+	Hash   crypto.Hash
+	Digest []byte
+
+	// Nonce of the request, if any.
+	Nonce *big.Int
+}
+
+// SignTimestamp returns the DER encoded timestamp token with the content `info`, signed by the
+// time stamping authority with `signer` and the certificate chain `certs`, starting with the
+// certificate of the authority.
+func SignTimestamp(info *TimestampInfo, signer crypto.Signer, certs []*x509.Certificate) ([]byte, error) {
+	hashOID, ok := digestAlgorithms[info.Hash]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported digest algorithm (%v)", info.Hash)
+	}
+	content, err := asn1.Marshal(tstInfo{
+		Version: 1,
+		Policy:  info.Policy,
+		MessageImprint: messageImprint{
+			HashAlgorithm: algorithmIdentifier{Algorithm: hashOID, Parameters: asn1.NullRawValue},
+			HashedMessage: info.Digest,
+		},
+		SerialNumber: info.SerialNumber,
+		GenTime:      info.Time.UTC(),
+		Nonce:        info.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := crypto.SHA256.New()
+	h.Write(content)
+	opts := &SignOptions{Hash: crypto.SHA256, SigningCertificateV2: true}
+	return sign(oidTSTInfo, content, h.Sum(nil), signer, certs, opts)
+}
+
+// MarshalTimestampResponse returns the DER encoding of a timestamp response granting the
+// timestamp token `token`.
+func MarshalTimestampResponse(token []byte) ([]byte, error) {
+	return asn1.Marshal(timeStampResp{TimeStampToken: asn1.RawValue{FullBytes: token}})
+}
+
+// ParseTimestampResponse parses the DER encoded timestamp response `data`, and returns the
+// timestamp token if granted.
+func ParseTimestampResponse(data []byte) ([]byte, error) {
+	var resp timeStampResp
+	if _, err := asn1.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	// Granted (0) or granted with modifications (1).
+	if resp.Status.Status > 1 {
+		return nil, fmt.Errorf("Timestamp request rejected (status %d)", resp.Status.Status)
+	}
+	if len(resp.TimeStampToken.FullBytes) == 0 {
+		return nil, errors.New("Missing timestamp token")
+	}
+	return resp.TimeStampToken.FullBytes, nil
+}
+
+// TimestampToken is a parsed timestamp token.
+type TimestampToken struct {
+	Info TimestampInfo
+	// Signed data of the token, signed by the time stamping authority.
+	SignedData *SignedData
+}
+
+// ParseTimestampToken parses the DER encoded timestamp token `token`, which may be followed by
+// zero padding.
+func ParseTimestampToken(token []byte) (*TimestampToken, error) {
+	sd, err := ParseSignedData(token)
+	if err != nil {
+		return nil, err
+	}
+	if !sd.contentType.Equal(oidTSTInfo) || sd.Content == nil {
+		return nil, ErrUnsupportedContentType
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(sd.Content, &info); err != nil {
+		return nil, err
+	}
+	hash := hashForAlgorithm(info.MessageImprint.HashAlgorithm.Algorithm)
+	if hash == 0 {
+		return nil, fmt.Errorf("Unsupported digest algorithm (%v)", info.MessageImprint.HashAlgorithm.Algorithm)
+	}
+	return &TimestampToken{
+		Info: TimestampInfo{
+			Policy:       info.Policy,
+			SerialNumber: info.SerialNumber,
+			Time:         info.GenTime,
+			Hash:         hash,
+			Digest:       info.MessageImprint.HashedMessage,
+			Nonce:        info.Nonce,
+		},
+		SignedData: sd,
+	}, nil
+}
+
+// Verify checks that the timestamped data has the digest `digest`, computed with the digest
+// algorithm tt.Info.Hash, and that the token is validly signed by the time stamping authority.
+// Returns ErrDigestMismatch or ErrInvalidSignature if the verification fails.
+func (tt *TimestampToken) Verify(digest []byte) error {
+	if !bytes.Equal(tt.Info.Digest, digest) {
+		return ErrDigestMismatch
+	}
+	h := tt.SignedData.Hash.New()
+	h.Write(tt.SignedData.Content)
+	return tt.SignedData.Verify(h.Sum(nil))
+}
+
+// VerifyTimestamp verifies the timestamp token of the signature, and returns it.
+// Returns nil if the signature has no timestamp token.
+func (sd *SignedData) VerifyTimestamp() (*TimestampToken, error) {
+	if sd.TimestampToken == nil {
+		return nil, nil
+	}
+	tt, err := ParseTimestampToken(sd.TimestampToken)
+	if err != nil {
+		return nil, err
+	}
+	// The timestamped data is the signature value.
+	h := tt.Info.Hash.New()
+	h.Write(sd.signer.Signature)
+	if err := tt.Verify(h.Sum(nil)); err != nil {
+		return nil, err
+	}
+	return tt, nil
+}
@@ -0,0 +1,131 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package pkcs7
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/unidoc/unidoc/pdf/internal/testutil"
+)
+
+func TestTimestampRequest(t *testing.T) {
+	digest := sha256.Sum256([]byte("Timestamped content"))
+	req := &TimestampRequest{Hash: crypto.SHA256, Digest: digest[:], Nonce: big.NewInt(1234), CertReq: true}
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	parsed, err := ParseTimestampRequest(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if parsed.Hash != crypto.SHA256 || string(parsed.Digest) != string(digest[:]) ||
+		parsed.Nonce.Int64() != 1234 || !parsed.CertReq {
+		t.Fatalf("Incorrect request %+v", parsed)
+	}
+}
+
+func TestTimestampToken(t *testing.T) {
+	tsaCert, tsaKey := testutil.MakeCertificate(t, "TSA", 1)
+
+	digest := sha256.Sum256([]byte("Timestamped content"))
+	info := &TimestampInfo{
+		Policy:       asn1.ObjectIdentifier{1, 2, 3, 4},
+		SerialNumber: big.NewInt(42),
+		Time:         time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+		Hash:         crypto.SHA256,
+		Digest:       digest[:],
+		Nonce:        big.NewInt(1234),
+	}
+	token, err := SignTimestamp(info, tsaKey, []*x509.Certificate{tsaCert})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	resp, err := MarshalTimestampResponse(token)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	token, err = ParseTimestampResponse(resp)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	tt, err := ParseTimestampToken(token)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !tt.Info.Time.Equal(info.Time) || tt.Info.SerialNumber.Int64() != 42 || tt.Info.Nonce.Int64() != 1234 ||
+		!tt.Info.Policy.Equal(info.Policy) || tt.Info.Hash != crypto.SHA256 {
+		t.Fatalf("Incorrect token info %+v", tt.Info)
+	}
+	if !tt.SignedData.SignerCertificate.Equal(tsaCert) {
+		t.Fatalf("Incorrect signer certificate")
+	}
+	if err := tt.Verify(digest[:]); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	other := sha256.Sum256([]byte("Other content"))
+	if err := tt.Verify(other[:]); err != ErrDigestMismatch {
+		t.Fatalf("Incorrect digest not detected (%v)", err)
+	}
+
+	// Signed data that is not a timestamp token.
+	data, err := SignDetached(digest[:], tsaKey, []*x509.Certificate{tsaCert}, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := ParseTimestampToken(data); err != ErrUnsupportedContentType {
+		t.Fatalf("Invalid token accepted (%v)", err)
+	}
+}
+
+// Test signatures with a signature timestamp.
+func TestSignDetachedTimestamp(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Signer", 1)
+	tsaCert, tsaKey := testutil.MakeCertificate(t, "TSA", 2)
+
+	timestamp := func(signature []byte) ([]byte, error) {
+		digest := sha256.Sum256(signature)
+		info := &TimestampInfo{
+			Policy:       asn1.ObjectIdentifier{1, 2, 3, 4},
+			SerialNumber: big.NewInt(1),
+			Time:         time.Now(),
+			Hash:         crypto.SHA256,
+			Digest:       digest[:],
+		}
+		return SignTimestamp(info, tsaKey, []*x509.Certificate{tsaCert})
+	}
+	digest := sha256.Sum256([]byte("Signed content"))
+	data, err := SignDetached(digest[:], key, []*x509.Certificate{cert}, &SignOptions{Timestamp: timestamp})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sd, err := ParseSignedData(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := sd.Verify(digest[:]); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	tt, err := sd.VerifyTimestamp()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if tt == nil || !tt.SignedData.SignerCertificate.Equal(tsaCert) {
+		t.Fatalf("Incorrect timestamp token")
+	}
+
+	sd.signer.Signature[0] ^= 0xff
+	if _, err := sd.VerifyTimestamp(); err != ErrDigestMismatch {
+		t.Fatalf("Timestamp of another signature not detected (%v)", err)
+	}
+}
@@ -0,0 +1,435 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// PdfAppender writes an incremental update of a document loaded with PdfReader (Section 7.5.6).
+// The original file is left untouched: only the new and changed objects are appended, followed by
+// a cross-reference section that refers to the previous one.  Objects of the original document
+// keep their object numbers, which keeps existing digital signatures valid.
+//
+// Changes made to objects of the original document are only written if the objects are marked as
+// updated with UpdateObject (or UpdatePage, AddPage, SetForms).  New objects referred to by
+// updated objects are appended automatically.
+type PdfAppender struct {
+	reader  *PdfReader
+	catalog *PdfIndirectObject
+	pages   *PdfIndirectObject
+
+	// Objects to write, in order.
+	updated    []PdfObject
+	updatedMap map[PdfObject]bool
+
+	// Digital signature, computed after writing.
+	signing *pdfSigning
+
+	// Checked for cancellation while writing, if set.
+	ctx context.Context
+}
+
+// NewPdfAppender returns a new appender for the document loaded by `reader`, which must be
+// decrypted if encrypted.
+//
+// The appender identifies the objects of the original document through the object cache of the
+// reader, which is made unbounded.  With a reader with a bounded cache, the objects to update
+// should be loaded after creating the appender.
+func NewPdfAppender(reader *PdfReader) (*PdfAppender, error) {
+	if reader.parser.GetCrypter() != nil && !reader.parser.IsAuthenticated() {
+		return nil, errors.New("File needs to be decrypted first")
+	}
+	if reader.rs == nil || reader.catalog == nil {
+		return nil, errors.New("Document not loaded")
+	}
+
+	appender := &PdfAppender{}
+	appender.reader = reader
+	appender.updatedMap = map[PdfObject]bool{}
+	reader.parser.SetCacheLimit(0)
+
+	root, ok := reader.root.(*PdfObjectReference)
+	if !ok {
+		return nil, errors.New("Invalid Root")
+	}
+	obj, err := reader.parser.LookupByReference(*root)
+	if err != nil {
+		return nil, err
+	}
+	appender.catalog, ok = obj.(*PdfIndirectObject)
+	if !ok {
+		return nil, errors.New("Invalid catalog")
+	}
+
+	pagesRef, ok := reader.catalog.Get("Pages").(*PdfObjectReference)
+	if !ok {
+		return nil, errors.New("Pages in catalog should be a reference")
+	}
+	obj, err = reader.parser.LookupByReference(*pagesRef)
+	if err != nil {
+		return nil, err
+	}
+	appender.pages, ok = obj.(*PdfIndirectObject)
+	if !ok {
+		return nil, errors.New("Pages object invalid")
+	}
+
+	return appender, nil
+}
+
+// UpdateObject marks the indirect or stream object `obj` as updated, to be written in the
+// incremental update.  Objects of the original document keep their object numbers, other objects
+// are added as new objects.
+func (this *PdfAppender) UpdateObject(obj PdfObject) {
+	switch obj.(type) {
+	case *PdfIndirectObject, *PdfObjectStream:
+	default:
+		common.Log.Debug("ERROR: Only indirect and stream objects can be updated (%T)", obj)
+		return
+	}
+	if this.updatedMap[obj] {
+		return
+	}
+	this.updatedMap[obj] = true
+	this.updated = append(this.updated, obj)
+}
+
+// UpdatePage writes the changes made to the `page` of the document, such as added annotations,
+// in the incremental update.
+func (this *PdfAppender) UpdatePage(page *PdfPage) {
+	this.UpdateObject(page.ToPdfObject())
+}
+
+// AddPage appends the `page` to the document.  The page can be new or loaded from another
+// document.
+func (this *PdfAppender) AddPage(page *PdfPage) error {
+	procPage(page)
+	pageObj, ok := page.ToPdfObject().(*PdfIndirectObject)
+	if !ok {
+		return errors.New("Page should be an indirect object")
+	}
+	pDict, ok := pageObj.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return errors.New("Page object should be a dictionary")
+	}
+
+	// Copy inherited fields if missing, as the page is moved to the root of the page tree.
+	err := inheritPageFields(pDict)
+	if err != nil {
+		return err
+	}
+	pDict.Set("Parent", this.pages)
+	page.Parent = this.pages
+
+	pagesDict, ok := this.pages.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return errors.New("Invalid Pages obj (not a dict)")
+	}
+	kidsObj := pagesDict.Get("Kids")
+	if ref, isRef := kidsObj.(*PdfObjectReference); isRef {
+		// Not resolved when loading lazily.
+		obj, err := this.reader.traceToObject(ref)
+		if err != nil {
+			return err
+		}
+		kidsObj = obj
+	}
+	switch kids := kidsObj.(type) {
+	case *PdfObjectArray:
+		*kids = append(*kids, pageObj)
+	case *PdfIndirectObject:
+		arr, ok := kids.PdfObject.(*PdfObjectArray)
+		if !ok {
+			return errors.New("Invalid Pages Kids obj (not an array)")
+		}
+		*arr = append(*arr, pageObj)
+		this.UpdateObject(kids)
+	default:
+		return errors.New("Invalid Pages Kids obj (not an array)")
+	}
+	pageCount, ok := TraceToDirectObject(pagesDict.Get("Count")).(*PdfObjectInteger)
+	if !ok {
+		return errors.New("Invalid Pages Count object (not an integer)")
+	}
+	pagesDict.Set("Count", MakeInteger(int64(*pageCount)+1))
+
+	this.UpdateObject(this.pages)
+	this.UpdateObject(pageObj)
+	return nil
+}
+
+// SetForms replaces the interactive form of the document with `form`, which can be the form of
+// the document with changes, such as filled in field values.  The form and all its fields and
+// widget annotations are written in the incremental update.
+func (this *PdfAppender) SetForms(form *PdfAcroForm) error {
+	formObj := form.ToPdfObject()
+	catalogDict, ok := this.catalog.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return errors.New("Invalid catalog")
+	}
+	catalogDict.Set("AcroForm", formObj)
+	this.UpdateObject(this.catalog)
+	this.UpdateObject(formObj)
+
+	if form.Fields != nil {
+		for _, field := range *form.Fields {
+			this.updateField(field)
+		}
+	}
+	return nil
+}
+
+// updateField marks the `field`, its widget annotations and its descendants as updated.
+func (this *PdfAppender) updateField(field *PdfField) {
+	this.UpdateObject(field.GetContainingPdfObject())
+	for _, kid := range field.KidsF {
+		if kidField, isField := kid.(*PdfField); isField {
+			this.updateField(kidField)
+		} else {
+			this.UpdateObject(kid.GetContainingPdfObject())
+		}
+	}
+	for _, annot := range field.KidsA {
+		this.UpdateObject(annot.GetContainingPdfObject())
+	}
+}
+
+// isOriginal returns true if `obj` is an object loaded from the original document.
+func (this *PdfAppender) isOriginal(obj PdfObject) bool {
+	var objNum int64
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		objNum = t.ObjectNumber
+	case *PdfObjectStream:
+		objNum = t.ObjectNumber
+	default:
+		return false
+	}
+	cached, ok := this.reader.parser.ObjCache[int(objNum)]
+	return ok && cached == obj
+}
+
+// collectObjects adds the updated objects and the new (not original) objects referred to by `obj`
+// to `objects`.
+func (this *PdfAppender) collectObjects(obj PdfObject, objects *[]PdfObject, added map[PdfObject]bool) {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		if added[obj] || (this.isOriginal(obj) && !this.updatedMap[obj]) {
+			return
+		}
+		added[obj] = true
+		*objects = append(*objects, obj)
+		this.collectObjects(t.PdfObject, objects, added)
+	case *PdfObjectStream:
+		if added[obj] || (this.isOriginal(obj) && !this.updatedMap[obj]) {
+			return
+		}
+		added[obj] = true
+		*objects = append(*objects, obj)
+		this.collectObjects(t.PdfObjectDictionary, objects, added)
+	case *PdfObjectDictionary:
+		for _, key := range t.Keys() {
+			this.collectObjects(t.Get(key), objects, added)
+		}
+	case *PdfObjectArray:
+		for _, v := range *t {
+			this.collectObjects(v, objects, added)
+		}
+	}
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += int64(n)
+	return n, err
+}
+
+// Write writes the original document followed by the incremental update to `w`.
+// If the document is encrypted, the updated objects are encrypted in place, the appender and the
+// reader should not be used after writing.
+func (this *PdfAppender) Write(w io.Writer) error {
+	if this.signing == nil {
+		return this.write(w)
+	}
+
+	// The signature is computed over the output.
+	var buf bytes.Buffer
+	if err := this.write(&buf); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if this.ctx != nil && this.ctx.Err() != nil {
+		return this.ctx.Err()
+	}
+	if err := this.signing.sign(data); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// WriteContext writes the document like Write, and stops with the error of `ctx` once canceled or
+// past its deadline.  The output is incomplete in that case.
+func (this *PdfAppender) WriteContext(ctx context.Context, w io.Writer) error {
+	this.ctx = ctx
+	defer func() { this.ctx = nil }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return this.Write(w)
+}
+
+func (this *PdfAppender) write(w io.Writer) error {
+	parser := this.reader.parser
+	origTrailer := parser.GetTrailer()
+	if origTrailer == nil {
+		return errors.New("Missing trailer")
+	}
+
+	// Object numbers of new objects start after the objects of the original document.
+	var nextNum int64
+	if size, ok := origTrailer.Get("Size").(*PdfObjectInteger); ok {
+		nextNum = int64(*size)
+	}
+	for _, objNum := range parser.GetObjectNums() {
+		if int64(objNum) >= nextNum {
+			nextNum = int64(objNum) + 1
+		}
+	}
+
+	// Objects to write: the updated objects and the new objects they refer to.
+	objects := []PdfObject{}
+	added := map[PdfObject]bool{}
+	for _, obj := range this.updated {
+		this.collectObjects(obj, &objects, added)
+	}
+	// Number the new objects prior to writing, as they can be referred to by any object.
+	for _, obj := range objects {
+		if this.isOriginal(obj) {
+			continue
+		}
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			t.ObjectNumber = nextNum
+			t.GenerationNumber = 0
+		case *PdfObjectStream:
+			t.ObjectNumber = nextNum
+			t.GenerationNumber = 0
+		}
+		nextNum++
+	}
+
+	// Copy the original file.
+	if _, err := this.reader.rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cw := &countingWriter{w: w}
+	if _, err := io.Copy(cw, this.reader.rs); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(cw)
+
+	// The update starts on a new line.
+	if cw.n > 0 {
+		last := make([]byte, 1)
+		this.reader.rs.Seek(-1, io.SeekEnd)
+		if _, err := io.ReadFull(this.reader.rs, last); err == nil && last[0] != '\n' && last[0] != '\r' {
+			bw.WriteString("\n")
+		}
+	}
+
+	crypter := parser.GetCrypter()
+	entries := []xrefEntry{}
+	for _, obj := range objects {
+		if this.ctx != nil && this.ctx.Err() != nil {
+			return this.ctx.Err()
+		}
+		var objNum, genNum int64
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			objNum, genNum = t.ObjectNumber, t.GenerationNumber
+		case *PdfObjectStream:
+			objNum, genNum = t.ObjectNumber, t.GenerationNumber
+		}
+		// The updated objects are encrypted with the key of the original document.
+		if crypter != nil {
+			err := crypter.Encrypt(obj, objNum, genNum)
+			if err != nil {
+				common.Log.Debug("ERROR: Failed encrypting (%s)", err)
+				return err
+			}
+		}
+		offset := cw.n + int64(bw.Buffered())
+		entries = append(entries, xrefEntry{objNum: objNum, typ: 1, offset: offset, gen: int(genNum)})
+		writeIndirectObject(bw, objNum, genNum, obj)
+	}
+
+	// The trailer of the update has the entries of the original trailer, with Prev referring to
+	// the original cross-reference section.
+	trailer := MakeDict()
+	for _, key := range origTrailer.Keys() {
+		switch key {
+		case "Prev", "XRefStm", "Type", "W", "Index", "Filter", "DecodeParms", "Length", "DL",
+			"F", "FFilter", "FDecodeParms":
+			continue
+		}
+		trailer.Set(key, origTrailer.Get(key))
+	}
+	trailer.Set("Size", MakeInteger(nextNum))
+	trailer.Set("Prev", MakeInteger(parser.GetXrefOffset()))
+	// The first identifier is permanent, the second identifies the version.
+	if ids, ok := TraceToDirectObject(origTrailer.Get("ID")).(*PdfObjectArray); ok && len(*ids) == 2 {
+		b := make([]byte, 100)
+		rand.Read(b)
+		hashcode := md5.Sum(b)
+		trailer.Set("ID", MakeArray((*ids)[0], MakeString(string(hashcode[:]))))
+	}
+
+	xrefOffset := cw.n + int64(bw.Buffered())
+	// Cross-reference streams are used for the update if the original document uses them.
+	if name, ok := origTrailer.Get("Type").(*PdfObjectName); ok && *name == "XRef" {
+		xrefNum := nextNum
+		entries = append(entries, xrefEntry{objNum: xrefNum, typ: 1, offset: xrefOffset})
+		trailer.Set("Size", MakeInteger(xrefNum+1))
+		sort.Slice(entries, func(i, j int) bool { return entries[i].objNum < entries[j].objNum })
+
+		xrefStream, err := makeXrefStream(entries, trailer)
+		if err != nil {
+			return err
+		}
+		// Cross-reference streams are not encrypted.
+		writeIndirectObject(bw, xrefNum, 0, xrefStream)
+	} else {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].objNum < entries[j].objNum })
+		writeXrefTable(bw, entries)
+
+		bw.WriteString("trailer\n")
+		bw.WriteString(trailer.DefaultWriteString())
+		bw.WriteString("\n")
+	}
+
+	bw.WriteString(fmt.Sprintf("startxref\n%d\n", xrefOffset))
+	bw.WriteString("%%EOF\n")
+	return bw.Flush()
+}
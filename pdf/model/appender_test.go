@@ -0,0 +1,155 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+const testAppendContent = "BT /F1 18 Tf 10 10 Td (Appended) Tj ET"
+
+// appendTestUpdate adds a text annotation to the first page of the document of `reader` and
+// appends a new page, returning the incremental update written after the original `data`.
+func appendTestUpdate(t *testing.T, reader *PdfReader, data []byte) []byte {
+	appender, err := NewPdfAppender(reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	annot := NewPdfAnnotationText()
+	annot.Rect = MakeArrayFromFloats([]float64{10, 10, 50, 50})
+	annot.Contents = MakeString("Note")
+	page.Annotations = append(page.Annotations, annot.PdfAnnotation)
+	appender.UpdatePage(page)
+
+	newPage := NewPdfPage()
+	newPage.MediaBox = &PdfRectangle{Llx: 0, Lly: 0, Urx: 200, Ury: 100}
+	newPage.Resources = NewPdfPageResources()
+	newPage.AddContentStreamByString(testAppendContent)
+	if err := appender.AddPage(newPage); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := appender.Write(&buf); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	updated := buf.Bytes()
+	if !bytes.HasPrefix(updated, data) {
+		t.Fatalf("Original file not preserved")
+	}
+	return updated
+}
+
+// checkTestUpdate checks that the document of `reader` has the changes of appendTestUpdate.
+func checkTestUpdate(t *testing.T, reader *PdfReader) {
+	numPages, err := reader.GetNumPages()
+	if err != nil || numPages != 2 {
+		t.Fatalf("Incorrect number of pages %d (%v)", numPages, err)
+	}
+	checkTestContent(t, reader)
+
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(page.Annotations) != 1 {
+		t.Fatalf("Incorrect number of annotations %d", len(page.Annotations))
+	}
+	if _, ok := page.Annotations[0].GetContext().(*PdfAnnotationText); !ok {
+		t.Fatalf("Incorrect annotation %T", page.Annotations[0].GetContext())
+	}
+	contents, ok := TraceToDirectObject(page.Annotations[0].Contents).(*PdfObjectString)
+	if !ok || string(*contents) != "Note" {
+		t.Fatalf("Incorrect annotation contents %v", page.Annotations[0].Contents)
+	}
+
+	page, err = reader.GetPage(2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cstream, err := page.GetAllContentStreams()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.HasPrefix(cstream, testAppendContent) {
+		t.Fatalf("Content mismatch %q", cstream)
+	}
+}
+
+// Test incremental updates of documents with a cross-reference table and with a cross-reference
+// stream.
+func TestAppender(t *testing.T) {
+	for _, objectStreams := range []bool{false, true} {
+		w := newTestWriter(t)
+		w.SetObjectStreams(objectStreams)
+		data := writePdf(t, w)
+
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		updated := appendTestUpdate(t, reader, data)
+
+		update := updated[len(data):]
+		if bytes.Contains(update, []byte("\nxref")) == objectStreams {
+			t.Fatalf("Object streams %v: incorrect cross-reference section type", objectStreams)
+		}
+		// Only the changed objects are appended: page 1, the page tree, the annotation and the
+		// new page with its content streams and font.
+		if n := bytes.Count(update, []byte(" obj\n")); objectStreams && n != 8 || !objectStreams && n != 7 {
+			t.Fatalf("Object streams %v: incorrect number of appended objects %d", objectStreams, n)
+		}
+
+		reader, err = NewPdfReader(bytes.NewReader(updated))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		checkTestUpdate(t, reader)
+	}
+}
+
+// Test incremental updates of an encrypted document.
+func TestAppenderEncrypted(t *testing.T) {
+	w := newTestWriter(t)
+	err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Algorithm: AES_256bit})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writeTestPdf(t, w)
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := NewPdfAppender(reader); err == nil {
+		t.Fatalf("Appender created without decrypting")
+	}
+	if auth, err := reader.Decrypt([]byte("user")); err != nil || !auth {
+		t.Fatalf("Failed to authenticate (%v)", err)
+	}
+	updated := appendTestUpdate(t, reader, data)
+	if bytes.Contains(updated, []byte("Appended")) || bytes.Contains(updated, []byte("(Note)")) {
+		t.Fatalf("Update not encrypted")
+	}
+
+	reader, err = NewPdfReader(bytes.NewReader(updated))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if auth, err := reader.Decrypt([]byte("user")); err != nil || !auth {
+		t.Fatalf("Failed to authenticate (%v)", err)
+	}
+	checkTestUpdate(t, reader)
+}
@@ -0,0 +1,154 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"compress/zlib"
+	"runtime"
+	"sync"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// CompressOptions are the options for compressing the streams when writing.
+type CompressOptions struct {
+	// Level is the Flate compression level, from 1 (best speed) to 9 (best compression).  The
+	// default level is used if 0.
+	Level int
+
+	// Workers is the maximum number of streams compressed concurrently.  runtime.GOMAXPROCS(0) is
+	// used if 0.
+	Workers int
+}
+
+// SetCompression sets the writer to Flate encode the streams which are not encoded, such as raw
+// content streams and images, with the options `opts`.  The streams are compressed concurrently,
+// with the same output as if compressed one after the other.  The level also applies to the
+// object streams.  Compression is disabled if `opts` is nil.
+//
+// The streams are encoded in place when writing, the metadata streams are left unencoded.  The
+// streams already encoded when added, such as the images created with an encoder, are not
+// recompressed: they are encoded when created, one after the other.
+func (this *PdfWriter) SetCompression(opts *CompressOptions) {
+	this.compression = opts
+}
+
+// flateEncoder returns a Flate encoder with the compression level of the writer.
+func (this *PdfWriter) flateEncoder() *FlateEncoder {
+	encoder := NewFlateEncoder()
+	if this.compression != nil && this.compression.Level != 0 {
+		encoder.CompressionLevel = this.compression.Level
+	}
+	return encoder
+}
+
+// compressionWorkers returns the maximum number of streams compressed concurrently.
+func (this *PdfWriter) compressionWorkers() int {
+	if this.compression != nil && this.compression.Workers > 0 {
+		return this.compression.Workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// compressStreams Flate encodes the streams among `objects` which are not encoded, if compression
+// is enabled.
+func (this *PdfWriter) compressStreams(objects []PdfObject) error {
+	if this.compression == nil {
+		return nil
+	}
+	if this.compression.Level < 0 || this.compression.Level > zlib.BestCompression {
+		common.Log.Debug("ERROR: Invalid compression level %d", this.compression.Level)
+		return ErrRangeError
+	}
+
+	streams := []*PdfObjectStream{}
+	for _, obj := range objects {
+		stream, isStream := obj.(*PdfObjectStream)
+		if !isStream || !isCompressible(stream) {
+			continue
+		}
+		streams = append(streams, stream)
+	}
+
+	encoded := make([][]byte, len(streams))
+	err := runParallel(len(streams), this.compressionWorkers(), func(i int) error {
+		if err := this.checkContext(); err != nil {
+			return err
+		}
+		data, err := this.flateEncoder().EncodeBytes(streams[i].Stream)
+		if err != nil {
+			common.Log.Debug("ERROR: Failed to compress stream (%s)", err)
+			return err
+		}
+		encoded[i] = data
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, stream := range streams {
+		stream.Stream = encoded[i]
+		stream.PdfObjectDictionary.Set("Filter", MakeName(StreamEncodingFilterNameFlate))
+		stream.PdfObjectDictionary.Set("Length", MakeInteger(int64(len(encoded[i]))))
+	}
+	return nil
+}
+
+// isCompressible returns true if `stream` is not encoded and can be compressed.  Metadata streams
+// are left unencoded to remain readable by tools unaware of PDF.
+func isCompressible(stream *PdfObjectStream) bool {
+	dict := stream.PdfObjectDictionary
+	if dict == nil || dict.Get("Filter") != nil || dict.Get("DecodeParms") != nil {
+		return false
+	}
+	if name, ok := TraceToDirectObject(dict.Get("Type")).(*PdfObjectName); ok && *name == "Metadata" {
+		return false
+	}
+	return len(stream.Stream) > 0
+}
+
+// runParallel calls `fn` for each index from 0 to `n`-1, with up to `workers` calls running
+// concurrently.  Returns the error of the lowest failing index, if any.
+func runParallel(n int, workers int, fn func(i int) error) error {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, n)
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
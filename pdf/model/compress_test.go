@@ -0,0 +1,96 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// newCompressTestWriter returns a writer with `numPages` test pages with raw content streams,
+// and a metadata stream.
+func newCompressTestWriter(t *testing.T, numPages int) *PdfWriter {
+	w := newTestWriterPages(t, numPages)
+
+	metadata, err := MakeStream([]byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"></x:xmpmeta>"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	metadata.PdfObjectDictionary.Set("Type", MakeName("Metadata"))
+	metadata.PdfObjectDictionary.Set("Subtype", MakeName("XML"))
+	w.catalog.Set("Metadata", metadata)
+	if err := w.addObjects(metadata); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return w
+}
+
+// Test compressing the streams concurrently when writing.
+func TestWriterCompression(t *testing.T) {
+	numPages := 20
+	write := func(opts *CompressOptions, objectStreams bool) []byte {
+		w := newCompressTestWriter(t, numPages)
+		w.SetCompression(opts)
+		w.SetObjectStreams(objectStreams)
+		var buf bytes.Buffer
+		if err := w.Write(&buf); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	uncompressed := write(nil, false)
+	for _, objectStreams := range []bool{false, true} {
+		// The output does not depend on the number of workers.
+		data := write(&CompressOptions{Workers: 1}, objectStreams)
+		for _, workers := range []int{0, 2, 8} {
+			if !bytes.Equal(data, write(&CompressOptions{Workers: workers}, objectStreams)) {
+				t.Fatalf("Output changed with %d workers", workers)
+			}
+		}
+		if len(data) >= len(uncompressed)/2 {
+			t.Fatalf("Streams not compressed (%d >= %d/2)", len(data), len(uncompressed))
+		}
+		if !bytes.Contains(data, []byte("<x:xmpmeta")) {
+			t.Fatalf("Metadata compressed")
+		}
+
+		fast := write(&CompressOptions{Level: 1}, objectStreams)
+		best := write(&CompressOptions{Level: 9}, objectStreams)
+		if bytes.Equal(fast, best) {
+			t.Fatalf("Compression level not applied")
+		}
+
+		reader, err := NewPdfReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Strict: true})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		n, err := reader.GetNumPages()
+		if err != nil || n != numPages {
+			t.Fatalf("Incorrect number of pages %d (%v)", n, err)
+		}
+		page, err := reader.GetPage(numPages)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		cstream, err := page.GetAllContentStreams()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !strings.HasPrefix(cstream, testPageContent(numPages)) {
+			t.Fatalf("Content mismatch %q", cstream)
+		}
+	}
+
+	w := newCompressTestWriter(t, 1)
+	w.SetCompression(&CompressOptions{Level: 10})
+	if err := w.Write(&bytes.Buffer{}); err == nil {
+		t.Fatalf("Invalid compression level not rejected")
+	}
+}
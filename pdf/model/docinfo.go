@@ -0,0 +1,142 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// PdfDocumentInfo represents the document information dictionary (Section 14.3.3).  The text
+// entries are empty and the dates nil when not set.
+type PdfDocumentInfo struct {
+	Title    string
+	Author   string
+	Subject  string
+	Keywords string
+	Creator  string // Application which created the original document.
+	Producer string // Application which converted the document to PDF.
+
+	CreationDate *PdfDate
+	ModDate      *PdfDate
+
+	// Trapped is "True", "False" or "Unknown", whether the document has been modified to include
+	// trapping information.
+	Trapped string
+
+	// Custom holds the other text entries, by key.
+	Custom map[string]string
+}
+
+// Standard keys of the document information dictionary, in order.
+var docInfoKeys = []PdfObjectName{"Title", "Author", "Subject", "Keywords", "Creator", "Producer",
+	"CreationDate", "ModDate", "Trapped"}
+
+// NewPdfDocumentInfo returns a new empty document information.
+func NewPdfDocumentInfo() *PdfDocumentInfo {
+	return &PdfDocumentInfo{Custom: map[string]string{}}
+}
+
+// newPdfDocumentInfoFromDict loads the document information from the dictionary `dict` with the
+// references resolved.  Invalid entries are skipped.
+func newPdfDocumentInfoFromDict(dict *PdfObjectDictionary) *PdfDocumentInfo {
+	info := NewPdfDocumentInfo()
+	text := func(key PdfObjectName) string {
+		switch t := TraceToDirectObject(dict.Get(key)).(type) {
+		case *PdfObjectString:
+			return t.Decoded()
+		case *PdfObjectName:
+			return string(*t)
+		case nil, *PdfObjectNull:
+		default:
+			common.Log.Debug("ERROR: Invalid document info %s (%T)", key, t)
+		}
+		return ""
+	}
+	date := func(key PdfObjectName) *PdfDate {
+		str := text(key)
+		if str == "" {
+			return nil
+		}
+		d, err := NewPdfDate(str)
+		if err != nil {
+			common.Log.Debug("ERROR: Invalid document info %s: %v", key, err)
+			return nil
+		}
+		return &d
+	}
+
+	info.Title = text("Title")
+	info.Author = text("Author")
+	info.Subject = text("Subject")
+	info.Keywords = text("Keywords")
+	info.Creator = text("Creator")
+	info.Producer = text("Producer")
+	info.CreationDate = date("CreationDate")
+	info.ModDate = date("ModDate")
+	info.Trapped = text("Trapped")
+
+	for _, key := range dict.Keys() {
+		if isDocInfoKey(key) {
+			continue
+		}
+		if val := text(key); val != "" {
+			info.Custom[string(key)] = val
+		}
+	}
+	return info
+}
+
+// isDocInfoKey returns true if `key` is a standard key of the document information dictionary.
+func isDocInfoKey(key PdfObjectName) bool {
+	for _, k := range docInfoKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// ToPdfObject returns the document information dictionary, with the text entries encoded as text
+// strings and the custom entries sorted by key.
+func (this *PdfDocumentInfo) ToPdfObject() PdfObject {
+	dict := MakeDict()
+	setText := func(key PdfObjectName, val string) {
+		if val != "" {
+			dict.Set(key, MakeTextString(val))
+		}
+	}
+
+	setText("Title", this.Title)
+	setText("Author", this.Author)
+	setText("Subject", this.Subject)
+	setText("Keywords", this.Keywords)
+	setText("Creator", this.Creator)
+	setText("Producer", this.Producer)
+	if this.CreationDate != nil {
+		dict.Set("CreationDate", this.CreationDate.ToPdfObject())
+	}
+	if this.ModDate != nil {
+		dict.Set("ModDate", this.ModDate.ToPdfObject())
+	}
+	if this.Trapped != "" {
+		dict.Set("Trapped", MakeName(this.Trapped))
+	}
+
+	keys := []string{}
+	for key := range this.Custom {
+		if !isDocInfoKey(PdfObjectName(key)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		setText(PdfObjectName(key), this.Custom[key])
+	}
+	return dict
+}
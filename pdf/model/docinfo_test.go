@@ -0,0 +1,92 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test writing the document information and reading it back.
+func TestDocumentInfo(t *testing.T) {
+	created := NewPdfDateFromTime(time.Date(2018, 3, 4, 5, 6, 7, 0, time.FixedZone("", -5*3600)))
+	modified := NewPdfDateFromTime(time.Date(2018, 6, 7, 8, 9, 10, 0, time.UTC))
+	info := &PdfDocumentInfo{
+		Title:        "Résumé – “Ελληνικά”",
+		Author:       "Jane Doe",
+		Subject:      "Testing",
+		Keywords:     "pdf, info",
+		Creator:      "Test suite",
+		CreationDate: &created,
+		ModDate:      &modified,
+		Trapped:      "False",
+		Custom:       map[string]string{"Department": "Engineering", "Reviewer": "Ō"},
+	}
+
+	read := func(data []byte, password string) *PdfDocumentInfo {
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if password != "" {
+			if auth, err := reader.Decrypt([]byte(password)); err != nil || !auth {
+				t.Fatalf("Failed to authenticate (%v)", err)
+			}
+		}
+		readInfo, err := reader.GetDocumentInfo()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return readInfo
+	}
+	check := func(readInfo *PdfDocumentInfo) {
+		if readInfo.Title != info.Title || readInfo.Author != info.Author || readInfo.Subject != info.Subject ||
+			readInfo.Keywords != info.Keywords || readInfo.Creator != info.Creator || readInfo.Trapped != info.Trapped {
+			t.Fatalf("Info mismatch: %+v", readInfo)
+		}
+		if !strings.HasPrefix(readInfo.Producer, "UniDoc") {
+			t.Fatalf("Default producer not set: %q", readInfo.Producer)
+		}
+		if readInfo.CreationDate == nil || !readInfo.CreationDate.ToGoTime().Equal(created.ToGoTime()) {
+			t.Fatalf("Creation date mismatch: %v", readInfo.CreationDate)
+		}
+		if readInfo.ModDate == nil || !readInfo.ModDate.ToGoTime().Equal(modified.ToGoTime()) {
+			t.Fatalf("Modification date mismatch: %v", readInfo.ModDate)
+		}
+		if !reflect.DeepEqual(readInfo.Custom, info.Custom) {
+			t.Fatalf("Custom entries mismatch: %v", readInfo.Custom)
+		}
+	}
+
+	w := newTestWriter(t)
+	w.SetDocumentInfo(info)
+	data := writePdf(t, w)
+	if !bytes.Contains(data, []byte("/Trapped /False")) {
+		t.Fatalf("Trapped not written as a name")
+	}
+	check(read(data, ""))
+
+	w = newTestWriter(t)
+	w.SetDocumentInfo(info)
+	if err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Algorithm: AES_128bit}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data = writeTestPdf(t, w)
+	if bytes.Contains(data, []byte("Jane Doe")) {
+		t.Fatalf("Info not encrypted")
+	}
+	check(read(data, "user"))
+
+	// Defaults.
+	readInfo := read(writePdf(t, newTestWriter(t)), "")
+	if readInfo.Title != "" || readInfo.CreationDate != nil || len(readInfo.Custom) != 0 ||
+		!strings.HasPrefix(readInfo.Producer, "UniDoc") || readInfo.Creator == "" {
+		t.Fatalf("Invalid default info: %+v", readInfo)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// PdfValidationData is validation data of signatures, stored in the document security store (DSS)
+// of a document for the long-term validation of the signatures (PAdES, ETSI EN 319 142-1 section
+// 5.4).
+type PdfValidationData struct {
+	// Certificates of the signers and time stamping authorities, and their chains.
+	Certificates []*x509.Certificate
+	// DER encoded OCSP responses.
+	OCSPs [][]byte
+	// DER encoded certificate revocation lists.
+	CRLs [][]byte
+}
+
+// vriKey returns the key of the validation data of the signature `sig` in the VRI dictionary of
+// the document security store: the upper case hex encoded SHA-1 digest of the signature contents.
+func vriKey(sig *PdfSignature) (PdfObjectName, error) {
+	contents, ok := TraceToDirectObject(sig.Contents).(*PdfObjectString)
+	if !ok {
+		return "", errors.New("Missing signature contents")
+	}
+	digest := sha1.Sum([]byte(*contents))
+	return PdfObjectName(strings.ToUpper(hex.EncodeToString(digest[:]))), nil
+}
+
+// updatedEntry returns the direct value of the entry `key` of `d`, or nil if missing.  If the
+// value is an indirect object, the object is marked as updated, as the value will be modified.
+func (this *PdfAppender) updatedEntry(d *PdfObjectDictionary, key PdfObjectName) (PdfObject, error) {
+	obj := d.Get(key)
+	if obj == nil {
+		return nil, nil
+	}
+	obj, err := this.reader.traceToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	if indObj, isIndirect := obj.(*PdfIndirectObject); isIndirect {
+		this.UpdateObject(indObj)
+		return indObj.PdfObject, nil
+	}
+	return obj, nil
+}
+
+// addDSSStreams adds the `values` as streams to the array `key` of the dictionary `d` of the
+// document security store, unless already present.  Returns the streams holding the values.
+func (this *PdfAppender) addDSSStreams(d *PdfObjectDictionary, key PdfObjectName, values [][]byte) ([]PdfObject, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	obj, err := this.updatedEntry(d, key)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := obj.(*PdfObjectArray)
+	if !ok {
+		arr = &PdfObjectArray{}
+		d.Set(key, arr)
+	}
+
+	streams := []PdfObject{}
+	for _, value := range values {
+		var stream PdfObject
+		for _, entry := range *arr {
+			data, err := this.reader.loadDSSStream(entry)
+			if err == nil && bytes.Equal(data, value) {
+				stream = entry
+				break
+			}
+		}
+		if stream == nil {
+			newStream, err := MakeStream(value, NewFlateEncoder())
+			if err != nil {
+				return nil, err
+			}
+			stream = newStream
+			*arr = append(*arr, stream)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+// addDSSReferences adds the `streams` to the array `key` of the dictionary `d`, unless already
+// present.
+func (this *PdfAppender) addDSSReferences(d *PdfObjectDictionary, key PdfObjectName, streams []PdfObject) error {
+	if len(streams) == 0 {
+		return nil
+	}
+	obj, err := this.updatedEntry(d, key)
+	if err != nil {
+		return err
+	}
+	arr, ok := obj.(*PdfObjectArray)
+	if !ok {
+		arr = &PdfObjectArray{}
+		d.Set(key, arr)
+	}
+	for _, stream := range streams {
+		found := false
+		for _, entry := range *arr {
+			if sameDSSStream(entry, stream) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			*arr = append(*arr, stream)
+		}
+	}
+	return nil
+}
+
+// sameDSSStream returns true if `a` and `b` are the same stream or refer to the same stream.
+func sameDSSStream(a, b PdfObject) bool {
+	if a == b {
+		return true
+	}
+	refA, okA := a.(*PdfObjectReference)
+	refB, okB := b.(*PdfObjectReference)
+	return okA && okB && refA.ObjectNumber == refB.ObjectNumber && refA.GenerationNumber == refB.GenerationNumber
+}
+
+// AddValidationData adds the validation data `data` to the document security store (DSS) in the
+// incremental update, creating the store if needed.  The data is added for all the signatures of
+// the document, and for the signature `sig` (as the validation-related information of the
+// signature) unless nil.  The signature must be a signature of the original document, such as a
+// signature returned by PdfReader.VerifySignatures.
+// Existing validation data is kept, values already present are not duplicated.
+func (this *PdfAppender) AddValidationData(sig *PdfSignature, data *PdfValidationData) error {
+	catalogDict, ok := this.catalog.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return errors.New("Invalid catalog")
+	}
+	var key PdfObjectName
+	if sig != nil {
+		var err error
+		key, err = vriKey(sig)
+		if err != nil {
+			return err
+		}
+	}
+
+	var dss *PdfObjectDictionary
+	if catalogDict.Get("DSS") != nil {
+		obj, err := this.updatedEntry(catalogDict, "DSS")
+		if err != nil {
+			return err
+		}
+		if _, isDirect := catalogDict.Get("DSS").(*PdfObjectDictionary); isDirect {
+			this.UpdateObject(this.catalog)
+		}
+		dss, _ = obj.(*PdfObjectDictionary)
+	}
+	if dss == nil {
+		dssObj := MakeIndirectObject(MakeDict())
+		catalogDict.Set("DSS", dssObj)
+		this.UpdateObject(this.catalog)
+		this.UpdateObject(dssObj)
+		dss = dssObj.PdfObject.(*PdfObjectDictionary)
+	}
+
+	certs := [][]byte{}
+	for _, cert := range data.Certificates {
+		certs = append(certs, cert.Raw)
+	}
+	certStreams, err := this.addDSSStreams(dss, "Certs", certs)
+	if err != nil {
+		return err
+	}
+	ocspStreams, err := this.addDSSStreams(dss, "OCSPs", data.OCSPs)
+	if err != nil {
+		return err
+	}
+	crlStreams, err := this.addDSSStreams(dss, "CRLs", data.CRLs)
+	if err != nil {
+		return err
+	}
+	if sig == nil {
+		return nil
+	}
+
+	// Validation-related information of the signature.
+	obj, err := this.updatedEntry(dss, "VRI")
+	if err != nil {
+		return err
+	}
+	vri, ok := obj.(*PdfObjectDictionary)
+	if !ok {
+		vri = MakeDict()
+		dss.Set("VRI", vri)
+	}
+	obj, err = this.updatedEntry(vri, key)
+	if err != nil {
+		return err
+	}
+	entry, ok := obj.(*PdfObjectDictionary)
+	if !ok {
+		entry = MakeDict()
+		vri.Set(key, entry)
+	}
+	if err := this.addDSSReferences(entry, "Cert", certStreams); err != nil {
+		return err
+	}
+	if err := this.addDSSReferences(entry, "OCSP", ocspStreams); err != nil {
+		return err
+	}
+	return this.addDSSReferences(entry, "CRL", crlStreams)
+}
+
+// loadDSSStream returns the decoded data of the stream `obj` of the document security store.
+func (this *PdfReader) loadDSSStream(obj PdfObject) ([]byte, error) {
+	obj, err := this.traceToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	stream, ok := obj.(*PdfObjectStream)
+	if !ok {
+		return nil, errors.New("Validation data not a stream")
+	}
+	return DecodeStream(stream)
+}
+
+// loadDSSStreams returns the decoded data of the streams of the array `obj`.
+func (this *PdfReader) loadDSSStreams(obj PdfObject) ([][]byte, error) {
+	if obj == nil {
+		return nil, nil
+	}
+	obj, err := this.traceToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := TraceToDirectObject(obj).(*PdfObjectArray)
+	if !ok {
+		return nil, errors.New("Validation data not an array")
+	}
+	values := [][]byte{}
+	for _, entry := range *arr {
+		data, err := this.loadDSSStream(entry)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, data)
+	}
+	return values, nil
+}
+
+// GetValidationData returns the validation data of the document security store (DSS) of the
+// document, for all the signatures if `sig` is nil, or the validation-related information of the
+// signature `sig`.  Returns nil if there is no such data.
+func (this *PdfReader) GetValidationData(sig *PdfSignature) (*PdfValidationData, error) {
+	certsKey, ocspsKey, crlsKey := PdfObjectName("Certs"), PdfObjectName("OCSPs"), PdfObjectName("CRLs")
+
+	obj, err := this.traceToObject(this.catalog.Get("DSS"))
+	if err != nil {
+		return nil, err
+	}
+	d, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		return nil, nil
+	}
+	if sig != nil {
+		key, err := vriKey(sig)
+		if err != nil {
+			return nil, err
+		}
+		obj, err := this.traceToObject(d.Get("VRI"))
+		if err != nil {
+			return nil, err
+		}
+		vri, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+		if !ok {
+			return nil, nil
+		}
+		obj, err = this.traceToObject(vri.Get(key))
+		if err != nil {
+			return nil, err
+		}
+		d, ok = TraceToDirectObject(obj).(*PdfObjectDictionary)
+		if !ok {
+			return nil, nil
+		}
+		certsKey, ocspsKey, crlsKey = "Cert", "OCSP", "CRL"
+	}
+
+	data := &PdfValidationData{}
+	certs, err := this.loadDSSStreams(d.Get(certsKey))
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range certs {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		data.Certificates = append(data.Certificates, cert)
+	}
+	data.OCSPs, err = this.loadDSSStreams(d.Get(ocspsKey))
+	if err != nil {
+		return nil, err
+	}
+	data.CRLs, err = this.loadDSSStreams(d.Get(crlsKey))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
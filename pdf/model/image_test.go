@@ -6,7 +6,11 @@
 package model
 
 import (
+	"bytes"
+	"context"
 	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
 )
 
 func TestImageResampling(t *testing.T) {
@@ -64,3 +68,188 @@ func TestImageResampling(t *testing.T) {
 		t.Errorf("Value != 64 (%d)", img.Data[1])
 	}
 }
+
+// Test CCITTFax (Group 4) encoding of a bilevel image XObject and decoding it back.
+func TestXObjectImageCCITTFax(t *testing.T) {
+	img := &Image{}
+	img.Width = 12
+	img.Height = 3
+	img.BitsPerComponent = 1
+	img.ColorComponents = 1
+	// 12 pixels per row padded (with white) to 2 bytes.  1 is white (DeviceGray).
+	img.Data = []byte{0xff, 0xff, 0x0f, 0x0f, 0xf0, 0xff}
+
+	ximg, err := NewXObjectImageFromImage(img, nil, NewCCITTFaxEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	stream, ok := ximg.ToPdfObject().(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Not a stream object")
+	}
+	if filter, ok := stream.PdfObjectDictionary.Get("Filter").(*PdfObjectName); !ok || *filter != StreamEncodingFilterNameCCITTFax {
+		t.Fatalf("Incorrect filter: %v", stream.PdfObjectDictionary.Get("Filter"))
+	}
+	decodeParms, ok := stream.PdfObjectDictionary.Get("DecodeParms").(*PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("DecodeParms missing")
+	}
+	if k, ok := decodeParms.Get("K").(*PdfObjectInteger); !ok || *k != -1 {
+		t.Errorf("Incorrect K: %v", decodeParms.Get("K"))
+	}
+	if columns, ok := decodeParms.Get("Columns").(*PdfObjectInteger); !ok || *columns != 12 {
+		t.Errorf("Incorrect Columns: %v", decodeParms.Get("Columns"))
+	}
+	if rows, ok := decodeParms.Get("Rows").(*PdfObjectInteger); !ok || *rows != 3 {
+		t.Errorf("Incorrect Rows: %v", decodeParms.Get("Rows"))
+	}
+
+	ximg2, err := NewXObjectImageFromStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	img2, err := ximg2.ToImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(img2.Data) != string(img.Data) {
+		t.Errorf("Decoded data mismatch: % x != % x", img2.Data, img.Data)
+	}
+}
+
+// JP2 file with a 4x2 sRGB image and an alpha channel.
+var testJP2Data = []byte{
+	0x00, 0x00, 0x00, 0x0c, 0x6a, 0x50, 0x20, 0x20, 0x0d, 0x0a, 0x87, 0x0a,
+	0x00, 0x00, 0x00, 0x14, 0x66, 0x74, 0x79, 0x70, 0x6a, 0x70, 0x32, 0x20,
+	0x00, 0x00, 0x00, 0x00, 0x6a, 0x70, 0x32, 0x20, 0x00, 0x00, 0x00, 0x39,
+	0x6a, 0x70, 0x32, 0x68, 0x00, 0x00, 0x00, 0x0f, 0x63, 0x6f, 0x6c, 0x72,
+	0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x22, 0x63,
+	0x64, 0x65, 0x66, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00,
+	0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x02, 0x00, 0x00, 0x00, 0x03, 0x00,
+	0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc2, 0x6a, 0x70, 0x32,
+	0x63, 0xff, 0x4f, 0xff, 0x51, 0x00, 0x32, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x04, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x07, 0x01, 0x01, 0x07, 0x01,
+	0x01, 0x07, 0x01, 0x01, 0x07, 0x01, 0x01, 0xff, 0x52, 0x00, 0x0c, 0x00,
+	0x00, 0x00, 0x01, 0x01, 0x01, 0x02, 0x02, 0x00, 0x01, 0xff, 0x5c, 0x00,
+	0x07, 0x40, 0x40, 0x48, 0x48, 0x50, 0xff, 0x90, 0x00, 0x0a, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x6b, 0x00, 0x01, 0xff, 0x93, 0xc7, 0xd4, 0x06, 0x08,
+	0x27, 0x9f, 0xcf, 0xb4, 0x0c, 0x09, 0xf7, 0xdf, 0xcf, 0xb4, 0x0c, 0x0c,
+	0x4a, 0xf5, 0xdf, 0x80, 0x18, 0x04, 0x4f, 0xe5, 0xc3, 0xea, 0x03, 0x87,
+	0xd4, 0x07, 0x0f, 0xb4, 0x0c, 0x02, 0x72, 0x3f, 0x06, 0x15, 0x7f, 0x05,
+	0xeb, 0x5f, 0xcf, 0xc0, 0x0e, 0x7e, 0x00, 0x93, 0xf3, 0x02, 0x08, 0xf5,
+	0x7b, 0x03, 0x80, 0x8a, 0x7f, 0x03, 0x7f, 0xcf, 0xc0, 0x0e, 0x3e, 0xd0,
+	0x39, 0xf9, 0x81, 0x00, 0x07, 0xff, 0x7f, 0x05, 0x7f, 0x57, 0x05, 0x5f,
+	0xc7, 0xda, 0x05, 0x3f, 0x00, 0x38, 0xfc, 0x00, 0xc0, 0x0b, 0xbf, 0x0b,
+	0x74, 0xef, 0x0b, 0x4a, 0x4b, 0xff, 0xd9,
+}
+
+// Test decoding of a JPX image XObject without ColorSpace and BitsPerComponent, which are taken
+// from the JPEG 2000 data, and with the soft mask in the data (SMaskInData).
+func TestXObjectImageJPX(t *testing.T) {
+
+	stream := &PdfObjectStream{}
+	stream.PdfObjectDictionary = MakeDict()
+	stream.PdfObjectDictionary.Set("Type", MakeName("XObject"))
+	stream.PdfObjectDictionary.Set("Subtype", MakeName("Image"))
+	stream.PdfObjectDictionary.Set("Width", MakeInteger(4))
+	stream.PdfObjectDictionary.Set("Height", MakeInteger(2))
+	stream.PdfObjectDictionary.Set("Filter", MakeName(StreamEncodingFilterNameJPX))
+	stream.PdfObjectDictionary.Set("SMaskInData", MakeInteger(1))
+	stream.Stream = testJP2Data
+
+	ximg, err := NewXObjectImageFromStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := ximg.ColorSpace.(*PdfColorspaceDeviceRGB); !ok {
+		t.Fatalf("Incorrect colorspace: %T", ximg.ColorSpace)
+	}
+	if ximg.BitsPerComponent == nil || *ximg.BitsPerComponent != 8 {
+		t.Fatalf("Incorrect BitsPerComponent: %v", ximg.BitsPerComponent)
+	}
+
+	img, err := ximg.ToImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if img.ColorComponents != 3 || len(img.Data) != 4*2*3 {
+		t.Fatalf("Incorrect image: %d components, %d bytes", img.ColorComponents, len(img.Data))
+	}
+	goimg, err := img.ToGoImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	r, g, b, a := goimg.At(2, 0).RGBA()
+	if r>>8 != 0 || g>>8 != 0 || b>>8 != 255 || a>>8 != 128 {
+		t.Errorf("Incorrect pixel (2, 0): %d %d %d %d", r>>8, g>>8, b>>8, a>>8)
+	}
+	if _, _, _, a := goimg.At(3, 0).RGBA(); a != 0 {
+		t.Errorf("Pixel (3, 0) not transparent: %d", a)
+	}
+}
+
+// Test decoding a JPX image loaded by a reader, subject to the limits and the context of the
+// reader.
+func TestXObjectImageJPXReader(t *testing.T) {
+	stream, err := MakeStream(testJP2Data, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream.Set("Subtype", MakeName("Image"))
+	stream.Set("Width", MakeInteger(4))
+	stream.Set("Height", MakeInteger(2))
+	stream.Set("Filter", MakeName(StreamEncodingFilterNameJPX))
+	stream.Set("SMaskInData", MakeInteger(1))
+	page := initTestPage(NewPdfPage(), newTestFont(), 1)
+	page.Resources.SetXObjectByName("Im1", stream)
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writePdf(t, &w)
+
+	loadImage := func(ctx context.Context, opts *ReaderOptions) *XObjectImage {
+		reader, err := NewPdfReaderWithContext(ctx, bytes.NewReader(data), opts)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		page, err := reader.GetPage(1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		stream, _ := page.Resources.GetXObjectByName("Im1")
+		if stream == nil {
+			t.Fatalf("Image missing")
+		}
+		ximg, err := NewXObjectImageFromStream(stream)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return ximg
+	}
+
+	img, err := loadImage(context.Background(), nil).ToImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(img.Data) != 4*2*3 || !img.hasAlpha {
+		t.Fatalf("Incorrect image: %d bytes, alpha %t", len(img.Data), img.hasAlpha)
+	}
+
+	// The color and alpha samples of 32 bytes exceed the limit.
+	opts := &ReaderOptions{Limits: ParserLimits{MaxStreamSize: 16}}
+	_, err = loadImage(context.Background(), opts).ToImage()
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != "MaxStreamSize" {
+		t.Fatalf("Stream size limit not detected (%v)", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ximg := loadImage(ctx, nil)
+	cancel()
+	if _, err := ximg.ToImage(); err != context.Canceled {
+		t.Fatalf("Decoding not canceled (%v)", err)
+	}
+}
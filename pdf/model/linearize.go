@@ -0,0 +1,560 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Linearized output (Annex F).  The file is organized as follows:
+//  1. Header.
+//  2. Linearization parameter dictionary.
+//  3. First-page cross-reference table and trailer.
+//  4. Document catalog and the document-level objects needed to open the document.
+//  5. Primary hint stream.
+//  6. First-page section: the first page and all the objects it uses.
+//  7. Remaining pages, each with the objects used only by the page.
+//  8. Objects shared by the remaining pages.
+//  9. Other objects.
+//  10. Main cross-reference table and trailer.
+// The objects of parts 7-9 are numbered first, so that the objects of the first-page section
+// (parts 2-6) form a single subsection at the end.  The hint tables fit in the primary hint
+// stream, no overflow hint stream is written.
+
+// linearizedPage holds the objects of a page in a linearized file.
+type linearizedPage struct {
+	objects []PdfObject // Objects written with the page, starting with the page object.
+	used    []PdfObject // All objects used by the page.
+}
+
+// bitWriter packs unsigned integers into big-endian bit fields, as used in the hint tables.
+type bitWriter struct {
+	buf   bytes.Buffer
+	cur   byte
+	nbits uint // Number of bits used in cur.
+}
+
+// writeBits writes the `n` low order bits of `val`.
+func (w *bitWriter) writeBits(val uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | byte(val>>uint(i)&1)
+		w.nbits++
+		if w.nbits == 8 {
+			w.buf.WriteByte(w.cur)
+			w.cur = 0
+			w.nbits = 0
+		}
+	}
+}
+
+// align pads the bits written to a byte boundary.
+func (w *bitWriter) align() {
+	if w.nbits > 0 {
+		w.buf.WriteByte(w.cur << (8 - w.nbits))
+		w.cur = 0
+		w.nbits = 0
+	}
+}
+
+// bitsNeeded returns the number of bits needed to represent `val`.
+func bitsNeeded(val int64) int {
+	n := 0
+	for ; val > 0; val >>= 1 {
+		n++
+	}
+	return n
+}
+
+// minMax returns the least and greatest of `vals`.
+func minMax(vals []int64) (int64, int64) {
+	least, greatest := vals[0], vals[0]
+	for _, v := range vals[1:] {
+		if v < least {
+			least = v
+		}
+		if v > greatest {
+			greatest = v
+		}
+	}
+	return least, greatest
+}
+
+// isStructureNode returns true if `obj` is the catalog, a node of the page tree or a page, which
+// are not followed when collecting the objects used by a page.
+func (this *PdfWriter) isStructureNode(obj PdfObject) bool {
+	if obj == this.root || obj == this.pages {
+		return true
+	}
+	io, isIndirect := obj.(*PdfIndirectObject)
+	if !isIndirect {
+		return false
+	}
+	dict, isDict := io.PdfObject.(*PdfObjectDictionary)
+	if !isDict {
+		return false
+	}
+	name, ok := dict.Get("Type").(*PdfObjectName)
+	return ok && (*name == "Page" || *name == "Pages")
+}
+
+// usedObjects returns the objects of the writer used by `obj`, in depth-first order starting with
+// `obj` itself if it is an indirect or stream object.  Parent entries, the catalog and other pages
+// are not followed.
+func (this *PdfWriter) usedObjects(obj PdfObject, inWriter map[PdfObject]bool) []PdfObject {
+	objects := []PdfObject{}
+	visited := map[PdfObject]bool{}
+
+	var visit func(obj PdfObject, start bool)
+	visit = func(obj PdfObject, start bool) {
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			if visited[obj] || !inWriter[obj] || (!start && this.isStructureNode(obj)) {
+				return
+			}
+			visited[obj] = true
+			objects = append(objects, obj)
+			visit(t.PdfObject, false)
+		case *PdfObjectStream:
+			if visited[obj] || !inWriter[obj] {
+				return
+			}
+			visited[obj] = true
+			objects = append(objects, obj)
+			visit(t.PdfObjectDictionary, false)
+		case *PdfObjectDictionary:
+			for _, key := range t.Keys() {
+				if key != "Parent" {
+					visit(t.Get(key), false)
+				}
+			}
+		case *PdfObjectArray:
+			for _, v := range *t {
+				visit(v, false)
+			}
+		}
+	}
+	visit(obj, true)
+
+	return objects
+}
+
+// objectNumber returns the object number of the indirect or stream object `obj`.
+func objectNumber(obj PdfObject) int64 {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		return t.ObjectNumber
+	case *PdfObjectStream:
+		return t.ObjectNumber
+	}
+	return 0
+}
+
+// setObjectNumber sets the object number of the indirect or stream object `obj`.
+func setObjectNumber(obj PdfObject, objNum int64) {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		t.ObjectNumber = objNum
+		t.GenerationNumber = 0
+	case *PdfObjectStream:
+		t.ObjectNumber = objNum
+		t.GenerationNumber = 0
+	}
+}
+
+// renderXrefTable returns the cross-reference table with the `entries`.
+func renderXrefTable(entries []xrefEntry) []byte {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeXrefTable(w, entries)
+	w.Flush()
+	return buf.Bytes()
+}
+
+// linearizationDict returns the linearization parameter dictionary object.  The numbers that
+// depend on the layout have a fixed width, so that the size is known prior to the layout.
+func linearizationDict(objNum, fileLen, hintOffset, hintLen, firstPageNum, firstPageEnd int64, numPages int,
+	mainXrefEntry int64) []byte {
+	return []byte(fmt.Sprintf("%d 0 obj\n<</Linearized 1/L %10d/H [%10d %10d]/O %d/E %10d/N %d/T %10d>>\nendobj\n",
+		objNum, fileLen, hintOffset, hintLen, firstPageNum, firstPageEnd, numPages, mainXrefEntry))
+}
+
+// hintTables holds the values of the page offset and shared object hint tables (Section F.4).
+type hintTables struct {
+	firstPageOffset int64     // Location of the first page object.
+	pageNumObjects  []int64   // Number of objects of each page.
+	pageLengths     []int64   // Length of each page.
+	pageShared      [][]int64 // Shared object identifiers used by each page.
+
+	firstSharedNum    int64   // Object number of the first object of the shared objects section.
+	firstSharedOffset int64   // Location of the first object of the shared objects section.
+	numFirstPage      int64   // Number of shared object entries for the first page.
+	sharedLengths     []int64 // Length of each shared object group (one object per group).
+}
+
+// makeHintStreamData returns the data of the hint stream with the hint tables and the offset of
+// the shared object hint table.
+func makeHintStreamData(h *hintTables) ([]byte, int) {
+	w := &bitWriter{}
+
+	// Page offset hint table header (Table F.3).
+	minObjs, maxObjs := minMax(h.pageNumObjects)
+	minLen, maxLen := minMax(h.pageLengths)
+	nbitsLen := bitsNeeded(maxLen - minLen)
+	var maxShared, maxIdentifier int64
+	for _, shared := range h.pageShared {
+		if int64(len(shared)) > maxShared {
+			maxShared = int64(len(shared))
+		}
+		for _, id := range shared {
+			if id > maxIdentifier {
+				maxIdentifier = id
+			}
+		}
+	}
+	nbitsObjs := bitsNeeded(maxObjs - minObjs)
+	nbitsShared := bitsNeeded(maxShared)
+	nbitsIdentifier := bitsNeeded(maxIdentifier)
+
+	w.writeBits(uint64(minObjs), 32)
+	w.writeBits(uint64(h.firstPageOffset), 32)
+	w.writeBits(uint64(nbitsObjs), 16)
+	w.writeBits(uint64(minLen), 32)
+	w.writeBits(uint64(nbitsLen), 16)
+	// The content stream offsets and lengths are those of the pages, as written by Acrobat.
+	w.writeBits(0, 32)
+	w.writeBits(0, 16)
+	w.writeBits(uint64(minLen), 32)
+	w.writeBits(uint64(nbitsLen), 16)
+	w.writeBits(uint64(nbitsShared), 16)
+	w.writeBits(uint64(nbitsIdentifier), 16)
+	// Fractional positions are not used.
+	w.writeBits(0, 16)
+	w.writeBits(1, 16)
+
+	// Per-page entries (Table F.4), each item for all pages starting at a byte boundary.
+	for _, n := range h.pageNumObjects {
+		w.writeBits(uint64(n-minObjs), nbitsObjs)
+	}
+	w.align()
+	for _, l := range h.pageLengths {
+		w.writeBits(uint64(l-minLen), nbitsLen)
+	}
+	w.align()
+	for _, shared := range h.pageShared {
+		w.writeBits(uint64(len(shared)), nbitsShared)
+	}
+	w.align()
+	for _, shared := range h.pageShared {
+		for _, id := range shared {
+			w.writeBits(uint64(id), nbitsIdentifier)
+		}
+	}
+	w.align()
+	// Numerators of the fractional positions and content stream offsets take no bits.
+	for _, l := range h.pageLengths {
+		w.writeBits(uint64(l-minLen), nbitsLen)
+	}
+	w.align()
+
+	// Shared object hint table header (Table F.5).
+	sharedOffset := w.buf.Len()
+	minGroupLen, maxGroupLen := minMax(h.sharedLengths)
+	nbitsGroupLen := bitsNeeded(maxGroupLen - minGroupLen)
+	w.writeBits(uint64(h.firstSharedNum), 32)
+	w.writeBits(uint64(h.firstSharedOffset), 32)
+	w.writeBits(uint64(h.numFirstPage), 32)
+	w.writeBits(uint64(len(h.sharedLengths)), 32)
+	// Each group has a single object.
+	w.writeBits(0, 16)
+	w.writeBits(uint64(minGroupLen), 32)
+	w.writeBits(uint64(nbitsGroupLen), 16)
+
+	// Shared object group entries (Table F.6).
+	for _, l := range h.sharedLengths {
+		w.writeBits(uint64(l-minGroupLen), nbitsGroupLen)
+	}
+	w.align()
+	// No MD5 signatures.
+	for range h.sharedLengths {
+		w.writeBits(0, 1)
+	}
+	w.align()
+
+	return w.buf.Bytes(), sharedOffset
+}
+
+// writeLinearized writes the linearized document (Annex F) to `out`.
+func (this *PdfWriter) writeLinearized(out io.Writer) error {
+	if this.useObjectStreams {
+		return errors.New("Linearized output with object streams not supported")
+	}
+	pagesDict, ok := this.pages.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return errors.New("Invalid Pages obj (not a dict)")
+	}
+	kids, ok := pagesDict.Get("Kids").(*PdfObjectArray)
+	if !ok || len(*kids) == 0 {
+		return errors.New("Linearized output requires at least one page")
+	}
+
+	inWriter := map[PdfObject]bool{}
+	for _, obj := range this.objects {
+		inWriter[obj] = true
+	}
+
+	// Objects used by each page and the number of pages using each object.
+	pages := make([]*linearizedPage, len(*kids))
+	users := map[PdfObject]int{}
+	for i, kid := range *kids {
+		pages[i] = &linearizedPage{used: this.usedObjects(kid, inWriter)}
+		for _, obj := range pages[i].used {
+			users[obj]++
+		}
+	}
+
+	// Assign the objects to the parts of the file.
+	assigned := map[PdfObject]bool{}
+	assign := func(list []PdfObject, obj PdfObject) []PdfObject {
+		if assigned[obj] || !inWriter[obj] {
+			return list
+		}
+		assigned[obj] = true
+		return append(list, obj)
+	}
+
+	// Part 4: catalog and document-level objects.
+	docObjects := assign(nil, this.root)
+	if this.encryptObj != nil {
+		docObjects = assign(docObjects, this.encryptObj)
+	}
+	for _, key := range []PdfObjectName{"ViewerPreferences", "PageMode", "Threads", "OpenAction"} {
+		if val := this.catalog.Get(key); val != nil {
+			for _, obj := range this.usedObjects(val, inWriter) {
+				docObjects = assign(docObjects, obj)
+			}
+		}
+	}
+	// Part 6: first page.
+	for _, obj := range pages[0].used {
+		pages[0].objects = assign(pages[0].objects, obj)
+	}
+	// Part 7: remaining pages with their own objects.
+	for _, page := range pages[1:] {
+		for i, obj := range page.used {
+			if i == 0 || users[obj] == 1 {
+				page.objects = assign(page.objects, obj)
+			}
+		}
+	}
+	// Part 8: objects shared by the remaining pages.
+	var sharedObjects []PdfObject
+	for _, page := range pages[1:] {
+		for _, obj := range page.used {
+			sharedObjects = assign(sharedObjects, obj)
+		}
+	}
+	// Part 9: other objects.
+	var otherObjects []PdfObject
+	for _, obj := range this.objects {
+		otherObjects = assign(otherObjects, obj)
+	}
+
+	// Number the objects, the main section first.
+	mainObjects := []PdfObject{}
+	for _, page := range pages[1:] {
+		mainObjects = append(mainObjects, page.objects...)
+	}
+	mainObjects = append(mainObjects, sharedObjects...)
+	mainObjects = append(mainObjects, otherObjects...)
+	for i, obj := range mainObjects {
+		setObjectNumber(obj, int64(i+1))
+	}
+	linNum := int64(len(mainObjects) + 1)
+	firstObjects := append(append([]PdfObject{}, docObjects...), pages[0].objects...)
+	for i, obj := range firstObjects {
+		setObjectNumber(obj, linNum+int64(i+1))
+	}
+	hintNum := linNum + int64(len(firstObjects)) + 1
+	size := hintNum + 1
+
+	// Serialize the objects.
+	serialize := func(obj PdfObject) ([]byte, error) {
+		objNum := objectNumber(obj)
+		// Encrypt prior to writing.  Encrypt dictionary should not be encrypted.
+		if this.crypter != nil && obj != this.encryptObj {
+			err := this.crypter.Encrypt(obj, objNum, 0)
+			if err != nil {
+				common.Log.Debug("ERROR: Failed encrypting (%s)", err)
+				return nil, err
+			}
+		}
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeIndirectObject(w, objNum, 0, obj)
+		w.Flush()
+		return buf.Bytes(), nil
+	}
+	data := map[PdfObject][]byte{}
+	for _, obj := range append(append([]PdfObject{}, firstObjects...), mainObjects...) {
+		if err := this.checkContext(); err != nil {
+			return err
+		}
+		b, err := serialize(obj)
+		if err != nil {
+			return err
+		}
+		data[obj] = b
+	}
+
+	// Hint stream with the hint tables for the layout.
+	hints := &hintTables{numFirstPage: int64(len(pages[0].objects))}
+	index := map[PdfObject]int64{}
+	for _, obj := range pages[0].objects {
+		index[obj] = int64(len(hints.sharedLengths))
+		hints.sharedLengths = append(hints.sharedLengths, int64(len(data[obj])))
+	}
+	for _, obj := range sharedObjects {
+		index[obj] = int64(len(hints.sharedLengths))
+		hints.sharedLengths = append(hints.sharedLengths, int64(len(data[obj])))
+	}
+	for _, page := range pages {
+		hints.pageNumObjects = append(hints.pageNumObjects, int64(len(page.objects)))
+		length := int64(0)
+		for _, obj := range page.objects {
+			length += int64(len(data[obj]))
+		}
+		hints.pageLengths = append(hints.pageLengths, length)
+
+		// Objects of the first page and of the shared objects section used by other pages too.
+		shared := []int64{}
+		for _, obj := range page.used {
+			if id, ok := index[obj]; ok && users[obj] > 1 {
+				shared = append(shared, id)
+			}
+		}
+		hints.pageShared = append(hints.pageShared, shared)
+	}
+	makeHintStream := func() ([]byte, error) {
+		hintData, sharedOffset := makeHintStreamData(hints)
+		stream, err := MakeStream(hintData, nil)
+		if err != nil {
+			return nil, err
+		}
+		stream.PdfObjectDictionary.Set("S", MakeInteger(int64(sharedOffset)))
+		stream.ObjectNumber = hintNum
+		return serialize(stream)
+	}
+	// The size of the hint stream does not depend on the locations.
+	hintStream, err := makeHintStream()
+	if err != nil {
+		return err
+	}
+
+	// Layout.
+	header := []byte(fmt.Sprintf("%%PDF-%d.%d\n%%âãÏÓ\n", this.majorVersion, this.minorVersion))
+	offset := int64(len(header))
+	linOffset := offset
+	firstPage := pages[0].objects[0]
+	offset += int64(len(linearizationDict(linNum, 0, 0, 0, objectNumber(firstPage), 0, len(pages), 0)))
+
+	firstXrefOffset := offset
+	firstEntries := []xrefEntry{}
+	for objNum := linNum; objNum < size; objNum++ {
+		firstEntries = append(firstEntries, xrefEntry{objNum: objNum, typ: 1})
+	}
+	offset += int64(len(renderXrefTable(firstEntries)))
+
+	trailer := MakeDict()
+	trailer.Set("Info", this.infoObj)
+	trailer.Set("Root", this.root)
+	trailer.Set("Size", MakeInteger(size))
+	if this.crypter != nil {
+		trailer.Set("Encrypt", this.encryptObj)
+		trailer.Set("ID", this.ids)
+	}
+	trailerStr := trailer.DefaultWriteString()
+	firstTrailer := func(mainXrefOffset int64) []byte {
+		return []byte(fmt.Sprintf("trailer\n%s/Prev %10d>>\nstartxref\n0\n%%%%EOF\n",
+			trailerStr[:len(trailerStr)-2], mainXrefOffset))
+	}
+	offset += int64(len(firstTrailer(0)))
+
+	offsets := map[PdfObject]int64{}
+	place := func(objects []PdfObject) {
+		for _, obj := range objects {
+			offsets[obj] = offset
+			offset += int64(len(data[obj]))
+		}
+	}
+	place(docObjects)
+	hintOffset := offset
+	hintLen := int64(len(hintStream))
+	offset += hintLen
+	place(pages[0].objects)
+	firstPageEnd := offset
+	place(mainObjects)
+
+	mainXrefOffset := offset
+	mainEntries := []xrefEntry{{objNum: 0, typ: 0, gen: 65535}}
+	for i, obj := range mainObjects {
+		mainEntries = append(mainEntries, xrefEntry{objNum: int64(i + 1), typ: 1, offset: offsets[obj]})
+	}
+	mainXref := renderXrefTable(mainEntries)
+	// Offset of the end-of-line marker preceding the entry of object 0.
+	mainXrefEntry := mainXrefOffset + int64(len("xref\r\n")+len(fmt.Sprintf("0 %d\r\n", len(mainEntries)))) - 1
+	mainTrailer := []byte(fmt.Sprintf("trailer\n<</Size %d>>\nstartxref\n%d\n%%%%EOF\n", linNum, firstXrefOffset))
+	fileLen := mainXrefOffset + int64(len(mainXref)) + int64(len(mainTrailer))
+
+	// Hint tables with the locations, which are given as if the hint stream was not present.
+	hints.firstPageOffset = offsets[firstPage] - hintLen
+	if len(sharedObjects) > 0 {
+		hints.firstSharedNum = objectNumber(sharedObjects[0])
+		hints.firstSharedOffset = offsets[sharedObjects[0]] - hintLen
+	}
+	hintStream, err = makeHintStream()
+	if err != nil {
+		return err
+	}
+	if int64(len(hintStream)) != hintLen {
+		common.Log.Debug("ERROR: Hint stream length changed (%d != %d)", len(hintStream), hintLen)
+		return errors.New("Hint stream length mismatch")
+	}
+
+	firstEntries[0].offset = linOffset
+	for i, obj := range firstObjects {
+		firstEntries[i+1].offset = offsets[obj]
+	}
+	firstEntries[len(firstEntries)-1].offset = hintOffset
+
+	// Write out.
+	w := bufio.NewWriter(out)
+	w.Write(header)
+	w.Write(linearizationDict(linNum, fileLen, hintOffset, hintLen, objectNumber(firstPage), firstPageEnd,
+		len(pages), mainXrefEntry))
+	w.Write(renderXrefTable(firstEntries))
+	w.Write(firstTrailer(mainXrefOffset))
+	for _, obj := range docObjects {
+		w.Write(data[obj])
+	}
+	w.Write(hintStream)
+	for _, obj := range pages[0].objects {
+		w.Write(data[obj])
+	}
+	for _, obj := range mainObjects {
+		w.Write(data[obj])
+	}
+	w.Write(mainXref)
+	w.Write(mainTrailer)
+
+	return w.Flush()
+}
@@ -0,0 +1,178 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// bitReader reads the big-endian bit fields of hint tables.
+type bitReader struct {
+	data []byte
+	pos  int // Bit position.
+}
+
+func (r *bitReader) readBits(n int) int64 {
+	var val int64
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> uint(7-r.pos%8) & 1
+		val = val<<1 | int64(bit)
+		r.pos++
+	}
+	return val
+}
+
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) / 8 * 8
+}
+
+// newLinearizedTestWriter returns a linearized writer with `numPages` test pages.
+func newLinearizedTestWriter(t *testing.T, numPages int) *PdfWriter {
+	w := newTestWriterPages(t, numPages)
+	w.SetLinearized(true)
+	return w
+}
+
+var reLinearizationDict = regexp.MustCompile(
+	`^(\d+) 0 obj\n<</Linearized 1/L +(\d+)/H \[ *(\d+) +(\d+)\]/O (\d+)/E +(\d+)/N (\d+)/T +(\d+)>>`)
+
+// objectOffset returns the offset of object `objNum` in `data`.
+func objectOffset(t *testing.T, data []byte, objNum int64) int64 {
+	re := regexp.MustCompile(fmt.Sprintf(`(?m)^%d 0 obj\n`, objNum))
+	loc := re.FindIndex(data)
+	if loc == nil {
+		t.Fatalf("Object %d not found", objNum)
+	}
+	return int64(loc[0])
+}
+
+// Test the layout and the hint tables of linearized output.
+func TestWriterLinearized(t *testing.T) {
+	const numPages = 3
+	data := writePdf(t, newLinearizedTestWriter(t, numPages))
+
+	header := []byte("%PDF-1.3\n%âãÏÓ\n")
+	if !bytes.HasPrefix(data, header) {
+		t.Fatalf("Incorrect header %q", data[:8])
+	}
+	m := reLinearizationDict.FindSubmatch(data[len(header):])
+	if m == nil {
+		t.Fatalf("Missing linearization dictionary")
+	}
+	vals := make([]int64, len(m))
+	for i := 1; i < len(m); i++ {
+		vals[i], _ = strconv.ParseInt(string(m[i]), 10, 64)
+	}
+	fileLen, hintOffset, hintLen, firstPageNum, firstPageEnd, n, mainXrefEntry :=
+		vals[2], vals[3], vals[4], vals[5], vals[6], vals[7], vals[8]
+	if fileLen != int64(len(data)) || n != numPages {
+		t.Fatalf("Incorrect L %d or N %d", fileLen, n)
+	}
+	if !bytes.HasPrefix(data[mainXrefEntry:], []byte("\n0000000000 65535 f")) {
+		t.Fatalf("Incorrect T %d", mainXrefEntry)
+	}
+	if !bytes.HasSuffix(data[:hintOffset+hintLen], []byte("endobj\n")) ||
+		!bytes.HasSuffix(data[:firstPageEnd], []byte("endobj\n")) {
+		t.Fatalf("Incorrect H or E")
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	pageOffsets := []int64{}
+	for i := 1; i <= numPages; i++ {
+		page, err := reader.GetPage(i)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		cstream, err := page.GetAllContentStreams()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !strings.HasPrefix(cstream, fmt.Sprintf("BT /F1 18 Tf 10 10 Td (Page %d) Tj ET", i)) {
+			t.Fatalf("Page %d: content mismatch %q", i, cstream)
+		}
+		objNum := page.GetPageAsIndirectObject().ObjectNumber
+		if i == 1 && objNum != firstPageNum {
+			t.Fatalf("Incorrect O %d (%d)", firstPageNum, objNum)
+		}
+		pageOffsets = append(pageOffsets, objectOffset(t, data, objNum))
+	}
+	if pageOffsets[1] != firstPageEnd {
+		t.Fatalf("Second page not following the first page section")
+	}
+
+	// Page offset hint table.
+	hint := data[hintOffset : hintOffset+hintLen]
+	start := bytes.Index(hint, []byte("stream\n")) + len("stream\n")
+	r := &bitReader{data: hint[start:]}
+	minObjs := r.readBits(32)
+	firstPageOffset := r.readBits(32)
+	nbitsObjs := int(r.readBits(16))
+	minLen := r.readBits(32)
+	nbitsLen := int(r.readBits(16))
+	r.readBits(32 + 16 + 32 + 16 + 16 + 16 + 16 + 16)
+	if firstPageOffset != pageOffsets[0]-hintLen {
+		t.Fatalf("Incorrect first page offset %d", firstPageOffset)
+	}
+	firstNumObjs := minObjs + r.readBits(nbitsObjs)
+	for i := 1; i < numPages; i++ {
+		// The font is shared and in the first page section only.
+		if numObjs := minObjs + r.readBits(nbitsObjs); numObjs != firstNumObjs-1 {
+			t.Fatalf("Page %d: incorrect number of objects %d", i+1, numObjs)
+		}
+	}
+	r.align()
+	for i := 0; i < numPages; i++ {
+		length := minLen + r.readBits(nbitsLen)
+		if i < numPages-1 && pageOffsets[i]+length != pageOffsets[i+1] {
+			t.Fatalf("Page %d: incorrect length %d", i+1, length)
+		}
+	}
+}
+
+// Test reading back encrypted linearized output.
+func TestWriterLinearizedEncrypted(t *testing.T) {
+	w := newLinearizedTestWriter(t, 2)
+	err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Algorithm: AES_128bit})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writePdf(t, w)
+	if bytes.Contains(data, []byte("(Page ")) {
+		t.Fatalf("Content not encrypted")
+	}
+	header := []byte("%PDF-1.6\n%âãÏÓ\n")
+	if !bytes.HasPrefix(data, header) || !reLinearizationDict.Match(data[len(header):]) {
+		t.Fatalf("Linearization dictionary not at the start of the file")
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if auth, err := reader.Decrypt([]byte("user")); err != nil || !auth {
+		t.Fatalf("Failed to authenticate (%v)", err)
+	}
+	numPages, err := reader.GetNumPages()
+	if err != nil || numPages != 2 {
+		t.Fatalf("Incorrect number of pages %d (%v)", numPages, err)
+	}
+	page, err := reader.GetPage(2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cstream, err := page.GetAllContentStreams()
+	if err != nil || !strings.HasPrefix(cstream, "BT /F1 18 Tf 10 10 Td (Page 2) Tj ET") {
+		t.Fatalf("Content mismatch %q (%v)", cstream, err)
+	}
+}
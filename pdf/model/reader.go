@@ -6,16 +6,25 @@
 package model
 
 import (
+	"context"
+	"crypto"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 
 	"github.com/unidoc/unidoc/common"
 	. "github.com/unidoc/unidoc/pdf/core"
 )
 
+// PdfReader reads a PDF document.  The pages can be loaded and processed from multiple goroutines:
+// GetPage, GetPageAsIndirectObject, GetNumPages and the methods loading the outlines and the
+// optional content properties are safe for concurrent use.  The pages returned can be used
+// concurrently as long as they are not modified.
 type PdfReader struct {
+	rs          io.ReadSeeker
 	parser      *PdfParser
 	root        PdfObject
 	pages       *PdfObjectDictionary
@@ -30,21 +39,83 @@ type PdfReader struct {
 
 	// For tracking traversal (cache).
 	traversed map[PdfObject]bool
+
+	// Pages and outlines loaded on demand.
+	lazy           bool
+	outlinesLoaded bool
+
+	// Serializes the loading of objects resolved in place.
+	mu sync.Mutex
+}
+
+// ReaderOptions defines options for loading documents with NewPdfReaderWithOptions.
+type ReaderOptions struct {
+	// LazyLoad loads the pages on demand, when requested with GetPage or GetPageAsIndirectObject,
+	// and the outlines when first requested, instead of loading the whole page tree up front.
+	// PageList is not filled, and each call to GetPage loads the page anew.
+	//
+	// References from a page to other pages (such as the parents of the page, or the pages
+	// referred to by annotations) are resolved to the page objects, but the contents of these
+	// pages are only loaded when requested.
+	LazyLoad bool
+
+	// CacheSize is the budget of the object cache of the parser in bytes, 0 for unbounded.  The
+	// least recently used objects are evicted from the cache when the budget is exceeded, and
+	// loaded again from the file when needed.  Decoded stream data is not retained, except the
+	// decoded object streams, which are cached within the budget.  The objects whose references
+	// were resolved in place keep referring to the objects loaded at the time, which are distinct
+	// from the objects loaded again.
+	CacheSize int64
+
+	// Limits bounds the resources used for parsing the document, unlimited by default.  Untrusted
+	// documents should be read with limits.
+	Limits ParserLimits
+
+	// Strict fails on malformed documents instead of repairing them.  By default damaged
+	// cross-reference data is repaired and the repairs are reported by GetDiagnostics.
+	Strict bool
 }
 
+// NewPdfReader returns a new reader of the document `rs`, loading the whole page tree up front.
 func NewPdfReader(rs io.ReadSeeker) (*PdfReader, error) {
+	return NewPdfReaderWithOptions(rs, nil)
+}
+
+// NewPdfReaderWithOptions returns a new reader of the document `rs` with the options `opts`, or the
+// default options if nil.  Reading large documents with bounded memory requires lazy loading and
+// a bounded object cache.
+func NewPdfReaderWithOptions(rs io.ReadSeeker, opts *ReaderOptions) (*PdfReader, error) {
+	return NewPdfReaderWithContext(context.Background(), rs, opts)
+}
+
+// NewPdfReaderWithContext returns a new reader of the document `rs` like NewPdfReaderWithOptions.
+// The loading, including the repairs of damaged files, stops with the error of `ctx` once canceled
+// or past its deadline.  The context also applies to the objects loaded later on by the reader,
+// such as the pages loaded lazily, and to the decoding of their streams.
+func NewPdfReaderWithContext(ctx context.Context, rs io.ReadSeeker, opts *ReaderOptions) (*PdfReader, error) {
 	pdfReader := &PdfReader{}
+	pdfReader.rs = rs
 	pdfReader.traversed = map[PdfObject]bool{}
 
 	pdfReader.modelManager = NewModelManager()
 
 	// Create the parser, loads the cross reference table and trailer.
-	parser, err := NewParser(rs)
+	parserOpts := &ParserOptions{}
+	if opts != nil {
+		parserOpts.Limits = opts.Limits
+		parserOpts.Strict = opts.Strict
+	}
+	parser, err := NewParserWithOptions(ctx, rs, parserOpts)
 	if err != nil {
 		return nil, err
 	}
 	pdfReader.parser = parser
 
+	if opts != nil {
+		pdfReader.lazy = opts.LazyLoad
+		parser.SetCacheLimit(opts.CacheSize)
+	}
+
 	isEncrypted, err := pdfReader.IsEncrypted()
 	if err != nil {
 		return nil, err
@@ -81,7 +152,7 @@ func (this *PdfReader) GetEncryptionMethod() string {
 		str += fmt.Sprintf("RC4: %d bits", crypter.Length)
 	} else if crypter.V == 3 {
 		str += "Unpublished algorithm"
-	} else if crypter.V == 4 {
+	} else if crypter.V == 4 || crypter.V == 5 {
 		// Look at CF, StmF, StrF
 		str += fmt.Sprintf("Stream filter: %s - String filter: %s", crypter.StreamFilter, crypter.StringFilter)
 		str += "; Crypt filters:"
@@ -116,6 +187,27 @@ func (this *PdfReader) Decrypt(password []byte) (bool, error) {
 	return true, nil
 }
 
+// DecryptWithCertificate decrypts a PDF file encrypted with the public-key security handler, using
+// the certificate and private key of one of the recipients.  Returns true if successful, false
+// if the certificate is not a recipient.
+func (this *PdfReader) DecryptWithCertificate(cert *x509.Certificate, key crypto.PrivateKey) (bool, error) {
+	success, err := this.parser.DecryptWithCertificate(cert, key)
+	if err != nil {
+		return false, err
+	}
+	if !success {
+		return false, nil
+	}
+
+	err = this.loadStructure()
+	if err != nil {
+		common.Log.Debug("ERROR: Fail to load structure (%s)", err)
+		return false, err
+	}
+
+	return true, nil
+}
+
 // Check access rights and permissions for a specified password.  If either user/owner password is specified,
 // full rights are granted, otherwise the access rights are specified by the Permissions flag.
 //
@@ -192,6 +284,15 @@ func (this *PdfReader) loadStructure() error {
 	this.pageCount = int(*pageCount)
 	this.pageList = []*PdfIndirectObject{}
 
+	if this.lazy {
+		// Pages and outlines are loaded on demand.
+		this.PageList = nil
+		this.outlineTree = nil
+		this.outlinesLoaded = false
+		this.AcroForm, err = this.loadForms()
+		return err
+	}
+
 	traversedPageNodes := map[PdfObject]bool{}
 	err = this.buildPageList(ppages, nil, traversedPageNodes)
 	if err != nil {
@@ -404,11 +505,32 @@ func (this *PdfReader) buildOutlineTree(obj PdfObject, parent *PdfOutlineTreeNod
 
 // Get the outline tree.
 func (this *PdfReader) GetOutlineTree() *PdfOutlineTreeNode {
+	this.loadOutlinesLazily()
 	return this.outlineTree
 }
 
+// loadOutlinesLazily loads the outlines on first request when loading lazily.
+func (this *PdfReader) loadOutlinesLazily() {
+	if !this.lazy {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.outlinesLoaded || this.catalog == nil {
+		return
+	}
+	outlineTree, err := this.loadOutlines()
+	if err != nil {
+		common.Log.Debug("ERROR: Failed to build outline tree (%s)", err)
+		return
+	}
+	this.outlineTree = outlineTree
+	this.outlinesLoaded = true
+}
+
 // Return a flattened list of tree nodes and titles.
 func (this *PdfReader) GetOutlinesFlattened() ([]*PdfOutlineTreeNode, []string, error) {
+	this.loadOutlinesLazily()
 	outlineNodeList := []*PdfOutlineTreeNode{}
 	flattenedTitleList := []string{}
 
@@ -593,23 +715,17 @@ func (this *PdfReader) GetNumPages() (int, error) {
 	if this.parser.GetCrypter() != nil && !this.parser.IsAuthenticated() {
 		return 0, fmt.Errorf("File need to be decrypted first")
 	}
+	if this.lazy {
+		return this.pageCount, nil
+	}
 	return len(this.pageList), nil
 }
 
-// Resolves a reference, returning the object and indicates whether or not
-// it was cached.
-func (this *PdfReader) resolveReference(ref *PdfObjectReference) (PdfObject, bool, error) {
-	cachedObj, isCached := this.parser.ObjCache[int(ref.ObjectNumber)]
-	if !isCached {
-		common.Log.Trace("Reader Lookup ref: %s", ref)
-		obj, err := this.parser.LookupByReference(*ref)
-		if err != nil {
-			return nil, false, err
-		}
-		this.parser.ObjCache[int(ref.ObjectNumber)] = obj
-		return obj, false, nil
-	}
-	return cachedObj, true, nil
+// Resolves a reference, returning the object, loaded from the object cache of the parser if
+// cached.
+func (this *PdfReader) resolveReference(ref *PdfObjectReference) (PdfObject, error) {
+	common.Log.Trace("Reader Lookup ref: %s", ref)
+	return this.parser.LookupByReference(*ref)
 }
 
 /*
@@ -619,22 +735,33 @@ func (this *PdfReader) resolveReference(ref *PdfObjectReference) (PdfObject, boo
  * GH: Are we fully protected against circular references? (Add tests).
  */
 func (this *PdfReader) traverseObjectData(o PdfObject) error {
+	if this.lazy {
+		// Objects traversed are not tracked across calls, to avoid retaining them.
+		return this.traverseObjectDataWrapper(o, map[PdfObject]bool{})
+	}
+	return this.traverseObjectDataWrapper(o, this.traversed)
+}
+
+// traverseObjectDataWrapper traverses `o`, tracking the objects already traversed in `traversed`.
+// When loading lazily, the other pages and page tree nodes referred to are resolved but not
+// traversed.
+func (this *PdfReader) traverseObjectDataWrapper(o PdfObject, traversed map[PdfObject]bool) error {
 	common.Log.Trace("Traverse object data")
-	if _, isTraversed := this.traversed[o]; isTraversed {
+	if _, isTraversed := traversed[o]; isTraversed {
 		common.Log.Trace("-Already traversed...")
 		return nil
 	}
-	this.traversed[o] = true
+	traversed[o] = true
 
 	if io, isIndirectObj := o.(*PdfIndirectObject); isIndirectObj {
 		common.Log.Trace("io: %s", io)
 		common.Log.Trace("- %s", io.PdfObject)
-		err := this.traverseObjectData(io.PdfObject)
+		err := this.traverseObjectDataWrapper(io.PdfObject, traversed)
 		return err
 	}
 
 	if so, isStreamObj := o.(*PdfObjectStream); isStreamObj {
-		err := this.traverseObjectData(so.PdfObjectDictionary)
+		err := this.traverseObjectDataWrapper(so.PdfObjectDictionary, traversed)
 		return err
 	}
 
@@ -643,20 +770,19 @@ func (this *PdfReader) traverseObjectData(o PdfObject) error {
 		for _, name := range dict.Keys() {
 			v := dict.Get(name)
 			if ref, isRef := v.(*PdfObjectReference); isRef {
-				resolvedObj, _, err := this.resolveReference(ref)
+				resolvedObj, err := this.resolveReference(ref)
 				if err != nil {
 					return err
 				}
 				dict.Set(name, resolvedObj)
-				err = this.traverseObjectData(resolvedObj)
-				if err != nil {
-					return err
-				}
-			} else {
-				err := this.traverseObjectData(v)
-				if err != nil {
-					return err
-				}
+				v = resolvedObj
+			}
+			if this.lazy && isPageNode(v) {
+				continue
+			}
+			err := this.traverseObjectDataWrapper(v, traversed)
+			if err != nil {
+				return err
 			}
 		}
 		return nil
@@ -666,21 +792,19 @@ func (this *PdfReader) traverseObjectData(o PdfObject) error {
 		common.Log.Trace("- array: %s", arr)
 		for idx, v := range *arr {
 			if ref, isRef := v.(*PdfObjectReference); isRef {
-				resolvedObj, _, err := this.resolveReference(ref)
+				resolvedObj, err := this.resolveReference(ref)
 				if err != nil {
 					return err
 				}
 				(*arr)[idx] = resolvedObj
-
-				err = this.traverseObjectData(resolvedObj)
-				if err != nil {
-					return err
-				}
-			} else {
-				err := this.traverseObjectData(v)
-				if err != nil {
-					return err
-				}
+				v = resolvedObj
+			}
+			if this.lazy && isPageNode(v) {
+				continue
+			}
+			err := this.traverseObjectDataWrapper(v, traversed)
+			if err != nil {
+				return err
 			}
 		}
 		return nil
@@ -694,11 +818,150 @@ func (this *PdfReader) traverseObjectData(o PdfObject) error {
 	return nil
 }
 
+// isPageNode returns true if `obj` is a page or a node of the page tree.
+func isPageNode(obj PdfObject) bool {
+	io, isIndirect := obj.(*PdfIndirectObject)
+	if !isIndirect {
+		return false
+	}
+	dict, ok := io.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return false
+	}
+	objType, ok := dict.Get("Type").(*PdfObjectName)
+	return ok && (*objType == "Page" || *objType == "Pages")
+}
+
+// loadPage loads the page `pageNumber` on demand, descending the page tree from the root using
+// the page counts of the nodes.  The Parent entries of the page and its ancestors are set to the
+// loaded ancestors, and the inheritable entries of the ancestors are loaded.
+func (this *PdfReader) loadPage(pageNumber int) (*PdfIndirectObject, error) {
+	if pageNumber < 1 || pageNumber > this.pageCount {
+		return nil, errors.New("Invalid page number (page count too short)")
+	}
+	inheritedFields := []PdfObjectName{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+	obj, err := this.traceToObject(this.catalog.Get("Pages"))
+	if err != nil {
+		return nil, err
+	}
+	node, ok := obj.(*PdfIndirectObject)
+	if !ok {
+		return nil, errors.New("Pages object invalid")
+	}
+	var parent *PdfIndirectObject
+	idx := pageNumber - 1
+	traversedPageNodes := map[PdfObject]bool{}
+	for {
+		if _, alreadyTraversed := traversedPageNodes[node]; alreadyTraversed {
+			return nil, errors.New("Cyclic page tree")
+		}
+		traversedPageNodes[node] = true
+
+		nodeDict, ok := node.PdfObject.(*PdfObjectDictionary)
+		if !ok {
+			return nil, errors.New("Node not a dictionary")
+		}
+		// Only set if not already set, as the node can be in use by another goroutine.
+		if parent != nil && nodeDict.Get("Parent") != parent {
+			nodeDict.Set("Parent", parent)
+		}
+		objType, ok := nodeDict.Get("Type").(*PdfObjectName)
+		if !ok {
+			return nil, errors.New("Node missing Type (Required)")
+		}
+		if *objType == "Page" {
+			if idx != 0 {
+				return nil, errors.New("Page not found")
+			}
+			// Look up all references related to page and load everything.
+			err := this.traverseObjectData(node)
+			if err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+		if *objType != "Pages" {
+			common.Log.Debug("ERROR: Table of content containing non Page/Pages object! (%s)", objType)
+			return nil, errors.New("Table of content containing non Page/Pages object!")
+		}
+
+		for _, field := range inheritedFields {
+			v := nodeDict.Get(field)
+			if v == nil {
+				continue
+			}
+			if ref, isRef := v.(*PdfObjectReference); isRef {
+				v, err = this.resolveReference(ref)
+				if err != nil {
+					return nil, err
+				}
+				nodeDict.Set(field, v)
+			}
+			err := this.traverseObjectData(v)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		kidsObj, err := this.traceToObject(nodeDict.Get("Kids"))
+		if err != nil {
+			common.Log.Debug("ERROR: Failed loading Kids object")
+			return nil, err
+		}
+		kids, ok := TraceToDirectObject(kidsObj).(*PdfObjectArray)
+		if !ok {
+			return nil, errors.New("Invalid Kids object")
+		}
+
+		// Find the kid containing the page.
+		var next *PdfIndirectObject
+		for _, kid := range *kids {
+			kidObj, err := this.traceToObject(kid)
+			if err != nil {
+				return nil, err
+			}
+			kidNode, ok := kidObj.(*PdfIndirectObject)
+			if !ok {
+				common.Log.Debug("ERROR: Page not indirect object - (%s)", kidObj)
+				return nil, errors.New("Page not indirect object")
+			}
+			kidDict, ok := kidNode.PdfObject.(*PdfObjectDictionary)
+			if !ok {
+				return nil, errors.New("Node not a dictionary")
+			}
+			count := 1
+			if kidType, ok := kidDict.Get("Type").(*PdfObjectName); ok && *kidType == "Pages" {
+				kidCount, ok := TraceToDirectObject(kidDict.Get("Count")).(*PdfObjectInteger)
+				if !ok {
+					return nil, errors.New("Pages count invalid")
+				}
+				count = int(*kidCount)
+			}
+			if idx < count {
+				next = kidNode
+				break
+			}
+			idx -= count
+		}
+		if next == nil {
+			return nil, errors.New("Page not found")
+		}
+		parent = node
+		node = next
+	}
+}
+
 // Get a page by the page number. Indirect object with type /Page.
 func (this *PdfReader) GetPageAsIndirectObject(pageNumber int) (PdfObject, error) {
 	if this.parser.GetCrypter() != nil && !this.parser.IsAuthenticated() {
 		return nil, fmt.Errorf("File needs to be decrypted first")
 	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.lazy {
+		return this.loadPage(pageNumber)
+	}
 	if len(this.pageList) < pageNumber {
 		return nil, errors.New("Invalid page number (page count too short)")
 	}
@@ -721,6 +984,20 @@ func (this *PdfReader) GetPage(pageNumber int) (*PdfPage, error) {
 	if this.parser.GetCrypter() != nil && !this.parser.IsAuthenticated() {
 		return nil, fmt.Errorf("File needs to be decrypted first")
 	}
+	if this.lazy {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		node, err := this.loadPage(pageNumber)
+		if err != nil {
+			return nil, err
+		}
+		page, err := this.newPdfPageFromDict(node.PdfObject.(*PdfObjectDictionary))
+		if err != nil {
+			return nil, err
+		}
+		page.setContainer(node)
+		return page, nil
+	}
 	if len(this.pageList) < pageNumber {
 		return nil, errors.New("Invalid page number (page count too short)")
 	}
@@ -735,6 +1012,9 @@ func (this *PdfReader) GetPage(pageNumber int) (*PdfPage, error) {
 
 // Get optional content properties
 func (this *PdfReader) GetOCProperties() (PdfObject, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
 	dict := this.catalog
 	obj := dict.Get("OCProperties")
 	var err error
@@ -755,6 +1035,109 @@ func (this *PdfReader) GetOCProperties() (PdfObject, error) {
 	return obj, nil
 }
 
+// GetDocumentInfo returns the document information dictionary (Info entry of the trailer), empty if
+// the document has none.
+func (this *PdfReader) GetDocumentInfo() (*PdfDocumentInfo, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	trailerDict := this.parser.GetTrailer()
+	if trailerDict == nil {
+		return nil, errors.New("Trailer missing")
+	}
+	obj, err := this.traceToObject(trailerDict.Get("Info"))
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return NewPdfDocumentInfo(), nil
+	}
+	if err := this.traverseObjectData(obj); err != nil {
+		return nil, err
+	}
+
+	switch t := TraceToDirectObject(obj).(type) {
+	case *PdfObjectDictionary:
+		return newPdfDocumentInfoFromDict(t), nil
+	case *PdfObjectNull:
+		return NewPdfDocumentInfo(), nil
+	default:
+		common.Log.Debug("ERROR: Invalid document info (%T)", t)
+		return nil, ErrTypeError
+	}
+}
+
+// GetXmpMetadata returns the XMP metadata of the document (Metadata entry of the catalog), nil if
+// none.
+func (this *PdfReader) GetXmpMetadata() (*XmpMetadata, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	obj, err := this.traceToObject(this.catalog.Get("Metadata"))
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, nil
+	}
+	if _, isNull := obj.(*PdfObjectNull); isNull {
+		return nil, nil
+	}
+	return newXmpMetadataFromPdfObject(obj)
+}
+
+// LoadNameTree loads the name tree with root `root`, such as an entry of the Names dictionary of
+// the catalog.
+func (this *PdfReader) LoadNameTree(root PdfObject) (*PdfNameTree, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return newPdfNameTreeFromPdfObject(root, this.traceToObject)
+}
+
+// LoadNumberTree loads the number tree with root `root`, such as the ParentTree of the structure
+// tree root.
+func (this *PdfReader) LoadNumberTree(root PdfObject) (*PdfNumberTree, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return newPdfNumberTreeFromPdfObject(root, this.traceToObject)
+}
+
+// GetNameTree returns the name tree `name` of the Names dictionary of the catalog, such as Dests,
+// EmbeddedFiles, JavaScript or AP.  Nil if the document has none.
+func (this *PdfReader) GetNameTree(name string) (*PdfNameTree, error) {
+	this.mu.Lock()
+	namesObj, err := this.traceToObject(this.catalog.Get("Names"))
+	this.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if namesObj == nil {
+		return nil, nil
+	}
+	names, ok := TraceToDirectObject(namesObj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("ERROR: Names not a dictionary (%T)", namesObj)
+		return nil, ErrTypeError
+	}
+	root := names.Get(PdfObjectName(name))
+	if root == nil {
+		return nil, nil
+	}
+	return this.LoadNameTree(root)
+}
+
+// GetPageLabels returns the number tree of the page labels (PageLabels entry of the catalog),
+// mapping the page indices to the page label dictionaries.  Nil if the document has none.
+func (this *PdfReader) GetPageLabels() (*PdfNumberTree, error) {
+	this.mu.Lock()
+	root := this.catalog.Get("PageLabels")
+	this.mu.Unlock()
+	if root == nil {
+		return nil, nil
+	}
+	return this.LoadNumberTree(root)
+}
+
 // Inspect the object types, subtypes and content in the PDF file.
 func (this *PdfReader) Inspect() (map[string]int, error) {
 	return this.parser.Inspect()
@@ -775,6 +1158,12 @@ func (this *PdfReader) GetIndirectObjectByNumber(number int) (PdfObject, error)
 	return obj, err
 }
 
+// GetDiagnostics returns the problems found in the document and the repairs applied so far.  Empty
+// for a well-formed document.
+func (this *PdfReader) GetDiagnostics() []Diagnostic {
+	return this.parser.GetDiagnostics()
+}
+
 func (this *PdfReader) GetTrailer() (*PdfObjectDictionary, error) {
 	trailerDict := this.parser.GetTrailer()
 	if trailerDict == nil {
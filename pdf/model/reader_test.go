@@ -0,0 +1,380 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// makeTestPageTree returns a document with `numPages` pages in a page tree of two levels.  The
+// media box and the resources are inherited from the root of the tree, and each page has a link
+// to the next page.
+func makeTestPageTree(numPages int) []byte {
+	half := numPages / 2
+	pageNum := func(i int) int { return 6 + 2*i }
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [3 0 R 4 0 R] /Count %d /MediaBox [0 0 200 100] /Resources 5 0 R >>", numPages),
+		"", "",
+		"<< /ProcSet [/PDF /Text] >>",
+	}
+	kids := [2][]string{}
+	for i := 0; i < numPages; i++ {
+		parent := 3
+		if i >= half {
+			parent = 4
+		}
+		kids[parent-3] = append(kids[parent-3], fmt.Sprintf("%d 0 R", pageNum(i)))
+		page := fmt.Sprintf("<< /Type /Page /Parent %d 0 R /Contents %d 0 R", parent, pageNum(i)+1)
+		if i+1 < numPages {
+			page += fmt.Sprintf(" /Annots [<< /Type /Annot /Subtype /Link /Rect [0 0 10 10] /Dest [%d 0 R /Fit] >>]", pageNum(i+1))
+		}
+		content := fmt.Sprintf("BT /F1 12 Tf 10 10 Td (Page %d) Tj ET", i+1)
+		objects = append(objects, page+" >>",
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+	objects[2] = fmt.Sprintf("<< /Type /Pages /Parent 2 0 R /Kids [%s] /Count %d >>", strings.Join(kids[0], " "), len(kids[0]))
+	objects[3] = fmt.Sprintf("<< /Type /Pages /Parent 2 0 R /Kids [%s] /Count %d >>", strings.Join(kids[1], " "), len(kids[1]))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, obj := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xrefOffset := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f\r\n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n\r\n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xrefOffset)
+	return buf.Bytes()
+}
+
+// Test loading pages on demand with a bounded object cache.
+func TestLazyLoading(t *testing.T) {
+	numPages := 20
+	data := makeTestPageTree(numPages)
+	cacheSize := int64(2000)
+
+	reader, err := NewPdfReaderWithOptions(bytes.NewReader(data), &ReaderOptions{LazyLoad: true, CacheSize: cacheSize})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	n, err := reader.GetNumPages()
+	if err != nil || n != numPages {
+		t.Fatalf("Incorrect number of pages %d (%v)", n, err)
+	}
+	if len(reader.PageList) != 0 {
+		t.Fatalf("Pages loaded up front")
+	}
+
+	// Out of order.
+	for _, pageNum := range []int{numPages, 1, numPages / 2, numPages/2 + 1, 3} {
+		page, err := reader.GetPage(pageNum)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		content, err := page.GetAllContentStreams()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !strings.Contains(content, fmt.Sprintf("(Page %d)", pageNum)) {
+			t.Fatalf("Incorrect content of page %d: %s", pageNum, content)
+		}
+		mbox, err := page.GetMediaBox()
+		if err != nil || mbox.Urx != 200 || mbox.Ury != 100 {
+			t.Fatalf("Incorrect inherited media box %v (%v)", mbox, err)
+		}
+		if page.Resources == nil || page.Resources.ProcSet == nil {
+			t.Fatalf("Resources not inherited")
+		}
+		if size := reader.parser.CacheSize(); size > cacheSize {
+			t.Fatalf("Cache size %d exceeding the budget %d", size, cacheSize)
+		}
+	}
+	if _, err := reader.GetPage(numPages + 1); err == nil {
+		t.Fatalf("Invalid page number not detected")
+	}
+
+	// Linked pages are resolved, but not loaded.
+	obj, err := reader.GetPageAsIndirectObject(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	annots, ok := obj.(*PdfIndirectObject).PdfObject.(*PdfObjectDictionary).Get("Annots").(*PdfObjectArray)
+	if !ok {
+		t.Fatalf("Annotations not loaded")
+	}
+	dest := (*annots)[0].(*PdfObjectDictionary).Get("Dest").(*PdfObjectArray)
+	linked, ok := (*dest)[0].(*PdfIndirectObject)
+	if !ok {
+		t.Fatalf("Linked page not resolved (%T)", (*dest)[0])
+	}
+	if _, isRef := linked.PdfObject.(*PdfObjectDictionary).Get("Contents").(*PdfObjectReference); !isRef {
+		t.Fatalf("Linked page loaded")
+	}
+
+	// The pages loaded up front are the same.
+	reader, err = NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(reader.PageList) != numPages {
+		t.Fatalf("Incorrect number of pages %d", len(reader.PageList))
+	}
+	if size := reader.parser.CacheSize(); size <= cacheSize {
+		t.Fatalf("Document too small for the test (%d)", size)
+	}
+	for i, page := range reader.PageList {
+		content, err := page.GetAllContentStreams()
+		if err != nil || !strings.Contains(content, fmt.Sprintf("(Page %d)", i+1)) {
+			t.Fatalf("Incorrect content of page %d: %s (%v)", i+1, content, err)
+		}
+	}
+}
+
+// Test loading and processing the pages from multiple goroutines.
+func TestConcurrentReading(t *testing.T) {
+	numPages := 40
+	data := makeTestPageTree(numPages)
+
+	for _, opts := range []*ReaderOptions{nil, {LazyLoad: true}, {LazyLoad: true, CacheSize: 2000}} {
+		reader, err := NewPdfReaderWithOptions(bytes.NewReader(data), opts)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, numPages)
+		for i := 1; i <= numPages; i++ {
+			wg.Add(1)
+			go func(pageNum int) {
+				defer wg.Done()
+				if _, err := reader.GetPageAsIndirectObject(pageNum); err != nil {
+					errs <- err
+					return
+				}
+				page, err := reader.GetPage(pageNum)
+				if err != nil {
+					errs <- err
+					return
+				}
+				content, err := page.GetAllContentStreams()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !strings.Contains(content, fmt.Sprintf("(Page %d)", pageNum)) {
+					errs <- fmt.Errorf("Incorrect content of page %d: %s", pageNum, content)
+					return
+				}
+				if _, err := page.GetMediaBox(); err != nil {
+					errs <- err
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("Error (options %+v): %v", opts, err)
+		}
+	}
+}
+
+// Test canceling the reading, while loading and while loading pages lazily.
+func TestReaderContext(t *testing.T) {
+	data := makeTestPageTree(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewPdfReaderWithContext(ctx, bytes.NewReader(data), nil); err != context.Canceled {
+		t.Fatalf("Loading not canceled (%v)", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	reader, err := NewPdfReaderWithContext(ctx, bytes.NewReader(data), &ReaderOptions{LazyLoad: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := reader.GetPage(1); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cancel()
+	if _, err := reader.GetPage(2); err != context.Canceled {
+		t.Fatalf("Page loading not canceled (%v)", err)
+	}
+}
+
+// Test reading with limits.
+func TestReaderLimits(t *testing.T) {
+	data := makeTestPageTree(10)
+
+	_, err := NewPdfReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Limits: ParserLimits{MaxNestingDepth: 2}})
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != "MaxNestingDepth" {
+		t.Fatalf("Nesting limit not detected (%v)", err)
+	}
+
+	reader, err := NewPdfReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Limits: ParserLimits{MaxStreamSize: 10}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = page.GetAllContentStreams()
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != "MaxStreamSize" {
+		t.Fatalf("Stream size limit not detected (%v)", err)
+	}
+
+	// Images of 8 MB and more with little data, rejected before decoding.
+	images := []struct {
+		filter       string
+		decodeParams *PdfObjectDictionary
+		data         []byte
+	}{
+		{StreamEncodingFilterNameCCITTFax, MakeDict(), []byte{0x80}},
+		// Page information segment of 8192 x 8192 pixels.
+		{StreamEncodingFilterNameJBIG2, nil, []byte{
+			0x00, 0x00, 0x00, 0x00, 0x30, 0x00, 0x01, 0x00, 0x00, 0x00, 0x13,
+			0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x20, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00,
+		}},
+		// Codestream header of 16384 x 16384 pixels with 3 components.
+		{StreamEncodingFilterNameJPX, nil, []byte{
+			0xff, 0x4f, 0xff, 0x51, 0x00, 0x2f, 0x00, 0x00,
+			0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x40, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x40, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x03, 0x07, 0x01, 0x01, 0x07, 0x01, 0x01, 0x07, 0x01, 0x01,
+			0xff, 0x52, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x00, 0x01,
+			0xff, 0x5c, 0x00, 0x04, 0x40, 0x40,
+			0xff, 0xd9,
+		}},
+	}
+	images[0].decodeParams.Set("K", MakeInteger(-1))
+	images[0].decodeParams.Set("Columns", MakeInteger(8192))
+	images[0].decodeParams.Set("Rows", MakeInteger(8192))
+
+	page = initTestPage(NewPdfPage(), newTestFont(), 1)
+	for i, image := range images {
+		stream, err := MakeStream(image.data, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		stream.Set("Subtype", MakeName("Image"))
+		stream.Set("Filter", MakeName(image.filter))
+		if image.decodeParams != nil {
+			stream.Set("DecodeParms", image.decodeParams)
+		}
+		page.Resources.SetXObjectByName(PdfObjectName(fmt.Sprintf("Im%d", i)), stream)
+	}
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data = writePdf(t, &w)
+
+	reader, err = NewPdfReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Limits: ParserLimits{MaxStreamSize: 1 << 20}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i, image := range images {
+		stream, _ := page.Resources.GetXObjectByName(PdfObjectName(fmt.Sprintf("Im%d", i)))
+		if stream == nil {
+			t.Fatalf("%s: image missing", image.filter)
+		}
+		_, err = DecodeStream(stream)
+		if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != "MaxStreamSize" {
+			t.Fatalf("%s: stream size limit not detected (%v)", image.filter, err)
+		}
+	}
+}
+
+// Test the repairs reported in lenient mode and the failure in strict mode.
+func TestReaderStrict(t *testing.T) {
+	data := makeTestPageTree(4)
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if diags := reader.GetDiagnostics(); len(diags) != 0 {
+		t.Fatalf("Unexpected diagnostics: %v", diags)
+	}
+
+	// Startxref pointing outside of the file.
+	i := bytes.LastIndex(data, []byte("startxref\n")) + len("startxref\n")
+	data = append(data[:i:i], []byte("99999\n%%EOF\n")...)
+
+	reader, err = NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if numPages, err := reader.GetNumPages(); err != nil || numPages != 4 {
+		t.Fatalf("Invalid number of pages %d (%v)", numPages, err)
+	}
+	diags := reader.GetDiagnostics()
+	if len(diags) != 1 || diags[0].Offset <= 0 {
+		t.Fatalf("Invalid diagnostics: %v", diags)
+	}
+
+	_, err = NewPdfReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Strict: true})
+	if _, ok := err.(*SyntaxError); !ok {
+		t.Fatalf("Invalid startxref not detected (%v)", err)
+	}
+
+	// Content stream of the first page (object 7) with a length going past the next object.
+	content := "BT /F1 12 Tf 10 10 Td (Page 1) Tj ET"
+	data = bytes.Replace(makeTestPageTree(4), []byte(fmt.Sprintf("<< /Length %d >>", len(content))),
+		[]byte("<< /Length 99 >>"), 1)
+	checkContent := func(reader *PdfReader) error {
+		page, err := reader.GetPage(1)
+		if err != nil {
+			return err
+		}
+		cstream, err := page.GetAllContentStreams()
+		if err == nil && !strings.Contains(cstream, content) {
+			t.Fatalf("Content mismatch %q", cstream)
+		}
+		return err
+	}
+
+	reader, err = NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := checkContent(reader); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	diags = reader.GetDiagnostics()
+	if len(diags) != 1 || diags[0].Offset <= 0 || diags[0].ObjectNumber != 7 {
+		t.Fatalf("Invalid diagnostics: %v", diags)
+	}
+
+	reader, err = NewPdfReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Strict: true})
+	if err == nil {
+		err = checkContent(reader)
+	}
+	if syntaxErr, ok := err.(*SyntaxError); !ok || syntaxErr.Key != "Length" || syntaxErr.Offset <= 0 {
+		t.Fatalf("Invalid stream length not detected (%v)", err)
+	}
+}
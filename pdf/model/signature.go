@@ -0,0 +1,497 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/internal/pkcs7"
+)
+
+// Signature formats (SubFilter values of signature dictionaries).
+const (
+	// PKCS #7 detached signature (ISO 32000-1).
+	SubFilterPKCS7Detached = "adbe.pkcs7.detached"
+	// CAdES detached signature (PAdES, ETSI EN 319 142-1).
+	SubFilterCAdESDetached = "ETSI.CAdES.detached"
+	// RFC 3161 document timestamp (PAdES, ETSI EN 319 142-1).
+	SubFilterRFC3161 = "ETSI.RFC3161"
+)
+
+// Default number of bytes reserved for the signature contents.
+const defaultSignatureSize = 8192
+
+// PdfSignature represents a signature dictionary (section 12.8.1), or a document timestamp
+// dictionary of type DocTimeStamp.
+type PdfSignature struct {
+	Type        *PdfObjectName
+	Filter      *PdfObjectName
+	SubFilter   *PdfObjectName
+	Contents    PdfObject
+	Cert        PdfObject
+	ByteRange   PdfObject
+	Reference   PdfObject
+	Changes     PdfObject
+	Name        *PdfObjectString
+	M           *PdfObjectString
+	Location    *PdfObjectString
+	Reason      *PdfObjectString
+	ContactInfo *PdfObjectString
+
+	container *PdfIndirectObject
+}
+
+func NewPdfSignature() *PdfSignature {
+	sig := &PdfSignature{}
+	sig.container = MakeIndirectObject(MakeDict())
+	return sig
+}
+
+func (this *PdfSignature) GetContainingPdfObject() PdfObject {
+	return this.container
+}
+
+func (this *PdfSignature) ToPdfObject() PdfObject {
+	d := this.container.PdfObject.(*PdfObjectDictionary)
+
+	if this.Type != nil {
+		d.Set("Type", this.Type)
+	} else {
+		d.Set("Type", MakeName("Sig"))
+	}
+	d.SetIfNotNil("Filter", this.Filter)
+	d.SetIfNotNil("SubFilter", this.SubFilter)
+	// The byte range directly follows the contents, see pdfSigning.sign.
+	if this.Contents != nil {
+		d.Set("Contents", this.Contents)
+	}
+	if this.ByteRange != nil {
+		d.Set("ByteRange", this.ByteRange)
+	}
+	d.SetIfNotNil("Cert", this.Cert)
+	d.SetIfNotNil("Reference", this.Reference)
+	d.SetIfNotNil("Changes", this.Changes)
+	d.SetIfNotNil("Name", this.Name)
+	d.SetIfNotNil("M", this.M)
+	d.SetIfNotNil("Location", this.Location)
+	d.SetIfNotNil("Reason", this.Reason)
+	d.SetIfNotNil("ContactInfo", this.ContactInfo)
+
+	return this.container
+}
+
+// SignOptions are the options of a digital signature.
+type SignOptions struct {
+	// Signature format, SubFilterPKCS7Detached (default) or SubFilterCAdESDetached.
+	// Document timestamps have the format SubFilterRFC3161.
+	SubFilter string
+
+	// Digest algorithm: crypto.SHA256 (default), crypto.SHA384, crypto.SHA512 or crypto.SHA1.
+	Hash crypto.Hash
+
+	// Signing time (default: current time).
+	SigningTime time.Time
+
+	// Optional information about the signing.
+	Name        string
+	Reason      string
+	Location    string
+	ContactInfo string
+
+	// Name of the signature field (default: "SignatureN").
+	FieldName string
+
+	// Page of the (invisible) widget annotation of the signature field (default: 1).
+	PageNum int
+
+	// Number of bytes reserved for the signature (default: 8192).  The signature, including the
+	// certificate chain and the timestamp token, must fit in the reserved space.
+	Size int
+
+	// Time stamping authority of the signature timestamp, added to the signature if not nil.
+	// Document timestamps are obtained from this authority.
+	Timestamp TimestampClient
+}
+
+// pdfSigning is a signature to create when the document is written.
+type pdfSigning struct {
+	signer crypto.Signer
+	certs  []*x509.Certificate
+	opts   SignOptions
+	sig    *PdfSignature
+
+	// Marker at the start of the reserved signature contents, to locate them in the output.
+	marker []byte
+}
+
+// signaturePlaceholder reserves the space of the signature contents in the output.
+type signaturePlaceholder struct {
+	marker []byte
+	size   int
+}
+
+func (this *signaturePlaceholder) String() string {
+	return "Signature placeholder"
+}
+
+func (this *signaturePlaceholder) DefaultWriteString() string {
+	contents := make([]byte, 2*this.size)
+	for i := range contents {
+		contents[i] = '0'
+	}
+	hex.Encode(contents, this.marker)
+	return "<" + string(contents) + ">"
+}
+
+// byteRangePlaceholder reserves the space of the byte range in the output.
+type byteRangePlaceholder struct{}
+
+func (this *byteRangePlaceholder) String() string {
+	return "Byte range placeholder"
+}
+
+func (this *byteRangePlaceholder) DefaultWriteString() string {
+	return formatByteRange(0, 0, 0)
+}
+
+// formatByteRange returns the fixed width byte range array of a signature with contents from
+// offset `start` to `end` in a file of length `length`.
+func formatByteRange(start, end, length int64) string {
+	return fmt.Sprintf("[0 %10d %10d %10d]", start, end, length-end)
+}
+
+// newPdfSigning prepares a signature with `signer` and the certificate chain `certs`, starting
+// with the signer certificate.  Returns the signature and the signature field, with a widget
+// annotation on page `opts.PageNum`.
+// Document timestamps (format SubFilterRFC3161) have no signer, the timestamp token is obtained
+// from the time stamping authority opts.Timestamp.
+func newPdfSigning(signer crypto.Signer, certs []*x509.Certificate, opts *SignOptions) (*pdfSigning, *PdfField, error) {
+	signing := &pdfSigning{signer: signer, certs: certs}
+	if opts != nil {
+		signing.opts = *opts
+	}
+	o := &signing.opts
+	switch o.SubFilter {
+	case "":
+		o.SubFilter = SubFilterPKCS7Detached
+	case SubFilterPKCS7Detached, SubFilterCAdESDetached, SubFilterRFC3161:
+	default:
+		return nil, nil, fmt.Errorf("Unsupported signature format (%s)", o.SubFilter)
+	}
+	if o.SubFilter == SubFilterRFC3161 {
+		if o.Timestamp == nil {
+			return nil, nil, errors.New("Missing time stamping authority")
+		}
+	} else if signer == nil || len(certs) == 0 {
+		return nil, nil, errors.New("Missing signer or certificate")
+	}
+	if o.Hash == 0 {
+		o.Hash = crypto.SHA256
+	}
+	if !o.Hash.Available() {
+		return nil, nil, fmt.Errorf("Unsupported digest algorithm (%v)", o.Hash)
+	}
+	if o.SigningTime.IsZero() {
+		o.SigningTime = time.Now()
+	}
+	if o.PageNum == 0 {
+		o.PageNum = 1
+	}
+	if o.Size == 0 {
+		o.Size = defaultSignatureSize
+	}
+
+	signing.marker = make([]byte, 16)
+	if _, err := rand.Read(signing.marker); err != nil {
+		return nil, nil, err
+	}
+
+	sig := NewPdfSignature()
+	sig.Filter = MakeName("Adobe.PPKLite")
+	sig.SubFilter = MakeName(o.SubFilter)
+	sig.Contents = &signaturePlaceholder{marker: signing.marker, size: o.Size}
+	sig.ByteRange = &byteRangePlaceholder{}
+	if o.SubFilter == SubFilterRFC3161 {
+		// The time is given by the timestamp token.
+		sig.Type = MakeName("DocTimeStamp")
+	} else {
+		date := NewPdfDateFromTime(o.SigningTime)
+		sig.M = date.ToPdfObject().(*PdfObjectString)
+	}
+	if o.Name != "" {
+		sig.Name = MakeString(o.Name)
+	}
+	if o.Reason != "" {
+		sig.Reason = MakeString(o.Reason)
+	}
+	if o.Location != "" {
+		sig.Location = MakeString(o.Location)
+	}
+	if o.ContactInfo != "" {
+		sig.ContactInfo = MakeString(o.ContactInfo)
+	}
+	sig.ToPdfObject()
+	signing.sig = sig
+
+	// Signature field with an invisible widget annotation.
+	field := NewPdfField()
+	field.FT = MakeName("Sig")
+	field.V = sig.GetContainingPdfObject()
+	widget := NewPdfAnnotationWidget()
+	widget.Rect = MakeArrayFromFloats([]float64{0, 0, 0, 0})
+	widget.F = MakeInteger(132) // Print and Locked.
+	widget.Parent = field.GetContainingPdfObject()
+	field.KidsA = append(field.KidsA, widget.PdfAnnotation)
+
+	return signing, field, nil
+}
+
+// setFieldName sets the name of the signature `field`, the `n`-th field of the form if not
+// specified in the options.
+func (this *pdfSigning) setFieldName(field *PdfField, n int) {
+	name := this.opts.FieldName
+	if name == "" {
+		name = fmt.Sprintf("Signature%d", n)
+	}
+	field.T = MakeString(name)
+}
+
+// sign computes the signature of the document `data` as written, and fills in the byte range and
+// the signature contents in place.
+func (this *pdfSigning) sign(data []byte) error {
+	marker := []byte("<" + hex.EncodeToString(this.marker))
+	start := bytes.Index(data, marker)
+	if start < 0 {
+		return errors.New("Signature dictionary not found in output")
+	}
+	end := start + 2*this.opts.Size + 2
+
+	// The byte range follows the contents.
+	prefix := []byte("/ByteRange ")
+	if !bytes.HasPrefix(data[end:], prefix) {
+		return errors.New("Signature byte range not found in output")
+	}
+	byteRange := formatByteRange(int64(start), int64(end), int64(len(data)))
+	copy(data[end+len(prefix):], byteRange)
+
+	h := this.opts.Hash.New()
+	h.Write(data[:start])
+	h.Write(data[end:])
+
+	contents, err := this.signDigest(h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	if len(contents) > this.opts.Size {
+		common.Log.Debug("ERROR: Signature size %d exceeds the reserved size %d", len(contents), this.opts.Size)
+		return errors.New("Signature too large")
+	}
+	hex.Encode(data[start+1:], contents)
+	return nil
+}
+
+// signDigest returns the signature contents for the signed data with the digest `digest`: a
+// signed-data content info, or a timestamp token for document timestamps.
+func (this *pdfSigning) signDigest(digest []byte) ([]byte, error) {
+	tsa := this.opts.Timestamp
+	if this.opts.SubFilter == SubFilterRFC3161 {
+		return tsa.Timestamp(digest, this.opts.Hash)
+	}
+
+	opts := &pkcs7.SignOptions{Hash: this.opts.Hash}
+	if this.opts.SubFilter == SubFilterCAdESDetached {
+		// The signing time is given by M only.
+		opts.SigningCertificateV2 = true
+	} else {
+		opts.SigningTime = this.opts.SigningTime
+	}
+	if tsa != nil {
+		// The signature timestamp is the timestamp of the signature value.
+		opts.Timestamp = func(signature []byte) ([]byte, error) {
+			h := this.opts.Hash.New()
+			h.Write(signature)
+			return tsa.Timestamp(h.Sum(nil), this.opts.Hash)
+		}
+	}
+	return pkcs7.SignDetached(digest, this.signer, this.certs, opts)
+}
+
+// Sign digitally signs the document when it is written, with `signer` and the certificate chain
+// `certs`, starting with the signer certificate.  A signature field is added to the form of the
+// document, with an invisible widget annotation on the page given by the options.
+// The document is written in memory to compute the signature.
+func (this *PdfWriter) Sign(signer crypto.Signer, certs []*x509.Certificate, opts *SignOptions) error {
+	signing, field, err := newPdfSigning(signer, certs, opts)
+	if err != nil {
+		return err
+	}
+	return this.addSignature(signing, field)
+}
+
+// Timestamp adds a document timestamp, obtained from the time stamping authority `tsa` when the
+// document is written.  The timestamp is added as a signature field like signatures, with the
+// options `opts`, of which the signer related options are ignored.
+func (this *PdfWriter) Timestamp(tsa TimestampClient, opts *SignOptions) error {
+	signing, field, err := newPdfTimestamping(tsa, opts)
+	if err != nil {
+		return err
+	}
+	return this.addSignature(signing, field)
+}
+
+// newPdfTimestamping prepares a document timestamp, see newPdfSigning.
+func newPdfTimestamping(tsa TimestampClient, opts *SignOptions) (*pdfSigning, *PdfField, error) {
+	o := SignOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.SubFilter = SubFilterRFC3161
+	o.Timestamp = tsa
+	return newPdfSigning(nil, nil, &o)
+}
+
+// addSignature adds the signature field `field` to the document, to be signed by `signing`.
+func (this *PdfWriter) addSignature(signing *pdfSigning, field *PdfField) error {
+	if this.signing != nil {
+		return errors.New("Document already signed")
+	}
+	pagesDict := this.pages.PdfObject.(*PdfObjectDictionary)
+	kids := pagesDict.Get("Kids").(*PdfObjectArray)
+	if signing.opts.PageNum < 1 || signing.opts.PageNum > len(*kids) {
+		return errors.New("Invalid page number")
+	}
+	page := (*kids)[signing.opts.PageNum-1].(*PdfIndirectObject)
+	widget := field.KidsA[0]
+	widget.P = page
+	widgetObj := widget.GetContext().ToPdfObject()
+	pageDict := page.PdfObject.(*PdfObjectDictionary)
+	switch annots := pageDict.Get("Annots").(type) {
+	case nil:
+		pageDict.Set("Annots", MakeArray(widgetObj))
+	case *PdfObjectArray:
+		*annots = append(*annots, widgetObj)
+	case *PdfIndirectObject:
+		arr, ok := annots.PdfObject.(*PdfObjectArray)
+		if !ok {
+			return errors.New("Invalid page Annots (not an array)")
+		}
+		*arr = append(*arr, widgetObj)
+	default:
+		return errors.New("Invalid page Annots (not an array)")
+	}
+
+	if this.acroForm == nil {
+		this.acroForm = NewPdfAcroForm()
+	}
+	if this.acroForm.Fields == nil {
+		this.acroForm.Fields = &[]*PdfField{}
+	}
+	signing.setFieldName(field, len(*this.acroForm.Fields)+1)
+	*this.acroForm.Fields = append(*this.acroForm.Fields, field)
+	// Signatures exist, the document should be saved by incremental updates (12.7.2).
+	this.acroForm.SigFlags = MakeInteger(3)
+
+	this.signing = signing
+	return nil
+}
+
+// Sign digitally signs the document in the incremental update, with `signer` and the
+// certificate chain `certs`, starting with the signer certificate.  A signature field is added to
+// the form of the document, with an invisible widget annotation on the page given by the options.
+// Existing signatures remain valid.  The update is written in memory to compute the signature.
+func (this *PdfAppender) Sign(signer crypto.Signer, certs []*x509.Certificate, opts *SignOptions) error {
+	signing, field, err := newPdfSigning(signer, certs, opts)
+	if err != nil {
+		return err
+	}
+	return this.addSignature(signing, field)
+}
+
+// Timestamp adds a document timestamp in the incremental update, obtained from the time stamping
+// authority `tsa` when the update is written.  The timestamp is added as a signature field like
+// signatures, with the options `opts`, of which the signer related options are ignored.
+// A document timestamp added after the validation data (see AddValidationData) protects the
+// validation data and the previous signatures for long-term validation.
+func (this *PdfAppender) Timestamp(tsa TimestampClient, opts *SignOptions) error {
+	signing, field, err := newPdfTimestamping(tsa, opts)
+	if err != nil {
+		return err
+	}
+	return this.addSignature(signing, field)
+}
+
+// addSignature adds the signature field `field` to the document, to be signed by `signing`.
+func (this *PdfAppender) addSignature(signing *pdfSigning, field *PdfField) error {
+	if this.signing != nil {
+		return errors.New("Update already signed")
+	}
+	page, err := this.reader.GetPage(signing.opts.PageNum)
+	if err != nil {
+		return err
+	}
+	widget := field.KidsA[0]
+	widget.P = page.GetPageAsIndirectObject()
+	page.Annotations = append(page.Annotations, widget)
+	this.UpdatePage(page)
+
+	// Only the form dictionary and the new field are written, leaving the other fields as is.
+	catalogDict, ok := this.catalog.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return errors.New("Invalid catalog")
+	}
+	var formDict *PdfObjectDictionary
+	if obj := catalogDict.Get("AcroForm"); obj != nil {
+		obj, err := this.reader.traceToObject(obj)
+		if err != nil {
+			return err
+		}
+		if formObj, isIndirect := obj.(*PdfIndirectObject); isIndirect {
+			this.UpdateObject(formObj)
+		} else {
+			this.UpdateObject(this.catalog)
+		}
+		formDict, _ = TraceToDirectObject(obj).(*PdfObjectDictionary)
+	}
+	if formDict == nil {
+		formObj := MakeIndirectObject(MakeDict())
+		catalogDict.Set("AcroForm", formObj)
+		this.UpdateObject(this.catalog)
+		this.UpdateObject(formObj)
+		formDict = formObj.PdfObject.(*PdfObjectDictionary)
+	}
+
+	var fields *PdfObjectArray
+	if obj := formDict.Get("Fields"); obj != nil {
+		obj, err := this.reader.traceToObject(obj)
+		if err != nil {
+			return err
+		}
+		if fieldsObj, isIndirect := obj.(*PdfIndirectObject); isIndirect {
+			this.UpdateObject(fieldsObj)
+		}
+		fields, _ = TraceToDirectObject(obj).(*PdfObjectArray)
+	}
+	if fields == nil {
+		fields = &PdfObjectArray{}
+		formDict.Set("Fields", fields)
+	}
+	signing.setFieldName(field, len(*fields)+1)
+	*fields = append(*fields, field.ToPdfObject())
+	// Signatures exist, the document should be saved by incremental updates (12.7.2).
+	formDict.Set("SigFlags", MakeInteger(3))
+
+	this.signing = signing
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"regexp"
+	"strconv"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/internal/pkcs7"
+	"github.com/unidoc/unidoc/pdf/internal/testutil"
+)
+
+var reByteRange = regexp.MustCompile(`/ByteRange \[0 +(\d+) +(\d+) +(\d+)\]`)
+
+// checkTestSignatures checks the byte ranges and the digests of the signatures in `data`, and
+// returns the signature contents in order.  Signature `i` covers the first `revisions[i]` bytes.
+func checkTestSignatures(t *testing.T, data []byte, cert *x509.Certificate, revisions []int) [][]byte {
+	matches := reByteRange.FindAllSubmatch(data, -1)
+	if len(matches) != len(revisions) {
+		t.Fatalf("Incorrect number of signatures %d", len(matches))
+	}
+	signatures := [][]byte{}
+	for i, m := range matches {
+		start, _ := strconv.Atoi(string(m[1]))
+		end, _ := strconv.Atoi(string(m[2]))
+		length, _ := strconv.Atoi(string(m[3]))
+		if end+length != revisions[i] {
+			t.Fatalf("Signature %d: incorrect byte range %s", i+1, m[0])
+		}
+		if data[start] != '<' || data[end-1] != '>' {
+			t.Fatalf("Signature %d: byte range not excluding the contents", i+1)
+		}
+		contents, err := hex.DecodeString(string(data[start+1 : end-1]))
+		if err != nil {
+			t.Fatalf("Signature %d: %v", i+1, err)
+		}
+
+		h := sha256.New()
+		h.Write(data[:start])
+		h.Write(data[end:revisions[i]])
+		if !bytes.Contains(contents, h.Sum(nil)) || !bytes.Contains(contents, cert.Raw) {
+			t.Fatalf("Signature %d: digest or certificate missing", i+1)
+		}
+		signatures = append(signatures, contents)
+	}
+	return signatures
+}
+
+// checkTestSignatureFields checks that the form of `reader` has `n` signature fields.
+func checkTestSignatureFields(t *testing.T, reader *PdfReader, n int) {
+	if reader.AcroForm == nil || reader.AcroForm.Fields == nil || len(*reader.AcroForm.Fields) != n {
+		t.Fatalf("Incorrect number of form fields")
+	}
+	for _, field := range *reader.AcroForm.Fields {
+		// The widget annotation is loaded as a kid field.
+		if field.FT == nil || *field.FT != "Sig" || len(field.KidsF)+len(field.KidsA) != 1 {
+			t.Fatalf("Invalid signature field %+v", field)
+		}
+	}
+	if flags := reader.AcroForm.SigFlags; flags == nil || *flags != 3 {
+		t.Fatalf("Incorrect SigFlags %v", reader.AcroForm.SigFlags)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(page.Annotations) != n {
+		t.Fatalf("Incorrect number of annotations %d", len(page.Annotations))
+	}
+}
+
+// Test signing new documents, with and without object streams and encryption.
+func TestWriterSign(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Signer", 1)
+
+	for _, objectStreams := range []bool{false, true} {
+		for _, encrypt := range []bool{false, true} {
+			w := newTestWriter(t)
+			w.SetObjectStreams(objectStreams)
+			if encrypt {
+				err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Algorithm: AES_128bit})
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+			}
+			opts := &SignOptions{Reason: "Approval", SubFilter: SubFilterCAdESDetached}
+			if err := w.Sign(key, []*x509.Certificate{cert}, opts); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			data := writePdf(t, w)
+			checkTestSignatures(t, data, cert, []int{len(data)})
+
+			reader, err := NewPdfReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if encrypt {
+				if auth, err := reader.Decrypt([]byte("user")); err != nil || !auth {
+					t.Fatalf("Failed to authenticate (%v)", err)
+				}
+				// Reload the form, with the decrypted strings.
+				reader.AcroForm, _ = reader.loadForms()
+			}
+			checkTestContent(t, reader)
+			checkTestSignatureFields(t, reader, 1)
+		}
+	}
+}
+
+// Test signing existing documents, keeping the previous signatures valid.
+func TestAppenderSign(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Signer", 1)
+
+	data := writePdf(t, newTestWriter(t))
+	revisions := []int{}
+	for i := 1; i <= 2; i++ {
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		appender, err := NewPdfAppender(reader)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := appender.Sign(key, []*x509.Certificate{cert}, nil); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := appender.Write(&buf); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), data) {
+			t.Fatalf("Original file not preserved")
+		}
+		data = buf.Bytes()
+		revisions = append(revisions, len(data))
+		checkTestSignatures(t, data, cert, revisions)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkTestContent(t, reader)
+	checkTestSignatureFields(t, reader, 2)
+	names := []string{}
+	for _, field := range *reader.AcroForm.Fields {
+		names = append(names, string(*field.T.(*PdfObjectString)))
+	}
+	if names[0] != "Signature1" || names[1] != "Signature2" {
+		t.Fatalf("Incorrect field names %v", names)
+	}
+}
+
+// Test that signatures larger than the reserved space are rejected.
+func TestSignTooLarge(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Signer", 1)
+	w := newTestWriter(t)
+	if err := w.Sign(key, []*x509.Certificate{cert}, &SignOptions{Size: 100}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := w.Write(&buf); err == nil {
+		t.Fatalf("Signature written in too small space")
+	}
+}
+
+// verifyTestSignatures verifies the signatures of the document `data`, expecting `n` signatures.
+func verifyTestSignatures(t *testing.T, data []byte, n int) []*PdfSignatureVerification {
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	results, err := reader.VerifySignatures()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(results) != n {
+		t.Fatalf("Incorrect number of signatures %d", len(results))
+	}
+	return results
+}
+
+// Test verification of signatures, with incremental updates after signing.
+func TestVerifySignatures(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Signer", 1)
+
+	w := newTestWriter(t)
+	if err := w.Sign(key, []*x509.Certificate{cert}, &SignOptions{Reason: "Approval"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writePdf(t, w)
+	results := verifyTestSignatures(t, data, 1)
+	result := results[0]
+	if !result.Valid || result.Error != nil {
+		t.Fatalf("Invalid signature (%v)", result.Error)
+	}
+	if result.FieldName != "Signature1" || !result.CoversWholeDocument || result.Revision != 0 ||
+		len(result.LaterRevisions) != 0 {
+		t.Fatalf("Incorrect verification %+v", result)
+	}
+	if len(result.Certificates) != 1 || !result.Certificates[0].Equal(cert) || result.SigningTime.IsZero() {
+		t.Fatalf("Incorrect signer %+v", result)
+	}
+
+	// Tampering with the signed content.
+	i := bytes.Index(data, []byte("Approval"))
+	tampered := append([]byte{}, data...)
+	tampered[i] = 'a'
+	result = verifyTestSignatures(t, tampered, 1)[0]
+	if result.Valid || result.Error != pkcs7.ErrDigestMismatch {
+		t.Fatalf("Tampered document not detected (%v)", result.Error)
+	}
+
+	// Second signature in an incremental update.
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appender, err := NewPdfAppender(reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := appender.Sign(key, []*x509.Certificate{cert}, &SignOptions{SubFilter: SubFilterCAdESDetached}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := appender.Write(&buf); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	results = verifyTestSignatures(t, buf.Bytes(), 2)
+	for _, result := range results {
+		if !result.Valid || result.Error != nil {
+			t.Fatalf("Invalid signature %s (%v)", result.FieldName, result.Error)
+		}
+	}
+	first, second := results[0], results[1]
+	if first.CoversWholeDocument || first.Revision != 0 || len(first.LaterRevisions) != 1 {
+		t.Fatalf("Incorrect verification %+v", first)
+	}
+	if !second.CoversWholeDocument || second.Revision != 1 || len(second.LaterRevisions) != 0 {
+		t.Fatalf("Incorrect verification %+v", second)
+	}
+	types := map[string]bool{}
+	for _, change := range first.LaterRevisions[0].Changes {
+		types[change.Type] = change.Added
+	}
+	if added, ok := types["Field/Sig"]; !ok || !added {
+		t.Fatalf("Signature field not reported in changes %+v", first.LaterRevisions[0].Changes)
+	}
+	if added, ok := types["Sig"]; !ok || !added {
+		t.Fatalf("Signature not reported in changes %+v", first.LaterRevisions[0].Changes)
+	}
+	if added, ok := types["Page"]; !ok || added {
+		t.Fatalf("Page not reported in changes %+v", first.LaterRevisions[0].Changes)
+	}
+}
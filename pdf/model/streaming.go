@@ -0,0 +1,318 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// writerStream is the state of a writer writing the pages as they are added.  The objects are
+// numbered when written, or when referred to before being added for writing (pages and parents),
+// and their content is released once written.
+type writerStream struct {
+	cw      *countingWriter
+	nextNum int64
+	nums    map[PdfObject]int64 // Numbers of the objects numbered so far.
+	written map[PdfObject]bool
+	pages   map[PdfObject]bool          // Pages added to the writer.
+	pending map[*PdfIndirectObject]bool // Pages created with NewPage, not added yet.
+	entries []xrefEntry
+
+	// Set when writing the document-level objects, which can refer to any page.
+	finishing bool
+}
+
+// StartStreaming starts writing the document to `w`, with each page written as soon as it is
+// added with AddPage rather than when writing the whole document.  The memory used for writing
+// documents with many pages is bounded, as the content of the written pages and of the objects
+// they use is released.  FinishStreaming completes the document.
+//
+// The options of the writer (version, encryption, object streams) must be set prior to starting.
+// Linearized and signed output are not supported when streaming.  The pages and the objects they
+// use must not be modified once added; objects shared by several pages such as fonts are written
+// once, with the first page using them.  The pages referred to before being added, such as the
+// destinations of links to the following pages, must be created with NewPage.
+func (this *PdfWriter) StartStreaming(w io.Writer) error {
+	if this.stream != nil {
+		return errors.New("Writer already streaming")
+	}
+	if this.linearize {
+		return errors.New("Linearized output not supported when streaming")
+	}
+	if this.signing != nil {
+		return errors.New("Signing not supported when streaming")
+	}
+	if this.useObjectStreams {
+		this.requireVersion(1, 5)
+	}
+
+	stream := &writerStream{
+		cw:      &countingWriter{w: w},
+		nextNum: 1,
+		nums:    map[PdfObject]int64{},
+		written: map[PdfObject]bool{},
+		pages:   map[PdfObject]bool{},
+		pending: map[*PdfIndirectObject]bool{},
+	}
+	// The objects added so far, including the pages, are written when finishing.
+	for _, obj := range this.objects {
+		stream.number(obj)
+	}
+	if pagesDict, ok := this.pages.PdfObject.(*PdfObjectDictionary); ok {
+		if kids, ok := pagesDict.Get("Kids").(*PdfObjectArray); ok {
+			for _, kid := range *kids {
+				stream.pages[kid] = true
+			}
+		}
+	}
+	this.stream = stream
+	this.writer = bufio.NewWriter(stream.cw)
+
+	this.writeHeader()
+	return this.writer.Flush()
+}
+
+// FinishStreaming completes the document started with StartStreaming, writing the document-level
+// objects (catalog, page tree, outlines, forms) and the cross-reference section.
+func (this *PdfWriter) FinishStreaming() error {
+	stream := this.stream
+	if stream == nil {
+		return errors.New("Writer not streaming")
+	}
+	if err := this.prepareWrite(); err != nil {
+		return err
+	}
+
+	stream.finishing = true
+	objects := []PdfObject{}
+	added := map[PdfObject]bool{}
+	for _, obj := range this.objects {
+		if err := stream.collect(obj, &objects, added); err != nil {
+			return err
+		}
+	}
+
+	// The objects referred to but never added for writing, such as parents, are null objects, as
+	// the references have been written already.
+	missing := []int64{}
+	for obj, num := range stream.nums {
+		if !stream.written[obj] && !added[obj] {
+			missing = append(missing, num)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	for _, num := range missing {
+		common.Log.Debug("ERROR: Object %d never added for writing, replaced with null", num)
+		nullObj := &PdfIndirectObject{PdfObject: MakeNull()}
+		nullObj.ObjectNumber = num
+		stream.nums[nullObj] = num
+		objects = append(objects, nullObj)
+	}
+
+	if err := this.writeStreamObjects(objects); err != nil {
+		return err
+	}
+
+	// Cross-reference entries, starting with the head of the free list.
+	entries := append([]xrefEntry{{objNum: 0, typ: 0, gen: 65535}}, stream.entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].objNum < entries[j].objNum })
+
+	this.stream = nil
+	return this.writeXref(entries, this.makeTrailer(stream.nextNum), stream.offset(this.writer))
+}
+
+// NewPage returns a new page to be added with AddPage.  When streaming, the page can be referred to
+// before being added, and is written once added.
+func (this *PdfWriter) NewPage() *PdfPage {
+	page := NewPdfPage()
+	if this.stream != nil {
+		this.stream.pending[page.GetPageAsIndirectObject()] = true
+	}
+	return page
+}
+
+// writePage writes the page `pageObj` added when streaming, with the objects it uses which are not
+// written yet, and releases them.
+func (this *PdfWriter) writePage(pageObj *PdfIndirectObject) error {
+	stream := this.stream
+	if stream.written[pageObj] {
+		common.Log.Debug("ERROR: Page written before being added, not created with NewPage")
+		return errors.New("Page already written")
+	}
+	delete(stream.pending, pageObj)
+	stream.pages[pageObj] = true
+	objects := []PdfObject{}
+	if err := stream.collect(pageObj, &objects, map[PdfObject]bool{}); err != nil {
+		return err
+	}
+	if err := this.writeStreamObjects(objects); err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		releaseObject(obj)
+	}
+	return nil
+}
+
+// writeStreamObjects writes the numbered `objects` when streaming, compressed and packed into
+// object streams if enabled, and flushes the output.
+func (this *PdfWriter) writeStreamObjects(objects []PdfObject) error {
+	stream := this.stream
+	if err := this.compressStreams(objects); err != nil {
+		return err
+	}
+	toWrite := objects
+	var packed map[PdfObject]packedObject
+	if this.useObjectStreams {
+		objstms, entries, err := this.makeObjectStreams(objects, stream.nextNum)
+		if err != nil {
+			return err
+		}
+		toWrite = make([]PdfObject, 0, len(objects)+len(objstms))
+		toWrite = append(toWrite, objects...)
+		for _, so := range objstms {
+			// Numbered consecutively as by makeObjectStreams.
+			stream.number(so)
+			toWrite = append(toWrite, so)
+		}
+		for obj, p := range entries {
+			stream.entries = append(stream.entries, xrefEntry{objNum: stream.nums[obj], typ: 2, offset: p.streamNum, gen: p.index})
+			stream.written[obj] = true
+		}
+		packed = entries
+	}
+
+	for _, obj := range toWrite {
+		if _, isPacked := packed[obj]; isPacked {
+			continue
+		}
+		num := stream.nums[obj]
+		// Encrypt prior to writing.
+		// Encrypt dictionary should not be encrypted.
+		if this.crypter != nil && obj != this.encryptObj {
+			err := this.crypter.Encrypt(obj, num, 0)
+			if err != nil {
+				common.Log.Debug("ERROR: Failed encrypting (%s)", err)
+				return err
+			}
+		}
+		stream.entries = append(stream.entries, xrefEntry{objNum: num, typ: 1, offset: stream.offset(this.writer)})
+		this.writeObject(int(num), obj)
+		stream.written[obj] = true
+	}
+	return this.writer.Flush()
+}
+
+// offset returns the current offset in the output, with the data buffered in `w`.
+func (stream *writerStream) offset(w *bufio.Writer) int64 {
+	return stream.cw.n + int64(w.Buffered())
+}
+
+// number returns the object number of `obj`, numbering it if not numbered yet.
+func (stream *writerStream) number(obj PdfObject) int64 {
+	if num, has := stream.nums[obj]; has {
+		return num
+	}
+	num := stream.nextNum
+	stream.nextNum++
+	stream.nums[obj] = num
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		t.ObjectNumber = num
+		t.GenerationNumber = 0
+	case *PdfObjectStream:
+		t.ObjectNumber = num
+		t.GenerationNumber = 0
+	}
+	return num
+}
+
+// collect appends the objects used by `obj` which are not written yet to `objects`, and numbers
+// them.  The pages not added yet and the parents are only numbered, to be written once added, or
+// replaced by null objects when finishing.
+// `added` tracks the objects already collected.
+func (stream *writerStream) collect(obj PdfObject, objects *[]PdfObject, added map[PdfObject]bool) error {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		if stream.written[t] || added[t] {
+			return nil
+		}
+		if !stream.finishing && !stream.pages[t] && (stream.pending[t] || isPageObject(t)) {
+			// Referred to (e.g. by a link) prior to being added.
+			stream.number(t)
+			return nil
+		}
+		added[t] = true
+		stream.number(t)
+		*objects = append(*objects, t)
+		return stream.collect(t.PdfObject, objects, added)
+	case *PdfObjectStream:
+		if stream.written[t] || added[t] {
+			return nil
+		}
+		added[t] = true
+		stream.number(t)
+		*objects = append(*objects, t)
+		return stream.collect(t.PdfObjectDictionary, objects, added)
+	case *PdfObjectDictionary:
+		for _, key := range t.Keys() {
+			val := t.Get(key)
+			if key == "Parent" {
+				// Parents, such as the page tree nodes and the form fields, are written when added.
+				switch val.(type) {
+				case *PdfIndirectObject, *PdfObjectStream:
+					stream.number(val)
+				}
+				continue
+			}
+			if err := stream.collect(val, objects, added); err != nil {
+				return err
+			}
+		}
+	case *PdfObjectArray:
+		if t == nil {
+			return errors.New("Array is nil")
+		}
+		for _, val := range *t {
+			if err := stream.collect(val, objects, added); err != nil {
+				return err
+			}
+		}
+	case *PdfObjectReference:
+		// Should never be a reference, should already be resolved.
+		common.Log.Debug("ERROR: Cannot be a reference!")
+		return errors.New("Reference not allowed")
+	}
+	return nil
+}
+
+// isPageObject returns true if `obj` is a page object, to be written once added.
+func isPageObject(obj *PdfIndirectObject) bool {
+	dict, ok := obj.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return false
+	}
+	name, ok := dict.Get("Type").(*PdfObjectName)
+	return ok && *name == "Page"
+}
+
+// releaseObject releases the content of the written object `obj`, keeping its number for the
+// references to it.
+func releaseObject(obj PdfObject) {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		t.PdfObject = MakeNull()
+	case *PdfObjectStream:
+		t.PdfObjectDictionary = MakeDict()
+		t.Stream = nil
+	}
+}
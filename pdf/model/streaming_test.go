@@ -0,0 +1,203 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// writerOnly hides the other methods of the underlying writer, such as Seek.
+type writerOnly struct {
+	buf bytes.Buffer
+}
+
+func (w *writerOnly) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// streamTestPages writes `numPages` pages sharing a font with `w` while streaming, each page
+// linking to the next one.  Returns the output.
+func streamTestPages(t *testing.T, w *PdfWriter, numPages int) []byte {
+	font := newTestFont()
+	out := &writerOnly{}
+	if err := w.StartStreaming(out); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	next := w.NewPage()
+	for i := 1; i <= numPages; i++ {
+		page := initTestPage(next, font, i)
+		if i < numPages {
+			next = w.NewPage()
+			link := NewPdfAnnotationLink()
+			link.Rect = MakeArray(MakeInteger(0), MakeInteger(0), MakeInteger(10), MakeInteger(10))
+			link.Dest = MakeArray(next.GetPageAsIndirectObject(), MakeName("Fit"))
+			page.Annotations = []*PdfAnnotation{link.PdfAnnotation}
+		}
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		// Released once written.
+		if _, isNull := page.GetPageAsIndirectObject().PdfObject.(*PdfObjectNull); !isNull {
+			t.Fatalf("Page %d not released", i)
+		}
+	}
+	if err := w.FinishStreaming(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return out.buf.Bytes()
+}
+
+// checkStreamTestPages checks the pages written by streamTestPages.
+func checkStreamTestPages(t *testing.T, reader *PdfReader, numPages int) {
+	n, err := reader.GetNumPages()
+	if err != nil || n != numPages {
+		t.Fatalf("Incorrect number of pages %d (%v)", n, err)
+	}
+	for i := 1; i <= numPages; i++ {
+		page, err := reader.GetPage(i)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		cstream, err := page.GetAllContentStreams()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !strings.HasPrefix(cstream, fmt.Sprintf("BT /F1 18 Tf 10 10 Td (Page %d) Tj ET", i)) {
+			t.Fatalf("Content mismatch %q", cstream)
+		}
+		if i == numPages {
+			continue
+		}
+		// The link points to the next page.
+		if len(page.Annotations) != 1 {
+			t.Fatalf("Missing link on page %d", i)
+		}
+		link, ok := page.Annotations[0].GetContext().(*PdfAnnotationLink)
+		if !ok {
+			t.Fatalf("Not a link (%T)", page.Annotations[0].GetContext())
+		}
+		dest, ok := TraceToDirectObject(link.Dest).(*PdfObjectArray)
+		if !ok || len(*dest) != 2 {
+			t.Fatalf("Invalid link destination %v", link.Dest)
+		}
+		nextPage, err := reader.GetPage(i + 1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if (*dest)[0] != nextPage.GetPageAsIndirectObject() {
+			t.Fatalf("Link to the wrong page on page %d", i)
+		}
+	}
+}
+
+// Test writing to a writer which cannot seek.
+func TestWriteNonSeekable(t *testing.T) {
+	for _, setup := range []func(w *PdfWriter){
+		func(w *PdfWriter) {},
+		func(w *PdfWriter) { w.SetObjectStreams(true) },
+		func(w *PdfWriter) { w.SetLinearized(true) },
+	} {
+		w := newTestWriter(t)
+		setup(w)
+		out := &writerOnly{}
+		if err := w.Write(out); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		reader, err := NewPdfReader(bytes.NewReader(out.buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if diags := reader.GetDiagnostics(); len(diags) != 0 {
+			t.Fatalf("Invalid output: %v", diags)
+		}
+		checkTestContent(t, reader)
+	}
+}
+
+// Test writing the pages as they are added.
+func TestWriterStreaming(t *testing.T) {
+	numPages := 5
+	for _, setup := range []func(w *PdfWriter){
+		func(w *PdfWriter) {},
+		func(w *PdfWriter) { w.SetObjectStreams(true) },
+		func(w *PdfWriter) { w.SetCompression(&CompressOptions{Workers: 2}) },
+	} {
+		w := NewPdfWriter()
+		setup(&w)
+		data := streamTestPages(t, &w, numPages)
+		if !w.useObjectStreams && bytes.Count(data, []byte("/BaseFont /Courier")) != 1 {
+			t.Fatalf("Shared font not written once")
+		}
+
+		reader, err := NewPdfReaderWithOptions(bytes.NewReader(data), &ReaderOptions{Strict: true})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		checkStreamTestPages(t, reader, numPages)
+	}
+
+	// Encrypted.
+	w := NewPdfWriter()
+	if err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Algorithm: AES_128bit}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := streamTestPages(t, &w, numPages)
+	if bytes.Contains(data, []byte("Page 1")) {
+		t.Fatalf("Content not encrypted")
+	}
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	auth, err := reader.Decrypt([]byte("user"))
+	if err != nil || !auth {
+		t.Fatalf("Failed to authenticate (%v)", err)
+	}
+	checkStreamTestPages(t, reader, numPages)
+
+	w = NewPdfWriter()
+	w.SetLinearized(true)
+	if err := w.StartStreaming(&writerOnly{}); err == nil {
+		t.Fatalf("Linearized streaming not rejected")
+	}
+}
+
+// Test streaming a page using an empty indirect object, written with the page.
+func TestWriterStreamingEmptyObject(t *testing.T) {
+	w := NewPdfWriter()
+	out := &writerOnly{}
+	if err := w.StartStreaming(out); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page := initTestPage(w.NewPage(), newTestFont(), 1)
+	if err := page.Resources.AddExtGState("GS1", MakeIndirectObject(MakeDict())); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.FinishStreaming(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReaderWithOptions(bytes.NewReader(out.buf.Bytes()), &ReaderOptions{Strict: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	readPage, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gs, has := readPage.Resources.GetExtGState("GS1")
+	if _, isDict := TraceToDirectObject(gs).(*PdfObjectDictionary); !has || !isDict {
+		t.Fatalf("ExtGState not written (%v)", gs)
+	}
+}
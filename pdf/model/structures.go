@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"time"
 
 	. "github.com/unidoc/unidoc/pdf/core"
 )
@@ -124,6 +125,38 @@ func NewPdfDate(dateStr string) (PdfDate, error) {
 	return d, nil
 }
 
+// Make a new PdfDate object from a time.
+func NewPdfDateFromTime(t time.Time) PdfDate {
+	d := PdfDate{
+		year:   int64(t.Year()),
+		month:  int64(t.Month()),
+		day:    int64(t.Day()),
+		hour:   int64(t.Hour()),
+		minute: int64(t.Minute()),
+		second: int64(t.Second()),
+	}
+	_, offset := t.Zone()
+	d.utOffsetSign = '+'
+	if offset < 0 {
+		d.utOffsetSign = '-'
+		offset = -offset
+	}
+	d.utOffsetHours = int64(offset / 3600)
+	d.utOffsetMins = int64(offset % 3600 / 60)
+	return d
+}
+
+// ToGoTime returns the date as a time.
+func (date *PdfDate) ToGoTime() time.Time {
+	offset := int(date.utOffsetHours*3600 + date.utOffsetMins*60)
+	if date.utOffsetSign == '-' {
+		offset = -offset
+	}
+	loc := time.FixedZone("", offset)
+	return time.Date(int(date.year), time.Month(date.month), int(date.day), int(date.hour),
+		int(date.minute), int(date.second), 0, loc)
+}
+
 // Convert to a PDF string object.
 func (date *PdfDate) ToPdfObject() PdfObject {
 	str := fmt.Sprintf("D:%.4d%.2d%.2d%.2d%.2d%.2d%c%.2d'%.2d'",
@@ -0,0 +1,93 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+
+	"github.com/unidoc/unidoc/pdf/internal/pkcs7"
+)
+
+// Maximum size of timestamp responses.
+const maxTimestampResponseSize = 1 << 20
+
+// TimestampClient obtains RFC 3161 timestamp tokens from a time stamping authority (TSA), for
+// signature timestamps and document timestamps.
+type TimestampClient interface {
+	// Timestamp returns the DER encoded timestamp token of the data with the digest `digest`,
+	// computed with the digest algorithm `hash`.
+	Timestamp(digest []byte, hash crypto.Hash) ([]byte, error)
+}
+
+// HTTPTimestampClient is a TimestampClient using the HTTP transport of RFC 3161 (section 3.4).
+type HTTPTimestampClient struct {
+	// URL of the time stamping authority.
+	URL string
+
+	// HTTP client used for the requests (default: http.DefaultClient).  Authentication with the
+	// time stamping authority, if needed, can be done by the transport of the client.
+	Client *http.Client
+}
+
+// NewHTTPTimestampClient returns a client of the time stamping authority at `url`.
+func NewHTTPTimestampClient(url string) *HTTPTimestampClient {
+	return &HTTPTimestampClient{URL: url}
+}
+
+// Timestamp requests the timestamp token of the data with the digest `digest` from the time
+// stamping authority.  The token is checked to match the request.
+func (this *HTTPTimestampClient) Timestamp(digest []byte, hash crypto.Hash) ([]byte, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req := &pkcs7.TimestampRequest{Hash: hash, Digest: digest, Nonce: nonce, CertReq: true}
+	reqData, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	client := this.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(this.URL, "application/timestamp-query", bytes.NewReader(reqData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Timestamp request failed (%s)", resp.Status)
+	}
+	respData, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTimestampResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := pkcs7.ParseTimestampResponse(respData)
+	if err != nil {
+		return nil, err
+	}
+	tt, err := pkcs7.ParseTimestampToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if tt.Info.Hash != hash || !bytes.Equal(tt.Info.Digest, digest) {
+		return nil, errors.New("Timestamp token not matching the request")
+	}
+	if tt.Info.Nonce == nil || tt.Info.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("Timestamp token nonce not matching the request")
+	}
+	return token, nil
+}
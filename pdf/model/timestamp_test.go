@@ -0,0 +1,251 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/unidoc/unidoc/pdf/internal/pkcs7"
+	"github.com/unidoc/unidoc/pdf/internal/testutil"
+)
+
+// testTSA is an in-process time stamping authority.
+type testTSA struct {
+	cert   *x509.Certificate
+	key    *rsa.PrivateKey
+	serial int64
+	time   time.Time
+}
+
+func newTestTSA(t *testing.T) *testTSA {
+	cert, key := testutil.MakeCertificate(t, "TSA", 100)
+	return &testTSA{cert: cert, key: key, time: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+func (this *testTSA) sign(digest []byte, hash crypto.Hash, nonce *big.Int) ([]byte, error) {
+	this.serial++
+	info := &pkcs7.TimestampInfo{
+		Policy:       asn1.ObjectIdentifier{1, 2, 3, 4},
+		SerialNumber: big.NewInt(this.serial),
+		Time:         this.time,
+		Hash:         hash,
+		Digest:       digest,
+		Nonce:        nonce,
+	}
+	return pkcs7.SignTimestamp(info, this.key, []*x509.Certificate{this.cert})
+}
+
+func (this *testTSA) Timestamp(digest []byte, hash crypto.Hash) ([]byte, error) {
+	return this.sign(digest, hash, nil)
+}
+
+// ServeHTTP implements the HTTP transport of RFC 3161.
+func (this *testTSA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/timestamp-query" {
+		http.Error(w, "Invalid content type", http.StatusBadRequest)
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	req, err := pkcs7.ParseTimestampRequest(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := this.sign(req.Digest, req.Hash, req.Nonce)
+	if err == nil {
+		data, err = pkcs7.MarshalTimestampResponse(token)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(data)
+}
+
+// writeTestUpdate writes the incremental update of `appender` and returns the updated document.
+func writeTestUpdate(t *testing.T, appender *PdfAppender) []byte {
+	var buf bytes.Buffer
+	if err := appender.Write(&buf); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Test signatures with a signature timestamp, and document timestamps.
+func TestTimestamps(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Signer", 1)
+	tsa := newTestTSA(t)
+
+	w := newTestWriter(t)
+	if err := w.Sign(key, []*x509.Certificate{cert}, &SignOptions{Timestamp: tsa}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writePdf(t, w)
+	result := verifyTestSignatures(t, data, 1)[0]
+	if !result.Valid {
+		t.Fatalf("Invalid signature (%v)", result.Error)
+	}
+	ts := result.Timestamp
+	if ts == nil || !ts.Time.Equal(tsa.time) || len(ts.Certificates) != 1 || !ts.Certificates[0].Equal(tsa.cert) {
+		t.Fatalf("Incorrect signature timestamp %+v", ts)
+	}
+
+	// Document timestamp.
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appender, err := NewPdfAppender(reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := appender.Timestamp(tsa, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data = writeTestUpdate(t, appender)
+	results := verifyTestSignatures(t, data, 2)
+	if !results[0].Valid || len(results[0].LaterRevisions) != 1 {
+		t.Fatalf("Incorrect signature verification %+v", results[0])
+	}
+	result = results[1]
+	if !result.Valid {
+		t.Fatalf("Invalid document timestamp (%v)", result.Error)
+	}
+	if result.Signature.Type == nil || *result.Signature.Type != "DocTimeStamp" || !result.CoversWholeDocument {
+		t.Fatalf("Incorrect document timestamp %+v", result)
+	}
+	if result.Timestamp == nil || !result.SigningTime.Equal(tsa.time) || !result.Certificates[0].Equal(tsa.cert) {
+		t.Fatalf("Incorrect document timestamp %+v", result)
+	}
+
+	// Tampering with the timestamped content.
+	tampered := append([]byte{}, data...)
+	tampered[len(data)-10] ^= 1
+	results = verifyTestSignatures(t, tampered, 2)
+	if results[1].Valid || results[1].Error != pkcs7.ErrDigestMismatch {
+		t.Fatalf("Tampered document not detected (%v)", results[1].Error)
+	}
+}
+
+func TestHTTPTimestampClient(t *testing.T) {
+	tsa := newTestTSA(t)
+	server := httptest.NewServer(tsa)
+	defer server.Close()
+
+	client := NewHTTPTimestampClient(server.URL)
+	digest := bytes.Repeat([]byte{1}, 32)
+	token, err := client.Timestamp(digest, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	tt, err := pkcs7.ParseTimestampToken(token)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := tt.Verify(digest); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	client = NewHTTPTimestampClient(server.URL + "/invalid")
+	server.Config.Handler = http.NotFoundHandler()
+	if _, err := client.Timestamp(digest, crypto.SHA256); err == nil {
+		t.Fatalf("Failed request not detected")
+	}
+}
+
+// Test adding validation data to the document security store.
+func TestValidationData(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Signer", 1)
+	root, _ := testutil.MakeCertificate(t, "Root", 2)
+	tsa := newTestTSA(t)
+
+	w := newTestWriter(t)
+	if err := w.Sign(key, []*x509.Certificate{cert}, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writePdf(t, w)
+
+	ocsp := []byte("OCSP response")
+	crl := []byte("CRL")
+	for i := 0; i < 2; i++ {
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		results, err := reader.VerifySignatures()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		appender, err := NewPdfAppender(reader)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		vd := &PdfValidationData{Certificates: []*x509.Certificate{cert, root}, OCSPs: [][]byte{ocsp}}
+		if err := appender.AddValidationData(results[0].Signature, vd); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		vd = &PdfValidationData{Certificates: []*x509.Certificate{tsa.cert}, CRLs: [][]byte{crl}}
+		if err := appender.AddValidationData(nil, vd); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := appender.Timestamp(tsa, nil); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data = writeTestUpdate(t, appender)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	results, err := reader.VerifySignatures()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Incorrect number of signatures %d", len(results))
+	}
+	for _, result := range results {
+		if !result.Valid {
+			t.Fatalf("Invalid signature %s (%v)", result.FieldName, result.Error)
+		}
+	}
+
+	// The values added twice are not duplicated.
+	vd, err := reader.GetValidationData(nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if vd == nil || len(vd.Certificates) != 3 || len(vd.OCSPs) != 1 || len(vd.CRLs) != 1 {
+		t.Fatalf("Incorrect validation data %+v", vd)
+	}
+	if !vd.Certificates[0].Equal(cert) || !vd.Certificates[2].Equal(tsa.cert) ||
+		!bytes.Equal(vd.OCSPs[0], ocsp) || !bytes.Equal(vd.CRLs[0], crl) {
+		t.Fatalf("Incorrect validation data %+v", vd)
+	}
+	vd, err = reader.GetValidationData(results[0].Signature)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if vd == nil || len(vd.Certificates) != 2 || !vd.Certificates[1].Equal(root) || len(vd.OCSPs) != 1 || len(vd.CRLs) != 0 {
+		t.Fatalf("Incorrect signature validation data %+v", vd)
+	}
+	vd, err = reader.GetValidationData(results[1].Signature)
+	if err != nil || vd != nil {
+		t.Fatalf("Unexpected validation data of the document timestamp %+v (%v)", vd, err)
+	}
+}
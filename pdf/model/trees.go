@@ -0,0 +1,364 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Maximum number of entries of the leaf nodes and of kids of the intermediate nodes of the trees
+// written.
+const treeNodeSize = 64
+
+// Maximum depth of the trees read, beyond which the tree is considered invalid.
+const maxTreeDepth = 64
+
+// PdfNameTree represents a name tree (Section 7.9.6), mapping strings to objects such as the named
+// destinations or the embedded files.  The keys are compared as bytes.
+type PdfNameTree struct {
+	keys   []string // Sorted.
+	values []PdfObject
+}
+
+// PdfNumberTree represents a number tree (Section 7.9.7), mapping integers to objects such as the
+// page labels or the structural parents.
+type PdfNumberTree struct {
+	keys   []int64 // Sorted.
+	values []PdfObject
+}
+
+// NewPdfNameTree returns a new empty name tree.
+func NewPdfNameTree() *PdfNameTree {
+	return &PdfNameTree{}
+}
+
+// NewPdfNumberTree returns a new empty number tree.
+func NewPdfNumberTree() *PdfNumberTree {
+	return &PdfNumberTree{}
+}
+
+// Len returns the number of entries of the tree.
+func (this *PdfNameTree) Len() int {
+	return len(this.keys)
+}
+
+// Keys returns the keys of the tree in order.
+func (this *PdfNameTree) Keys() []string {
+	return append([]string{}, this.keys...)
+}
+
+// Get returns the value of `key`, and false if not in the tree.
+func (this *PdfNameTree) Get(key string) (PdfObject, bool) {
+	i := sort.SearchStrings(this.keys, key)
+	if i < len(this.keys) && this.keys[i] == key {
+		return this.values[i], true
+	}
+	return nil, false
+}
+
+// Set sets the value of `key` to `val`.
+func (this *PdfNameTree) Set(key string, val PdfObject) {
+	i := sort.SearchStrings(this.keys, key)
+	if i < len(this.keys) && this.keys[i] == key {
+		this.values[i] = val
+		return
+	}
+	this.keys = append(this.keys, "")
+	copy(this.keys[i+1:], this.keys[i:])
+	this.keys[i] = key
+	this.values = append(this.values, nil)
+	copy(this.values[i+1:], this.values[i:])
+	this.values[i] = val
+}
+
+// Remove removes `key` from the tree, if present.
+func (this *PdfNameTree) Remove(key string) {
+	i := sort.SearchStrings(this.keys, key)
+	if i < len(this.keys) && this.keys[i] == key {
+		this.keys = append(this.keys[:i], this.keys[i+1:]...)
+		this.values = append(this.values[:i], this.values[i+1:]...)
+	}
+}
+
+// ToPdfObject returns the root node of the tree, balanced with the other nodes as indirect objects.
+func (this *PdfNameTree) ToPdfObject() PdfObject {
+	return buildTree(len(this.keys), "Names",
+		func(i int) PdfObject { return MakeString(this.keys[i]) },
+		func(i int) PdfObject { return this.values[i] })
+}
+
+// Len returns the number of entries of the tree.
+func (this *PdfNumberTree) Len() int {
+	return len(this.keys)
+}
+
+// Keys returns the keys of the tree in order.
+func (this *PdfNumberTree) Keys() []int64 {
+	return append([]int64{}, this.keys...)
+}
+
+// search returns the index of `key`, or where to insert it.
+func (this *PdfNumberTree) search(key int64) int {
+	return sort.Search(len(this.keys), func(i int) bool { return this.keys[i] >= key })
+}
+
+// Get returns the value of `key`, and false if not in the tree.
+func (this *PdfNumberTree) Get(key int64) (PdfObject, bool) {
+	i := this.search(key)
+	if i < len(this.keys) && this.keys[i] == key {
+		return this.values[i], true
+	}
+	return nil, false
+}
+
+// Set sets the value of `key` to `val`.
+func (this *PdfNumberTree) Set(key int64, val PdfObject) {
+	i := this.search(key)
+	if i < len(this.keys) && this.keys[i] == key {
+		this.values[i] = val
+		return
+	}
+	this.keys = append(this.keys, 0)
+	copy(this.keys[i+1:], this.keys[i:])
+	this.keys[i] = key
+	this.values = append(this.values, nil)
+	copy(this.values[i+1:], this.values[i:])
+	this.values[i] = val
+}
+
+// Remove removes `key` from the tree, if present.
+func (this *PdfNumberTree) Remove(key int64) {
+	i := this.search(key)
+	if i < len(this.keys) && this.keys[i] == key {
+		this.keys = append(this.keys[:i], this.keys[i+1:]...)
+		this.values = append(this.values[:i], this.values[i+1:]...)
+	}
+}
+
+// ToPdfObject returns the root node of the tree, balanced with the other nodes as indirect objects.
+func (this *PdfNumberTree) ToPdfObject() PdfObject {
+	return buildTree(len(this.keys), "Nums",
+		func(i int) PdfObject { return MakeInteger(this.keys[i]) },
+		func(i int) PdfObject { return this.values[i] })
+}
+
+// buildTree returns the root node of a balanced tree with `n` sorted entries, the leaves holding
+// the `key` and `value` of the entries in the array `leafKey` (Names or Nums).  The root holds the
+// entries directly if few enough.
+func buildTree(n int, leafKey PdfObjectName, key func(i int) PdfObject, value func(i int) PdfObject) PdfObject {
+	// Nodes of the current level, with the range of entries below each one.
+	type treeNode struct {
+		obj        *PdfIndirectObject
+		start, end int
+	}
+	makeLeaf := func(start, end int) *PdfObjectDictionary {
+		arr := PdfObjectArray{}
+		for i := start; i < end; i++ {
+			arr = append(arr, key(i), value(i))
+		}
+		dict := MakeDict()
+		dict.Set(leafKey, &arr)
+		return dict
+	}
+	limits := func(start, end int) PdfObject {
+		return MakeArray(key(start), key(end-1))
+	}
+
+	if n <= treeNodeSize {
+		return makeLeaf(0, n)
+	}
+
+	nodes := []treeNode{}
+	for start := 0; start < n; start += treeNodeSize {
+		end := start + treeNodeSize
+		if end > n {
+			end = n
+		}
+		leaf := makeLeaf(start, end)
+		leaf.Set("Limits", limits(start, end))
+		nodes = append(nodes, treeNode{obj: MakeIndirectObject(leaf), start: start, end: end})
+	}
+	for {
+		if len(nodes) <= treeNodeSize {
+			kids := PdfObjectArray{}
+			for _, node := range nodes {
+				kids = append(kids, node.obj)
+			}
+			root := MakeDict()
+			root.Set("Kids", &kids)
+			return root
+		}
+		parents := []treeNode{}
+		for start := 0; start < len(nodes); start += treeNodeSize {
+			end := start + treeNodeSize
+			if end > len(nodes) {
+				end = len(nodes)
+			}
+			kids := PdfObjectArray{}
+			for _, node := range nodes[start:end] {
+				kids = append(kids, node.obj)
+			}
+			dict := MakeDict()
+			dict.Set("Kids", &kids)
+			first, last := nodes[start].start, nodes[end-1].end
+			dict.Set("Limits", limits(first, last))
+			parents = append(parents, treeNode{obj: MakeIndirectObject(dict), start: first, end: last})
+		}
+		nodes = parents
+	}
+}
+
+// loadTree traverses the tree with root `root`, calling `add` for each entry of the leaves holding
+// the entries in the array `leafKey`.  The nodes and the values are resolved with `resolve`.
+// Invalid entries are skipped, circular and too deep trees are rejected.
+func loadTree(root PdfObject, leafKey PdfObjectName, resolve func(PdfObject) (PdfObject, error),
+	add func(key PdfObject, val PdfObject)) error {
+	visited := map[PdfObject]bool{}
+
+	var loadNode func(obj PdfObject, depth int) error
+	loadNode = func(obj PdfObject, depth int) error {
+		if depth > maxTreeDepth {
+			common.Log.Debug("ERROR: Tree too deep")
+			return errors.New("Tree too deep")
+		}
+		obj, err := resolve(obj)
+		if err != nil {
+			return err
+		}
+		if visited[obj] {
+			common.Log.Debug("ERROR: Circular tree")
+			return errors.New("Circular tree")
+		}
+		visited[obj] = true
+		dict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+		if !ok {
+			common.Log.Debug("ERROR: Tree node not a dictionary (%T)", obj)
+			return ErrTypeError
+		}
+
+		if kidsObj := dict.Get("Kids"); kidsObj != nil {
+			kidsObj, err := resolve(kidsObj)
+			if err != nil {
+				return err
+			}
+			kids, ok := TraceToDirectObject(kidsObj).(*PdfObjectArray)
+			if !ok {
+				common.Log.Debug("ERROR: Tree Kids not an array (%T)", kidsObj)
+				return ErrTypeError
+			}
+			for _, kid := range *kids {
+				if err := loadNode(kid, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+
+		entriesObj := dict.Get(leafKey)
+		if entriesObj == nil {
+			return nil
+		}
+		entriesObj, err = resolve(entriesObj)
+		if err != nil {
+			return err
+		}
+		entries, ok := TraceToDirectObject(entriesObj).(*PdfObjectArray)
+		if !ok {
+			common.Log.Debug("ERROR: Tree %s not an array (%T)", leafKey, entriesObj)
+			return ErrTypeError
+		}
+		if len(*entries)%2 != 0 {
+			common.Log.Debug("ERROR: Odd number of elements in tree %s, last one skipped", leafKey)
+		}
+		for i := 0; i+1 < len(*entries); i += 2 {
+			val, err := resolve((*entries)[i+1])
+			if err != nil {
+				common.Log.Debug("ERROR: Failed to resolve tree %s value (%s), skipped", leafKey, err)
+				continue
+			}
+			add(TraceToDirectObject((*entries)[i]), val)
+		}
+		return nil
+	}
+
+	return loadNode(root, 0)
+}
+
+// newPdfNameTreeFromPdfObject loads the name tree with root `root`, resolving the references with
+// `resolve`.  The first value is kept for duplicate keys.
+func newPdfNameTreeFromPdfObject(root PdfObject, resolve func(PdfObject) (PdfObject, error)) (*PdfNameTree, error) {
+	tree := NewPdfNameTree()
+	err := loadTree(root, "Names", resolve, func(key PdfObject, val PdfObject) {
+		str, ok := key.(*PdfObjectString)
+		if !ok {
+			common.Log.Debug("ERROR: Invalid name tree key (%T), skipped", key)
+			return
+		}
+		tree.keys = append(tree.keys, string(*str))
+		tree.values = append(tree.values, val)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := NewPdfNameTree()
+	for _, i := range sortTreeEntries(len(tree.keys),
+		func(i, j int) bool { return tree.keys[i] < tree.keys[j] },
+		func(i int) interface{} { return tree.keys[i] }) {
+		sorted.keys = append(sorted.keys, tree.keys[i])
+		sorted.values = append(sorted.values, tree.values[i])
+	}
+	return sorted, nil
+}
+
+// newPdfNumberTreeFromPdfObject loads the number tree with root `root`, resolving the references
+// with `resolve`.  The first value is kept for duplicate keys.
+func newPdfNumberTreeFromPdfObject(root PdfObject, resolve func(PdfObject) (PdfObject, error)) (*PdfNumberTree, error) {
+	tree := NewPdfNumberTree()
+	err := loadTree(root, "Nums", resolve, func(key PdfObject, val PdfObject) {
+		num, ok := key.(*PdfObjectInteger)
+		if !ok {
+			common.Log.Debug("ERROR: Invalid number tree key (%T), skipped", key)
+			return
+		}
+		tree.keys = append(tree.keys, int64(*num))
+		tree.values = append(tree.values, val)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := NewPdfNumberTree()
+	for _, i := range sortTreeEntries(len(tree.keys),
+		func(i, j int) bool { return tree.keys[i] < tree.keys[j] },
+		func(i int) interface{} { return tree.keys[i] }) {
+		sorted.keys = append(sorted.keys, tree.keys[i])
+		sorted.values = append(sorted.values, tree.values[i])
+	}
+	return sorted, nil
+}
+
+// sortTreeEntries returns the indices of the `n` entries read from a tree, sorted with `less`.  The
+// entries are sorted in a valid tree.  Only the first entry is kept for duplicate `key`s.
+func sortTreeEntries(n int, less func(i, j int) bool, key func(i int) interface{}) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.SliceStable(indices, func(i, j int) bool { return less(indices[i], indices[j]) })
+	unique := []int{}
+	for _, i := range indices {
+		if k := len(unique); k > 0 && key(unique[k-1]) == key(i) {
+			common.Log.Debug("Duplicate tree key %#v, skipped", key(i))
+			continue
+		}
+		unique = append(unique, i)
+	}
+	return unique
+}
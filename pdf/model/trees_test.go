@@ -0,0 +1,124 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Test writing name and number trees and reading them back.
+func TestWriterTrees(t *testing.T) {
+	numNames := 5000 // Two levels of intermediate nodes.
+	names := NewPdfNameTree()
+	for i := numNames - 1; i >= 0; i-- {
+		names.Set(fmt.Sprintf("name%05d", i), MakeInteger(int64(i)))
+	}
+	names.Set("name00000", MakeString("first"))
+	names.Remove("name00001")
+	if names.Len() != numNames-1 {
+		t.Fatalf("Incorrect number of names %d", names.Len())
+	}
+
+	labels := NewPdfNumberTree()
+	decimal := MakeDict()
+	decimal.Set("S", MakeName("D"))
+	roman := MakeDict()
+	roman.Set("S", MakeName("r"))
+	labels.Set(1, decimal)
+	labels.Set(0, roman)
+
+	w := newTestWriter(t)
+	if err := w.SetNameTree("Dests", names); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.SetPageLabels(labels); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writePdf(t, w)
+	if !bytes.Contains(data, []byte("/Limits [(name00000) (name00064)]")) {
+		t.Fatalf("Limits missing")
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	readNames, err := reader.GetNameTree("Dests")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(readNames.Keys(), names.Keys()) {
+		t.Fatalf("Keys mismatch")
+	}
+	for _, key := range names.Keys() {
+		val, _ := names.Get(key)
+		readVal, has := readNames.Get(key)
+		if !has || readVal.DefaultWriteString() != val.DefaultWriteString() {
+			t.Fatalf("Value mismatch for %s: %v", key, readVal)
+		}
+	}
+	if missing, err := reader.GetNameTree("EmbeddedFiles"); missing != nil || err != nil {
+		t.Fatalf("Unexpected tree (%v)", err)
+	}
+
+	readLabels, err := reader.GetPageLabels()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(readLabels.Keys(), []int64{0, 1}) {
+		t.Fatalf("Keys mismatch %v", readLabels.Keys())
+	}
+	if label, _ := readLabels.Get(0); TraceToDirectObject(label).DefaultWriteString() != roman.DefaultWriteString() {
+		t.Fatalf("Label mismatch %v", label)
+	}
+}
+
+// Test reading invalid trees.
+func TestLoadTrees(t *testing.T) {
+	resolve := func(obj PdfObject) (PdfObject, error) {
+		if _, isRef := obj.(*PdfObjectReference); isRef {
+			return nil, errors.New("Unresolvable reference")
+		}
+		return obj, nil
+	}
+
+	// Unsorted, with duplicates, invalid keys and unresolvable values.
+	leaf := MakeDict()
+	leaf.Set("Nums", MakeArray(MakeInteger(5), MakeName("five"), MakeInteger(2), MakeName("two"),
+		MakeName("bad"), MakeNull(), MakeInteger(3), &PdfObjectReference{ObjectNumber: 99},
+		MakeInteger(5), MakeName("again"), MakeInteger(7)))
+	root := MakeDict()
+	root.Set("Kids", MakeArray(MakeIndirectObject(leaf)))
+	tree, err := newPdfNumberTreeFromPdfObject(root, resolve)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(tree.Keys(), []int64{2, 5}) {
+		t.Fatalf("Keys mismatch %v", tree.Keys())
+	}
+	if val, _ := tree.Get(5); val.DefaultWriteString() != "/five" {
+		t.Fatalf("Value mismatch %v", val)
+	}
+
+	// Circular.
+	node := MakeIndirectObject(MakeDict())
+	kids := MakeArray(node)
+	node.PdfObject.(*PdfObjectDictionary).Set("Kids", kids)
+	if _, err := newPdfNameTreeFromPdfObject(node, resolve); err == nil {
+		t.Fatalf("Circular tree not rejected")
+	}
+
+	// Not a dictionary.
+	if _, err := newPdfNameTreeFromPdfObject(MakeArray(), resolve); err == nil {
+		t.Fatalf("Invalid tree not rejected")
+	}
+}
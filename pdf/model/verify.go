@@ -0,0 +1,532 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/internal/pkcs7"
+)
+
+// PdfSignatureVerification is the result of the verification of a signature of a document.
+type PdfSignatureVerification struct {
+	// Fully qualified name of the signature field.
+	FieldName string
+	Signature *PdfSignature
+
+	// Valid is true if the signed part of the document is unchanged and the signature is valid for
+	// the signer certificate.  The trust of the signer certificate is not verified: check the
+	// certificate chain against trusted roots (see x509.Certificate.Verify).
+	Valid bool
+	// Reason of the verification failure.
+	Error error
+
+	// Certificate chain of the signer, starting with the signer certificate, built from the
+	// certificates included in the signature.
+	Certificates []*x509.Certificate
+
+	// Signing time given by the signer, or the M entry of the signature dictionary.
+	// For document timestamps, the time of the timestamp.
+	SigningTime time.Time
+
+	// Verified signature timestamp, or document timestamp, nil if none.
+	Timestamp *PdfTimestamp
+
+	// The signature covers the whole file, there are no later changes.
+	CoversWholeDocument bool
+	// Index of the signed revision, 0 being the original document and the following revisions
+	// being incremental updates.
+	Revision int
+	// Changes made by the later revisions.
+	LaterRevisions []PdfRevisionChanges
+}
+
+// PdfTimestamp is a verified RFC 3161 timestamp.
+type PdfTimestamp struct {
+	// Time at which the signature, or the document, existed.
+	Time time.Time
+	// Serial number of the timestamp token.
+	SerialNumber *big.Int
+	// Certificate chain of the time stamping authority, built from the certificates included in
+	// the timestamp token.  The trust of the certificates is not verified.
+	Certificates []*x509.Certificate
+}
+
+// newPdfTimestamp returns the timestamp of the verified timestamp token `tt`.
+func newPdfTimestamp(tt *pkcs7.TimestampToken) *PdfTimestamp {
+	return &PdfTimestamp{
+		Time:         tt.Info.Time,
+		SerialNumber: tt.Info.SerialNumber,
+		Certificates: tt.SignedData.Chain(),
+	}
+}
+
+// PdfRevisionChanges are the objects changed by an incremental update of a document.
+type PdfRevisionChanges struct {
+	// Index of the revision.
+	Revision int
+	Changes  []PdfObjectChange
+}
+
+// PdfObjectChange is an object added or modified by an incremental update.
+type PdfObjectChange struct {
+	ObjectNumber int
+	// Type of the object as in the current revision, with the subtype if any, e.g. "Annot/Widget".
+	// Fields have type "Field" and the field type as subtype.
+	Type string
+	// The object is added rather than modified.
+	Added bool
+}
+
+// Used when loading signatures from PDF files.
+func (r *PdfReader) newPdfSignatureFromIndirect(container *PdfIndirectObject) (*PdfSignature, error) {
+	d, isDict := container.PdfObject.(*PdfObjectDictionary)
+	if !isDict {
+		return nil, errors.New("Signature not containing a dictionary")
+	}
+
+	sig := &PdfSignature{container: container}
+	sig.Type, _ = d.Get("Type").(*PdfObjectName)
+	sig.Filter, _ = d.Get("Filter").(*PdfObjectName)
+	sig.SubFilter, _ = d.Get("SubFilter").(*PdfObjectName)
+	sig.Contents = d.Get("Contents")
+	sig.Cert = d.Get("Cert")
+	sig.ByteRange = d.Get("ByteRange")
+	sig.Reference = d.Get("Reference")
+	sig.Changes = d.Get("Changes")
+	sig.Name, _ = d.Get("Name").(*PdfObjectString)
+	sig.M, _ = d.Get("M").(*PdfObjectString)
+	sig.Location, _ = d.Get("Location").(*PdfObjectString)
+	sig.Reason, _ = d.Get("Reason").(*PdfObjectString)
+	sig.ContactInfo, _ = d.Get("ContactInfo").(*PdfObjectString)
+
+	return sig, nil
+}
+
+// signatureField is a signature field with a signature value.
+type signatureField struct {
+	name string
+	sig  *PdfSignature
+}
+
+// collectSignatureFields adds the signed signature fields of `field` and its descendants to
+// `fields`.  The field type is inherited from the parent field type `ft`.
+func (this *PdfReader) collectSignatureFields(field *PdfField, parentName string, ft *PdfObjectName,
+	fields *[]signatureField) error {
+	name := parentName
+	if t, ok := field.T.(*PdfObjectString); ok {
+		if name != "" {
+			name += "."
+		}
+		name += string(*t)
+	}
+	if field.FT != nil {
+		ft = field.FT
+	}
+
+	if ft != nil && *ft == "Sig" && field.V != nil {
+		obj, err := this.traceToObject(field.V)
+		if err != nil {
+			return err
+		}
+		var container *PdfIndirectObject
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			container = t
+		case *PdfObjectDictionary:
+			container = &PdfIndirectObject{PdfObject: t}
+		}
+		if container != nil {
+			sig, err := this.newPdfSignatureFromIndirect(container)
+			if err != nil {
+				return err
+			}
+			*fields = append(*fields, signatureField{name: name, sig: sig})
+		}
+	}
+
+	for _, kid := range field.KidsF {
+		if kidField, isField := kid.(*PdfField); isField {
+			err := this.collectSignatureFields(kidField, name, ft, fields)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pdfRevision is a revision of a document, the original document or an incremental update.
+type pdfRevision struct {
+	end   int64 // Offset of the end of the revision in the file.
+	xrefs XrefTable
+}
+
+// revisionReader reads the first `size` bytes of a file, which hold a previous revision of the
+// document.
+type revisionReader struct {
+	rs   io.ReadSeeker
+	size int64
+	pos  int64
+}
+
+func (this *revisionReader) Read(p []byte) (int, error) {
+	if this.pos >= this.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > this.size-this.pos {
+		p = p[:this.size-this.pos]
+	}
+	if _, err := this.rs.Seek(this.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := this.rs.Read(p)
+	this.pos += int64(n)
+	return n, err
+}
+
+func (this *revisionReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += this.pos
+	case io.SeekEnd:
+		offset += this.size
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	this.pos = offset
+	return offset, nil
+}
+
+// loadRevisions returns the revisions of the document in order.  Each revision ends with an
+// end-of-file marker, the cross-reference table of the revision is loaded from the file up to it.
+func (this *PdfReader) loadRevisions() ([]pdfRevision, error) {
+	if _, err := this.rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(this.rs)
+	marker := []byte("%%EOF")
+	ends := []int64{}
+	var offset int64
+	matched := 0
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset++
+		switch {
+		case b == marker[matched]:
+			matched++
+		case b == '%':
+			matched = 2
+		default:
+			matched = 0
+		}
+		if matched < len(marker) {
+			continue
+		}
+		matched = 0
+		// Including the end-of-line marker.
+		if next, err := r.Peek(2); err == nil && next[0] == '\r' && next[1] == '\n' {
+			r.Discard(2)
+			offset += 2
+		} else if next, err := r.Peek(1); err == nil && (next[0] == '\r' || next[0] == '\n') {
+			r.Discard(1)
+			offset++
+		}
+		ends = append(ends, offset)
+	}
+
+	revisions := []pdfRevision{}
+	for _, end := range ends {
+		// Markers that do not end a revision, e.g. in stream data, fail to load.
+		parser, err := NewParser(&revisionReader{rs: this.rs, size: end})
+		if err != nil {
+			common.Log.Debug("Not a revision ending at %d (%v)", end, err)
+			continue
+		}
+		revisions = append(revisions, pdfRevision{end: end, xrefs: parser.GetXrefTable()})
+	}
+	return revisions, nil
+}
+
+// describeObject returns the type of the object `objNum`, see PdfObjectChange.
+func (this *PdfReader) describeObject(objNum int) string {
+	obj, err := this.parser.LookupByNumber(objNum)
+	if err != nil {
+		return ""
+	}
+	var d *PdfObjectDictionary
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		d, _ = t.PdfObject.(*PdfObjectDictionary)
+	case *PdfObjectStream:
+		d = t.PdfObjectDictionary
+	}
+	if d == nil {
+		return ""
+	}
+
+	typ, _ := d.Get("Type").(*PdfObjectName)
+	subtype, _ := d.Get("Subtype").(*PdfObjectName)
+	if typ == nil {
+		if ft, ok := d.Get("FT").(*PdfObjectName); ok {
+			return "Field/" + string(*ft)
+		}
+		if subtype == nil {
+			return ""
+		}
+		// The type is optional for annotations and XObjects.
+		return string(*subtype)
+	}
+	if subtype != nil {
+		return string(*typ) + "/" + string(*subtype)
+	}
+	return string(*typ)
+}
+
+// revisionChanges returns the objects changed by `revision` with respect to `previous`.
+func (this *PdfReader) revisionChanges(revision, previous pdfRevision) []PdfObjectChange {
+	changes := []PdfObjectChange{}
+	for _, objNum := range sortedObjectNumbers(revision.xrefs) {
+		prev, existed := previous.xrefs[objNum]
+		if existed && prev == revision.xrefs[objNum] {
+			continue
+		}
+		changes = append(changes, PdfObjectChange{
+			ObjectNumber: objNum,
+			Type:         this.describeObject(objNum),
+			Added:        !existed,
+		})
+	}
+	return changes
+}
+
+// sortedObjectNumbers returns the object numbers of `xrefs` in ascending order.
+func sortedObjectNumbers(xrefs XrefTable) []int {
+	objNums := make([]int, 0, len(xrefs))
+	for objNum := range xrefs {
+		objNums = append(objNums, objNum)
+	}
+	sort.Ints(objNums)
+	return objNums
+}
+
+// hashByteRange writes the parts of the file given by the signature byte range `byteRange` to `h`.
+func (this *PdfReader) hashByteRange(h hash.Hash, byteRange []int64) error {
+	for i := 0; i < len(byteRange); i += 2 {
+		if _, err := this.rs.Seek(byteRange[i], io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(h, this.rs, byteRange[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkByteRange checks that the signature byte range `byteRange` covers the file from the start
+// except the signature contents, up to the end of a revision of the file of size `fileSize`.
+func (this *PdfReader) checkByteRange(byteRange []int64, fileSize int64) error {
+	if len(byteRange) != 4 || byteRange[0] != 0 || byteRange[1] < 0 || byteRange[3] < 0 ||
+		byteRange[2] < byteRange[1]+2 || byteRange[2]+byteRange[3] > fileSize {
+		return fmt.Errorf("Invalid byte range %v", byteRange)
+	}
+	// The excluded part is the contents string.
+	delims := make([]byte, 2)
+	for i, offset := range []int64{byteRange[1], byteRange[2] - 1} {
+		if _, err := this.rs.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(this.rs, delims[i:i+1]); err != nil {
+			return err
+		}
+	}
+	if delims[0] != '<' || delims[1] != '>' {
+		return errors.New("Byte range not excluding the signature contents only")
+	}
+	return nil
+}
+
+// verifySignature verifies the signature `sig` of the file.
+func (this *PdfReader) verifySignature(sig *PdfSignature, byteRange []int64, result *PdfSignatureVerification) error {
+	if sig.SubFilter == nil {
+		return errors.New("Missing signature format")
+	}
+	contents, ok := TraceToDirectObject(sig.Contents).(*PdfObjectString)
+	if !ok {
+		return errors.New("Missing signature contents")
+	}
+
+	switch *sig.SubFilter {
+	case SubFilterPKCS7Detached, SubFilterCAdESDetached, "adbe.pkcs7.sha1":
+	case SubFilterRFC3161:
+		return this.verifyDocumentTimestamp([]byte(*contents), byteRange, result)
+	default:
+		return fmt.Errorf("Unsupported signature format (%s)", *sig.SubFilter)
+	}
+	sd, err := pkcs7.ParseSignedData([]byte(*contents))
+	if err != nil {
+		return err
+	}
+	result.Certificates = sd.Chain()
+	if !sd.SigningTime.IsZero() {
+		result.SigningTime = sd.SigningTime
+	}
+
+	if *sig.SubFilter == "adbe.pkcs7.sha1" {
+		// The signed content is the SHA-1 digest of the byte range.
+		h := crypto.SHA1.New()
+		if err := this.hashByteRange(h, byteRange); err != nil {
+			return err
+		}
+		if !bytes.Equal(sd.Content, h.Sum(nil)) {
+			return pkcs7.ErrDigestMismatch
+		}
+		h = sd.Hash.New()
+		h.Write(sd.Content)
+		err = sd.Verify(h.Sum(nil))
+	} else {
+		if sd.Content != nil {
+			return errors.New("Signature not detached")
+		}
+		h := sd.Hash.New()
+		if err := this.hashByteRange(h, byteRange); err != nil {
+			return err
+		}
+		err = sd.Verify(h.Sum(nil))
+	}
+	if err != nil {
+		return err
+	}
+
+	tt, err := sd.VerifyTimestamp()
+	if err != nil {
+		common.Log.Debug("Invalid signature timestamp: %v", err)
+		return err
+	}
+	if tt != nil {
+		result.Timestamp = newPdfTimestamp(tt)
+	}
+	return nil
+}
+
+// verifyDocumentTimestamp verifies the document timestamp token `token` of the file.
+func (this *PdfReader) verifyDocumentTimestamp(token []byte, byteRange []int64, result *PdfSignatureVerification) error {
+	tt, err := pkcs7.ParseTimestampToken(token)
+	if err != nil {
+		return err
+	}
+	result.Certificates = tt.SignedData.Chain()
+	result.SigningTime = tt.Info.Time
+
+	h := tt.Info.Hash.New()
+	if err := this.hashByteRange(h, byteRange); err != nil {
+		return err
+	}
+	if err := tt.Verify(h.Sum(nil)); err != nil {
+		return err
+	}
+	result.Timestamp = newPdfTimestamp(tt)
+	return nil
+}
+
+// VerifySignatures verifies the digital signatures of the signature fields of the document.  For
+// each signature, reports whether it is valid, the signer, and the changes made to the document
+// after signing by later incremental updates.  The document must be decrypted if encrypted.
+func (this *PdfReader) VerifySignatures() ([]*PdfSignatureVerification, error) {
+	if this.parser.GetCrypter() != nil && !this.parser.IsAuthenticated() {
+		return nil, errors.New("File needs to be decrypted first")
+	}
+	if this.AcroForm == nil || this.AcroForm.Fields == nil {
+		return nil, nil
+	}
+
+	fields := []signatureField{}
+	for _, field := range *this.AcroForm.Fields {
+		if err := this.collectSignatureFields(field, "", nil, &fields); err != nil {
+			return nil, err
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	fileSize, err := this.rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	revisions, err := this.loadRevisions()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*PdfSignatureVerification{}
+	for _, field := range fields {
+		sig := field.sig
+		result := &PdfSignatureVerification{FieldName: field.name, Signature: sig}
+		results = append(results, result)
+		if sig.M != nil {
+			if date, err := NewPdfDate(string(*sig.M)); err == nil {
+				result.SigningTime = date.ToGoTime()
+			}
+		}
+
+		byteRange := []int64{}
+		if arr, ok := TraceToDirectObject(sig.ByteRange).(*PdfObjectArray); ok {
+			vals, err := arr.ToIntegerArray()
+			if err != nil {
+				result.Error = err
+				continue
+			}
+			for _, val := range vals {
+				byteRange = append(byteRange, int64(val))
+			}
+		}
+		if err := this.checkByteRange(byteRange, fileSize); err != nil {
+			result.Error = err
+			continue
+		}
+
+		// The signed revision and the later revisions.
+		signedEnd := byteRange[2] + byteRange[3]
+		result.CoversWholeDocument = signedEnd == fileSize
+		for i, revision := range revisions {
+			if revision.end <= signedEnd {
+				result.Revision = i
+			} else if i > 0 {
+				result.LaterRevisions = append(result.LaterRevisions, PdfRevisionChanges{
+					Revision: i,
+					Changes:  this.revisionChanges(revision, revisions[i-1]),
+				})
+			}
+		}
+
+		if err := this.verifySignature(sig, byteRange, result); err != nil {
+			result.Error = err
+			continue
+		}
+		result.Valid = true
+	}
+	return results, nil
+}
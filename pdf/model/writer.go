@@ -10,12 +10,14 @@ package model
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"sort"
 	"time"
 
 	"github.com/unidoc/unidoc/common"
@@ -67,6 +69,18 @@ type PdfWriter struct {
 	majorVersion int
 	minorVersion int
 
+	// Pack objects into object streams and write a cross-reference stream.
+	useObjectStreams bool
+
+	// Write a linearized file.
+	linearize bool
+
+	// Compression of the streams which are not encoded, nil if disabled.
+	compression *CompressOptions
+
+	// XMP metadata of the document, nil if none.
+	xmp *XmpMetadata
+
 	// Objects to be followed up on prior to writing.
 	// These are objects that are added and reference objects that are not included
 	// for writing.
@@ -76,6 +90,15 @@ type PdfWriter struct {
 
 	// Forms.
 	acroForm *PdfAcroForm
+
+	// Digital signature, computed after writing.
+	signing *pdfSigning
+
+	// Checked for cancellation while writing, if set.
+	ctx context.Context
+
+	// Output of the pages written as they are added, when streaming.
+	stream *writerStream
 }
 
 func NewPdfWriter() PdfWriter {
@@ -134,6 +157,61 @@ func (this *PdfWriter) SetVersion(majorVersion, minorVersion int) {
 	this.minorVersion = minorVersion
 }
 
+// SetObjectStreams sets whether objects are packed into compressed object streams, with a
+// cross-reference stream in place of the cross-reference table.  This reduces the file size
+// considerably, but requires PDF 1.5 (the version of the output is raised if needed).
+func (this *PdfWriter) SetObjectStreams(enable bool) {
+	this.useObjectStreams = enable
+}
+
+// SetLinearized sets whether the output is linearized ("Fast Web View"), organized so that the
+// first page can be displayed before the whole file is downloaded, with hint tables for accessing
+// the other pages (Annex F).
+func (this *PdfWriter) SetLinearized(enable bool) {
+	this.linearize = enable
+}
+
+// SetDocumentInfo sets the document information dictionary of the output to `info`.  The producer
+// and the creator are those of unidoc if not set.
+func (this *PdfWriter) SetDocumentInfo(info *PdfDocumentInfo) {
+	withDefaults := *info
+	if withDefaults.Producer == "" {
+		withDefaults.Producer = getPdfProducer()
+	}
+	if withDefaults.Creator == "" {
+		withDefaults.Creator = getPdfCreator()
+	}
+	this.infoObj.PdfObject = withDefaults.ToPdfObject()
+}
+
+// SetXmpMetadata sets the XMP metadata of the document to `m`.  The properties corresponding to
+// entries of the document information dictionary are synchronized with it when writing: those set
+// in `m` replace the entries, and the other entries are added to `m`.
+func (this *PdfWriter) SetXmpMetadata(m *XmpMetadata) {
+	this.xmp = m
+}
+
+// SetNameTree sets the name tree `name` of the Names dictionary of the catalog, such as Dests,
+// EmbeddedFiles, JavaScript or AP, to `tree`.
+func (this *PdfWriter) SetNameTree(name string, tree *PdfNameTree) error {
+	names, ok := this.catalog.Get("Names").(*PdfObjectDictionary)
+	if !ok {
+		names = MakeDict()
+		this.catalog.Set("Names", names)
+	}
+	root := tree.ToPdfObject()
+	names.Set(PdfObjectName(name), root)
+	return this.addObjects(root)
+}
+
+// SetPageLabels sets the page labels (Section 12.4.2) to the number tree `tree`, mapping the page
+// indices to the page label dictionaries.
+func (this *PdfWriter) SetPageLabels(tree *PdfNumberTree) error {
+	root := tree.ToPdfObject()
+	this.catalog.Set("PageLabels", root)
+	return this.addObjects(root)
+}
+
 // Set the optional content properties.
 func (this *PdfWriter) SetOCProperties(ocProperties PdfObject) error {
 	dict := this.catalog
@@ -149,6 +227,9 @@ func (this *PdfWriter) SetOCProperties(ocProperties PdfObject) error {
 }
 
 func (this *PdfWriter) hasObject(obj PdfObject) bool {
+	if this.stream != nil && this.stream.written[obj] {
+		return true
+	}
 	// Check if already added.
 	for _, o := range this.objects {
 		// GH: May perform better to use a hash map to check if added?
@@ -290,32 +371,10 @@ func (this *PdfWriter) AddPage(page *PdfPage) error {
 	}
 
 	// Copy inherited fields if missing.
-	inheritedFields := []PdfObjectName{"Resources", "MediaBox", "CropBox", "Rotate"}
-	parent, hasParent := pDict.Get("Parent").(*PdfIndirectObject)
-	common.Log.Trace("Page Parent: %T (%v)", pDict.Get("Parent"), hasParent)
-	for hasParent {
-		common.Log.Trace("Page Parent: %T", parent)
-		parentDict, ok := parent.PdfObject.(*PdfObjectDictionary)
-		if !ok {
-			return errors.New("Invalid Parent object")
-		}
-		for _, field := range inheritedFields {
-			common.Log.Trace("Field %s", field)
-			if pDict.Get(field) != nil {
-				common.Log.Trace("- page has already")
-				continue
-			}
-
-			if obj := parentDict.Get(field); obj != nil {
-				// Parent has the field.  Inherit, pass to the new page.
-				common.Log.Trace("Inheriting field %s", field)
-				pDict.Set(field, obj)
-			}
-		}
-		parent, hasParent = parentDict.Get("Parent").(*PdfIndirectObject)
-		common.Log.Trace("Next parent: %T", parentDict.Get("Parent"))
+	err := inheritPageFields(pDict)
+	if err != nil {
+		return err
 	}
-
 	common.Log.Trace("Traversal done")
 
 	// Update the dictionary.
@@ -340,12 +399,14 @@ func (this *PdfWriter) AddPage(page *PdfPage) error {
 	// Update the count.
 	*pageCount = *pageCount + 1
 
-	this.addObject(pageObj)
-
+	if this.stream != nil {
+		return this.writePage(pageObj)
+	}
 
+	this.addObject(pageObj)
 
 	// Traverse the page and record all object references.
-	err := this.addObjects(pDict)
+	err = this.addObjects(pDict)
 	if err != nil {
 		return err
 	}
@@ -353,6 +414,38 @@ func (this *PdfWriter) AddPage(page *PdfPage) error {
 	return nil
 }
 
+// inheritPageFields copies the inheritable fields that are missing in the page dictionary `pDict`
+// from its ancestors in the page tree.
+func inheritPageFields(pDict *PdfObjectDictionary) error {
+	inheritedFields := []PdfObjectName{"Resources", "MediaBox", "CropBox", "Rotate"}
+	parent, hasParent := pDict.Get("Parent").(*PdfIndirectObject)
+	common.Log.Trace("Page Parent: %T (%v)", pDict.Get("Parent"), hasParent)
+	for hasParent {
+		common.Log.Trace("Page Parent: %T", parent)
+		parentDict, ok := parent.PdfObject.(*PdfObjectDictionary)
+		if !ok {
+			return errors.New("Invalid Parent object")
+		}
+		for _, field := range inheritedFields {
+			common.Log.Trace("Field %s", field)
+			if pDict.Get(field) != nil {
+				common.Log.Trace("- page has already")
+				continue
+			}
+
+			if obj := parentDict.Get(field); obj != nil {
+				// Parent has the field.  Inherit, pass to the new page.
+				common.Log.Trace("Inheriting field %s", field)
+				pDict.Set(field, obj)
+			}
+		}
+		parent, hasParent = parentDict.Get("Parent").(*PdfIndirectObject)
+		common.Log.Trace("Next parent: %T", parentDict.Get("Parent"))
+	}
+
+	return nil
+}
+
 func procPage(p *PdfPage) {
 	lk := license.GetLicenseKey()
 	if lk != nil && lk.IsLicensed() {
@@ -435,28 +528,32 @@ func (this *PdfWriter) SetForms(form *PdfAcroForm) error {
 // Write out an indirect / stream object.
 func (this *PdfWriter) writeObject(num int, obj PdfObject) {
 	common.Log.Trace("Write obj #%d\n", num)
+	writeIndirectObject(this.writer, int64(num), 0, obj)
+}
 
+// writeIndirectObject writes `obj` to `w` as object number `num` with generation number `gen`.
+func writeIndirectObject(w *bufio.Writer, num, gen int64, obj PdfObject) {
 	if pobj, isIndirect := obj.(*PdfIndirectObject); isIndirect {
-		outStr := fmt.Sprintf("%d 0 obj\n", num)
+		outStr := fmt.Sprintf("%d %d obj\n", num, gen)
 		outStr += pobj.PdfObject.DefaultWriteString()
 		outStr += "\nendobj\n"
-		this.writer.WriteString(outStr)
+		w.WriteString(outStr)
 		return
 	}
 
 	// XXX/TODO: Add a default encoder if Filter not specified?
 	// Still need to make sure is encrypted.
 	if pobj, isStream := obj.(*PdfObjectStream); isStream {
-		outStr := fmt.Sprintf("%d 0 obj\n", num)
+		outStr := fmt.Sprintf("%d %d obj\n", num, gen)
 		outStr += pobj.PdfObjectDictionary.DefaultWriteString()
 		outStr += "\nstream\n"
-		this.writer.WriteString(outStr)
-		this.writer.Write(pobj.Stream)
-		this.writer.WriteString("\nendstream\nendobj\n")
+		w.WriteString(outStr)
+		w.Write(pobj.Stream)
+		w.WriteString("\nendstream\nendobj\n")
 		return
 	}
 
-	this.writer.WriteString(obj.DefaultWriteString())
+	w.WriteString(obj.DefaultWriteString())
 }
 
 // Update all the object numbers prior to writing.
@@ -474,84 +571,349 @@ func (this *PdfWriter) updateObjectNumbers() {
 	}
 }
 
+// EncryptionAlgorithm is used in EncryptOptions to change the default algorithm used to encrypt the document.
+type EncryptionAlgorithm int
+
+const (
+	// RC4_128bit uses RC4 encryption (128 bit).  This is the default.
+	RC4_128bit = EncryptionAlgorithm(iota)
+	// RC4_40bit uses RC4 encryption (40 bit).  Weak, only for compatibility with old readers.
+	RC4_40bit
+	// AES_128bit uses AES encryption (128 bit, PDF 1.6).
+	AES_128bit
+	// AES_256bit uses AES encryption (256 bit, PDF 2.0 / PDF 1.7 Adobe extension level 8).
+	AES_256bit
+)
+
+// EncryptOptions represents encryption options for an output PDF.
 type EncryptOptions struct {
 	Permissions AccessPermissions
+	Algorithm   EncryptionAlgorithm
+
+	// UnencryptedMetadata leaves the metadata streams unencrypted (EncryptMetadata false), to keep
+	// them readable by tools unaware of PDF encryption.  Only supported with the AES algorithms.
+	UnencryptedMetadata bool
 }
 
 // Encrypt the output file with a specified user/owner password.
 func (this *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptions) error {
-	crypter := PdfCrypt{}
-	this.crypter = &crypter
-
-	crypter.EncryptedObjects = map[PdfObject]bool{}
-
-	crypter.CryptFilters = CryptFilters{}
-	crypter.CryptFilters["Default"] = CryptFilter{Cfm: "V2", Length: 128}
-
-	// Set
+	crypter, err := this.newCrypter("Standard", options)
+	if err != nil {
+		return err
+	}
 	crypter.P = -1
-	crypter.V = 2
-	crypter.R = 3
-	crypter.Length = 128
-	crypter.EncryptMetadata = true
 	if options != nil {
 		crypter.P = int(options.Permissions.GetP())
 	}
 
-	// Prepare the ID object for the trailer.
-	hashcode := md5.Sum([]byte(time.Now().Format(time.RFC850)))
-	id0 := PdfObjectString(hashcode[:])
-	b := make([]byte, 100)
-	rand.Read(b)
-	hashcode = md5.Sum(b)
-	id1 := PdfObjectString(hashcode[:])
-	common.Log.Trace("Random b: % x", b)
+	// Make the O and U objects, and the encryption key.
+	err = crypter.GenerateParams(userPass, ownerPass)
+	if err != nil {
+		common.Log.Debug("ERROR: Error generating encryption parameters (%s)", err)
+		return err
+	}
 
-	this.ids = &PdfObjectArray{&id0, &id1}
-	common.Log.Trace("Gen Id 0: % x", id0)
+	this.setCrypter(crypter)
+	return nil
+}
 
-	crypter.Id0 = string(id0)
+// EncryptForRecipients encrypts the output file for the recipient certificates with the public-key
+// security handler (Adobe.PubSec).  The file can be opened by each recipient with its private key,
+// with the access permissions specified for it.  The Permissions of the options are not used.
+func (this *PdfWriter) EncryptForRecipients(recipients []PubKeyRecipient, options *EncryptOptions) error {
+	crypter, err := this.newCrypter("Adobe.PubSec", options)
+	if err != nil {
+		return err
+	}
 
-	// Make the O and U objects.
-	O, err := crypter.Alg3(userPass, ownerPass)
+	err = crypter.GeneratePubKeyParams(recipients)
 	if err != nil {
-		common.Log.Debug("ERROR: Error generating O for encryption (%s)", err)
+		common.Log.Debug("ERROR: Error generating encryption parameters (%s)", err)
 		return err
 	}
-	crypter.O = []byte(O)
-	common.Log.Trace("gen O: % x", O)
-	U, key, err := crypter.Alg5(userPass)
+
+	if crypter.V >= 4 {
+		// Recipients are specified in the crypt filter.
+		crypter.Subfilter = "adbe.pkcs7.s5"
+		cf := crypter.CryptFilters[crypter.StreamFilter]
+		cf.Recipients = crypter.Recipients
+		crypter.CryptFilters[crypter.StreamFilter] = cf
+	} else {
+		crypter.Subfilter = "adbe.pkcs7.s4"
+	}
+
+	this.setCrypter(crypter)
+	return nil
+}
+
+// EncryptLike encrypts the output file with the same security settings as the encrypted document
+// read by `reader`: security handler, algorithm and key length, permissions, EncryptMetadata and the
+// permanent file identifier.  The passwords (or recipients) of the source document remain valid.
+// The owner password of the source document is required for the standard security handler.  For
+// the public-key security handler the source must be decrypted with a recipient certificate.
+func (this *PdfWriter) EncryptLike(reader *PdfReader, ownerPass []byte) error {
+	crypter, err := reader.parser.DuplicateCrypter(ownerPass)
 	if err != nil {
-		common.Log.Debug("ERROR: Error generating O for encryption (%s)", err)
+		common.Log.Debug("ERROR: Unable to adopt the source encryption (%s)", err)
 		return err
 	}
-	common.Log.Trace("gen U: % x", U)
-	crypter.U = []byte(U)
-	crypter.EncryptionKey = key
+	this.setIDs(crypter.Id0)
 
-	// Generate the encryption dictionary.
-	encDict := MakeDict()
-	encDict.Set("Filter", MakeName("Standard"))
-	encDict.Set("P", MakeInteger(int64(crypter.P)))
-	encDict.Set("V", MakeInteger(int64(crypter.V)))
-	encDict.Set("R", MakeInteger(int64(crypter.R)))
-	encDict.Set("Length", MakeInteger(int64(crypter.Length)))
-	encDict.Set("O", &O)
-	encDict.Set("U", &U)
+	this.setCrypter(crypter)
+	return nil
+}
+
+// newCrypter returns a crypter for the security handler `filter` with the encryption algorithm and
+// the metadata encryption of `options` (RC4 128 bit if nil) and generates the file identifiers.
+func (this *PdfWriter) newCrypter(filter string, options *EncryptOptions) (*PdfCrypt, error) {
+	algorithm := RC4_128bit
+	if options != nil {
+		algorithm = options.Algorithm
+	}
+
+	crypter := PdfCrypt{}
+	crypter.Filter = filter
+	crypter.EncryptedObjects = map[PdfObject]bool{}
+	crypter.CryptFilters = CryptFilters{}
+	crypter.EncryptMetadata = true
+
+	// Crypt filter for the V4 and V5 handlers, used for both strings and streams.
+	var cfMethod string
+	var cfLength int
+
+	switch algorithm {
+	case RC4_128bit:
+		crypter.V = 2
+		crypter.R = 3
+		crypter.Length = 128
+		crypter.CryptFilters["Default"] = CryptFilter{Cfm: "V2", Length: 128}
+	case RC4_40bit:
+		crypter.V = 1
+		crypter.R = 2
+		crypter.Length = 40
+		crypter.CryptFilters["Default"] = CryptFilter{Cfm: "V2", Length: 40}
+	case AES_128bit:
+		crypter.V = 4
+		crypter.R = 4
+		crypter.Length = 128
+		cfMethod, cfLength = "AESV2", 16
+	case AES_256bit:
+		crypter.V = 5
+		crypter.R = 6
+		crypter.Length = 256
+		cfMethod, cfLength = "AESV3", 32
+	default:
+		common.Log.Debug("ERROR: Unsupported encryption algorithm (%d)", algorithm)
+		return nil, errors.New("Unsupported encryption algorithm")
+	}
+	if crypter.V >= 4 {
+		// The standard security handler conventionally names its crypt filter StdCF.
+		cfName := "StdCF"
+		if filter == "Adobe.PubSec" {
+			cfName = "DefaultCryptFilter"
+		}
+		crypter.CryptFilters[cfName] = CryptFilter{Cfm: cfMethod, Length: cfLength, EncryptMetadata: true}
+		crypter.CryptFilters["Identity"] = CryptFilter{}
+		crypter.StreamFilter = cfName
+		crypter.StringFilter = cfName
+	}
+	if options != nil && options.UnencryptedMetadata {
+		// EncryptMetadata is only defined with crypt filters.
+		if crypter.V < 4 {
+			common.Log.Debug("ERROR: Unencrypted metadata requires AES encryption")
+			return nil, errors.New("Unencrypted metadata not supported with RC4 encryption")
+		}
+		crypter.EncryptMetadata = false
+		for name, cf := range crypter.CryptFilters {
+			cf.EncryptMetadata = false
+			crypter.CryptFilters[name] = cf
+		}
+	}
+
+	crypter.Id0 = this.setIDs("")
+	return &crypter, nil
+}
+
+// setIDs sets the file identifiers for the trailer: the permanent identifier `id0` (generated if
+// empty) and a newly generated changing identifier.  Returns the permanent identifier.
+func (this *PdfWriter) setIDs(id0 string) string {
+	if len(id0) == 0 {
+		hashcode := md5.Sum([]byte(time.Now().Format(time.RFC850)))
+		id0 = string(hashcode[:])
+	}
+	b := make([]byte, 100)
+	rand.Read(b)
+	hashcode := md5.Sum(b)
+	common.Log.Trace("Random b: % x", b)
+
+	this.ids = &PdfObjectArray{MakeString(id0), MakeString(string(hashcode[:]))}
+	common.Log.Trace("Gen Id 0: % x", id0)
+	return id0
+}
+
+// setCrypter sets the crypter of the output file and generates its encryption dictionary.  The PDF
+// version is raised as needed for the encryption algorithm.
+func (this *PdfWriter) setCrypter(crypter *PdfCrypt) {
+	this.crypter = crypter
+
+	for _, cf := range crypter.CryptFilters {
+		switch cf.Cfm {
+		case "AESV2":
+			this.requireVersion(1, 6)
+		case "AESV3":
+			this.requireVersion(1, 7)
+			// AES-256 in PDF 1.7 is defined by the Adobe extension level 8 (ISO 32000-2 in PDF 2.0).
+			if this.majorVersion < 2 {
+				adbe := MakeDict()
+				adbe.Set("BaseVersion", MakeName("1.7"))
+				adbe.Set("ExtensionLevel", MakeInteger(8))
+				extensions := MakeDict()
+				extensions.Set("ADBE", adbe)
+				this.catalog.Set("Extensions", extensions)
+			}
+		}
+	}
+	if crypter.V >= 4 {
+		// Crypt filters.
+		this.requireVersion(1, 5)
+	}
+
+	encDict := makeEncryptDict(crypter)
 	this.encryptDict = encDict
 
 	// Make an object to contain it.
 	io := MakeIndirectObject(encDict)
 	this.encryptObj = io
 	this.addObject(io)
+}
 
-	return nil
+// makeEncryptDict returns the encryption dictionary for `crypter`.
+func makeEncryptDict(crypter *PdfCrypt) *PdfObjectDictionary {
+	isPubSec := crypter.Filter == "Adobe.PubSec"
+
+	encDict := MakeDict()
+	encDict.Set("Filter", MakeName(crypter.Filter))
+	if len(crypter.Subfilter) > 0 {
+		encDict.Set("SubFilter", MakeName(crypter.Subfilter))
+	}
+	encDict.Set("V", MakeInteger(int64(crypter.V)))
+	encDict.Set("Length", MakeInteger(int64(crypter.Length)))
+
+	if crypter.V >= 4 {
+		names := []string{}
+		for name := range crypter.CryptFilters {
+			if name != "Identity" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		cfs := MakeDict()
+		for _, name := range names {
+			cf := crypter.CryptFilters[name]
+			cfDict := MakeDict()
+			cfDict.Set("Type", MakeName("CryptFilter"))
+			cfDict.Set("AuthEvent", MakeName("DocOpen"))
+			cfDict.Set("CFM", MakeName(cf.Cfm))
+			cfDict.Set("Length", MakeInteger(int64(cf.Length)))
+			if isPubSec {
+				cfDict.Set("Recipients", makeRecipientsArray(cf.Recipients))
+				cfDict.Set("EncryptMetadata", MakeBool(cf.EncryptMetadata))
+			}
+			cfs.Set(PdfObjectName(name), cfDict)
+		}
+		encDict.Set("CF", cfs)
+		encDict.Set("StmF", MakeName(crypter.StreamFilter))
+		encDict.Set("StrF", MakeName(crypter.StringFilter))
+	}
+
+	if isPubSec {
+		if crypter.V < 4 {
+			encDict.Set("Recipients", makeRecipientsArray(crypter.Recipients))
+		}
+		return encDict
+	}
+
+	encDict.Set("P", MakeInteger(int64(crypter.P)))
+	encDict.Set("R", MakeInteger(int64(crypter.R)))
+	encDict.Set("O", MakeString(string(crypter.O)))
+	encDict.Set("U", MakeString(string(crypter.U)))
+	if crypter.V >= 4 {
+		encDict.Set("EncryptMetadata", MakeBool(crypter.EncryptMetadata))
+	}
+	if crypter.R >= 5 {
+		encDict.Set("OE", MakeString(string(crypter.OE)))
+		encDict.Set("UE", MakeString(string(crypter.UE)))
+		encDict.Set("Perms", MakeString(string(crypter.Perms)))
+	}
+	return encDict
 }
 
-// Write the pdf out.
-func (this *PdfWriter) Write(ws io.WriteSeeker) error {
-	common.Log.Trace("Write()")
+// makeRecipientsArray returns the Recipients array of the public-key security handler.
+func makeRecipientsArray(recipients [][]byte) *PdfObjectArray {
+	arr := PdfObjectArray{}
+	for _, recipient := range recipients {
+		arr = append(arr, MakeString(string(recipient)))
+	}
+	return &arr
+}
+
+// requireVersion raises the PDF version of the output file to at least majorVersion.minorVersion.
+func (this *PdfWriter) requireVersion(majorVersion, minorVersion int) {
+	if this.majorVersion > majorVersion ||
+		(this.majorVersion == majorVersion && this.minorVersion >= minorVersion) {
+		return
+	}
+	this.SetVersion(majorVersion, minorVersion)
+}
+
+// Write the pdf out to `w`.  The output is written sequentially, `w` does not need to be seekable.
+func (this *PdfWriter) Write(w io.Writer) error {
+	if this.stream != nil {
+		return errors.New("Writer is streaming, use FinishStreaming")
+	}
+	if this.signing == nil {
+		return this.write(w)
+	}
+
+	// The signature is computed over the output.
+	var buf bytes.Buffer
+	if err := this.write(&buf); err != nil {
+		return err
+	}
+	if err := this.checkContext(); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if err := this.signing.sign(data); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
 
+// WriteContext writes out the PDF like Write, and stops with the error of `ctx` once canceled or
+// past its deadline.  The output is incomplete in that case.
+func (this *PdfWriter) WriteContext(ctx context.Context, w io.Writer) error {
+	this.ctx = ctx
+	defer func() { this.ctx = nil }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return this.Write(w)
+}
+
+// checkContext returns the error of the context of the writer if canceled, nil otherwise.
+func (this *PdfWriter) checkContext() error {
+	if this.ctx == nil {
+		return nil
+	}
+	return this.ctx.Err()
+}
+
+// prepareWrite adds the outlines and the forms for writing, and sets the version of the document,
+// prior to writing the document-level objects.
+func (this *PdfWriter) prepareWrite() error {
 	lk := license.GetLicenseKey()
 	if lk == nil || !lk.IsLicensed() {
 		fmt.Printf("Unlicensed copy of unidoc\n")
@@ -582,6 +944,24 @@ func (this *PdfWriter) Write(ws io.WriteSeeker) error {
 		}
 	}
 
+	// Metadata.
+	if this.xmp != nil {
+		infoDict, ok := this.infoObj.PdfObject.(*PdfObjectDictionary)
+		if !ok {
+			return ErrTypeError
+		}
+		info := newPdfDocumentInfoFromDict(infoDict)
+		syncXmpDocumentInfo(info, this.xmp)
+		this.infoObj.PdfObject = info.ToPdfObject()
+
+		metadata := this.xmp.ToPdfObject()
+		this.catalog.Set("Metadata", metadata)
+		if err := this.addObjects(metadata); err != nil {
+			return err
+		}
+		this.requireVersion(1, 4)
+	}
+
 	// Check pending objects prior to write.
 	for pendingObj, pendingObjDict := range this.pendingObjects {
 		if !this.hasObject(pendingObj) {
@@ -596,27 +976,70 @@ func (this *PdfWriter) Write(ws io.WriteSeeker) error {
 			}
 		}
 	}
+	if this.useObjectStreams {
+		this.requireVersion(1, 5)
+	}
+
 	// Set version in the catalog.
 	this.catalog.Set("Version", MakeName(fmt.Sprintf("%d.%d", this.majorVersion, this.minorVersion)))
+	return nil
+}
 
-	w := bufio.NewWriter(ws)
+func (this *PdfWriter) write(out io.Writer) error {
+	common.Log.Trace("Write()")
+
+	if err := this.prepareWrite(); err != nil {
+		return err
+	}
+	if err := this.compressStreams(this.objects); err != nil {
+		return err
+	}
+	if this.linearize {
+		return this.writeLinearized(out)
+	}
+
+	// The offsets are counted as the output is written.
+	cw := &countingWriter{w: out}
+	w := bufio.NewWriter(cw)
 	this.writer = w
+	offset := func() int64 {
+		return cw.n + int64(w.Buffered())
+	}
 
-	w.WriteString(fmt.Sprintf("%%PDF-%d.%d\n", this.majorVersion, this.minorVersion))
-	w.WriteString("%âãÏÓ\n")
-	w.Flush()
+	this.writeHeader()
 
 	this.updateObjectNumbers()
 
-	offsets := []int64{}
+	// Objects packed into object streams are written as part of the object streams, which are
+	// numbered after the other objects.
+	objects := this.objects
+	var packed map[PdfObject]packedObject
+	if this.useObjectStreams {
+		objstms, entries, err := this.makeObjectStreams(this.objects, int64(len(this.objects)+1))
+		if err != nil {
+			return err
+		}
+		objects = make([]PdfObject, 0, len(this.objects)+len(objstms))
+		objects = append(objects, this.objects...)
+		for _, so := range objstms {
+			objects = append(objects, so)
+		}
+		packed = entries
+	}
+
+	offsets := make([]int64, len(objects))
 
 	// Write objects
-	common.Log.Trace("Writing %d obj", len(this.objects))
-	for idx, obj := range this.objects {
+	common.Log.Trace("Writing %d obj", len(objects))
+	for idx, obj := range objects {
+		if _, isPacked := packed[obj]; isPacked {
+			continue
+		}
+		if err := this.checkContext(); err != nil {
+			return err
+		}
 		common.Log.Trace("Writing %d", idx)
-		this.writer.Flush()
-		offset, _ := ws.Seek(0, os.SEEK_CUR)
-		offsets = append(offsets, offset)
+		offsets[idx] = offset()
 
 		// Encrypt prior to writing.
 		// Encrypt dictionary should not be encrypted.
@@ -630,40 +1053,240 @@ func (this *PdfWriter) Write(ws io.WriteSeeker) error {
 		}
 		this.writeObject(idx+1, obj)
 	}
-	w.Flush()
 
-	xrefOffset, _ := ws.Seek(0, os.SEEK_CUR)
-	// Write xref table.
-	this.writer.WriteString("xref\r\n")
-	outStr := fmt.Sprintf("%d %d\r\n", 0, len(this.objects)+1)
-	this.writer.WriteString(outStr)
-	outStr = fmt.Sprintf("%.10d %.5d f\r\n", 0, 65535)
-	this.writer.WriteString(outStr)
-	for _, offset := range offsets {
-		outStr = fmt.Sprintf("%.10d %.5d n\r\n", offset, 0)
-		this.writer.WriteString(outStr)
+	trailer := this.makeTrailer(int64(len(objects) + 1))
+
+	// Cross-reference entries, starting with the head of the free list.
+	entries := []xrefEntry{{objNum: 0, typ: 0, gen: 65535}}
+	for idx, obj := range objects {
+		if p, isPacked := packed[obj]; isPacked {
+			entries = append(entries, xrefEntry{objNum: int64(idx + 1), typ: 2, offset: p.streamNum, gen: p.index})
+		} else {
+			entries = append(entries, xrefEntry{objNum: int64(idx + 1), typ: 1, offset: offsets[idx]})
+		}
 	}
 
-	// Generate & write trailer
+	return this.writeXref(entries, trailer, offset())
+}
+
+// writeHeader writes the header of the file with the version of the writer.
+func (this *PdfWriter) writeHeader() {
+	this.writer.WriteString(fmt.Sprintf("%%PDF-%d.%d\n", this.majorVersion, this.minorVersion))
+	this.writer.WriteString("%âãÏÓ\n")
+}
+
+// makeTrailer returns the trailer dictionary for `size` objects.
+func (this *PdfWriter) makeTrailer(size int64) *PdfObjectDictionary {
 	trailer := MakeDict()
 	trailer.Set("Info", this.infoObj)
 	trailer.Set("Root", this.root)
-	trailer.Set("Size", MakeInteger(int64(len(this.objects)+1)))
+	trailer.Set("Size", MakeInteger(size))
 	// If encrypted!
 	if this.crypter != nil {
 		trailer.Set("Encrypt", this.encryptObj)
 		trailer.Set("ID", this.ids)
 		common.Log.Trace("Ids: %s", this.ids)
 	}
-	this.writer.WriteString("trailer\n")
-	this.writer.WriteString(trailer.DefaultWriteString())
-	this.writer.WriteString("\n")
+	return trailer
+}
+
+// writeXref writes the cross-reference section with the `entries` at offset `xrefOffset`, followed
+// by the trailer and the end of the file, and flushes the output.  The cross-reference section is a
+// stream when using object streams, numbered after the entries.
+func (this *PdfWriter) writeXref(entries []xrefEntry, trailer *PdfObjectDictionary, xrefOffset int64) error {
+	if this.useObjectStreams {
+		// The cross-reference stream itself is the last object.
+		xrefNum := entries[len(entries)-1].objNum + 1
+		entries = append(entries, xrefEntry{objNum: xrefNum, typ: 1, offset: xrefOffset})
+		trailer.Set("Size", MakeInteger(xrefNum+1))
+
+		xrefStream, err := makeXrefStream(entries, trailer)
+		if err != nil {
+			return err
+		}
+		// Cross-reference streams are not encrypted.
+		this.writeObject(int(xrefNum), xrefStream)
+	} else {
+		writeXrefTable(this.writer, entries)
+
+		// Write trailer
+		this.writer.WriteString("trailer\n")
+		this.writer.WriteString(trailer.DefaultWriteString())
+		this.writer.WriteString("\n")
+	}
 
 	// Make offset reference.
-	outStr = fmt.Sprintf("startxref\n%d\n", xrefOffset)
+	outStr := fmt.Sprintf("startxref\n%d\n", xrefOffset)
 	this.writer.WriteString(outStr)
 	this.writer.WriteString("%%EOF\n")
-	w.Flush()
+	return this.writer.Flush()
+}
 
-	return nil
+// Maximum number of objects packed into a single object stream.
+const objectStreamSize = 100
+
+// packedObject is the location of an object packed into an object stream.
+type packedObject struct {
+	streamNum int64 // Object number of the object stream.
+	index     int   // Index of the object within the object stream.
+}
+
+// makeObjectStreams packs the indirect objects among `objects` into Flate encoded object streams
+// (Section 7.5.7), numbered consecutively from `firstNum`, and encoded concurrently.  Streams and the encryption dictionary
+// cannot be stored in object streams and are left out, as well as the signature dictionary.
+// Returns the object streams and the location of each packed object.
+func (this *PdfWriter) makeObjectStreams(objects []PdfObject, firstNum int64) ([]*PdfObjectStream, map[PdfObject]packedObject, error) {
+	candidates := []*PdfIndirectObject{}
+	for _, obj := range objects {
+		io, isIndirect := obj.(*PdfIndirectObject)
+		if !isIndirect || obj == this.encryptObj {
+			continue
+		}
+		if this.signing != nil && obj == this.signing.sig.GetContainingPdfObject() {
+			// The signature contents are filled in after writing.
+			continue
+		}
+		if _, isStream := io.PdfObject.(*PdfObjectStream); isStream {
+			continue
+		}
+		candidates = append(candidates, io)
+	}
+
+	// Data, number of objects and offset of the first object of each object stream.
+	type objstmData struct {
+		data  []byte
+		n     int
+		first int
+	}
+	datas := []objstmData{}
+	packed := map[PdfObject]packedObject{}
+	for start := 0; start < len(candidates); start += objectStreamSize {
+		end := start + objectStreamSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		if err := this.checkContext(); err != nil {
+			return nil, nil, err
+		}
+		streamNum := firstNum + int64(len(datas))
+
+		// Pairs of object number and offset, followed by the objects.
+		var header, body bytes.Buffer
+		for i, io := range candidates[start:end] {
+			header.WriteString(fmt.Sprintf("%d %d ", io.ObjectNumber, body.Len()))
+			body.WriteString(io.PdfObject.DefaultWriteString())
+			body.WriteString("\n")
+			packed[io] = packedObject{streamNum: streamNum, index: i}
+		}
+		header.WriteString("\n")
+		first := header.Len()
+		header.Write(body.Bytes())
+		datas = append(datas, objstmData{data: header.Bytes(), n: end - start, first: first})
+	}
+
+	objstms := make([]*PdfObjectStream, len(datas))
+	err := runParallel(len(datas), this.compressionWorkers(), func(i int) error {
+		if err := this.checkContext(); err != nil {
+			return err
+		}
+		so, err := MakeStream(datas[i].data, this.flateEncoder())
+		if err != nil {
+			common.Log.Debug("ERROR: Failed to encode object stream (%s)", err)
+			return err
+		}
+		so.PdfObjectDictionary.Set("Type", MakeName("ObjStm"))
+		so.PdfObjectDictionary.Set("N", MakeInteger(int64(datas[i].n)))
+		so.PdfObjectDictionary.Set("First", MakeInteger(int64(datas[i].first)))
+		so.ObjectNumber = firstNum + int64(i)
+		objstms[i] = so
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return objstms, packed, nil
+}
+
+// xrefEntry is an entry of a cross-reference section.
+type xrefEntry struct {
+	objNum int64
+	typ    int   // 0: free, 1: in use, 2: packed into an object stream.
+	offset int64 // Byte offset (type 1) or object number of the object stream (type 2).
+	gen    int   // Generation number (types 0 and 1) or index within the object stream (type 2).
+}
+
+// writeXrefTable writes a cross-reference table (Section 7.5.4) with the `entries`, which must be
+// sorted by object number and not packed into object streams.  Entries with consecutive object
+// numbers form a subsection.
+func writeXrefTable(w *bufio.Writer, entries []xrefEntry) {
+	w.WriteString("xref\r\n")
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && entries[end].objNum == entries[end-1].objNum+1 {
+			end++
+		}
+		w.WriteString(fmt.Sprintf("%d %d\r\n", entries[start].objNum, end-start))
+		for _, entry := range entries[start:end] {
+			if entry.typ == 0 {
+				w.WriteString(fmt.Sprintf("%.10d %.5d f\r\n", entry.offset, entry.gen))
+			} else {
+				w.WriteString(fmt.Sprintf("%.10d %.5d n\r\n", entry.offset, entry.gen))
+			}
+		}
+		start = end
+	}
+}
+
+// makeXrefStream returns a Flate encoded cross-reference stream (Section 7.5.8) with the
+// `entries`, which must be sorted by object number.  The stream dictionary includes the entries
+// of `trailer`, which must include Size.
+func makeXrefStream(entries []xrefEntry, trailer *PdfObjectDictionary) (*PdfObjectStream, error) {
+	// The second field holds offsets or object stream numbers.
+	var maxVal int64
+	for _, entry := range entries {
+		if entry.offset > maxVal {
+			maxVal = entry.offset
+		}
+	}
+	width := 1
+	for v := maxVal >> 8; v > 0; v >>= 8 {
+		width++
+	}
+
+	var data bytes.Buffer
+	// Pairs of first object number and number of entries for each subsection.
+	index := []int64{}
+	for i, entry := range entries {
+		if i == 0 || entry.objNum != entries[i-1].objNum+1 {
+			index = append(index, entry.objNum, 0)
+		}
+		index[len(index)-1]++
+
+		data.WriteByte(byte(entry.typ))
+		for b := width - 1; b >= 0; b-- {
+			data.WriteByte(byte(entry.offset >> uint(8*b)))
+		}
+		data.WriteByte(byte(entry.gen >> 8))
+		data.WriteByte(byte(entry.gen))
+	}
+
+	so, err := MakeStream(data.Bytes(), NewFlateEncoder())
+	if err != nil {
+		common.Log.Debug("ERROR: Failed to encode xref stream (%s)", err)
+		return nil, err
+	}
+	dict := so.PdfObjectDictionary
+	dict.Set("Type", MakeName("XRef"))
+	for _, key := range trailer.Keys() {
+		dict.Set(key, trailer.Get(key))
+	}
+	// Index defaults to [0 Size].
+	size, _ := trailer.Get("Size").(*PdfObjectInteger)
+	if len(index) != 2 || index[0] != 0 || size == nil || index[1] != int64(*size) {
+		dict.Set("Index", MakeArrayFromIntegers64(index))
+	}
+	dict.Set("W", MakeArray(MakeInteger(1), MakeInteger(int64(width)), MakeInteger(2)))
+
+	return so, nil
 }
@@ -0,0 +1,549 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/internal/testutil"
+)
+
+// testPageContent returns the content of page `i` of the test documents, text followed by
+// compressible drawing operations.
+func testPageContent(i int) string {
+	return fmt.Sprintf("BT /F1 18 Tf 10 10 Td (Page %d) Tj ET\n", i) +
+		strings.Repeat(fmt.Sprintf("0 0 m %d %d l S\n", i, i), 200)
+}
+
+// newTestFont returns a standard font to be shared by the test pages.
+func newTestFont() *PdfIndirectObject {
+	font := MakeIndirectObject(MakeDict())
+	font.PdfObject.(*PdfObjectDictionary).Set("Type", MakeName("Font"))
+	font.PdfObject.(*PdfObjectDictionary).Set("Subtype", MakeName("Type1"))
+	font.PdfObject.(*PdfObjectDictionary).Set("BaseFont", MakeName("Courier"))
+	return font
+}
+
+// initTestPage sets up `page` as page `i` of the test documents, with content testPageContent(i)
+// using `font`, and returns it.
+func initTestPage(page *PdfPage, font *PdfIndirectObject, i int) *PdfPage {
+	page.MediaBox = &PdfRectangle{Llx: 0, Lly: 0, Urx: 200, Ury: 100}
+	page.Resources = NewPdfPageResources()
+	page.Resources.SetFontByName("F1", font)
+	page.AddContentStreamByString(testPageContent(i))
+	return page
+}
+
+// newTestWriter returns a writer with a single test page.
+func newTestWriter(t *testing.T) *PdfWriter {
+	return newTestWriterPages(t, 1)
+}
+
+// newTestWriterPages returns a writer with `numPages` test pages sharing a font.
+func newTestWriterPages(t *testing.T, numPages int) *PdfWriter {
+	font := newTestFont()
+	w := NewPdfWriter()
+	for i := 1; i <= numPages; i++ {
+		if err := w.AddPage(initTestPage(NewPdfPage(), font, i)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	return &w
+}
+
+// writeTestPdf returns the output of `w`, checking that the content is encrypted.
+func writeTestPdf(t *testing.T, w *PdfWriter) []byte {
+	data := writePdf(t, w)
+	if bytes.Contains(data, []byte("(Page ")) {
+		t.Fatalf("Content not encrypted")
+	}
+	return data
+}
+
+// writePdf returns the output of `w`.
+func writePdf(t *testing.T, w *PdfWriter) []byte {
+	f, err := ioutil.TempFile("", "unidoc-writer")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if err := w.Write(f); err != nil {
+		f.Close()
+		t.Fatalf("Error: %v", err)
+	}
+	f.Close()
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return data
+}
+
+// checkTestContent checks that the first page of the decrypted `reader` has the test content.
+func checkTestContent(t *testing.T, reader *PdfReader) {
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cstream, err := page.GetAllContentStreams()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Unlicensed copies have a watermark appended.
+	if !strings.HasPrefix(cstream, testPageContent(1)) {
+		t.Fatalf("Content mismatch %q", cstream)
+	}
+}
+
+// Test writing encrypted files with each of the encryption algorithms and reading them back.
+func TestWriterEncrypt(t *testing.T) {
+	testcases := []struct {
+		Algorithm EncryptionAlgorithm
+		V, R      int
+		Cfm       string
+		Version   string
+	}{
+		{RC4_128bit, 2, 3, "", "1.3"},
+		{RC4_40bit, 1, 2, "", "1.3"},
+		{AES_128bit, 4, 4, "AESV2", "1.6"},
+		{AES_256bit, 5, 6, "AESV3", "1.7"},
+	}
+
+	for _, tcase := range testcases {
+		w := newTestWriter(t)
+		perms := AccessPermissions{Printing: true}
+		err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Permissions: perms, Algorithm: tcase.Algorithm})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data := writeTestPdf(t, w)
+		if !bytes.HasPrefix(data, []byte("%PDF-"+tcase.Version)) {
+			t.Fatalf("Algorithm %d: incorrect header %q", tcase.Algorithm, data[:8])
+		}
+
+		for _, pass := range []string{"user", "owner"} {
+			reader, err := NewPdfReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			isEncrypted, err := reader.IsEncrypted()
+			if err != nil || !isEncrypted {
+				t.Fatalf("Algorithm %d: should be encrypted (%v)", tcase.Algorithm, err)
+			}
+			crypter := reader.parser.GetCrypter()
+			if crypter.V != tcase.V || crypter.R != tcase.R || !crypter.EncryptMetadata {
+				t.Fatalf("Algorithm %d: incorrect crypter V=%d R=%d", tcase.Algorithm, crypter.V, crypter.R)
+			}
+			if tcase.Cfm != "" {
+				if crypter.StreamFilter != "StdCF" || crypter.StringFilter != "StdCF" ||
+					crypter.CryptFilters["StdCF"].Cfm != tcase.Cfm {
+					t.Fatalf("Algorithm %d: incorrect crypt filters %v", tcase.Algorithm, crypter.CryptFilters)
+				}
+			}
+
+			auth, err := reader.Decrypt([]byte("wrong"))
+			if err != nil || auth {
+				t.Fatalf("Algorithm %d: authenticated with wrong password (%v)", tcase.Algorithm, err)
+			}
+			auth, err = reader.Decrypt([]byte(pass))
+			if err != nil || !auth {
+				t.Fatalf("Algorithm %d: failed to authenticate with %q (%v)", tcase.Algorithm, pass, err)
+			}
+			if reader.GetEncryptionMethod() == "" || crypter.GetAccessPermissions() != perms {
+				t.Fatalf("Algorithm %d: incorrect permissions %+v", tcase.Algorithm, crypter.GetAccessPermissions())
+			}
+			checkTestContent(t, reader)
+		}
+	}
+}
+
+// Test encrypting files for recipient certificates (public-key security handler) and reading them
+// back with each recipient's private key.
+func TestWriterEncryptForRecipients(t *testing.T) {
+	cert1, key1 := testutil.MakeCertificate(t, "Recipient 1", 1)
+	cert2, key2 := testutil.MakeCertificate(t, "Recipient 2", 2)
+	cert3, key3 := testutil.MakeCertificate(t, "Other", 3)
+
+	perms1 := AccessPermissions{Printing: true, FullPrintQuality: true}
+	perms2 := AccessPermissions{Modify: true, Annotate: true}
+	recipients := []PubKeyRecipient{
+		{Certificate: cert1, Permissions: perms1},
+		{Certificate: cert2, Permissions: perms2},
+	}
+
+	testcases := []struct {
+		Algorithm EncryptionAlgorithm
+		V         int
+		SubFilter string
+	}{
+		{RC4_128bit, 2, "adbe.pkcs7.s4"},
+		{RC4_40bit, 1, "adbe.pkcs7.s4"},
+		{AES_128bit, 4, "adbe.pkcs7.s5"},
+		{AES_256bit, 5, "adbe.pkcs7.s5"},
+	}
+
+	for _, tcase := range testcases {
+		w := newTestWriter(t)
+		err := w.EncryptForRecipients(recipients, &EncryptOptions{Algorithm: tcase.Algorithm})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data := writeTestPdf(t, w)
+
+		for i, rcp := range []struct {
+			cert  *x509.Certificate
+			key   *rsa.PrivateKey
+			perms AccessPermissions
+		}{{cert1, key1, perms1}, {cert2, key2, perms2}} {
+			reader, err := NewPdfReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if isEncrypted, err := reader.IsEncrypted(); err != nil || !isEncrypted {
+				t.Fatalf("Algorithm %d: should be encrypted (%v)", tcase.Algorithm, err)
+			}
+			crypter := reader.parser.GetCrypter()
+			if crypter.Filter != "Adobe.PubSec" || crypter.Subfilter != tcase.SubFilter || crypter.V != tcase.V ||
+				len(crypter.Recipients) != 2 {
+				t.Fatalf("Algorithm %d: incorrect crypter %s %s V=%d", tcase.Algorithm, crypter.Filter,
+					crypter.Subfilter, crypter.V)
+			}
+
+			// Passwords and other certificates do not work.
+			if auth, err := reader.Decrypt([]byte("")); err != nil || auth {
+				t.Fatalf("Algorithm %d: authenticated with password (%v)", tcase.Algorithm, err)
+			}
+			if auth, err := reader.DecryptWithCertificate(cert3, key3); err != nil || auth {
+				t.Fatalf("Algorithm %d: authenticated with other certificate (%v)", tcase.Algorithm, err)
+			}
+
+			auth, err := reader.DecryptWithCertificate(rcp.cert, rcp.key)
+			if err != nil || !auth {
+				t.Fatalf("Algorithm %d: recipient %d failed to authenticate (%v)", tcase.Algorithm, i+1, err)
+			}
+			if crypter.GetAccessPermissions() != rcp.perms {
+				t.Fatalf("Algorithm %d: recipient %d incorrect permissions %+v", tcase.Algorithm, i+1,
+					crypter.GetAccessPermissions())
+			}
+			checkTestContent(t, reader)
+		}
+	}
+}
+
+// Test re-saving encrypted documents with the security settings of the source document.
+func TestWriterEncryptLike(t *testing.T) {
+	for _, algorithm := range []EncryptionAlgorithm{RC4_40bit, RC4_128bit, AES_128bit, AES_256bit} {
+		w := newTestWriter(t)
+		perms := AccessPermissions{Printing: true, ExtractGraphics: true}
+		err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Permissions: perms, Algorithm: algorithm})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data := writeTestPdf(t, w)
+
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if _, err := reader.IsEncrypted(); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if auth, err := reader.Decrypt([]byte("user")); err != nil || !auth {
+			t.Fatalf("Algorithm %d: failed to decrypt source (%v)", algorithm, err)
+		}
+		src := reader.parser.GetCrypter()
+		page, err := reader.GetPage(1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		// The owner password is required.
+		w2 := NewPdfWriter()
+		for _, pass := range []string{"user", "wrong"} {
+			if err := w2.EncryptLike(reader, []byte(pass)); err == nil {
+				t.Fatalf("Algorithm %d: adopted encryption with password %q", algorithm, pass)
+			}
+		}
+		if err := w2.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := w2.EncryptLike(reader, []byte("owner")); err != nil {
+			t.Fatalf("Algorithm %d: %v", algorithm, err)
+		}
+		// The source is left unchanged, and can be read meanwhile.
+		source, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if _, err := source.IsEncrypted(); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if auth, err := source.Decrypt([]byte("user")); err != nil || !auth {
+			t.Fatalf("Algorithm %d: failed to decrypt source (%v)", algorithm, err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			checkTestContent(t, source)
+		}()
+		w3 := NewPdfWriter()
+		if err := w3.EncryptLike(source, []byte("owner")); err != nil {
+			t.Fatalf("Algorithm %d: %v", algorithm, err)
+		}
+		<-done
+		data2 := writeTestPdf(t, &w2)
+
+		for _, pass := range []string{"user", "owner"} {
+			reader2, err := NewPdfReader(bytes.NewReader(data2))
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if isEncrypted, err := reader2.IsEncrypted(); err != nil || !isEncrypted {
+				t.Fatalf("Algorithm %d: should be encrypted (%v)", algorithm, err)
+			}
+			crypter := reader2.parser.GetCrypter()
+			if crypter.V != src.V || crypter.R != src.R || crypter.Length != src.Length || crypter.P != src.P ||
+				crypter.EncryptMetadata != src.EncryptMetadata || crypter.Id0 != src.Id0 ||
+				!bytes.Equal(crypter.O, src.O) || !bytes.Equal(crypter.U, src.U) {
+				t.Fatalf("Algorithm %d: security settings not preserved", algorithm)
+			}
+			if cf := crypter.CryptFilters[crypter.StreamFilter]; cf.Cfm != src.CryptFilters[src.StreamFilter].Cfm {
+				t.Fatalf("Algorithm %d: crypt filter not preserved (%s)", algorithm, cf.Cfm)
+			}
+
+			if auth, err := reader2.Decrypt([]byte(pass)); err != nil || !auth {
+				t.Fatalf("Algorithm %d: failed to authenticate with %q (%v)", algorithm, pass, err)
+			}
+			checkTestContent(t, reader2)
+		}
+	}
+}
+
+// Test that the metadata stream is left unencrypted with EncryptMetadata false, also when
+// re-saving the document with EncryptLike.
+func TestWriterEncryptLikeMetadata(t *testing.T) {
+	cert, key := testutil.MakeCertificate(t, "Recipient", 1)
+	m := NewXmpMetadata()
+	m.SetLangAlt(XmpNamespaceDC, "title", "Plain metadata")
+
+	// checkMetadata checks that the metadata is not encrypted in `data` but decrypted when read.
+	checkMetadata := func(algorithm EncryptionAlgorithm, data []byte, pubSec bool) *PdfReader {
+		if !bytes.Contains(data, []byte("Plain metadata")) {
+			t.Fatalf("Algorithm %d: metadata encrypted", algorithm)
+		}
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if pubSec {
+			if _, err := reader.IsEncrypted(); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if auth, err := reader.DecryptWithCertificate(cert, key); err != nil || !auth {
+				t.Fatalf("Algorithm %d: failed to decrypt (%v)", algorithm, err)
+			}
+		} else if auth, err := reader.Decrypt([]byte("user")); err != nil || !auth {
+			t.Fatalf("Algorithm %d: failed to decrypt (%v)", algorithm, err)
+		}
+		if reader.parser.GetCrypter().EncryptMetadata {
+			t.Fatalf("Algorithm %d: EncryptMetadata not preserved", algorithm)
+		}
+		readXmp, err := reader.GetXmpMetadata()
+		if err != nil || readXmp == nil || readXmp.GetText(XmpNamespaceDC, "title") != "Plain metadata" {
+			t.Fatalf("Algorithm %d: metadata mismatch (%v)", algorithm, err)
+		}
+		checkTestContent(t, reader)
+		return reader
+	}
+
+	for _, algorithm := range []EncryptionAlgorithm{AES_128bit, AES_256bit} {
+		options := &EncryptOptions{Algorithm: algorithm, UnencryptedMetadata: true}
+		w := newTestWriter(t)
+		w.SetXmpMetadata(m)
+		if err := w.Encrypt([]byte("user"), []byte("owner"), options); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		reader := checkMetadata(algorithm, writeTestPdf(t, w), false)
+
+		page, err := reader.GetPage(1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		w2 := NewPdfWriter()
+		if err := w2.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		w2.SetXmpMetadata(m)
+		if err := w2.EncryptLike(reader, []byte("owner")); err != nil {
+			t.Fatalf("Algorithm %d: %v", algorithm, err)
+		}
+		checkMetadata(algorithm, writeTestPdf(t, &w2), false)
+
+		w = newTestWriter(t)
+		w.SetXmpMetadata(m)
+		if err := w.EncryptForRecipients([]PubKeyRecipient{{Certificate: cert}}, options); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		checkMetadata(algorithm, writeTestPdf(t, w), true)
+	}
+
+	// Not supported without crypt filters.
+	w := newTestWriter(t)
+	options := &EncryptOptions{Algorithm: RC4_128bit, UnencryptedMetadata: true}
+	if err := w.Encrypt([]byte("user"), []byte("owner"), options); err == nil {
+		t.Fatalf("Unencrypted metadata with RC4 not rejected")
+	}
+}
+
+// Test re-saving a document encrypted for recipient certificates.
+func TestWriterEncryptLikeRecipients(t *testing.T) {
+	cert1, key1 := testutil.MakeCertificate(t, "Recipient 1", 1)
+	cert2, key2 := testutil.MakeCertificate(t, "Recipient 2", 2)
+	perms2 := AccessPermissions{Annotate: true}
+
+	w := newTestWriter(t)
+	recipients := []PubKeyRecipient{{Certificate: cert1}, {Certificate: cert2, Permissions: perms2}}
+	if err := w.EncryptForRecipients(recipients, &EncryptOptions{Algorithm: AES_256bit}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writeTestPdf(t, w)
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := reader.IsEncrypted(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// Must be decrypted first.
+	w2 := NewPdfWriter()
+	if err := w2.EncryptLike(reader, nil); err == nil {
+		t.Fatalf("Adopted encryption without authentication")
+	}
+	if auth, err := reader.DecryptWithCertificate(cert1, key1); err != nil || !auth {
+		t.Fatalf("Failed to decrypt source (%v)", err)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w2.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w2.EncryptLike(reader, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data2 := writeTestPdf(t, &w2)
+
+	// The other recipient can open the new file with its permissions.
+	reader2, err := NewPdfReader(bytes.NewReader(data2))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := reader2.IsEncrypted(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if auth, err := reader2.DecryptWithCertificate(cert2, key2); err != nil || !auth {
+		t.Fatalf("Failed to decrypt (%v)", err)
+	}
+	crypter := reader2.parser.GetCrypter()
+	if crypter.Subfilter != "adbe.pkcs7.s5" || crypter.V != 5 || crypter.GetAccessPermissions() != perms2 {
+		t.Fatalf("Security settings not preserved (%s V=%d %+v)", crypter.Subfilter, crypter.V,
+			crypter.GetAccessPermissions())
+	}
+	checkTestContent(t, reader2)
+}
+
+// Test writing with object streams and a cross-reference stream, with and without encryption.
+func TestWriterObjectStreams(t *testing.T) {
+	plain := writePdf(t, newTestWriter(t))
+
+	w := newTestWriter(t)
+	w.SetObjectStreams(true)
+	data := writePdf(t, w)
+	if !bytes.HasPrefix(data, []byte("%PDF-1.5")) {
+		t.Fatalf("Incorrect header %q", data[:8])
+	}
+	if bytes.Contains(data, []byte("\nxref")) || !bytes.Contains(data, []byte("/Type /XRef")) ||
+		!bytes.Contains(data, []byte("/Type /ObjStm")) {
+		t.Fatalf("Missing xref stream or object stream")
+	}
+	if len(data) >= len(plain) {
+		t.Fatalf("Output not smaller with object streams (%d >= %d)", len(data), len(plain))
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	numPages, err := reader.GetNumPages()
+	if err != nil || numPages != 1 {
+		t.Fatalf("Incorrect number of pages %d (%v)", numPages, err)
+	}
+	checkTestContent(t, reader)
+
+	for _, algorithm := range []EncryptionAlgorithm{RC4_128bit, AES_128bit, AES_256bit} {
+		w := newTestWriter(t)
+		w.SetObjectStreams(true)
+		err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Algorithm: algorithm})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data := writeTestPdf(t, w)
+
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		auth, err := reader.Decrypt([]byte("user"))
+		if err != nil || !auth {
+			t.Fatalf("Algorithm %d: failed to authenticate (%v)", algorithm, err)
+		}
+		checkTestContent(t, reader)
+	}
+}
+
+// Test canceling the writing.
+func TestWriteContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, setup := range []func(w *PdfWriter){
+		func(w *PdfWriter) {},
+		func(w *PdfWriter) { w.SetObjectStreams(true) },
+		func(w *PdfWriter) { w.SetLinearized(true) },
+	} {
+		w := newTestWriter(t)
+		setup(w)
+		var buf bytes.Buffer
+		if err := w.WriteContext(ctx, &buf); err != context.Canceled {
+			t.Fatalf("Writing not canceled (%v)", err)
+		}
+
+		w = newTestWriter(t)
+		setup(w)
+		buf.Reset()
+		if err := w.WriteContext(context.Background(), &buf); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		reader, err := NewPdfReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		checkTestContent(t, reader)
+	}
+}
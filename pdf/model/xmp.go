@@ -0,0 +1,566 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Namespaces of the XMP schemas used in PDF documents.
+const (
+	XmpNamespaceDC        = "http://purl.org/dc/elements/1.1/"
+	XmpNamespacePDF       = "http://ns.adobe.com/pdf/1.3/"
+	XmpNamespaceXMP       = "http://ns.adobe.com/xap/1.0/"
+	XmpNamespaceXMPMM     = "http://ns.adobe.com/xap/1.0/mm/"
+	XmpNamespaceXMPRights = "http://ns.adobe.com/xap/1.0/rights/"
+	XmpNamespacePDFAID    = "http://www.aiim.org/pdfa/ns/id/"
+
+	xmpNamespaceMeta = "adobe:ns:meta/"
+	xmpNamespaceRDF  = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpNamespaceXML  = "http://www.w3.org/XML/1998/namespace"
+)
+
+// Usual prefixes of the namespaces.
+var xmpDefaultPrefixes = map[string]string{
+	XmpNamespaceDC:        "dc",
+	XmpNamespacePDF:       "pdf",
+	XmpNamespaceXMP:       "xmp",
+	XmpNamespaceXMPMM:     "xmpMM",
+	XmpNamespaceXMPRights: "xmpRights",
+	XmpNamespacePDFAID:    "pdfaid",
+}
+
+// XmpValueType is the type of the value of an XMP property.
+type XmpValueType int
+
+const (
+	XmpSimple XmpValueType = iota // Text.
+	XmpBag                        // Unordered array.
+	XmpSeq                        // Ordered array.
+	XmpAlt                        // Alternatives, such as the same text in several languages.
+	XmpOther                      // Structured value, kept as XML.
+)
+
+// XmpProperty is a property of an XMP packet.
+type XmpProperty struct {
+	Namespace string // Namespace URI of the schema.
+	Name      string // Name within the namespace.
+	Type      XmpValueType
+
+	// Values holds the text of a simple value, or the items of an array.  Empty for structured
+	// values.
+	Values []string
+	// Langs holds the languages (xml:lang) of the items of language alternatives, empty otherwise.
+	Langs []string
+
+	// raw is the XML of the property element for structured values.
+	raw []byte
+}
+
+// XmpMetadata represents an XMP metadata packet (Section 14.3.2), describing the document or a
+// component of it such as a page.  The properties are kept in order.
+type XmpMetadata struct {
+	Properties []*XmpProperty
+
+	// Prefixes of the namespaces, by namespace URI.
+	prefixes map[string]string
+}
+
+// NewXmpMetadata returns a new XMP packet without properties.
+func NewXmpMetadata() *XmpMetadata {
+	return &XmpMetadata{prefixes: map[string]string{}}
+}
+
+// ParseXmpMetadata parses the XMP packet `data`, serialized as RDF/XML.  The properties of all the
+// rdf:Description elements are loaded.
+func ParseXmpMetadata(data []byte) (*XmpMetadata, error) {
+	m := NewXmpMetadata()
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			common.Log.Debug("ERROR: Invalid XMP packet (%s)", err)
+			return nil, err
+		}
+		start, isStart := tok.(xml.StartElement)
+		if !isStart {
+			continue
+		}
+		m.addPrefixes(start)
+		if start.Name.Space == xmpNamespaceRDF && start.Name.Local == "Description" {
+			if err := m.parseDescription(d, data, start); err != nil {
+				common.Log.Debug("ERROR: Invalid XMP description (%s)", err)
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// xmlNode is an element read from an XMP packet.
+type xmlNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     string
+}
+
+// parseDescription loads the properties of the rdf:Description element `start`, as attributes
+// and as elements.  `data` is the packet read by `d`.
+func (m *XmpMetadata) parseDescription(d *xml.Decoder, data []byte, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		if isXmlSyntaxAttr(attr) || attr.Name.Space == xmpNamespaceRDF {
+			continue
+		}
+		m.SetText(attr.Name.Space, attr.Name.Local, attr.Value)
+	}
+
+	for {
+		offset := d.InputOffset()
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			node, err := m.readNode(d, t)
+			if err != nil {
+				return err
+			}
+			prop := xmpPropertyFromNode(node)
+			if prop.Type == XmpOther {
+				prop.raw = append([]byte{}, data[offset:d.InputOffset()]...)
+			}
+			m.SetProperty(prop)
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// readNode reads the element `start` with its content from `d`.
+func (m *XmpMetadata) readNode(d *xml.Decoder, start xml.StartElement) (*xmlNode, error) {
+	m.addPrefixes(start)
+	node := &xmlNode{name: start.Name, attrs: start.Attr}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := m.readNode(d, t)
+			if err != nil {
+				return nil, err
+			}
+			node.children = append(node.children, child)
+		case xml.CharData:
+			node.text += string(t)
+		case xml.EndElement:
+			return node, nil
+		}
+	}
+}
+
+// xmpPropertyFromNode returns the property of the property element `node`, of type XmpOther if
+// the value is neither text nor an array of text items.
+func xmpPropertyFromNode(node *xmlNode) *XmpProperty {
+	prop := &XmpProperty{Namespace: node.name.Space, Name: node.name.Local, Type: XmpOther}
+	if len(attrsOf(node, false)) > 0 {
+		// Qualifiers, resources, parse types.
+		return prop
+	}
+	if len(node.children) == 0 {
+		prop.Type = XmpSimple
+		prop.Values = []string{node.text}
+		return prop
+	}
+	if len(node.children) != 1 || node.children[0].name.Space != xmpNamespaceRDF ||
+		len(attrsOf(node.children[0], false)) > 0 {
+		return prop
+	}
+
+	array := node.children[0]
+	typ, ok := map[string]XmpValueType{"Bag": XmpBag, "Seq": XmpSeq, "Alt": XmpAlt}[array.name.Local]
+	if !ok {
+		return prop
+	}
+	values := []string{}
+	langs := []string{}
+	for _, item := range array.children {
+		if item.name.Space != xmpNamespaceRDF || item.name.Local != "li" || len(item.children) > 0 ||
+			len(attrsOf(item, true)) > 0 {
+			return prop
+		}
+		lang := ""
+		for _, attr := range item.attrs {
+			if attr.Name.Space == xmpNamespaceXML && attr.Name.Local == "lang" {
+				lang = attr.Value
+			}
+		}
+		values = append(values, item.text)
+		langs = append(langs, lang)
+	}
+
+	prop.Type = typ
+	prop.Values = values
+	for _, lang := range langs {
+		if lang != "" {
+			prop.Langs = langs
+			break
+		}
+	}
+	return prop
+}
+
+// attrsOf returns the attributes of `node` other than the namespace declarations, and other than
+// the xml: attributes such as the language if `allowLang` is true.
+func attrsOf(node *xmlNode, allowLang bool) []xml.Attr {
+	attrs := []xml.Attr{}
+	for _, attr := range node.attrs {
+		if isXmlSyntaxAttr(attr) && (allowLang || attr.Name.Space != xmpNamespaceXML) {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// isXmlSyntaxAttr returns true if `attr` is a namespace declaration or an xml: attribute.
+func isXmlSyntaxAttr(attr xml.Attr) bool {
+	return attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") ||
+		attr.Name.Space == xmpNamespaceXML
+}
+
+// addPrefixes records the prefixes declared by the element `start`.
+func (m *XmpMetadata) addPrefixes(start xml.StartElement) {
+	for _, attr := range start.Attr {
+		if attr.Name.Space != "xmlns" || attr.Value == xmpNamespaceRDF || attr.Value == xmpNamespaceMeta {
+			continue
+		}
+		if _, has := m.prefixes[attr.Value]; !has && m.namespaceOf(attr.Name.Local) == "" {
+			m.prefixes[attr.Value] = attr.Name.Local
+		}
+	}
+}
+
+// namespaceOf returns the namespace with prefix `prefix`, empty if none.
+func (m *XmpMetadata) namespaceOf(prefix string) string {
+	for ns, p := range m.prefixes {
+		if p == prefix {
+			return ns
+		}
+	}
+	return ""
+}
+
+// SetNamespacePrefix sets the prefix of the namespace `ns` to `prefix` when serializing.  By
+// default, the usual prefixes are used for the namespaces of the standard schemas, and prefixes
+// are generated for the others.
+func (m *XmpMetadata) SetNamespacePrefix(prefix, ns string) {
+	m.prefixes[ns] = prefix
+}
+
+// prefix returns the prefix of the namespace `ns`, assigning one if needed.
+func (m *XmpMetadata) prefix(ns string) string {
+	if prefix, has := m.prefixes[ns]; has {
+		return prefix
+	}
+	prefix, has := xmpDefaultPrefixes[ns]
+	for i := 1; !has || m.namespaceOf(prefix) != "" || prefix == "rdf" || prefix == "x"; i++ {
+		prefix = fmt.Sprintf("ns%d", i)
+		has = true
+	}
+	m.prefixes[ns] = prefix
+	return prefix
+}
+
+// Get returns the property `name` in the namespace `ns`, nil if not set.
+func (m *XmpMetadata) Get(ns, name string) *XmpProperty {
+	for _, prop := range m.Properties {
+		if prop.Namespace == ns && prop.Name == name {
+			return prop
+		}
+	}
+	return nil
+}
+
+// GetText returns the text of the property `name` in the namespace `ns`: the value of a simple
+// property, the default (x-default) or first alternative, or the items of a Bag or a Seq separated
+// by commas.  Empty if not set or structured.
+func (m *XmpMetadata) GetText(ns, name string) string {
+	prop := m.Get(ns, name)
+	if prop == nil || len(prop.Values) == 0 {
+		return ""
+	}
+	switch prop.Type {
+	case XmpAlt:
+		for i, lang := range prop.Langs {
+			if lang == "x-default" {
+				return prop.Values[i]
+			}
+		}
+		return prop.Values[0]
+	case XmpBag, XmpSeq:
+		return strings.Join(prop.Values, ", ")
+	}
+	return prop.Values[0]
+}
+
+// SetProperty sets the property `prop`, replacing the property with the same name if any.
+func (m *XmpMetadata) SetProperty(prop *XmpProperty) {
+	for i, p := range m.Properties {
+		if p.Namespace == prop.Namespace && p.Name == prop.Name {
+			m.Properties[i] = prop
+			return
+		}
+	}
+	m.Properties = append(m.Properties, prop)
+}
+
+// SetText sets the property `name` in the namespace `ns` to the simple value `value`.
+func (m *XmpMetadata) SetText(ns, name, value string) {
+	m.SetProperty(&XmpProperty{Namespace: ns, Name: name, Type: XmpSimple, Values: []string{value}})
+}
+
+// SetArray sets the property `name` in the namespace `ns` to an array of type `typ` (XmpBag,
+// XmpSeq or XmpAlt) with the items `values`.
+func (m *XmpMetadata) SetArray(ns, name string, typ XmpValueType, values []string) {
+	m.SetProperty(&XmpProperty{Namespace: ns, Name: name, Type: typ, Values: values})
+}
+
+// SetLangAlt sets the property `name` in the namespace `ns` to language alternatives with the
+// default text `value`, as used for dc:title.
+func (m *XmpMetadata) SetLangAlt(ns, name, value string) {
+	m.SetProperty(&XmpProperty{Namespace: ns, Name: name, Type: XmpAlt, Values: []string{value},
+		Langs: []string{"x-default"}})
+}
+
+// Remove removes the property `name` in the namespace `ns`, if set.
+func (m *XmpMetadata) Remove(ns, name string) {
+	for i, prop := range m.Properties {
+		if prop.Namespace == ns && prop.Name == name {
+			m.Properties = append(m.Properties[:i], m.Properties[i+1:]...)
+			return
+		}
+	}
+}
+
+// Bytes returns the XMP packet serialized as RDF/XML, with the properties in a single
+// rdf:Description element.
+func (m *XmpMetadata) Bytes() []byte {
+	// Namespaces declared, in order of first use.
+	namespaces := []string{}
+	declared := map[string]bool{}
+	hasStructured := false
+	for _, prop := range m.Properties {
+		if prop.Type == XmpOther {
+			hasStructured = true
+		}
+		if !declared[prop.Namespace] {
+			m.prefix(prop.Namespace)
+			declared[prop.Namespace] = true
+			namespaces = append(namespaces, prop.Namespace)
+		}
+	}
+	if hasStructured {
+		// Structured values may use any namespace declared in the packet.
+		others := []string{}
+		for ns := range m.prefixes {
+			if !declared[ns] {
+				others = append(others, ns)
+			}
+		}
+		sort.Strings(others)
+		namespaces = append(namespaces, others...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString("<x:xmpmeta xmlns:x=\"" + xmpNamespaceMeta + "\">\n")
+	buf.WriteString(" <rdf:RDF xmlns:rdf=\"" + xmpNamespaceRDF + "\">\n")
+	buf.WriteString("  <rdf:Description rdf:about=\"\"")
+	for _, ns := range namespaces {
+		buf.WriteString(fmt.Sprintf("\n    xmlns:%s=\"%s\"", m.prefixes[ns], xmlEscape(ns)))
+	}
+	buf.WriteString(">\n")
+
+	for _, prop := range m.Properties {
+		if prop.Type == XmpOther {
+			buf.WriteString("   ")
+			buf.Write(bytes.TrimSpace(prop.raw))
+			buf.WriteString("\n")
+			continue
+		}
+		qname := m.prefixes[prop.Namespace] + ":" + prop.Name
+		if prop.Type == XmpSimple {
+			value := ""
+			if len(prop.Values) > 0 {
+				value = prop.Values[0]
+			}
+			buf.WriteString(fmt.Sprintf("   <%s>%s</%s>\n", qname, xmlEscape(value), qname))
+			continue
+		}
+		array := map[XmpValueType]string{XmpBag: "rdf:Bag", XmpSeq: "rdf:Seq", XmpAlt: "rdf:Alt"}[prop.Type]
+		buf.WriteString(fmt.Sprintf("   <%s>\n    <%s>\n", qname, array))
+		for i, value := range prop.Values {
+			if i < len(prop.Langs) && prop.Langs[i] != "" {
+				buf.WriteString(fmt.Sprintf("     <rdf:li xml:lang=\"%s\">%s</rdf:li>\n", xmlEscape(prop.Langs[i]), xmlEscape(value)))
+			} else {
+				buf.WriteString(fmt.Sprintf("     <rdf:li>%s</rdf:li>\n", xmlEscape(value)))
+			}
+		}
+		buf.WriteString(fmt.Sprintf("    </%s>\n   </%s>\n", array, qname))
+	}
+
+	buf.WriteString("  </rdf:Description>\n")
+	buf.WriteString(" </rdf:RDF>\n")
+	buf.WriteString("</x:xmpmeta>\n")
+	buf.WriteString("<?xpacket end=\"w\"?>")
+	return buf.Bytes()
+}
+
+// xmlEscape returns `s` escaped for XML text and attribute values.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// ToPdfObject returns a metadata stream (Section 14.3.2) holding the XMP packet, not encoded.
+func (m *XmpMetadata) ToPdfObject() PdfObject {
+	stream, _ := MakeStream(m.Bytes(), nil)
+	stream.PdfObjectDictionary.Set("Type", MakeName("Metadata"))
+	stream.PdfObjectDictionary.Set("Subtype", MakeName("XML"))
+	return stream
+}
+
+// newXmpMetadataFromPdfObject loads the XMP packet from the metadata stream `obj`.
+func newXmpMetadataFromPdfObject(obj PdfObject) (*XmpMetadata, error) {
+	stream, ok := obj.(*PdfObjectStream)
+	if !ok {
+		common.Log.Debug("ERROR: Metadata not a stream (%T)", obj)
+		return nil, ErrTypeError
+	}
+	data, err := DecodeStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	return ParseXmpMetadata(data)
+}
+
+// GetXmpMetadata returns the XMP metadata of the page, nil if none.
+func (this *PdfPage) GetXmpMetadata() (*XmpMetadata, error) {
+	if this.Metadata == nil {
+		return nil, nil
+	}
+	if _, isRef := this.Metadata.(*PdfObjectReference); isRef {
+		return nil, errors.New("Metadata not resolved")
+	}
+	return newXmpMetadataFromPdfObject(TraceToDirectObject(this.Metadata))
+}
+
+// SetXmpMetadata sets the XMP metadata of the page to `m`.
+func (this *PdfPage) SetXmpMetadata(m *XmpMetadata) {
+	this.Metadata = m.ToPdfObject()
+}
+
+// Properties of the XMP metadata corresponding to entries of the document information dictionary.
+var xmpDocInfoProperties = []struct {
+	key  string
+	ns   string
+	name string
+	typ  XmpValueType
+}{
+	{"Title", XmpNamespaceDC, "title", XmpAlt},
+	{"Author", XmpNamespaceDC, "creator", XmpSeq},
+	{"Subject", XmpNamespaceDC, "description", XmpAlt},
+	{"Keywords", XmpNamespacePDF, "Keywords", XmpSimple},
+	{"Creator", XmpNamespaceXMP, "CreatorTool", XmpSimple},
+	{"Producer", XmpNamespacePDF, "Producer", XmpSimple},
+	{"CreationDate", XmpNamespaceXMP, "CreateDate", XmpSimple},
+	{"ModDate", XmpNamespaceXMP, "ModifyDate", XmpSimple},
+	{"Trapped", XmpNamespacePDF, "Trapped", XmpSimple},
+}
+
+// syncXmpDocumentInfo synchronizes the entries of the document information `info` with the
+// corresponding properties of `m`.  The properties set in `m` take precedence, the other entries
+// of `info` are copied to `m`.
+func syncXmpDocumentInfo(info *PdfDocumentInfo, m *XmpMetadata) {
+	fields := map[string]*string{
+		"Title":    &info.Title,
+		"Author":   &info.Author,
+		"Subject":  &info.Subject,
+		"Keywords": &info.Keywords,
+		"Creator":  &info.Creator,
+		"Producer": &info.Producer,
+		"Trapped":  &info.Trapped,
+	}
+	dates := map[string]**PdfDate{
+		"CreationDate": &info.CreationDate,
+		"ModDate":      &info.ModDate,
+	}
+
+	for _, p := range xmpDocInfoProperties {
+		text := m.GetText(p.ns, p.name)
+		if date, isDate := dates[p.key]; isDate {
+			if text != "" {
+				if t, err := parseXmpDate(text); err == nil {
+					d := NewPdfDateFromTime(t)
+					*date = &d
+					continue
+				}
+				common.Log.Debug("ERROR: Invalid XMP date %s (%s)", p.name, text)
+			}
+			if *date != nil {
+				m.SetText(p.ns, p.name, (*date).ToGoTime().Format(time.RFC3339))
+			}
+			continue
+		}
+
+		field := fields[p.key]
+		if text != "" {
+			*field = text
+			continue
+		}
+		if *field == "" {
+			continue
+		}
+		switch p.typ {
+		case XmpAlt:
+			m.SetLangAlt(p.ns, p.name, *field)
+		case XmpSeq:
+			m.SetArray(p.ns, p.name, XmpSeq, []string{*field})
+		default:
+			m.SetText(p.ns, p.name, *field)
+		}
+	}
+}
+
+// parseXmpDate parses the XMP date `s` (ISO 8601), complete or not.
+func parseXmpDate(s string) (time.Time, error) {
+	layouts := []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00", "2006-01-02T15:04:05",
+		"2006-01-02T15:04", "2006-01-02", "2006-01", "2006"}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid date (%s)", s)
+}
@@ -0,0 +1,192 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testXmpPacket = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmp:CreatorTool="Test &amp; Co" xmp:CreateDate="2018-03-04T05:06:07-05:00"/>
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:title>
+    <rdf:Alt>
+     <rdf:li xml:lang="x-default">Report &lt;draft&gt;</rdf:li>
+     <rdf:li xml:lang="fr-FR">Rapport</rdf:li>
+    </rdf:Alt>
+   </dc:title>
+   <dc:creator><rdf:Seq><rdf:li>Jane Doe</rdf:li><rdf:li>John Doe</rdf:li></rdf:Seq></dc:creator>
+   <dc:subject><rdf:Bag><rdf:li>one</rdf:li><rdf:li>two</rdf:li></rdf:Bag></dc:subject>
+  </rdf:Description>
+  <rdf:Description rdf:about="" xmlns:dam="http://example.com/dam/1.0/"
+    xmlns:stEvt="http://ns.adobe.com/xap/1.0/sType/ResourceEvent#">
+   <dam:AssetID>A-1234</dam:AssetID>
+   <dam:History>
+    <rdf:Seq>
+     <rdf:li rdf:parseType="Resource"><stEvt:action>created</stEvt:action></rdf:li>
+    </rdf:Seq>
+   </dam:History>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+const testDamNamespace = "http://example.com/dam/1.0/"
+
+// checkTestXmpPacket checks the properties of testXmpPacket in `m`.
+func checkTestXmpPacket(t *testing.T, m *XmpMetadata) {
+	if len(m.Properties) != 7 {
+		t.Fatalf("Incorrect number of properties %d", len(m.Properties))
+	}
+	texts := []struct {
+		ns, name, text string
+	}{
+		{XmpNamespaceXMP, "CreatorTool", "Test & Co"},
+		{XmpNamespaceXMP, "CreateDate", "2018-03-04T05:06:07-05:00"},
+		{XmpNamespaceDC, "title", "Report <draft>"},
+		{XmpNamespaceDC, "creator", "Jane Doe, John Doe"},
+		{XmpNamespaceDC, "subject", "one, two"},
+		{testDamNamespace, "AssetID", "A-1234"},
+	}
+	for _, text := range texts {
+		if got := m.GetText(text.ns, text.name); got != text.text {
+			t.Fatalf("%s: %q, expected %q", text.name, got, text.text)
+		}
+	}
+
+	title := m.Get(XmpNamespaceDC, "title")
+	if title.Type != XmpAlt || !reflect.DeepEqual(title.Langs, []string{"x-default", "fr-FR"}) {
+		t.Fatalf("Invalid title %+v", title)
+	}
+	if creator := m.Get(XmpNamespaceDC, "creator"); creator.Type != XmpSeq || creator.Langs != nil {
+		t.Fatalf("Invalid creator %+v", creator)
+	}
+	if subject := m.Get(XmpNamespaceDC, "subject"); subject.Type != XmpBag {
+		t.Fatalf("Invalid subject %+v", subject)
+	}
+	history := m.Get(testDamNamespace, "History")
+	if history == nil || history.Type != XmpOther || !bytes.Contains(history.raw, []byte("<stEvt:action>created")) {
+		t.Fatalf("Invalid history %+v", history)
+	}
+}
+
+// Test parsing and serializing XMP packets.
+func TestXmpMetadata(t *testing.T) {
+	m, err := ParseXmpMetadata([]byte(testXmpPacket))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkTestXmpPacket(t, m)
+
+	// Round trip, with the structured values kept as is.
+	data := m.Bytes()
+	m, err = ParseXmpMetadata(data)
+	if err != nil {
+		t.Fatalf("Error: %v (%s)", err, data)
+	}
+	checkTestXmpPacket(t, m)
+	if !bytes.Equal(m.Bytes(), data) {
+		t.Fatalf("Output not stable:\n%s\n%s", data, m.Bytes())
+	}
+
+	// Prefixes of the new namespaces.
+	m.SetText("http://example.com/other/", "Value", "1")
+	m.SetNamespacePrefix("custom", "http://example.com/custom/")
+	m.SetArray("http://example.com/custom/", "Tags", XmpBag, []string{"a", "b"})
+	m.Remove(testDamNamespace, "AssetID")
+	data = m.Bytes()
+	if !bytes.Contains(data, []byte(`xmlns:ns1="http://example.com/other/"`)) ||
+		!bytes.Contains(data, []byte("<custom:Tags>")) || bytes.Contains(data, []byte("AssetID")) {
+		t.Fatalf("Invalid output:\n%s", data)
+	}
+	m, err = ParseXmpMetadata(data)
+	if err != nil {
+		t.Fatalf("Error: %v (%s)", err, data)
+	}
+	if m.GetText("http://example.com/other/", "Value") != "1" || m.GetText("http://example.com/custom/", "Tags") != "a, b" {
+		t.Fatalf("New properties not read back:\n%s", data)
+	}
+
+	if _, err := ParseXmpMetadata([]byte("<x:xmpmeta><rdf:RDF>")); err == nil {
+		t.Fatalf("Invalid packet not rejected")
+	}
+}
+
+// Test writing the XMP metadata of the document and of the pages, synchronized with the document
+// information.
+func TestWriterXmpMetadata(t *testing.T) {
+	m := NewXmpMetadata()
+	m.SetLangAlt(XmpNamespaceDC, "title", "XMP title")
+	m.SetText(XmpNamespaceXMP, "ModifyDate", "2018-06-07T08:09:10Z")
+	m.SetText(testDamNamespace, "AssetID", "A-1234")
+
+	pageXmp := NewXmpMetadata()
+	pageXmp.SetText(testDamNamespace, "PageID", "P-1")
+
+	w := newTestWriter(t)
+	w.SetDocumentInfo(&PdfDocumentInfo{Title: "Info title", Author: "Jane Doe"})
+	w.SetXmpMetadata(m)
+	w.SetCompression(&CompressOptions{})
+	page := NewPdfPage()
+	page.MediaBox = &PdfRectangle{Llx: 0, Lly: 0, Urx: 200, Ury: 100}
+	page.Resources = NewPdfPageResources()
+	page.SetXmpMetadata(pageXmp)
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := writePdf(t, w)
+	if !bytes.HasPrefix(data, []byte("%PDF-1.4")) {
+		t.Fatalf("Version not raised: %q", data[:8])
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	info, err := reader.GetDocumentInfo()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if info.Title != "XMP title" || info.Author != "Jane Doe" || info.ModDate == nil ||
+		!info.ModDate.ToGoTime().Equal(time.Date(2018, 6, 7, 8, 9, 10, 0, time.UTC)) {
+		t.Fatalf("Info not synchronized: %+v", info)
+	}
+
+	readXmp, err := reader.GetXmpMetadata()
+	if err != nil || readXmp == nil {
+		t.Fatalf("Missing metadata (%v)", err)
+	}
+	if readXmp.GetText(XmpNamespaceDC, "title") != "XMP title" || readXmp.GetText(XmpNamespaceDC, "creator") != "Jane Doe" ||
+		!strings.HasPrefix(readXmp.GetText(XmpNamespacePDF, "Producer"), "UniDoc") ||
+		readXmp.GetText(testDamNamespace, "AssetID") != "A-1234" {
+		t.Fatalf("Metadata not synchronized:\n%s", readXmp.Bytes())
+	}
+
+	readPage, err := reader.GetPage(2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	readPageXmp, err := readPage.GetXmpMetadata()
+	if err != nil || readPageXmp == nil || readPageXmp.GetText(testDamNamespace, "PageID") != "P-1" {
+		t.Fatalf("Page metadata mismatch (%v)", err)
+	}
+
+	// No metadata.
+	reader, err = NewPdfReader(bytes.NewReader(writePdf(t, newTestWriter(t))))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if readXmp, err := reader.GetXmpMetadata(); readXmp != nil || err != nil {
+		t.Fatalf("Unexpected metadata (%v)", err)
+	}
+}
@@ -244,6 +244,18 @@ func UpdateXObjectImageFromImage(xobjIn *XObjectImage, img *Image, cs PdfColorsp
 		encoder = NewRawEncoder()
 	}
 
+	if ccittEncoder, ok := encoder.(*CCITTFaxEncoder); ok {
+		// CCITT encoding is only for bilevel images, with the dimensions set from the image.  Only
+		// Group 4 encoding is supported.
+		if img.BitsPerComponent != 1 || img.ColorComponents != 1 {
+			common.Log.Debug("Error: CCITTFax encoding requires 1 bit per component grayscale image")
+			return nil, errors.New("Image not bilevel")
+		}
+		ccittEncoder.K = -1
+		ccittEncoder.Columns = int(img.Width)
+		ccittEncoder.Rows = int(img.Height)
+	}
+
 	encoded, err := encoder.EncodeBytes(img.Data)
 	if err != nil {
 		common.Log.Debug("Error with encoding: %v", err)
@@ -380,6 +392,14 @@ func NewXObjectImageFromStream(stream *PdfObjectStream) (*XObjectImage, error) {
 	}
 	img.Filter = encoder
 
+	// JPX images can take the colorspace and the bits per component from the JPEG 2000 data.
+	jpxEncoder, isJPX := encoder.(*JPXEncoder)
+	if isJPX && (dict.Get("ColorSpace") == nil || dict.Get("BitsPerComponent") == nil) {
+		if err := jpxEncoder.DecodeConfig(stream.Stream); err != nil {
+			return nil, err
+		}
+	}
+
 	if obj := TraceToDirectObject(dict.Get("Width")); obj != nil {
 		iObj, ok := obj.(*PdfObjectInteger)
 		if !ok {
@@ -408,6 +428,12 @@ func NewXObjectImageFromStream(stream *PdfObjectStream) (*XObjectImage, error) {
 			return nil, err
 		}
 		img.ColorSpace = cs
+	} else if isJPX {
+		cs, err := newJPXColorspace(jpxEncoder)
+		if err != nil {
+			return nil, err
+		}
+		img.ColorSpace = cs
 	} else {
 		// If not specified, assume gray..
 		common.Log.Debug("XObject Image colorspace not specified - assuming 1 color component")
@@ -421,6 +447,10 @@ func NewXObjectImageFromStream(stream *PdfObjectStream) (*XObjectImage, error) {
 		}
 		iVal := int64(*iObj)
 		img.BitsPerComponent = &iVal
+	} else if isJPX {
+		// Not required for JPX images, determined by the JPEG 2000 data.
+		iVal := int64(jpxEncoder.BitsPerComponent)
+		img.BitsPerComponent = &iVal
 	}
 
 	img.Intent = dict.Get("Intent")
@@ -444,6 +474,40 @@ func NewXObjectImageFromStream(stream *PdfObjectStream) (*XObjectImage, error) {
 	return img, nil
 }
 
+// newJPXColorspace returns the colorspace of JPEG 2000 image data for images without a ColorSpace
+// entry.  Uses the colour specification of the JP2 header, or the number of color components if
+// not specified.
+func newJPXColorspace(encoder *JPXEncoder) (PdfColorspace, error) {
+	if len(encoder.ICCProfile) > 0 {
+		cs, err := NewPdfColorspaceICCBased(encoder.ColorComponents)
+		if err != nil {
+			return nil, err
+		}
+		cs.Data = encoder.ICCProfile
+		return cs, nil
+	}
+
+	switch encoder.ColorSpace {
+	case JPXColorSpaceGray:
+		return NewPdfColorspaceDeviceGray(), nil
+	case JPXColorSpaceSRGB:
+		return NewPdfColorspaceDeviceRGB(), nil
+	case JPXColorSpaceCMYK:
+		return NewPdfColorspaceDeviceCMYK(), nil
+	}
+
+	switch encoder.ColorComponents {
+	case 1:
+		return NewPdfColorspaceDeviceGray(), nil
+	case 3:
+		return NewPdfColorspaceDeviceRGB(), nil
+	case 4:
+		return NewPdfColorspaceDeviceCMYK(), nil
+	}
+	common.Log.Debug("Error: Unsupported number of JPX color components (%d)", encoder.ColorComponents)
+	return nil, errors.New("Unsupported JPX colorspace")
+}
+
 // Update XObject Image with new image data.
 func (ximg *XObjectImage) SetImage(img *Image, cs PdfColorspace) error {
 	encoded, err := ximg.Filter.EncodeBytes(img.Data)
@@ -516,11 +580,26 @@ func (ximg *XObjectImage) ToImage() (*Image, error) {
 
 	image.ColorComponents = ximg.ColorSpace.GetNumComponents()
 
-	decoded, err := DecodeStream(ximg.primitive)
-	if err != nil {
-		return nil, err
+	if jpxEncoder, ok := ximg.Filter.(*JPXEncoder); ok {
+		// The bits per component are determined by the JPEG 2000 data, which can also hold the
+		// soft mask (SMaskInData).
+		decoded, alpha, err := jpxEncoder.DecodeStreamWithAlpha(ximg.primitive)
+		if err != nil {
+			return nil, err
+		}
+		image.BitsPerComponent = int64(jpxEncoder.BitsPerComponent)
+		image.Data = decoded
+		if jpxEncoder.SMaskInData > 0 && alpha != nil {
+			image.alphaData = alpha
+			image.hasAlpha = true
+		}
+	} else {
+		decoded, err := DecodeStream(ximg.primitive)
+		if err != nil {
+			return nil, err
+		}
+		image.Data = decoded
 	}
-	image.Data = decoded
 
 	if ximg.Decode != nil {
 		darr, ok := ximg.Decode.(*PdfObjectArray)